@@ -0,0 +1,118 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// allWindows returns the indices of all the windows.
+func allWindows() []int {
+	wins := make([]int, len(config.Windows))
+	for k := range wins {
+		wins[k] = k
+	}
+	return wins
+}
+
+// windowBatchList splits the windows into consecutive batches of at
+// most WindowBatch windows.
+func windowBatchList() [][]int {
+	var batches [][]int
+	wins := allWindows()
+	for len(wins) > 0 {
+		m := config.WindowBatch
+		if m > len(wins) {
+			m = len(wins)
+		}
+		batches = append(batches, wins[0:m])
+		wins = wins[m:]
+	}
+	return batches
+}
+
+// batchArgs returns the command-line arguments that restrict
+// muscato_window_reads and muscato_screen to a batch of windows,
+// which are the first and last window of the batch, or no arguments
+// if the batch contains all the windows.
+func batchArgs(wins []int) []string {
+	if len(wins) == len(config.Windows) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%d", wins[0]), fmt.Sprintf("%d", wins[len(wins)-1]+1)}
+}
+
+// batchStep is a stage that is run for each batch of windows.
+type batchStep struct {
+	name string
+	f    func([]int) error
+}
+
+// windowBatches runs the windowReads, sortWindows, screen, sortBloom
+// and confirm stages for each batch of WindowBatch windows in turn.
+// The intermediate files of a batch are released when the batch is
+// finished, as they would be after the stages that they are used by.
+// Once MaxWallTime has passed, the remaining batches are skipped.  If
+// ScreenOnly is set, the candidate matches of each batch are counted
+// in place of the confirm stage.
+func windowBatches() error {
+
+	batches := windowBatchList()
+	logger.Printf("Processing %d windows in %d batches", len(config.Windows), len(batches))
+
+	confirmed = confirmed[0:0]
+	var skipped []int
+	for i, wins := range batches {
+
+		if wallTimeUp() {
+			skipped = append(skipped, wins...)
+			continue
+		}
+
+		progressBatch(i+1, len(batches))
+		msg := fmt.Sprintf("Batch %d of %d, windows %d to %d\n", i+1, len(batches), wins[0], wins[len(wins)-1])
+		io.WriteString(os.Stderr, msg)
+		logger.Print(msg)
+
+		steps := []batchStep{
+			{"windowReads", windowReads},
+			{"sortWindows", sortWindows},
+			{"screen", screen},
+			{"sortBloom", sortBloom},
+		}
+		if config.Streaming {
+			steps = []batchStep{
+				{"streamWindows", streamWindows},
+				{"streamScreen", streamScreen},
+			}
+		}
+		for _, s := range steps {
+			if err := s.f(wins); err != nil {
+				return fmt.Errorf("%s (batch %d): %w", s.name, i+1, err)
+			}
+			releaseIntermediates(s.name)
+		}
+
+		if config.ScreenOnly {
+			if err := screenCounts(wins); err != nil {
+				return fmt.Errorf("screenReport (batch %d): %w", i+1, err)
+			}
+			releaseIntermediates("confirm")
+			continue
+		}
+
+		sk, err := confirmWindows(wins)
+		if err != nil {
+			return fmt.Errorf("confirm (batch %d): %w", i+1, err)
+		}
+		skipped = append(skipped, sk...)
+		releaseIntermediates("confirm")
+	}
+
+	if config.ScreenOnly {
+		return nil
+	}
+	return checkConfirmed(skipped)
+}
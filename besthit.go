@@ -0,0 +1,171 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// bestHitPath returns the path of the best hit file, including the
+// suffix for the compression method given by CompressResults.
+func bestHitPath() string {
+	return utils.CompressedName(config.BestHitFile, config.CompressResults)
+}
+
+// bestHits writes the best hit file, with one line per read sequence
+// giving the read sequence, the target id, position and number of
+// mismatches of its best match, the number of matches with the same
+// number of mismatches, and the number and identifiers of the reads
+// with the sequence.  The best matches are selected by
+// muscato_combine_windows, here the target names and read names are
+// joined to them.
+func bestHits() error {
+
+	io.WriteString(os.Stderr, "Writing best hits...\n")
+
+	fn := path.Join(config.TempDir, "besthit.txt.sz")
+	rn := path.Join(config.TempDir, "reads_sorted.txt.sz")
+
+	dflt := append(append([]string{}, utils.MatchColumns...), "ties")
+	lay, err := matchLayout("besthit.txt.sz", dflt)
+	if err != nil {
+		return err
+	}
+	var ix []int
+	for _, c := range []string{"gene", "read", "pos", "nmiss", "ties"} {
+		j, err := lay.Column(c)
+		if err != nil {
+			return err
+		}
+		ix = append(ix, j)
+	}
+	gcol := ix[0]
+
+	out, err := utils.CreateResult(bestHitPath(), config.CompressResults, config.SyncResults)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr2, pw2, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	sortArgs := func(key int) []string {
+		args := []string{fmt.Sprintf("-k%d", key), sortmem, sortpar}
+		if sortTmpFlag != "" {
+			args = append(args, sortTmpFlag)
+		}
+		return append(args, "-")
+	}
+
+	// Join the target names to the best hits, keeping the read,
+	// target name, position, number of mismatches and ties.
+	cmd1 := command("join", "-1", fmt.Sprintf("%d", gcol), "-2", "1", "-t", "\t",
+		"-o", fmt.Sprintf("1.%d,2.2,1.%d,1.%d,1.%d", ix[1], ix[2], ix[3], ix[4]))
+	cmd1.Stdout = pw2
+	pa, err := newInputPipe(cmd1, "besthit")
+	if err != nil {
+		return err
+	}
+	pb, err := newInputPipe(cmd1, "besthit_ids")
+	if err != nil {
+		return err
+	}
+	cmd1.Args = append(cmd1.Args, pa.path, pb.path)
+
+	// Decompress the best hits and sort them by target number
+	cmda := command("sztool", "-d", fn)
+	cmda.Stdout = pw1
+	cmdb := command("sort", sortArgs(gcol)...)
+	cmdb.Stdin = pr1
+	cmdb.Stdout = pa.w
+
+	// Join the read counts and names to the best hits
+	cmd2 := command("join", "-1", "1", "-2", "1", "-t", "\t", "-o", "1.1,1.2,1.3,1.4,1.5,2.2,2.3")
+	cmd2.Stdout = out
+	pc, err := newInputPipe(cmd2, "besthit_sr")
+	if err != nil {
+		return err
+	}
+	pd, err := newInputPipe(cmd2, "besthit_reads")
+	if err != nil {
+		return err
+	}
+	cmd2.Args = append(cmd2.Args, pc.path, pd.path)
+
+	// Sort the best hits by read
+	cmdc := command("sort", sortArgs(1)...)
+	cmdc.Stdin = pr2
+	cmdc.Stdout = pc.w
+
+	// Decompress the reads
+	cmdd := command("sztool", "-d", rn)
+	cmdd.Stdout = pd.w
+
+	cmds := []*exec.Cmd{cmda, cmdb, cmd1, cmdc, cmdd, cmd2}
+	for _, c := range cmds {
+		c.Stderr = stderrTail
+		c.Env = os.Environ()
+		if err := c.Start(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+	pa.Close()
+	pc.Close()
+	pd.Close()
+	if pb.r != nil {
+		pb.r.Close()
+	}
+
+	// Decompress the gene ids, which may be split into volumes.
+	idc := make(chan error, 1)
+	go func() {
+		defer pb.w.Close()
+		rdr, err := utils.OpenTargets(config.GeneIdFileName)
+		if err != nil {
+			idc <- err
+			return
+		}
+		defer rdr.Close()
+		_, err = io.Copy(pb.w, rdr)
+		idc <- err
+	}()
+
+	if err := cmda.Wait(); err != nil {
+		return cmdErr(cmda, err)
+	}
+	pw1.Close()
+	pr1.Close()
+
+	for _, c := range []*exec.Cmd{cmdb, cmd1} {
+		if err := c.Wait(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+	if err := <-idc; err != nil {
+		return fmt.Errorf("reading %s: %w", config.GeneIdFileName, err)
+	}
+	pw2.Close()
+	pr2.Close()
+
+	for _, c := range []*exec.Cmd{cmdc, cmdd, cmd2} {
+		if err := c.Wait(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+
+	return out.Close()
+}
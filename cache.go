@@ -0,0 +1,324 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// The cache entry used by the current run, set by cacheHit.
+var cachePath string
+
+// cacheInfo is saved as cache.json in each cache entry.
+type cacheInfo struct {
+	Created   time.Time
+	BloomSize uint64
+	NumHash   int
+	Windows   []int
+}
+
+// fileStamp identifies the contents of an input file by its name,
+// size and modification time.
+type fileStamp struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+func stamp(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// cacheKey returns a hash of the input files and configuration values
+// that determine the outputs of the stages up to and including
+// sortBloom.  The random seed is not included, since it only affects
+// the false positives of the screen, which are removed when the
+// matches are confirmed.
+func cacheKey() (string, error) {
+
+	reads, err := stamp(config.ReadFileName)
+	if err != nil {
+		return "", err
+	}
+	// The target file may be a manifest, in which case the volumes
+	// it lists are stamped as well.
+	var genes []fileStamp
+	files, err := utils.TargetFiles(config.GeneFileName)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range append([]string{config.GeneFileName}, files...) {
+		st, err := stamp(f)
+		if err != nil {
+			return "", err
+		}
+		genes = append(genes, st)
+	}
+
+	v := struct {
+		Reads         fileStamp
+		Genes         []fileStamp
+		Windows       []int
+		WindowStride  int
+		WindowWidth   int
+		WindowAnchor  string
+		BloomSize     uint64
+		NumHash       int
+		AutoBloom     bool
+		BloomFPR      float64
+		BloomHash     string
+		ScreenMethod  string
+		IndexSide     string
+		MinDinuc      int
+		MaxKmerReads  int
+		MinReadLength int
+		MaxReadLength int
+		MaxNameList   int
+		UMI           string
+		ReadGroup     string
+		Alphabet      string
+		Adapters      []string
+		MinOverlap    int
+		QualityTrim   int
+	}{
+		Reads:         reads,
+		Genes:         genes,
+		Windows:       config.Windows,
+		WindowStride:  config.WindowStride,
+		WindowWidth:   config.WindowWidth,
+		WindowAnchor:  config.WindowAnchor,
+		BloomSize:     config.BloomSize,
+		NumHash:       config.NumHash,
+		AutoBloom:     config.AutoBloom,
+		BloomFPR:      config.BloomFPR,
+		BloomHash:     config.BloomHash,
+		ScreenMethod:  config.ScreenMethod,
+		IndexSide:     config.IndexSide,
+		MinDinuc:      config.MinDinuc,
+		MaxKmerReads:  config.MaxKmerReads,
+		MinReadLength: config.MinReadLength,
+		MaxReadLength: config.MaxReadLength,
+		MaxNameList:   config.MaxNameList,
+		UMI:           config.UMI,
+		ReadGroup:     config.ReadGroup,
+		Alphabet:      config.SequenceAlphabet,
+		Adapters:      config.Adapters,
+		MinOverlap:    config.AdapterMinOverlap,
+		QualityTrim:   config.QualityTrim,
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+
+	return hex.EncodeToString(h[0:16]), nil
+}
+
+// cacheHit determines the cache entry for the current run, and returns
+// true if the entry is complete.
+func cacheHit() bool {
+
+	key, err := cacheKey()
+	if err != nil {
+		logger.Printf("Not using cache: %v", err)
+		return false
+	}
+	cachePath = path.Join(config.CacheDir, key)
+
+	_, err = os.Stat(path.Join(cachePath, "cache.json"))
+	if err != nil {
+		logger.Printf("Cache miss, will save to %s", cachePath)
+		return false
+	}
+
+	logger.Printf("Cache hit, reusing %s", cachePath)
+	return true
+}
+
+// cachedTemp returns the names of the files in TempDir that are saved
+// in the cache.
+func cachedTemp() []string {
+	files := []string{"reads_sorted.txt.sz", utils.NamesFileName}
+	for k := range config.Windows {
+		files = append(files, fmt.Sprintf("win_%d_sorted.txt.sz", k))
+		files = append(files, fmt.Sprintf("smatch_%d.txt.sz", k))
+	}
+	return files
+}
+
+// cachedLogs returns the names of the files in LogDir that are saved
+// in the cache, so that the run report and count checks are complete
+// when the cache is used.
+func cachedLogs() []string {
+	files := []string{
+		"prepinfo.json", "seqinfo.json", "windowinfo.json", "bloominfo.json",
+		"warnings_muscato_prep_reads.json", "warnings_muscato_uniqify.json",
+		"warnings_muscato_window_reads.json", "warnings_muscato_screen.json",
+	}
+	for k := range config.Windows {
+		files = append(files, fmt.Sprintf("blacklist_%d.txt", k))
+	}
+	return files
+}
+
+// linkOrCopy makes dst refer to the contents of src, using a hard link
+// if possible.
+func linkOrCopy(src, dst string) error {
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// linkWithLayout calls linkOrCopy for an intermediate file, and for
+// its layout if it has one, so that the stages reusing the file check
+// it against the layout of the run that wrote it.
+func linkWithLayout(src, dst string) error {
+
+	if err := linkOrCopy(src, dst); err != nil {
+		return err
+	}
+
+	lsrc := utils.LayoutName(src)
+	if _, err := os.Stat(lsrc); err != nil {
+		return nil
+	}
+
+	return linkOrCopy(lsrc, utils.LayoutName(dst))
+}
+
+// saveCache stores the screening results in the cache.  The entry is
+// written to a temporary directory that is renamed when complete, so
+// that a partial entry is never used.
+func saveCache() error {
+
+	if err := os.MkdirAll(config.CacheDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(config.CacheDir, "partial_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range cachedTemp() {
+		if err := linkWithLayout(path.Join(config.TempDir, f), path.Join(tmp, f)); err != nil {
+			return err
+		}
+	}
+	for _, f := range cachedLogs() {
+		src := path.Join(config.LogDir, f)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := linkOrCopy(src, path.Join(tmp, f)); err != nil {
+			return err
+		}
+	}
+
+	ci := cacheInfo{
+		Created:   time.Now(),
+		BloomSize: config.BloomSize,
+		NumHash:   config.NumHash,
+		Windows:   config.Windows,
+	}
+	fid, err := os.Create(path.Join(tmp, "cache.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(fid).Encode(ci); err != nil {
+		fid.Close()
+		return err
+	}
+	if err := fid.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, cachePath); err != nil {
+		// Another run may have saved the same entry.
+		if _, err2 := os.Stat(path.Join(cachePath, "cache.json")); err2 == nil {
+			return nil
+		}
+		return err
+	}
+	logger.Printf("Saved screening results to %s", cachePath)
+
+	return nil
+}
+
+// restoreCache places the cached screening results into TempDir and
+// LogDir, in place of running the screening stages.
+func restoreCache() error {
+
+	io.WriteString(os.Stderr, "Reusing cached screening results...\n")
+
+	fid, err := os.Open(path.Join(cachePath, "cache.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	var ci cacheInfo
+	if err := json.NewDecoder(fid).Decode(&ci); err != nil {
+		return err
+	}
+
+	// With WindowStride, the windows were chosen when the entry
+	// was saved.
+	if config.WindowStride > 0 {
+		config.Windows = ci.Windows
+	}
+
+	for _, f := range cachedTemp() {
+		if err := linkWithLayout(path.Join(cachePath, f), path.Join(config.TempDir, f)); err != nil {
+			return err
+		}
+	}
+	for _, f := range cachedLogs() {
+		src := path.Join(cachePath, f)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := linkOrCopy(src, path.Join(config.LogDir, f)); err != nil {
+			return err
+		}
+	}
+
+	// With AutoBloom, these were chosen when the entry was saved.
+	config.BloomSize = ci.BloomSize
+	config.NumHash = ci.NumHash
+
+	return saveConfig(config)
+}
@@ -0,0 +1,239 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kshedden/muscato"
+	"github.com/kshedden/muscato/utils"
+)
+
+// geneStatColumns gives the column of each statistic in the gene
+// statistics file.
+var geneStatColumns = map[string]int{
+	"n":       1,
+	"breadth": 3,
+	"depth":   4,
+	"RPKM":    5,
+}
+
+// aggRun contains the results of one run being aggregated.
+type aggRun struct {
+	label  string
+	report *muscato.RunResult
+	genes  map[string]float64
+}
+
+// aggregateCommand handles 'muscato aggregate', which combines the
+// gene statistics and run summaries of several completed runs into
+// two tables with one column per run.  Each run is identified by its
+// log directory, which contains run_report.json.
+func aggregateCommand(args []string) {
+
+	fs := flag.NewFlagSet("muscato aggregate", flag.ExitOnError)
+	out := fs.String("out", "aggregate", "Prefix of the output file names")
+	stat := fs.String("stat", "n", "Gene statistic to combine: n, breadth, depth or RPKM")
+	labels := fs.String("labels", "", "Comma-separated labels for the runs (default is based on the results file names)")
+	fs.Usage = func() {
+		os.Stderr.WriteString("usage: muscato aggregate [flags] logdir1 logdir2 ...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	col, ok := geneStatColumns[*stat]
+	if !ok {
+		msg := fmt.Sprintf("muscato aggregate: unknown statistic '%s', use one of n, breadth, depth or RPKM\n", *stat)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+
+	dirs := fs.Args()
+	if len(dirs) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	var lab []string
+	if *labels != "" {
+		lab = strings.Split(*labels, ",")
+		if len(lab) != len(dirs) {
+			msg := fmt.Sprintf("muscato aggregate: %d labels given for %d runs\n", len(lab), len(dirs))
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+	}
+
+	var runs []*aggRun
+	seen := make(map[string]bool)
+	for i, dir := range dirs {
+		run, err := readRun(dir, col)
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato aggregate: %v\n", err))
+			os.Exit(1)
+		}
+		if lab != nil {
+			run.label = lab[i]
+		} else if seen[run.label] {
+			run.label += "_" + filepath.Base(filepath.Clean(dir))
+		}
+		seen[run.label] = true
+		runs = append(runs, run)
+	}
+
+	for _, f := range []struct {
+		name  string
+		write func(*bufio.Writer, []*aggRun)
+	}{
+		{*out + "_genes.txt", writeAggGenes},
+		{*out + "_summary.txt", writeAggSummary},
+	} {
+		if err := writeTable(f.name, runs, f.write); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato aggregate: %v\n", err))
+			os.Exit(1)
+		}
+		os.Stderr.WriteString(fmt.Sprintf("Wrote %s\n", f.name))
+	}
+}
+
+// readRun reads the run report and one column of the gene statistics
+// for the run with the given log directory.
+func readRun(dir string, col int) (*aggRun, error) {
+
+	fid, err := os.Open(path.Join(dir, "run_report.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	rr := new(muscato.RunResult)
+	if err := json.NewDecoder(fid).Decode(rr); err != nil {
+		return nil, fmt.Errorf("%s: %v", fid.Name(), err)
+	}
+	if rr.Config == nil {
+		return nil, fmt.Errorf("%s does not contain the configuration", fid.Name())
+	}
+
+	c := rr.Config
+	gsname := utils.CompressedName(withSuffix(c.ResultsFileName, "_genestats"), c.CompressResults)
+	genes, err := geneColumn(gsname, col)
+	if err != nil {
+		return nil, err
+	}
+
+	label := path.Base(c.ResultsFileName)
+	label = label[0 : len(label)-len(path.Ext(label))]
+
+	return &aggRun{label: label, report: rr, genes: genes}, nil
+}
+
+// writeTable writes one of the aggregate tables to a file.
+func writeTable(name string, runs []*aggRun, write func(*bufio.Writer, []*aggRun)) error {
+
+	fid, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	wtr := bufio.NewWriter(fid)
+	write(wtr, runs)
+	if err := wtr.Flush(); err != nil {
+		fid.Close()
+		return err
+	}
+
+	return fid.Close()
+}
+
+// writeAggHeader writes the header row of an aggregate table.
+func writeAggHeader(wtr *bufio.Writer, first string, runs []*aggRun) {
+	wtr.WriteString(first)
+	for _, run := range runs {
+		wtr.WriteString("\t" + run.label)
+	}
+	wtr.WriteString("\n")
+}
+
+// writeAggGenes writes a table with one row per gene and one column per
+// run.  Genes with no matches in a run have a value of zero.
+func writeAggGenes(wtr *bufio.Writer, runs []*aggRun) {
+
+	all := make(map[string]bool)
+	for _, run := range runs {
+		for g := range run.genes {
+			all[g] = true
+		}
+	}
+	genes := make([]string, 0, len(all))
+	for g := range all {
+		genes = append(genes, g)
+	}
+	sort.Strings(genes)
+
+	writeAggHeader(wtr, "gene", runs)
+	for _, g := range genes {
+		wtr.WriteString(g)
+		for _, run := range runs {
+			fmt.Fprintf(wtr, "\t%g", run.genes[g])
+		}
+		wtr.WriteString("\n")
+	}
+}
+
+// writeAggSummary writes a table with one row for each of the
+// statistics in the run reports, and one column per run.
+func writeAggSummary(wtr *bufio.Writer, runs []*aggRun) {
+
+	rows := []struct {
+		name string
+		f    func(*aggRun) string
+	}{
+		{"NumInput", func(r *aggRun) string { return fmt.Sprint(r.report.NumInput) }},
+		{"NumSkipped", func(r *aggRun) string { return fmt.Sprint(r.report.NumSkipped) }},
+		{"NumReads", func(r *aggRun) string { return fmt.Sprint(r.report.NumReads) }},
+		{"NumUnique", func(r *aggRun) string { return fmt.Sprint(r.report.NumUnique) }},
+		{"NumDuplicates", func(r *aggRun) string { return fmt.Sprint(r.report.NumDuplicates) }},
+		{"UniqueFraction", func(r *aggRun) string {
+			var f float64
+			if r.report.NumReads > 0 {
+				f = float64(r.report.NumUnique) / float64(r.report.NumReads)
+			}
+			return fmt.Sprintf("%.4f", f)
+		}},
+		{"MatchedSeqs", func(r *aggRun) string { return fmt.Sprint(r.report.MatchedSeqs) }},
+		{"UnmatchedSeqs", func(r *aggRun) string { return fmt.Sprint(r.report.UnmatchedSeqs) }},
+		{"MatchedReads", func(r *aggRun) string { return fmt.Sprint(r.report.MatchedReads) }},
+		{"UnmatchedReads", func(r *aggRun) string { return fmt.Sprint(r.report.UnmatchedReads) }},
+		{"MappingRate", func(r *aggRun) string {
+			var rate float64
+			if r.report.NumInput > 0 {
+				rate = float64(r.report.MatchedReads) / float64(r.report.NumInput)
+			}
+			return fmt.Sprintf("%.4f", rate)
+		}},
+		{"Genes", func(r *aggRun) string { return fmt.Sprint(len(r.genes)) }},
+		{"Warnings", func(r *aggRun) string { return fmt.Sprint(len(r.report.Warnings)) }},
+		{"Seconds", func(r *aggRun) string {
+			var t float64
+			for _, st := range r.report.Stages {
+				t += st.Seconds
+			}
+			return fmt.Sprintf("%.1f", t)
+		}},
+	}
+
+	writeAggHeader(wtr, "statistic", runs)
+	for _, row := range rows {
+		wtr.WriteString(row.name)
+		for _, run := range runs {
+			wtr.WriteString("\t" + row.f(run))
+		}
+		wtr.WriteString("\n")
+	}
+}
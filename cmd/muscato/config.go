@@ -0,0 +1,109 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+const configUsage = `usage:
+  muscato config migrate old.json [new.json]
+  muscato config schema
+`
+
+// configCommand handles the 'muscato config' subcommands.
+func configCommand(args []string) {
+
+	if len(args) == 0 {
+		os.Stderr.WriteString(configUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "migrate":
+		migrateConfig(args[1:])
+	case "schema":
+		configSchema()
+	default:
+		os.Stderr.WriteString(fmt.Sprintf("Unknown config command '%s'\n", args[0]))
+		os.Stderr.WriteString(configUsage)
+		os.Exit(1)
+	}
+}
+
+// migrateConfig upgrades a configuration file written for an earlier
+// version of Muscato.  The normalized configuration is written to the
+// second argument if provided, otherwise to stdout.  The changes that
+// were made are reported on stderr.
+func migrateConfig(args []string) {
+
+	if len(args) != 1 && len(args) != 2 {
+		os.Stderr.WriteString(configUsage)
+		os.Exit(1)
+	}
+
+	cfg, notes, err := utils.MigrateConfig(args[0])
+	if err != nil {
+		msg := fmt.Sprintf("Unable to migrate %s: %v\n", args[0], err)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+
+	for _, n := range notes {
+		os.Stderr.WriteString(n + "\n")
+	}
+	if len(notes) == 0 {
+		os.Stderr.WriteString("No changes needed\n")
+	}
+
+	out := os.Stdout
+	if len(args) == 2 {
+		fid, err := os.Create(args[1])
+		if err != nil {
+			msg := fmt.Sprintf("Unable to create %s: %v\n", args[1], err)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+		out = fid
+	}
+
+	err = writeJSON(out, cfg)
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		msg := fmt.Sprintf("muscato config: %v\n", err)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+}
+
+// configSchema writes a JSON schema for the configuration file format
+// to stdout.
+func configSchema() {
+
+	if err := writeJSON(os.Stdout, utils.ConfigSchema()); err != nil {
+		msg := fmt.Sprintf("muscato config: %v\n", err)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+}
+
+// writeJSON writes v to w as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,149 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/muscato"
+	"github.com/kshedden/muscato/utils"
+)
+
+// The tools run by 'muscato demo', and some of those run by Muscato,
+// which are checked for before starting.
+var demoTools = []string{"muscato_gendat", "muscato_prep_targets", "muscato_eval", "muscato_screen", "muscato_confirm", "sztool", "sort"}
+
+// demoCommand handles 'muscato demo', which generates a small
+// synthetic data set with muscato_gendat, runs Muscato on it, and
+// compares the results to the true origins of the reads with
+// muscato_eval.  It is a quick check that Muscato and the tools it
+// uses are installed correctly.  The data, results and logs are kept
+// in the demo directory, which is a new temporary directory unless
+// -dir is given.
+func demoCommand(args []string) {
+
+	fs := flag.NewFlagSet("muscato demo", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory for the demo data, results and logs (default: a new temporary directory)")
+	numRead := fs.Int("NumRead", 2000, "Number of reads to generate")
+	numGene := fs.Int("NumGene", 200, "Number of genes to generate")
+	minSens := fs.Float64("MinSensitivity", 0.95, "The demo fails if fewer than this proportion of the reads drawn from the genes are matched correctly")
+	fs.Parse(args)
+
+	fail := func(format string, args ...interface{}) {
+		os.Stderr.WriteString(fmt.Sprintf("muscato demo: "+format+"\n", args...))
+		os.Exit(1)
+	}
+
+	for _, t := range demoTools {
+		if _, err := exec.LookPath(t); err != nil {
+			fail("%s was not found, check that GOBIN is on your PATH (see the installation instructions)", t)
+		}
+	}
+
+	var err error
+	if *dir == "" {
+		*dir, err = ioutil.TempDir("", "muscato_demo")
+	} else {
+		err = os.MkdirAll(*dir, 0755)
+	}
+	if err == nil {
+		*dir, err = filepath.Abs(*dir)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+
+	// run runs a tool in the demo directory, with its output
+	// saved in demo.log.
+	logname := path.Join(*dir, "demo.log")
+	logf, err := os.Create(logname)
+	if err != nil {
+		fail("%v", err)
+	}
+	defer logf.Close()
+	run := func(name string, args ...string) {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = *dir
+		cmd.Stdout = logf
+		cmd.Stderr = logf
+		if err := cmd.Run(); err != nil {
+			fail("%s failed: %v, see %s for details", name, err, logname)
+		}
+	}
+
+	os.Stderr.WriteString(fmt.Sprintf("Generating %d reads and %d genes in %s...\n", *numRead, *numGene, *dir))
+	run("muscato_gendat", "-Mode=sample", "-NumRead="+strconv.Itoa(*numRead), "-NumGene="+strconv.Itoa(*numGene),
+		"-ReadLen=100", "-GeneLen=1000", "-SubRate=0.005", "-Seed=1", "-Dir="+*dir)
+	run("muscato_prep_targets", path.Join(*dir, "genes.txt.sz"))
+
+	config = &utils.Config{
+		WorkDir:         *dir,
+		ReadFileName:    path.Join(*dir, "reads.fastq"),
+		GeneFileName:    path.Join(*dir, "musc_genes.txt.sz"),
+		GeneIdFileName:  path.Join(*dir, "musc_ids_genes.txt.sz"),
+		ResultsFileName: "results.txt",
+		Windows:         []int{0, 20, 40, 60, 80},
+		WindowWidth:     15,
+		MaxReadLength:   100,
+		PMatch:          0.95,
+		MinDinuc:        5,
+		RandomSeed:      1,
+	}
+	if err := config.Validate(); err != nil {
+		fail("%v", err)
+	}
+
+	ctx, cancel := signalContext()
+	_, err = muscato.Run(ctx, config)
+	cancel()
+	if err != nil {
+		fail("%v\nSee the log files in %s for details.", err, config.LogDir)
+	}
+
+	cmd := exec.Command("muscato_eval", "-postol=2", path.Join(*dir, "truth.txt"), config.ResultsPath())
+	cmd.Stderr = logf
+	out, err := cmd.Output()
+	if err != nil {
+		fail("muscato_eval failed: %v, see %s for details", err, logname)
+	}
+	os.Stdout.Write(out)
+
+	sens, err := evalValue(out, "Sensitivity")
+	if err != nil {
+		fail("%v", err)
+	}
+
+	fmt.Printf("\nDemo data: %s\n", *dir)
+	fmt.Printf("Results:   %s\n", config.ResultsPath())
+	fmt.Printf("Logs:      %s\n", config.LogDir)
+
+	if sens < *minSens {
+		fail("the sensitivity %.4f is below %.4f, Muscato may not be installed correctly", sens, *minSens)
+	}
+	fmt.Printf("\nThe demo completed successfully.\n")
+}
+
+// evalValue returns the value of a named statistic in the output of
+// muscato_eval.
+func evalValue(out []byte, name string) (float64, error) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		toks := strings.Split(scanner.Text(), "\t")
+		if len(toks) == 2 && toks[0] == name {
+			return strconv.ParseFloat(toks[1], 64)
+		}
+	}
+
+	return 0, fmt.Errorf("muscato_eval did not report %s", name)
+}
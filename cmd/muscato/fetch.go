@@ -0,0 +1,256 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// testDataset is a public data set downloaded by 'muscato
+// fetch-testdata'.
+type testDataset struct {
+
+	// The name of the data set, which is also the name of its
+	// subdirectory of the cache directory.
+	Name string
+
+	Description string
+
+	// Either "targets", for a fasta file of target sequences, or
+	// "reads", for a fastq file of reads.
+	Kind string
+
+	URL string
+
+	// The SHA-256 checksum of the file, in hexadecimal.  If it is
+	// empty, the checksum of the first download is recorded in the
+	// cache directory, and later downloads are checked against it.
+	SHA256 string
+}
+
+// testDatasets are the data sets downloaded by default.  They are
+// small enough to run the benchmarks in tests/benchmark in a few
+// minutes.
+var testDatasets = []testDataset{
+	{
+		Name:        "yeast_cdna",
+		Description: "Saccharomyces cerevisiae R64-1-1 cDNA (Ensembl release 110)",
+		Kind:        "targets",
+		URL:         "https://ftp.ensembl.org/pub/release-110/fasta/saccharomyces_cerevisiae/cdna/Saccharomyces_cerevisiae.R64-1-1.cdna.all.fa.gz",
+	},
+	{
+		Name:        "yeast_ncrna",
+		Description: "Saccharomyces cerevisiae R64-1-1 non-coding RNA (Ensembl release 110)",
+		Kind:        "targets",
+		URL:         "https://ftp.ensembl.org/pub/release-110/fasta/saccharomyces_cerevisiae/ncrna/Saccharomyces_cerevisiae.R64-1-1.ncrna.fa.gz",
+	},
+}
+
+// defaultTestDataDir returns the default cache directory for the
+// test data.
+func defaultTestDataDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "muscato_testdata"
+	}
+	return path.Join(dir, "muscato", "testdata")
+}
+
+// fetchCommand handles 'muscato fetch-testdata', which downloads
+// public data sets into a cache directory, for the benchmarks in
+// tests/benchmark.  Each file is checked against its SHA-256 checksum,
+// and is only downloaded again if it is missing or does not match.
+// The name and path of each data set is written to stdout, separated
+// by a tab.
+func fetchCommand(args []string) {
+
+	fs := flag.NewFlagSet("muscato fetch-testdata", flag.ExitOnError)
+	dir := fs.String("dir", defaultTestDataDir(), "Cache directory for the downloaded data sets")
+	manifest := fs.String("manifest", "", "JSON file listing the data sets to use in place of the built-in list")
+	list := fs.Bool("list", false, "List the available data sets without downloading them")
+	fs.Usage = func() {
+		os.Stderr.WriteString("usage: muscato fetch-testdata [flags] [dataset ...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	fail := func(format string, args ...interface{}) {
+		os.Stderr.WriteString(fmt.Sprintf("muscato fetch-testdata: "+format+"\n", args...))
+		os.Exit(1)
+	}
+
+	datasets := testDatasets
+	if *manifest != "" {
+		var err error
+		datasets, err = readManifest(*manifest)
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+
+	if *list {
+		for _, ds := range datasets {
+			fmt.Printf("%s\t%s\t%s\n", ds.Name, ds.Kind, ds.Description)
+		}
+		return
+	}
+
+	if fs.NArg() > 0 {
+		byName := make(map[string]testDataset)
+		for _, ds := range datasets {
+			byName[ds.Name] = ds
+		}
+		var sel []testDataset
+		for _, name := range fs.Args() {
+			ds, ok := byName[name]
+			if !ok {
+				fail("unknown data set '%s', see 'muscato fetch-testdata -list'", name)
+			}
+			sel = append(sel, ds)
+		}
+		datasets = sel
+	}
+
+	for _, ds := range datasets {
+		fname, err := fetchDataset(*dir, ds)
+		if err != nil {
+			fail("%s: %v", ds.Name, err)
+		}
+		fmt.Printf("%s\t%s\n", ds.Name, fname)
+	}
+}
+
+// readManifest reads a list of data sets from a JSON file.
+func readManifest(fname string) ([]testDataset, error) {
+
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var datasets []testDataset
+	if err := json.Unmarshal(b, &datasets); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	for _, ds := range datasets {
+		if ds.Name == "" || ds.URL == "" || strings.ContainsAny(ds.Name, "/\\") {
+			return nil, fmt.Errorf("%s: each data set needs a Name (without slashes) and a URL", fname)
+		}
+		if ds.Kind != "targets" && ds.Kind != "reads" {
+			return nil, fmt.Errorf("%s: the Kind of %s must be 'targets' or 'reads'", fname, ds.Name)
+		}
+	}
+
+	return datasets, nil
+}
+
+// fetchDataset downloads a data set into its subdirectory of dir,
+// unless it is already there with the expected checksum, and returns
+// the path of the file.
+func fetchDataset(dir string, ds testDataset) (string, error) {
+
+	sub := path.Join(dir, ds.Name)
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		return "", err
+	}
+	fname := path.Join(sub, path.Base(ds.URL))
+	sumname := fname + ".sha256"
+
+	// The checksum to check against, from the data set or an
+	// earlier download.
+	want := strings.ToLower(ds.SHA256)
+	if want == "" {
+		if b, err := ioutil.ReadFile(sumname); err == nil {
+			want = strings.TrimSpace(string(b))
+		}
+	}
+
+	if want != "" {
+		if got, err := fileSHA256(fname); err == nil {
+			if got == want {
+				return filepath.Abs(fname)
+			}
+			os.Stderr.WriteString(fmt.Sprintf("%s does not match its checksum, downloading it again\n", fname))
+		}
+	}
+
+	os.Stderr.WriteString(fmt.Sprintf("Downloading %s (%s)...\n", ds.Name, ds.URL))
+	got, err := download(ds.URL, fname)
+	if err != nil {
+		return "", err
+	}
+
+	if want != "" && got != want {
+		os.Remove(fname)
+		return "", fmt.Errorf("the checksum of %s is %s, expected %s", ds.URL, got, want)
+	}
+	if want == "" {
+		os.Stderr.WriteString(fmt.Sprintf("No checksum is listed for %s, recorded %s in %s\n", ds.Name, got, sumname))
+	}
+	if err := ioutil.WriteFile(sumname, []byte(got+"\n"), 0644); err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(fname)
+}
+
+// download copies the contents of a URL to a file, and returns their
+// SHA-256 checksum.  The file is only created if the download is
+// complete.
+func download(url, fname string) (string, error) {
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	tmpname := fname + ".part"
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		out.Close()
+		os.Remove(tmpname)
+		return "", fmt.Errorf("downloading %s: %v", url, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpname)
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), os.Rename(tmpname, fname)
+}
+
+// fileSHA256 returns the SHA-256 checksum of a file.
+func fileSHA256(fname string) (string, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fid); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
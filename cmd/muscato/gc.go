@@ -0,0 +1,164 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kshedden/muscato"
+)
+
+// gcCommand handles 'muscato gc', which removes the temporary and log
+// directories left behind by runs that crashed or were killed.
+//
+// Each run creates a subdirectory of the temporary and log roots,
+// named by a unique id.  A log directory is retained if its
+// status.json shows that the run completed, and a temporary directory
+// is retained if it is named in such a status.json (this is only the
+// case when NoCleanTemp is set).  Directories of runs that are still
+// running on this host are always retained.  All other directories
+// that have not been modified within the given age are removed.
+func gcCommand(args []string) {
+
+	fs := flag.NewFlagSet("muscato gc", flag.ExitOnError)
+	olderThan := fs.String("older-than", "7d", "Only remove directories not modified within this age (e.g. 36h or 7d)")
+	tempRoots := fs.String("TempDir", defaultTempRoots(), "Comma-separated list of directories containing temporary directories")
+	logRoots := fs.String("LogDir", "muscato_logs", "Comma-separated list of directories containing log directories")
+	workDir := fs.String("WorkDir", "", "The WorkDir of the runs, relative TempDir and LogDir locations are taken within it")
+	dryRun := fs.Bool("dry-run", false, "List the directories that would be removed without removing them")
+	fs.Parse(args)
+
+	if *workDir != "" {
+		*tempRoots = inWorkDir(*workDir, *tempRoots)
+		*logRoots = inWorkDir(*workDir, *logRoots)
+	}
+
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid value '%s' for -older-than: %v\n", *olderThan, err)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+	cutoff := time.Now().Add(-age)
+
+	// Temporary directories that are referenced by a status file,
+	// and should not be removed.
+	keepTemp := make(map[string]bool)
+
+	var candidates []string
+	for _, dir := range subdirs(*logRoots) {
+		st, err := muscato.ReadStatus(dir)
+		if err == nil && (st.State == "completed" || st.State == "partial" || isRunning(st)) {
+			keepTemp[st.TempDir] = true
+			continue
+		}
+		candidates = append(candidates, dir)
+	}
+
+	for _, dir := range subdirs(*tempRoots) {
+		if abs, err := filepath.Abs(dir); err == nil && keepTemp[abs] {
+			continue
+		}
+		candidates = append(candidates, dir)
+	}
+
+	var n int
+	for _, dir := range candidates {
+		fi, err := os.Stat(dir)
+		if err != nil || fi.ModTime().After(cutoff) {
+			continue
+		}
+		if *dryRun {
+			fmt.Println(dir)
+			n++
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			msg := fmt.Sprintf("Unable to remove %s: %v\n", dir, err)
+			os.Stderr.WriteString(msg)
+			continue
+		}
+		n++
+	}
+
+	if *dryRun {
+		os.Stderr.WriteString(fmt.Sprintf("%d directories would be removed\n", n))
+	} else {
+		os.Stderr.WriteString(fmt.Sprintf("Removed %d directories\n", n))
+	}
+}
+
+// parseAge parses a duration, allowing a number of days with suffix
+// 'd' in addition to the units understood by time.ParseDuration.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		d, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(d * 24 * float64(time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// subdirs returns the subdirectories of each directory in a
+// comma-separated list.
+func subdirs(roots string) []string {
+	var dirs []string
+	for _, root := range strings.Split(roots, ",") {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				dirs = append(dirs, filepath.Join(root, e.Name()))
+			}
+		}
+	}
+	return dirs
+}
+
+// isRunning returns true if the status shows a run that is still in
+// progress on this host.
+func isRunning(st *muscato.Status) bool {
+	if st.State != "running" {
+		return false
+	}
+	host, _ := os.Hostname()
+	if st.Host != host {
+		// We cannot check processes on other hosts, so assume
+		// that the run may still be active.
+		return true
+	}
+	return syscall.Kill(st.PID, 0) == nil
+}
+
+// inWorkDir places the relative directories in a comma-separated list
+// within workdir.
+func inWorkDir(workdir, roots string) string {
+	var dirs []string
+	for _, d := range strings.Split(roots, ",") {
+		if d != "" && !filepath.IsAbs(d) {
+			d = filepath.Join(workdir, d)
+		}
+		dirs = append(dirs, d)
+	}
+	return strings.Join(dirs, ",")
+}
+
+// defaultTempRoots returns the locations where runs create their
+// temporary directories if TempDir and WorkDir are not set.
+func defaultTempRoots() string {
+	if tmp := os.Getenv("TMPDIR"); tmp != "" {
+		return "muscato_tmp," + filepath.Join(tmp, "muscato_tmp")
+	}
+	return "muscato_tmp"
+}
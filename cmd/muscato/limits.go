@@ -0,0 +1,25 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// limitsCommand handles 'muscato limits', which describes the settings
+// that bound the work and resources of a run (see utils.Limits).
+func limitsCommand(args []string) {
+
+	if len(args) != 0 {
+		os.Stderr.WriteString("usage: muscato limits\n")
+		os.Exit(1)
+	}
+
+	if err := utils.WriteLimits(os.Stdout); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("muscato limits: %v\n", err))
+		os.Exit(1)
+	}
+}
@@ -46,1013 +46,221 @@
 //
 // See utils/Config.go for the full set of configuration parameters.
 //
+// The pipeline itself is implemented in the muscato package (the root
+// of this repository), which can be imported by other Go programs.
+//
+// Configuration files written for earlier versions of Muscato can be
+// upgraded to use the current field names with:
+//
+// muscato config migrate old.json new.json
+//
 // Muscato generates a number of intermediate files and logs that by
 // default are placed into the directory tmp/#####, where ##### is a
 // generated number.  This temporary directory can be deleted after a
 // successful run if desired.  The log files in the tmp directory may
 // contain useful information for troubleshooting.
 //
-// Since Muscato uses Unix-style FIFOs for interprocess communication,
-// it can only be run on Unix-like systems at present.  For the same
-// reason, Muscato may not be runnable from AFS or NFS implementations
-// that do not support FIFOs.
+// If muscato receives SIGINT (e.g. Ctrl-C) or SIGTERM, all of the
+// processes that it started are killed and the temporary files and
+// FIFOs are removed before it exits.
+//
+// The exit status of muscato gives the class of a failure: 1 for
+// other errors, 2 for a panic, 3 if MaxWallTime is exceeded, 4 for an
+// invalid configuration, 5 for a missing input file, 6 for a failed
+// command and 7 if TempDir runs out of space.  A failed run also
+// writes error.json to its log directory, with the failing stage and
+// command, the end of the stderr of the commands, and suggestions.
+//
+// Runs that crash or are killed may leave behind their temporary
+// directories.  These can be removed with:
+//
+// muscato gc --older-than=7d
+//
+// To compare the results for several values of a parameter that only
+// affects the confirmation of matches (PMatch, MMTol, MaxMatches or
+// MatchMode), use e.g.:
+//
+// muscato sweep --Param=PMatch:0.90,0.94,0.98 --ConfigFileName=config.json
+//
+// The screening results are computed once and reused for each value.
+//
+// To combine the gene statistics and summaries of several completed
+// runs into tables with one column per run, give their log
+// directories to:
+//
+// muscato aggregate --out=cohort muscato_logs/run1 muscato_logs/run2
+//
+// To check an installation, run Muscato on a small synthetic data set
+// and compare the results to the true origins of the reads with:
+//
+// muscato demo
+//
+// To download small public data sets (with their checksums checked)
+// into a cache directory, for the accuracy benchmarks in
+// tests/benchmark, use:
+//
+// muscato fetch-testdata
+//
+// The settings that bound the work and resources of a run (e.g.
+// MaxCandidates, MaxMatches, MaxWallTime and MaxMemory), and what
+// happens when each is reached, are described by:
+//
+// muscato limits
+//
+// When the run completes, a summary of the run (read counts, Bloom
+// filter fill rates, the number of matched and unmatched reads, the
+// time taken by each stage, and the configuration) is written to
+// run_report.json in the log directory.
+//
+// If MaxWallTime is set and passes while the matches are being
+// confirmed, the results are written using the windows that were
+// confirmed, and muscato exits with status 3 rather than 0.  If it
+// passes before any window is confirmed, no results are written and
+// the exit status is also 3.  Other errors give exit status 1.
+//
+// Since Muscato uses Unix-style pipes for interprocess communication,
+// it can only be run on Unix-like systems at present.  Commands that
+// read more than one input stream (e.g. join) are passed anonymous
+// pipes through /dev/fd.  On systems without /dev/fd, set PipeDir to
+// a directory on a local file system to use named pipes (FIFOs)
+// instead.  Many AFS and NFS implementations do not support FIFOs.
+// If PipeDir is found to be on a network file system, anonymous pipes
+// are used regardless.  If the results are written to a network file
+// system, the result files are synced to disk before being closed
+// (see SyncResults), so that write errors are reported rather than
+// silently producing truncated files.
 
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"os"
-	"os/exec"
-	"path"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 
-	"github.com/google/uuid"
+	"github.com/kshedden/muscato"
 	"github.com/kshedden/muscato/utils"
 )
 
 var (
-	configFilePath string
-
-	config   *utils.Config
-	basename string
-
-	// Flag for setting the tmp file location for sorting.
-	sortTmpFlag string
-
-	logger *log.Logger
-
-	sortpar string
-	sortmem string
+	config *utils.Config
 )
 
-// geneStats
-func geneStats() {
-
-	io.WriteString(os.Stderr, "Generating gene statistics...\n")
-
-	pr1, pw1, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	args := []string{sortmem, sortpar, "-k5"}
-	if sortTmpFlag != "" {
-		args = append(args, sortTmpFlag)
-	}
-	args = append(args, config.ResultsFileName)
-	cmd1 := exec.Command("sort", args...)
-	cmd1.Stderr = os.Stderr
-	cmd1.Env = os.Environ()
-	cmd1.Stdout = pw1
-
-	var outfile string
-	ext := path.Ext(config.ResultsFileName)
-	if ext != "" {
-		m := len(config.ResultsFileName)
-		outfile = config.ResultsFileName[0:m-len(ext)] + "_genestats" + ext
-	} else {
-		outfile = config.ResultsFileName + "_genestats"
-	}
-
-	cmd2 := exec.Command("muscato_genestats", "-")
-	cmd2.Stdin = pr1
-	cmd2.Stderr = os.Stderr
-	cmd2.Env = os.Environ()
-	fid, err := os.Create(outfile)
-	if err != nil {
-		panic(err)
-	}
-	defer fid.Close()
-	cmd2.Stdout = fid
-
-	for _, c := range []*exec.Cmd{cmd1, cmd2} {
-		c.Stderr = os.Stderr
-		if err := c.Start(); err != nil {
-			panic(err)
-		}
-	}
-
-	if err := cmd1.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw1.Close()
-	pr1.Close()
-
-	if err := cmd2.Wait(); err != nil {
-		panic(err)
-	}
-}
-
-func prepReads() {
-
-	io.WriteString(os.Stderr, "Preparing reads...\n")
-
-	pr1, pw1, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	pr2, pw2, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	// The destination file
-	outfinal := path.Join(config.TempDir, "reads_sorted.txt.sz")
-	fid, err := os.Create(outfinal)
-	if err != nil {
-		panic(err)
-	}
-	defer fid.Close()
-
-	// Run muscato_prep_reads
-	cmd1 := exec.Command("muscato_prep_reads", configFilePath)
-	cmd1.Stdout = pw1
-	cmd1.Env = os.Environ()
-	cmd1.Stderr = os.Stderr
-
-	// Sort the output of muscato_prep_reads
-	args := []string{sortmem, sortpar}
-	if sortTmpFlag != "" {
-		args = append(args, sortTmpFlag)
-	}
-	cmd2 := exec.Command("sort", args...)
-	cmd2.Stdin = pr1
-	cmd2.Stdout = pw2
-	cmd2.Env = os.Environ()
-	cmd2.Stderr = os.Stderr
-
-	// Uniqify and count duplicates
-	cmd3 := exec.Command("muscato_uniqify", configFilePath, "-")
-	cmd3.Stdin = pr2
-	cmd3.Stdout = fid
-	cmd3.Env = os.Environ()
-	cmd3.Stderr = os.Stderr
-
-	for _, cmd := range []*exec.Cmd{cmd1, cmd2, cmd3} {
-		if err := cmd.Start(); err != nil {
-			panic(err)
-		}
-	}
-
-	if err := cmd1.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw1.Close()
-	pr1.Close()
-
-	if err := cmd2.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw2.Close()
-	pr2.Close()
-
-	if err := cmd3.Wait(); err != nil {
-		panic(err)
-	}
-}
-
-func windowReads() {
-
-	io.WriteString(os.Stderr, "Windowing reads...\n")
-
-	// Run muscato_prep_reads
-	cmd := exec.Command("muscato_window_reads", configFilePath)
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-
-	if err := cmd.Run(); err != nil {
-		panic(err)
-	}
-}
-
-func sortWindows() {
-
-	for k := 0; k < len(config.Windows); k++ {
-
-		io.WriteString(os.Stderr, fmt.Sprintf("Sorting windows %d...\n", k))
-
-		pr1, pw1, err := os.Pipe()
-		if err != nil {
-			panic(err)
-		}
-
-		pr2, pw2, err := os.Pipe()
-		if err != nil {
-			panic(err)
-		}
-
-		// Decompress matches
-		fn := path.Join(config.TempDir, fmt.Sprintf("win_%d.txt.sz", k))
-		cmd1 := exec.Command("sztool", "-d", fn)
-		cmd1.Env = os.Environ()
-		cmd1.Stderr = os.Stderr
-		cmd1.Stdout = pw1
-
-		// Sort the matches
-		args := []string{sortmem, sortpar, "-k1"}
-		if sortTmpFlag != "" {
-			args = append(args, sortTmpFlag)
-		}
-		args = append(args, "-")
-		cmd2 := exec.Command("sort", args...)
-		cmd2.Env = os.Environ()
-		cmd2.Stderr = os.Stderr
-		cmd2.Stdin = pr1
-		cmd2.Stdout = pw2
-
-		// Compress results
-		fn = strings.Replace(fn, ".txt.sz", "_sorted.txt.sz", 1)
-		cmd3 := exec.Command("sztool", "-c", "-", fn)
-		cmd3.Stdin = pr2
-		cmd3.Stderr = os.Stderr
-		cmd3.Env = os.Environ()
-
-		for _, cmd := range []*exec.Cmd{cmd1, cmd2, cmd3} {
-			cmd.Stderr = os.Stderr
-			if err := cmd.Start(); err != nil {
-				panic(err)
-			}
-		}
-
-		if err := cmd1.Wait(); err != nil {
-			panic(err)
-		}
-
-		pw1.Close()
-		pr1.Close()
-
-		if err := cmd2.Wait(); err != nil {
-			panic(err)
-		}
-
-		pw2.Close()
-		pr2.Close()
-
-		if err := cmd3.Wait(); err != nil {
-			panic(err)
-		}
-	}
-}
-
-func screen() {
-
-	io.WriteString(os.Stderr, "Screening...\n")
-
-	cmd := exec.Command("muscato_screen", configFilePath)
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	if err := cmd.Run(); err != nil {
-		panic(err)
-	}
-}
-
-func sortBloom() {
-
-	for k := range config.Windows {
-
-		pr1, pw1, err := os.Pipe()
-		if err != nil {
-			panic(err)
-		}
-
-		pr2, pw2, err := os.Pipe()
-		if err != nil {
-			panic(err)
-		}
-
-		io.WriteString(os.Stderr, fmt.Sprintf("Sorting Bloom %d...\n", k))
-
-		// Decompress matches
-		fn := path.Join(config.TempDir, fmt.Sprintf("bmatch_%d.txt.sz", k))
-		cmd1 := exec.Command("sztool", "-d", fn)
-		cmd1.Stdout = pw1
-		cmd1.Env = os.Environ()
-		cmd1.Stderr = os.Stderr
-
-		// Sort the matches
-		args := []string{sortmem, sortpar, "-k1"}
-		if sortTmpFlag != "" {
-			args = append(args, sortTmpFlag)
-		}
-		args = append(args, "-")
-		cmd2 := exec.Command("sort", args...)
-		cmd2.Stdin = pr1
-		cmd2.Stdout = pw2
-		cmd2.Env = os.Environ()
-		cmd2.Stderr = os.Stderr
-
-		// Compress results
-		fn = path.Join(config.TempDir, fmt.Sprintf("smatch_%d.txt.sz", k))
-		cmd3 := exec.Command("sztool", "-c", "-", fn)
-		cmd3.Stdin = pr2
-		cmd3.Stderr = os.Stderr
-		cmd3.Env = os.Environ()
-
-		for _, cmd := range []*exec.Cmd{cmd1, cmd2, cmd3} {
-			cmd.Stderr = os.Stderr
-			if err := cmd.Start(); err != nil {
-				panic(err)
-			}
-		}
-
-		if err := cmd1.Wait(); err != nil {
-			panic(err)
-		}
-
-		pw1.Close()
-		pr1.Close()
-
-		if err := cmd2.Wait(); err != nil {
-			panic(err)
-		}
-
-		pw2.Close()
-		pr2.Close()
-
-		if err := cmd3.Wait(); err != nil {
-			panic(err)
-		}
-	}
-}
-
-func confirm() {
-
-	io.WriteString(os.Stderr, "Confirming...\n")
-
-	for j := 0; j < len(config.Windows); {
-
-		var cmds []*exec.Cmd
-
-		// Run a group of confirm processes in parallel
-		m := j + config.MaxConfirmProcs
-		if m > len(config.Windows) {
-			m = len(config.Windows)
-		}
-		for k := j; k < m; k++ {
-			logger.Printf("Starting confirm %d\n", k)
-			cmd := exec.Command("muscato_confirm", configFilePath, fmt.Sprintf("%d", k))
-			cmd.Stderr = os.Stderr
-			cmd.Env = os.Environ()
-			if err := cmd.Start(); err != nil {
-				panic(err)
-			}
-			cmds = append(cmds, cmd)
-		}
-
-		for _, c := range cmds {
-			if err := c.Wait(); err != nil {
-				panic(err)
-			}
-		}
-		logger.Printf("Confirm group done\n")
-
-		j = m
-	}
-}
-
-func combineWindows() {
-
-	io.WriteString(os.Stderr, "Combining windows...\n")
-
-	pr0, pw0, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	pr1, pw1, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	pr2, pw2, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	// Concatenate everything, excluding duplicates
-	cc := []string{"100000000", "0.000001", "run"}
-	for j := 0; j < len(config.Windows); j++ {
-		f := fmt.Sprintf("rmatch_%d.txt.sz", j)
-		fname := path.Join(config.TempDir, f)
-		cc = append(cc, fname)
-	}
-	cmd0 := exec.Command("muscato_combine_filter", cc...)
-	cmd0.Env = os.Environ()
-	cmd0.Stderr = os.Stderr
-	cmd0.Stdout = pw0
-
-	// Pipe everything into one sort/unique
-	var cmd1 *exec.Cmd
-	if sortTmpFlag != "" {
-		cmd1 = exec.Command("sort", sortmem, sortpar, sortTmpFlag, "-u", "-")
-	} else {
-		cmd1 = exec.Command("sort", sortmem, sortpar, "-u", "-")
-	}
-	cmd1.Env = os.Environ()
-	cmd1.Stderr = os.Stderr
-	cmd1.Stdin = pr0
-	cmd1.Stdout = pw1
-
-	cmd2 := exec.Command("muscato_combine_windows", configFilePath)
-	cmd2.Env = os.Environ()
-	cmd2.Stderr = os.Stderr
-	cmd2.Stdin = pr1
-	cmd2.Stdout = pw2
-
-	outname := path.Join(config.TempDir, "matches.txt.sz")
-	cmd3 := exec.Command("sztool", "-c", "-", outname)
-	cmd3.Env = os.Environ()
-	cmd3.Stderr = os.Stderr
-	cmd3.Stdin = pr2
-
-	for _, cmd := range []*exec.Cmd{cmd0, cmd1, cmd2, cmd3} {
-		cmd.Stderr = os.Stderr
-		if err := cmd.Start(); err != nil {
-			panic(err)
-		}
-	}
-
-	if err := cmd0.Wait(); err != nil {
-		panic(err)
-	}
-	pw0.Close()
-	pr0.Close()
-
-	if err := cmd1.Wait(); err != nil {
-		panic(err)
-	}
-	pw1.Close()
-	pr1.Close()
-
-	if err := cmd2.Wait(); err != nil {
-		panic(err)
-	}
-	pw2.Close()
-	pr2.Close()
-
-	if err := cmd3.Wait(); err != nil {
-		panic(err)
-	}
-}
-
-func sortByGeneId() {
-
-	io.WriteString(os.Stderr, "Sorting by gene id...\n")
-
-	inname := path.Join(config.TempDir, "matches.txt.sz")
-	outname := path.Join(config.TempDir, "matches_sg.txt.sz")
-
-	pr1, pw1, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	pr2, pw2, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	// Sort by gene number
-	cmd1 := exec.Command("sztool", "-d", inname)
-	cmd1.Stdout = pw1
-	cmd1.Env = os.Environ()
-	cmd1.Stderr = os.Stderr
-
-	// k5 is position of gene id
-	args := []string{sortmem, sortpar, "-k5"}
-	if sortTmpFlag != "" {
-		args = append(args, sortTmpFlag)
-	}
-	args = append(args, "-")
-	cmd2 := exec.Command("sort", args...)
-	cmd2.Stdin = pr1
-	cmd2.Stdout = pw2
-	cmd2.Env = os.Environ()
-	cmd2.Stderr = os.Stderr
-
-	// Compress the results
-	cmd3 := exec.Command("sztool", "-c", "-", outname)
-	cmd3.Stdin = pr2
-	cmd3.Env = os.Environ()
-	cmd3.Stderr = os.Stderr
-
-	for _, cmd := range []*exec.Cmd{cmd1, cmd2, cmd3} {
-		cmd.Stderr = os.Stderr
-		if err := cmd.Start(); err != nil {
-			panic(err)
-		}
-	}
-
-	if err := cmd1.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw1.Close()
-	pr1.Close()
-
-	if err := cmd2.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw2.Close()
-	pr2.Close()
-
-	if err := cmd3.Wait(); err != nil {
-		panic(err)
-	}
-}
-
-func joinGeneNames() {
-
-	io.WriteString(os.Stderr, "Joining gene names...\n")
-
-	pr1, pw1, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	pr2, pw2, err := os.Pipe()
-	if err != nil {
-		panic(err)
-	}
-
-	// Join genes and matches
-	fn := path.Join(config.TempDir, "matches_sg.txt.sz")
-	bs := fmt.Sprintf("join -1 5 -2 1 -t $'\t' <(sztool -d %s) <(sztool -d %s)\n", fn, config.GeneIdFileName)
-	fid, err := os.Create("bs.sh")
-	io.WriteString(fid, bs)
-	fid.Close()
-	cmd1 := exec.Command("/bin/bash", "bs.sh")
-	cmd1.Stdout = pw1
-	cmd1.Env = os.Environ()
-	cmd1.Stderr = os.Stderr
-
-	// Cut out unwanted column
-	// The first argument after cur is -d(tab)
-	cmd2 := exec.Command("cut", "-d	", "-f1", "--complement", "-")
-	cmd2.Stdin = pr1
-	cmd2.Stdout = pw2
-	cmd2.Env = os.Environ()
-	cmd2.Stderr = os.Stderr
-
-	// Compress the result
-	cmd3 := exec.Command("sztool", "-c", "-", path.Join(config.TempDir, "matches_sn.txt.sz"))
-	cmd3.Stdin = pr2
-	cmd3.Stderr = os.Stderr
-	cmd3.Env = os.Environ()
-
-	for _, cmd := range []*exec.Cmd{cmd1, cmd2, cmd3} {
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-		if err := cmd.Start(); err != nil {
-			panic(err)
-		}
-	}
-
-	if err := cmd1.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw1.Close()
-	pr1.Close()
-
-	if err := cmd2.Wait(); err != nil {
-		panic(err)
-	}
-
-	pw2.Close()
-	pr2.Close()
-
-	if err := cmd3.Wait(); err != nil {
-		panic(err)
-	}
-}
-
-func joinReadNames() {
-
-	io.WriteString(os.Stderr, "Joining read names...\n")
-
-	fn := path.Join(config.TempDir, "reads_sorted.txt.sz")
-	gn := path.Join(config.TempDir, "matches_sn.txt.sz")
-
-	if _, err := os.Stat(fn); os.IsNotExist(err) {
-		err := fmt.Errorf("reads_sorted.txt.sz does not exist")
-		panic(err)
-	}
-
-	if _, err := os.Stat(gn); os.IsNotExist(err) {
-		err := fmt.Errorf("matches_sn.txt.sz does not exist")
-		panic(err)
-	}
-
-	c1 := fmt.Sprintf("<(sort -k1 %s %s %s <(sztool -d %s))", sortmem, sortpar, sortTmpFlag, gn)
-	c2 := fmt.Sprintf("<(sztool -d %s)", fn)
-	bs := fmt.Sprintf("join -1 1 -2 1 -t'\t' %s %s > %s", c1, c2, config.ResultsFileName)
-	fid, err := os.Create("bs.sh")
-	if err != nil {
-		panic(err)
-	}
-	_, err = io.WriteString(fid, bs)
-	if err != nil {
-		panic(err)
-	}
-	fid.Close()
-
-	cmd := exec.Command("/bin/bash", "bs.sh")
-	cmd.Env = os.Environ()
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		panic(err)
-	}
-}
-
-// saveConfig saves the configuration file in json format into the log
-// directory.
-func saveConfig(config *utils.Config) {
-
-	fid, err := os.Create(path.Join(config.LogDir, "config.json"))
-	if err != nil {
-		msg := "Error in saveConfig, see log files for details."
-		os.Stderr.WriteString(msg)
-		log.Fatal(err)
-	}
-	defer fid.Close()
-	enc := json.NewEncoder(fid)
-	err = enc.Encode(config)
-	if err != nil {
-		msg := "Error in saveConfig, see log files for details."
-		os.Stderr.WriteString(msg)
-		log.Fatal(err)
-	}
-	configFilePath = path.Join(config.LogDir, "config.json")
-}
-
-func setupLog() {
-	logname := path.Join(config.LogDir, "muscato.log")
-	fid, err := os.Create(logname)
-	if err != nil {
-		panic(err)
-	}
-	logger = log.New(fid, "", log.Ltime)
-}
-
+// handleArgs reads the configuration file, if given, and applies the
+// other flags to it.  The configuration is validated here, so that
+// errors are reported before anything is run, and again by
+// muscato.Run.
 func handleArgs() {
 
 	ConfigFileName := flag.String("ConfigFileName", "", "JSON file containing configuration parameters")
-	ReadFileName := flag.String("ReadFileName", "", "Sequencing read file (fastq format)")
-	GeneFileName := flag.String("GeneFileName", "", "Gene file name (processed form)")
-	GeneIdFileName := flag.String("GeneIdFileName", "", "Gene ID file name (processed form)")
-	ResultsFileName := flag.String("ResultsFileName", "", "File name for results")
-	WindowsRaw := flag.String("Windows", "", "Starting position of each window")
-	WindowWidth := flag.Int("WindowWidth", 0, "Width of each window")
-	BloomSize := flag.Int("BloomSize", 0, "Size of Bloom filter, in bits")
-	NumHash := flag.Int("NumHash", 0, "Number of hashses")
-	PMatch := flag.Float64("PMatch", 0, "Required proportion of matching positions")
-	MinDinuc := flag.Int("MinDinuc", 0, "Minimum number of dinucleotides to check for match")
-	TempDir := flag.String("TempDir", "", "Workspace for temporary files")
-	MinReadLength := flag.Int("MinReadLength", 0, "Reads shorter than this length are skipped")
-	MaxReadLength := flag.Int("MaxReadLength", 0, "Reads longer than this length are truncated")
-	MaxMatches := flag.Int("MaxMatches", 0, "Return no more than this number of matches per window")
-	MaxConfirmProcs := flag.Int("MaxConfirmProcs", 0, "Run this number of match confirmation processes concurrently")
-	MMTol := flag.Int("MMTol", 0, "Number of mismatches allowed above best fit")
-	MatchMode := flag.String("MatchMode", "", "'first' or 'best' (retain first/best 'MaxMatches' matches meeting criteria)")
-	NoCleanTemp := flag.Bool("NoCleanTemp", false, "Do not delete temporary files from TempDir")
-	SortPar := flag.Int("SortPar", 0, "Number of parallel sort processes")
-	SortTemp := flag.String("SortTemp", "", "Directory to use for sort temp files")
-	SortMem := flag.String("SortMem", "", "Gnu sort -S parameter")
-	CPUProfile := flag.Bool("CPUProfile", false, "Capture CPU profile data")
-
+	utils.DefineFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *ConfigFileName != "" {
-		config = utils.ReadConfig(*ConfigFileName)
+		var err error
+		config, err = utils.LoadConfig(*ConfigFileName)
+		var cerr *utils.ConfigError
+		switch {
+		case errors.As(err, &cerr):
+			os.Stderr.WriteString(fmt.Sprintf("muscato: %v\n", err))
+			os.Exit(muscato.ExitConfig)
+		case err != nil:
+			os.Stderr.WriteString(fmt.Sprintf("muscato: %v\n", err))
+			os.Exit(muscato.ExitMissingInput)
+		}
 	} else {
 		config = new(utils.Config)
 	}
 
-	if *ReadFileName != "" {
-		config.ReadFileName = *ReadFileName
-	}
-	if *GeneFileName != "" {
-		config.GeneFileName = *GeneFileName
-	}
-	if *GeneIdFileName != "" {
-		config.GeneIdFileName = *GeneIdFileName
-	}
-	if *WindowWidth != 0 {
-		config.WindowWidth = *WindowWidth
-	}
-	if *BloomSize != 0 {
-		config.BloomSize = uint64(*BloomSize)
-	}
-	if *NumHash != 0 {
-		config.NumHash = *NumHash
-	}
-	if *PMatch != 0 {
-		config.PMatch = *PMatch
-	}
-	if *MinDinuc != 0 {
-		config.MinDinuc = *MinDinuc
-	}
-	if *TempDir != "" {
-		config.TempDir = *TempDir
+	if err := config.FromFlags(flag.CommandLine); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("muscato: %v\n", err))
+		os.Exit(muscato.ExitConfig)
 	}
-	if *MinReadLength != 0 {
-		config.MinReadLength = *MinReadLength
-	}
-	if *MaxReadLength != 0 {
-		config.MaxReadLength = *MaxReadLength
-	}
-	if *MaxMatches != 0 {
-		config.MaxMatches = *MaxMatches
-	}
-	if *MaxConfirmProcs != 0 {
-		config.MaxConfirmProcs = *MaxConfirmProcs
-	}
-	if *MatchMode != "" {
-		config.MatchMode = *MatchMode
-	}
-	if *MMTol != 0 {
-		config.MMTol = *MMTol
-	}
-	if *ResultsFileName != "" {
-		config.ResultsFileName = *ResultsFileName
-	}
-	if *NoCleanTemp {
-		config.NoCleanTemp = true
-	}
-	if *CPUProfile {
-		config.CPUProfile = true
-	}
-	if *SortPar != 0 {
-		config.SortPar = *SortPar
-	}
-	if *SortMem != "" {
-		config.SortMem = *SortMem
-	}
-
-	// Configure the temporary directory for sort.
-	if *SortTemp != "" {
-		config.SortTemp = *SortTemp
-		os.MkdirAll(config.SortTemp, os.ModePerm)
-	}
-	if config.SortTemp != "" {
-		sortTmpFlag = fmt.Sprintf("--temporary-directory=%s", config.SortTemp)
-	}
-
-	if config.ResultsFileName == "" {
-		config.ResultsFileName = "results.txt"
-		os.Stderr.WriteString("ResultsFileName not specified, defaulting to 'results.txt'\n")
+	if err := config.Validate(); err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("muscato: %v\n", err))
+		os.Exit(muscato.ExitConfig)
 	}
+}
 
-	if *WindowsRaw != "" {
-		toks := strings.Split(*WindowsRaw, ",")
-		var itoks []int
-		for _, x := range toks {
-			y, err := strconv.Atoi(x)
-			if err != nil {
-				msg := "Error in handleArgs, see log files for details.\n"
-				os.Stderr.WriteString(msg)
-				log.Fatal(err)
-			}
-			itoks = append(itoks, y)
+// signalContext returns a context that is cancelled on SIGINT or
+// SIGTERM, so that the child processes are killed and the temporary
+// files are removed before exiting.  A second signal terminates
+// muscato immediately.  The returned function stops the signal
+// handling.
+func signalContext() (context.Context, func()) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-sigc
+		if !ok {
+			return
 		}
-		config.Windows = itoks
+		signal.Stop(sigc)
+		os.Stderr.WriteString(fmt.Sprintf("\nReceived %v, stopping and removing temporary files...\n", sig))
+		cancel()
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigc)
+		close(sigc)
+		cancel()
 	}
 }
 
-func checkArgs() {
+func main() {
 
-	if config.ReadFileName == "" {
-		os.Stderr.WriteString("\nReadFileName not provided, run 'muscato --help for more information.\n\n")
-		os.Exit(1)
-	}
-	if config.GeneFileName == "" {
-		os.Stderr.WriteString("\nGeneFileName not provided, run 'muscato --help for more information.\n\n")
-		os.Exit(1)
-	}
-	if config.GeneIdFileName == "" {
-		os.Stderr.WriteString("\nGeneIdFileName not provided, run 'muscato --help for more information.\n\n")
-		os.Exit(1)
-	}
-	if config.ResultsFileName == "" {
-		config.ResultsFileName = "results.txt"
-		os.Stderr.WriteString("ResultsFileName not provided, defaulting to 'results.txt'\n")
-	}
-	if len(config.Windows) == 0 {
-		os.Stderr.WriteString("\nWindows not provided, run 'muscato --help for more information.\n\n")
-		os.Exit(1)
-	}
-	if config.WindowWidth == 0 {
-		os.Stderr.WriteString("\nWindowWidth not provided, run 'muscato --help for more information.\n\n")
-		os.Exit(1)
-	}
-	if config.BloomSize == 0 {
-		os.Stderr.WriteString("BloomSize not provided, defaulting to 4 billion\n")
-		config.BloomSize = 4 * 1000 * 1000 * 1000
-	}
-	if config.NumHash == 0 {
-		os.Stderr.WriteString("NumHash not provided, defaulting to 20\n")
-		config.NumHash = 20
-	}
-	if config.PMatch == 0 {
-		os.Stderr.WriteString("PMatch not provided, defaulting to 1\n")
-		config.PMatch = 1
-	}
-	if config.MaxReadLength == 0 {
-		os.Stderr.WriteString("MaxReadLength not provided, run 'muscato --help for more information.\n\n")
-		os.Exit(1)
-	}
-	if config.MaxMatches == 0 {
-		os.Stderr.WriteString("MaxMatches not provided, defaulting to 1 million\n")
-		config.MaxMatches = 1000 * 1000
-	}
-	if config.MaxConfirmProcs == 0 {
-		os.Stderr.WriteString("MaxConfirmProcs not provided, defaulting to 3\n")
-		config.MaxConfirmProcs = 3
-	}
-	if !strings.HasSuffix(config.ReadFileName, ".fastq") {
-		msg := fmt.Sprintf("Warning: %s may not be a fastq file, continuing anyway\n",
-			config.ReadFileName)
-		os.Stderr.WriteString(msg)
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCommand(os.Args[2:])
+		return
 	}
-	if config.MatchMode == "" {
-		os.Stderr.WriteString("MatchMode not provided, defaulting to 'best'\n")
-		config.MatchMode = "best"
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		gcCommand(os.Args[2:])
+		return
 	}
 
-	if config.SortPar == 0 {
-		// warning not needed
-		config.SortPar = 8
+	if len(os.Args) > 1 && os.Args[1] == "sweep" {
+		sweepCommand(os.Args[2:])
+		return
 	}
-	sortpar = fmt.Sprintf("--parallel=%d", config.SortPar)
-
-	if config.SortMem == "" {
-		os.Stderr.WriteString("SortMem not provided, defaulting to 50%\n")
-		config.SortMem = "50%"
+	if len(os.Args) > 1 && os.Args[1] == "aggregate" {
+		aggregateCommand(os.Args[2:])
+		return
 	}
-	sortmem = fmt.Sprintf("-S %s", config.SortMem)
-}
-
-func setupEnvs() {
-	err := os.Setenv("LC_ALL", "C")
-	if err != nil {
-		msg := "Error in setupEnvs, see log files for details.\n"
-		os.Stderr.WriteString(msg)
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "demo" {
+		demoCommand(os.Args[2:])
+		return
 	}
-	home := os.Getenv("HOME")
-	gopath := path.Join(home, "go")
-	err = os.Setenv("GOPATH", gopath)
-	if err != nil {
-		msg := "Error in setupEnvs, see log files for details.\n"
-		os.Stderr.WriteString(msg)
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "limits" {
+		limitsCommand(os.Args[2:])
+		return
 	}
-	err = os.Setenv("PATH", os.Getenv("PATH")+":"+home+"/go/bin")
-	if err != nil {
-		msg := "Error in setupEnvs, see log files for details.\n"
-		os.Stderr.WriteString(msg)
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "fetch-testdata" {
+		fetchCommand(os.Args[2:])
+		return
 	}
-}
 
-// Create the directory for all temporary files, if needed
-func makeTemp() {
-
-	// temp files, log files, etc. are stored in directories defined by this unique id.
-	xuid, err := uuid.NewUUID()
-	if err != nil {
-		msg := "Error in makeTemp, see log files for details.\n"
-		os.Stderr.WriteString(msg)
-		log.Fatal(err)
-	}
-	uid := xuid.String()
+	handleArgs()
 
-	if config.TempDir == "" {
-		config.TempDir = path.Join("muscato_tmp", uid)
-	} else {
-		// Overwrite the provided TempDir with a subdirectory.
-		config.TempDir = path.Join(config.TempDir, uid)
-	}
-	err = os.MkdirAll(config.TempDir, os.ModePerm)
+	ctx, cancel := signalContext()
+	res, err := muscato.Run(ctx, config)
+	cancel()
 	if err != nil {
-		if os.IsNotExist(err) {
-			msg := fmt.Sprintf("Directory %s does not exist and cannot be created.", config.TempDir)
-			os.Stderr.WriteString(msg)
-			os.Exit(1)
+		msg := fmt.Sprintf("muscato: %v\n", err)
+		if config.LogDir != "" {
+			msg += fmt.Sprintf("See the log files in %s for details.\n", config.LogDir)
 		}
-		log.Fatal(err)
-	}
-
-	// Setup the directory for logging.
-	if config.LogDir == "" {
-		config.LogDir = "muscato_logs"
-	}
-	config.LogDir = path.Join(config.LogDir, uid)
-
-	err = os.MkdirAll(config.LogDir, os.ModePerm)
-	if err != nil {
-		panic(err)
-	}
-}
-
-func cleanTmp() {
-
-	if config.NoCleanTemp {
-		return
-	}
-
-	err := os.RemoveAll(config.TempDir)
-	if err != nil {
-		panic(err)
-	}
-}
-
-func genReadStats() {
-
-	io.WriteString(os.Stderr, "Generating read statistics...\n")
-
-	cmd := exec.Command("muscato_readstats", configFilePath)
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	if err := cmd.Run(); err != nil {
-		panic(err)
+		os.Stderr.WriteString(msg)
+		os.Exit(muscato.ExitCode(err))
 	}
-}
-
-func writeNonMatch() {
-
-	io.WriteString(os.Stderr, "Writing non-matching sequences...\n")
-
-	cmd := exec.Command("muscato_nonmatch", configFilePath)
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	if err := cmd.Run(); err != nil {
-		panic(err)
+	if res.Partial {
+		msg := fmt.Sprintf("muscato: MaxWallTime exceeded, the results are partial (windows %v were not confirmed)\n",
+			res.SkippedWindows)
+		os.Stderr.WriteString(msg)
+		os.Exit(muscato.ExitPartial)
 	}
 }
-
-func main() {
-
-	defer cleanTmp()
-
-	handleArgs()
-	checkArgs()
-	setupEnvs()
-	makeTemp()
-
-	// The logger is not available until after makeTemp runs.
-	setupLog()
-
-	logger.Printf("Starting saveConfig...\n")
-	saveConfig(config)
-
-	logger.Printf("Starting prepReads...\n")
-	prepReads()
-
-	logger.Printf("Starting windowReads...\n")
-	windowReads()
-
-	logger.Printf("Starting sortWindows...\n")
-	sortWindows()
-
-	logger.Printf("Starting screen...\n")
-	screen()
-
-	logger.Printf("Starting sortBloom...\n")
-	sortBloom()
-
-	logger.Printf("Starting confirm...\n")
-	confirm()
-
-	logger.Printf("Starting combineWindows...\n")
-	combineWindows()
-
-	logger.Printf("Starting sortByGeneId...\n")
-	sortByGeneId()
-
-	logger.Printf("Starting joinGeneNames...\n")
-	joinGeneNames()
-
-	logger.Printf("Starting joinReadNames...\n")
-	joinReadNames()
-
-	logger.Printf("Starting writeNonMatch...\n")
-	writeNonMatch()
-
-	logger.Printf("Starting genReadStats...\n")
-	genReadStats()
-
-	logger.Printf("Starting geneStats...\n")
-	geneStats()
-}
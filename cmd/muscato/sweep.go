@@ -0,0 +1,258 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/muscato"
+	"github.com/kshedden/muscato/utils"
+)
+
+// sweepParams are the parameters that can be varied by 'muscato
+// sweep'.  They only affect the confirmation and later stages, so the
+// screening results are computed once and reused for every value.
+var sweepParams = map[string]func(c *utils.Config, v string) error{
+	"PMatch": func(c *utils.Config, v string) error {
+		x, err := strconv.ParseFloat(v, 64)
+		c.PMatch = x
+		return err
+	},
+	"MMTol": func(c *utils.Config, v string) error {
+		x, err := strconv.Atoi(v)
+		c.MMTol = x
+		return err
+	},
+	"MaxMatches": func(c *utils.Config, v string) error {
+		x, err := strconv.Atoi(v)
+		c.MaxMatches = x
+		return err
+	},
+	"MatchMode": func(c *utils.Config, v string) error {
+		c.MatchMode = v
+		return nil
+	},
+}
+
+// sweepResult contains the summary of one run of a sweep.
+type sweepResult struct {
+	value   string
+	result  *muscato.RunResult
+	matches int
+	genes   map[string]float64
+}
+
+// sweepCommand handles 'muscato sweep', which runs Muscato once for
+// each of several values of one parameter, and prints a table
+// comparing the runs.  The --Param flag has the form name:v1,v2,...,
+// and all other flags are as for a single run.  The screening results
+// are cached (in CacheDir, or muscato_cache if CacheDir is not set),
+// so only the first run carries out the screen.
+func sweepCommand(args []string) {
+
+	// Remove --Param from the arguments, the rest are handled by
+	// handleArgs.
+	var param string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		a := strings.TrimLeft(args[i], "-")
+		switch {
+		case strings.HasPrefix(a, "Param="):
+			param = strings.TrimPrefix(a, "Param=")
+		case a == "Param" && i+1 < len(args):
+			param = args[i+1]
+			i++
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+
+	toks := strings.SplitN(param, ":", 2)
+	if len(toks) != 2 || toks[1] == "" {
+		os.Stderr.WriteString("usage: muscato sweep --Param=name:value1,value2,... [flags]\n")
+		os.Exit(1)
+	}
+	name, values := toks[0], strings.Split(toks[1], ",")
+	set, ok := sweepParams[name]
+	if !ok {
+		var names []string
+		for k := range sweepParams {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		msg := fmt.Sprintf("muscato sweep: cannot sweep over %s, use one of %s\n", name, strings.Join(names, ", "))
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+
+	os.Args = append([]string{os.Args[0]}, rest...)
+	handleArgs()
+	if config.CacheDir == "" {
+		config.CacheDir = "muscato_cache"
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var results []*sweepResult
+	for _, v := range values {
+
+		c := *config
+		if err := set(&c, v); err != nil {
+			msg := fmt.Sprintf("muscato sweep: invalid value '%s' for %s: %v\n", v, name, err)
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+		c.ResultsFileName = withSuffix(config.ResultsFileName, fmt.Sprintf("_%s_%s", name, v))
+
+		os.Stderr.WriteString(fmt.Sprintf("Running with %s=%s...\n", name, v))
+		rslt, err := muscato.Run(ctx, &c)
+		if err != nil {
+			msg := fmt.Sprintf("muscato sweep: %v\n", err)
+			if c.LogDir != "" {
+				msg += fmt.Sprintf("See the log files in %s for details.\n", c.LogDir)
+			}
+			os.Stderr.WriteString(msg)
+			os.Exit(1)
+		}
+
+		sr := &sweepResult{value: v, result: rslt}
+		if sr.matches, err = countLines(c.ResultsPath()); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato sweep: %v\n", err))
+			os.Exit(1)
+		}
+		gsname := utils.CompressedName(withSuffix(c.ResultsFileName, "_genestats"), c.CompressResults)
+		if sr.genes, err = geneCounts(gsname); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato sweep: %v\n", err))
+			os.Exit(1)
+		}
+		results = append(results, sr)
+	}
+
+	writeSweep(name, results)
+}
+
+// withSuffix inserts a suffix into a file name before its extension.
+func withSuffix(name, suffix string) string {
+	ext := path.Ext(name)
+	return name[0:len(name)-len(ext)] + suffix + ext
+}
+
+// countLines returns the number of lines in a results file.
+func countLines(name string) (int, error) {
+
+	rdr, err := utils.OpenResult(name)
+	if err != nil {
+		return 0, err
+	}
+	defer rdr.Close()
+
+	var n int
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		n++
+	}
+
+	return n, scanner.Err()
+}
+
+// geneCounts returns the number of matches to each gene, from a gene
+// statistics file.
+func geneCounts(name string) (map[string]float64, error) {
+	return geneColumn(name, 1)
+}
+
+// geneColumn returns the values in one column of a gene statistics
+// file, for each gene.
+func geneColumn(name string, col int) (map[string]float64, error) {
+
+	rdr, err := utils.OpenResult(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	counts := make(map[string]float64)
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		f := bytes.Split(scanner.Bytes(), []byte("\t"))
+		if len(f) <= col {
+			continue
+		}
+		x, err := strconv.ParseFloat(string(f[col]), 64)
+		if err != nil {
+			return nil, err
+		}
+		counts[string(f[0])] = x
+	}
+
+	return counts, scanner.Err()
+}
+
+// correlation returns the Pearson correlation between two sets of gene
+// counts, treating genes missing from either set as having a count of
+// zero.
+func correlation(a, b map[string]float64) float64 {
+
+	genes := make(map[string]bool)
+	for g := range a {
+		genes[g] = true
+	}
+	for g := range b {
+		genes[g] = true
+	}
+
+	var n, sa, sb, saa, sbb, sab float64
+	for g := range genes {
+		x, y := a[g], b[g]
+		n++
+		sa += x
+		sb += y
+		saa += x * x
+		sbb += y * y
+		sab += x * y
+	}
+
+	if n == 0 {
+		return math.NaN()
+	}
+	va := saa - sa*sa/n
+	vb := sbb - sb*sb/n
+	if va <= 0 || vb <= 0 {
+		return math.NaN()
+	}
+
+	return (sab - sa*sb/n) / math.Sqrt(va*vb)
+}
+
+// writeSweep prints a tab-delimited table comparing the runs of a
+// sweep.  The gene count correlation is relative to the first run.
+func writeSweep(name string, results []*sweepResult) {
+
+	wtr := bufio.NewWriter(os.Stdout)
+	defer wtr.Flush()
+
+	fmt.Fprintf(wtr, "%s\tMappingRate\tMatchedReads\tMatchesPerRead\tGenes\tGeneCountCorr\n", name)
+	for _, sr := range results {
+		rr := sr.result
+		var rate, mpr float64
+		if rr.NumInput > 0 {
+			rate = float64(rr.MatchedReads) / float64(rr.NumInput)
+		}
+		if rr.MatchedSeqs > 0 {
+			mpr = float64(sr.matches) / float64(rr.MatchedSeqs)
+		}
+		r := correlation(results[0].genes, sr.genes)
+		fmt.Fprintf(wtr, "%s\t%.4f\t%d\t%.3f\t%d\t%.4f\n", sr.value, rate, rr.MatchedReads, mpr, len(sr.genes), r)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+// muscato_assign resolves reads that match multiple targets (genes),
+// using a results file that is sorted by read.  The resolution is
+// determined by Config.AssignMode:
+//
+// unique: only reads that match exactly one target are assigned
+//
+// fractional: each read is divided equally among all targets that it
+// matches
+//
+// best: each read is assigned to the target with the fewest
+// mismatches.  Ties are broken by taking the target whose identifier
+// sorts first, then by the smallest position.
+//
+// Two files are written.  The assignment file (results file name
+// with "_assign" appended) contains one row per assigned read and
+// target, with columns read sequence, target identifier, position,
+// number of mismatches, and the number of reads assigned (which may
+// be fractional).  The abundance file (results file name with
+// "_abundance" appended) contains one row per target, with columns
+// target identifier and the number of reads assigned to the target.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+var (
+	config *utils.Config
+
+	logger *log.Logger
+)
+
+// hit is a single match between a read and a target.
+type hit struct {
+	gene  string
+	pos   int
+	nmiss int
+}
+
+// readGroup contains all matches for one read sequence.
+type readGroup struct {
+	read  string
+	count float64
+	hits  []hit
+}
+
+// assign returns the hits that the read is assigned to, and the
+// number of reads assigned to each of them.
+func (rg *readGroup) assign(mode string) ([]hit, float64) {
+
+	// Retain one hit per target, with the fewest mismatches.
+	sort.Slice(rg.hits, func(i, j int) bool {
+		a, b := rg.hits[i], rg.hits[j]
+		if a.gene != b.gene {
+			return a.gene < b.gene
+		}
+		if a.nmiss != b.nmiss {
+			return a.nmiss < b.nmiss
+		}
+		return a.pos < b.pos
+	})
+	var hits []hit
+	for i, h := range rg.hits {
+		if i == 0 || h.gene != rg.hits[i-1].gene {
+			hits = append(hits, h)
+		}
+	}
+
+	switch mode {
+	case "unique":
+		if len(hits) != 1 {
+			return nil, 0
+		}
+		return hits, rg.count
+	case "fractional":
+		return hits, rg.count / float64(len(hits))
+	case "best":
+		best := hits[0]
+		for _, h := range hits[1:] {
+			if h.nmiss < best.nmiss {
+				best = h
+			}
+		}
+		return []hit{best}, rg.count
+	default:
+		panic(fmt.Sprintf("unknown AssignMode %s", mode))
+	}
+}
+
+// outName returns the name of an output file derived from the
+// results file name.
+func outName(suffix string) string {
+	ext := path.Ext(config.ResultsFileName)
+	if ext != "" {
+		m := len(config.ResultsFileName)
+		return config.ResultsFileName[0:m-len(ext)] + suffix + ext
+	}
+	return config.ResultsFileName + suffix
+}
+
+func setupLog() {
+	logname := path.Join(config.LogDir, "muscato_assign.log")
+	fid, err := os.Create(logname)
+	if err != nil {
+		panic(err)
+	}
+	logger = log.New(fid, "", log.Ltime)
+}
+
+// parseLine extracts the read sequence, the number of reads with the
+// sequence, and the match from one line of the results file.
+func parseLine(line []byte) (string, float64, hit, error) {
+
+	f := bytes.Split(line, []byte("\t"))
+	if len(f) < 7 {
+		return "", 0, hit{}, fmt.Errorf("results line has %d fields, expected at least 7", len(f))
+	}
+
+	pos, err := strconv.Atoi(string(f[2]))
+	if err != nil {
+		return "", 0, hit{}, err
+	}
+	nmiss, err := strconv.Atoi(string(f[3]))
+	if err != nil {
+		return "", 0, hit{}, err
+	}
+	count, err := strconv.ParseFloat(string(f[6]), 64)
+	if err != nil {
+		return "", 0, hit{}, err
+	}
+
+	return string(f[0]), count, hit{gene: string(f[4]), pos: pos, nmiss: nmiss}, nil
+}
+
+func run() error {
+
+	fid, err := utils.OpenResult(config.ResultsPath())
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	out, err := os.Create(outName("_assign"))
+	if err != nil {
+		return err
+	}
+	// Closed explicitly below, this only covers the early returns.
+	defer out.Close()
+	wtr := bufio.NewWriter(out)
+
+	abundance := make(map[string]float64)
+	var nread, nassigned float64
+
+	flush := func(rg *readGroup) error {
+		if len(rg.hits) == 0 {
+			return nil
+		}
+		nread += rg.count
+		hits, w := rg.assign(config.AssignMode)
+		for _, h := range hits {
+			abundance[h.gene] += w
+			nassigned += w
+			_, err := fmt.Fprintf(wtr, "%s\t%s\t%d\t%d\t%g\n", rg.read, h.gene, h.pos, h.nmiss, w)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(fid)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	rg := new(readGroup)
+	for jj := 0; scanner.Scan(); jj++ {
+		if jj == 0 {
+			utils.ResultsSchema.Require(scanner.Bytes(), logger)
+		}
+		read, count, h, err := parseLine(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if read != rg.read {
+			if err := flush(rg); err != nil {
+				return err
+			}
+			rg.read = read
+			rg.count = count
+			rg.hits = rg.hits[0:0]
+		}
+		rg.hits = append(rg.hits, h)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := flush(rg); err != nil {
+		return err
+	}
+
+	if err := wtr.Flush(); err != nil {
+		return err
+	}
+	if err := utils.CloseFile(out, config.SyncResults); err != nil {
+		return err
+	}
+
+	logger.Printf("AssignMode=%s: assigned %g of %g matched reads", config.AssignMode, nassigned, nread)
+
+	return writeAbundance(abundance)
+}
+
+// writeAbundance writes the number of reads assigned to each target,
+// ordered by target identifier.
+func writeAbundance(abundance map[string]float64) error {
+
+	genes := make([]string, 0, len(abundance))
+	for g := range abundance {
+		genes = append(genes, g)
+	}
+	sort.Strings(genes)
+
+	out, err := os.Create(outName("_abundance"))
+	if err != nil {
+		return err
+	}
+	wtr := bufio.NewWriter(out)
+
+	for _, g := range genes {
+		if _, err := fmt.Fprintf(wtr, "%s\t%g\n", g, abundance[g]); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := wtr.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return utils.CloseFile(out, config.SyncResults)
+}
+
+func main() {
+
+	defer utils.ExitOnPanic("muscato_assign")
+
+	if len(os.Args) != 2 {
+		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
+		os.Exit(1)
+	}
+
+	config = utils.ReadConfig(os.Args[1])
+
+	setupLog()
+
+	if err := run(); err != nil {
+		logger.Print(err)
+		os.Stderr.WriteString("Error in muscato_assign, see log files for details.\n")
+		log.Fatal(err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"strconv"
 
 	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/utils"
 	"github.com/willf/bloom"
 )
 
@@ -51,6 +52,8 @@ func makeReaders(files []string) []*bufio.Scanner {
 
 func main() {
 
+	defer utils.ExitOnPanic("muscato_combine_filter")
+
 	if len(os.Args) < 5 {
 		msg := fmt.Sprintf("Usage: %s num_objects fpr mode file1...\n", os.Args[0])
 		os.Stderr.WriteString(msg)
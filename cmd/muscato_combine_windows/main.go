@@ -3,12 +3,24 @@
 // muscato_combine_windows takes all matches for the same read, then
 // retains only those with nmiss equal to at most one greater than
 // the lowest nmiss.
+//
+// If BestHitFile is set, the match with the lowest nmiss for each
+// read is also written to besthit.txt.sz in the temporary directory,
+// followed by the number of matches for the read with the same
+// nmiss.  If there are several such matches, the first in sorted
+// order is used.
+//
+// If WindowMMTol is set, each match is followed by the MMTol of the
+// window that found it, which is used in place of MMTol, and removed
+// from the output.  A match found by several windows is written
+// once, using the largest of their values.
 
 package main
 
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
@@ -32,14 +44,22 @@ var (
 // writebest accepts a set of lines (lines), which have also been
 // broken into fields (bfr).  Every line represents a candidate match.
 // The matches with at most mmtol more matches than the best match are
-// printed out.  ibuf is provided workspace.
-func writebest(lines []string, bfr [][]string, ibuf []int, mmtol int) ([]int, error) {
+// printed out, or at most tols[i] more for line i if tols is not nil.
+// The number of mismatches is in column nmcol (counting from 0).  ibuf
+// is provided workspace.  If bw is not nil, the best match and the
+// number of ties is written to it.
+func writebest(lines []string, bfr [][]string, tols, ibuf []int, mmtol, nmcol int, bw io.Writer) ([]int, error) {
+
+	// There are no matches at all.
+	if len(lines) == 0 {
+		return ibuf, nil
+	}
 
 	// Find the best fit, determine the number of mismatches for each sequence.
 	ibuf = ibuf[0:0]
 	best := -1
 	for _, x := range bfr {
-		y, err := strconv.Atoi(x[3]) // 3 is position of nmiss
+		y, err := strconv.Atoi(x[nmcol])
 		if err != nil {
 			return nil, err
 		}
@@ -50,15 +70,80 @@ func writebest(lines []string, bfr [][]string, ibuf []int, mmtol int) ([]int, er
 	}
 
 	// Output the sequences with acceptable number of mismatches.
+	first, ties := -1, 0
 	for i, x := range lines {
+		if tols != nil {
+			mmtol = tols[i]
+		}
 		if ibuf[i] <= best+mmtol {
 			fmt.Println(x)
 		}
+		if ibuf[i] == best {
+			if first == -1 {
+				first = i
+			}
+			ties++
+		}
+	}
+
+	if bw != nil {
+		if _, err := fmt.Fprintf(bw, "%s\t%d\n", lines[first], ties); err != nil {
+			return nil, err
+		}
 	}
 
 	return ibuf, nil
 }
 
+// splitTols removes the MMTol column that follows each match when
+// WindowMMTol is set, and returns the values in tols.  The lines are
+// sorted, so a match found by several windows is on adjacent lines,
+// which are merged using the largest of their values.
+func splitTols(lines []string, bfr [][]string, tols []int) ([]string, [][]string, []int, error) {
+
+	var j int
+	tols = tols[0:0]
+	for i, x := range lines {
+		k := strings.LastIndexByte(x, '\t')
+		if k == -1 {
+			return nil, nil, nil, fmt.Errorf("match '%s' has no MMTol column", x)
+		}
+		tol, err := strconv.Atoi(x[k+1:])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		x = x[0:k]
+		if j > 0 && lines[j-1] == x {
+			if tol > tols[j-1] {
+				tols[j-1] = tol
+			}
+			continue
+		}
+		lines[j] = x
+		bfr[j] = bfr[i][0 : len(bfr[i])-1]
+		tols = append(tols, tol)
+		j++
+	}
+
+	return lines[0:j], bfr[0:j], tols, nil
+}
+
+// processBlock writes the retained matches of one read, see writebest.
+func processBlock(lines []string, bfr [][]string, tols, ibuf []int, mmtol, nmcol int, bw io.Writer) ([]int, []int, error) {
+
+	if len(config.WindowMMTol) == 0 {
+		ibuf, err := writebest(lines, bfr, nil, ibuf, mmtol, nmcol, bw)
+		return ibuf, tols, err
+	}
+
+	lines, bfr, tols, err := splitTols(lines, bfr, tols)
+	if err != nil {
+		return ibuf, tols, err
+	}
+	ibuf, err = writebest(lines, bfr, tols, ibuf, mmtol, nmcol, bw)
+	return ibuf, tols, err
+}
+
 func setupLog() {
 
 	logname := path.Join(config.LogDir, "muscato_combine_windows.log")
@@ -73,17 +158,19 @@ func setupLog() {
 
 func main() {
 
-	if len(os.Args) != 2 && len(os.Args) != 3 {
+	defer utils.ExitOnPanic("muscato_combine_windows")
+
+	if len(os.Args) != 2 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
 		os.Exit(1)
 	}
 
 	config = utils.ReadConfig(os.Args[1])
 
-	if config.TempDir == "" {
-		tmpdir = os.Args[2]
-	} else {
-		tmpdir = config.TempDir
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
 	}
 
 	setupLog()
@@ -91,15 +178,57 @@ func main() {
 
 	mmtol := config.MMTol
 
+	// The input is the concatenation of the confirmed matches for
+	// all windows, which have the same layout.  Some windows may
+	// not have been confirmed if MaxWallTime was exceeded.
+	first := path.Join(tmpdir, "rmatch_0.txt.sz")
+	for k := range config.Windows {
+		f := path.Join(tmpdir, fmt.Sprintf("rmatch_%d.txt.sz", k))
+		if _, err := os.Stat(f); err == nil {
+			first = f
+			break
+		}
+	}
+	lay, err := utils.ReadLayout(first, utils.MatchColumns)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("muscato_combine_windows: %v\n", err))
+		os.Exit(1)
+	}
+	nmcol, err := lay.Column("nmiss")
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("muscato_combine_windows: %v\n", err))
+		os.Exit(1)
+	}
+	nmcol--
+
+	var bw io.Writer
+	var bestfid *os.File
+	var bestout *utils.SnappyWriter
+	var bestname string
+	if config.BestHitFile != "" {
+		bestname = path.Join(tmpdir, "besthit.txt.sz")
+		bestfid, err = os.Create(bestname)
+		if err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato_combine_windows: %v\n", err))
+			os.Exit(1)
+		}
+		bestout = utils.NewSnappyWriter(bestfid, config.WriterBufferSize)
+		bw = bestout
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 	var lines []string
 	var fields [][]string
-	var ibuf []int
+	var ibuf, tols []int
 	var current string
-	var err error
+	schema := lay.Schema("confirm")
 	for scanner.Scan() {
 
 		line := scanner.Text()
+		if schema != nil {
+			schema.Require(scanner.Bytes(), logger)
+			schema = nil
+		}
 		field := strings.Fields(line)
 
 		// Add to the current block.
@@ -111,7 +240,7 @@ func main() {
 		}
 
 		// Process a block
-		ibuf, err = writebest(lines, fields, ibuf, mmtol)
+		ibuf, tols, err = processBlock(lines, fields, tols, ibuf, mmtol, nmcol, bw)
 		if err != nil {
 			msg := "Error in combineWindows, see log file for details.\n"
 			os.Stderr.WriteString(msg)
@@ -126,7 +255,7 @@ func main() {
 
 	if err := scanner.Err(); err == nil {
 		// Process the final block if possible
-		_, err := writebest(lines, fields, ibuf, mmtol)
+		_, _, err := processBlock(lines, fields, tols, ibuf, mmtol, nmcol, bw)
 		if err != nil {
 			msg := "Error in combineWindows, see log file for details.\n"
 			os.Stderr.WriteString(msg)
@@ -139,5 +268,21 @@ func main() {
 		logger.Printf("%v", err)
 	}
 
+	if bestout != nil {
+		if err := bestout.Close(); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato_combine_windows: %v\n", err))
+			os.Exit(1)
+		}
+		if err := bestfid.Close(); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato_combine_windows: %v\n", err))
+			os.Exit(1)
+		}
+		cols := append(lay.Columns, "ties")
+		if err := utils.WriteLayout(bestname, cols); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("muscato_combine_windows: %v\n", err))
+			os.Exit(1)
+		}
+	}
+
 	logger.Print("combineWindows done")
 }
@@ -0,0 +1,54 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// The parts of a 100 base read and its match, split around a 15 base
+// window at position 20.
+var (
+	benchLeft  = []byte("ACGTTGCAACGTTGCAACGT")
+	benchTag   = []byte("TGCAACGTTGCAACG")
+	benchRight = []byte("TTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTT")
+	benchGene  = []byte("00000012345")
+)
+
+func TestFormatMatch(t *testing.T) {
+
+	got := formatMatch(benchLeft, benchTag, benchRight, benchLeft, benchTag, benchRight[0:10], 230, 2, benchGene)
+	read := string(benchLeft) + string(benchTag) + string(benchRight)
+	targ := string(benchLeft) + string(benchTag) + string(benchRight[0:10])
+	want := fmt.Sprintf("%s\t%s\t%d\t%d\t%s\n", read, targ, 230, 2, benchGene)
+	if string(got) != want {
+		t.Errorf("formatMatch gave %q, expected %q", got, want)
+	}
+}
+
+func BenchmarkFormatMatch(b *testing.B) {
+
+	b.Run("formatMatch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			formatMatch(benchLeft, benchTag, benchRight, benchLeft, benchTag, benchRight, 230, 2, benchGene)
+		}
+	})
+
+	b.Run("Sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var bbuf bytes.Buffer
+			bbuf.Write(benchLeft)
+			bbuf.Write(benchTag)
+			bbuf.Write(benchRight)
+			bbuf.Write([]byte("\t"))
+			bbuf.Write(benchLeft)
+			bbuf.Write(benchTag)
+			bbuf.Write(benchRight)
+			bbuf.Write([]byte(fmt.Sprintf("\t%d\t%d\t%s\n", 230, 2, benchGene)))
+		}
+	})
+}
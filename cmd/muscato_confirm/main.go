@@ -12,18 +12,63 @@
 // "all pairs" matching is done for each k-mer sequence, and the
 // results that match sufficiently well, as determined by the PMatch
 // parameter, are retained for further processing.
+//
+// If ReadThrough is set, reads that extend beyond the 3' end of a
+// target are also matched, using the part of the read that is aligned
+// to the target, provided that at least ReadThrough bases are
+// aligned.  The target subsequence reported for such a match is
+// shorter than the read.
+//
+// If WindowAnchor is "end", the reads sharing a k-mer can have
+// different lengths, and the candidate matches carry enough of the
+// target to the left of the k-mer for the longest read.  This is cut
+// back to the length of each read, and reads that would extend past
+// the 5' end of the target are not matched.
+//
+// Low-complexity k-mers can be shared by very large numbers of reads
+// and targets.  Blocks with more than ConfirmBlockSize reads or
+// candidate matches are written to temporary files, and compared in
+// sub-batches of at most ConfirmBlockSize records from each side.  If
+// ConfirmFlank is set, such blocks are further divided by the bases
+// following the k-mer, so that only reads and targets that agree on
+// these bases are compared.
+//
+// If MismatchCosts is set, the PMatch criterion is applied to the
+// total cost of the unequal bases, rather than their number, e.g. so
+// that transitions, or bases read as N, count less than other
+// mismatches.  The number of mismatches is still reported, and used
+// to rank the matches.
+//
+// If WindowPMatch is set, the matches in window k must agree to
+// within its k'th value, in place of PMatch.
+//
+// If UnmatchedReasons is set, the status of each read that had at
+// least one candidate match in the window (matched, rejected by
+// PMatch, or dropped by MaxMatches) is saved to
+// readstatus_confirm_k.bin, for muscato_nonmatch.
+//
+// If RefineCommand is set, the read x gene pairs that were compared
+// but did not agree to within PMatch are written to refine_k.txt.sz,
+// with tab-delimited columns giving the full read sequence, the
+// target sequence around the shared k-mer, the position of this
+// sequence within the target, and the target number, so that they can
+// be passed to an external aligner.
 
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/golang/snappy"
 	"github.com/kshedden/muscato/utils"
@@ -31,14 +76,13 @@ import (
 )
 
 const (
-	// Number of simultaneous goroutines, maybe should scale with
-	// number of available cores.
-	concurrency = 100
-
 	doProfile = false
 )
 
 var (
+	// Number of simultaneous goroutines
+	concurrency int
+
 	logger *log.Logger
 
 	config *utils.Config
@@ -47,10 +91,28 @@ var (
 
 	win int // The window to process, win=0,1,...
 
+	// The costs of aligning each pair of bases, if MismatchCosts
+	// is set.
+	costs *utils.CostMatrix
+
 	// Pass results to driver then write to disk
 	rsltChan chan []byte
 
+	// The pairs to be passed to RefineCommand, if it is set.
+	refineChan chan []byte
+
 	alldone chan bool
+
+	// The status of each read, indexed by read id, if
+	// UnmatchedReasons is set.
+	status   []utils.ReadStatus
+	statusMu sync.Mutex
+
+	// The number of blocks (window sequences) whose matches were
+	// cut at MaxMatches.
+	nmaxed int64
+
+	warnings *utils.Warnings
 )
 
 type rec struct {
@@ -92,6 +154,20 @@ type breader struct {
 
 	// Used to confirm that file is sorted
 	last *rec
+
+	// The window sequence of the current block
+	key []byte
+
+	// If positive, blocks with more than this number of records
+	// are written to spill rather than held in memory.
+	maxrecs int
+
+	// The current block, if it was written to disk
+	spill *spillFile
+
+	// If not nil, the first record is checked against this
+	// schema.
+	schema *utils.RecordSchema
 }
 
 // Next advances a breader to the next block.
@@ -102,9 +178,15 @@ func (b *breader) Next() bool {
 	}
 
 	b.recs = b.recs[0:0]
+	b.key = nil
+	if b.spill != nil {
+		b.spill.remove()
+		b.spill = nil
+	}
 
 	if b.stash != nil {
 		b.recs = append(b.recs, b.stash)
+		b.key = b.stash.fields[0]
 		b.stash = nil
 	}
 
@@ -112,6 +194,9 @@ func (b *breader) Next() bool {
 
 		// Process a line
 		bb := b.scanner.Bytes()
+		if b.lnum == 0 && b.schema != nil {
+			b.schema.Require(bb, logger)
+		}
 		rx := new(rec)
 		rx.buf = make([]byte, len(bb))
 		copy(rx.buf, bb)
@@ -122,8 +207,9 @@ func (b *breader) Next() bool {
 			logger.Printf("%s: %d\n", b.name, b.lnum)
 		}
 
-		if (len(b.recs) > 0) && !bytes.Equal(b.recs[0].fields[0], rx.fields[0]) {
+		if (b.key != nil) && !bytes.Equal(b.key, rx.fields[0]) {
 			b.stash = rx
+			b.flush()
 			return true
 		}
 		// Check sorting (harder to check in other branch of the if).
@@ -134,7 +220,13 @@ func (b *breader) Next() bool {
 			}
 		}
 		b.last = rx
+		if b.key == nil {
+			b.key = rx.fields[0]
+		}
 		b.recs = append(b.recs, rx)
+		if b.maxrecs > 0 && len(b.recs) >= b.maxrecs {
+			b.spillRecs()
+		}
 	}
 
 	if err := b.scanner.Err(); err != nil {
@@ -142,11 +234,41 @@ func (b *breader) Next() bool {
 		panic(err)
 	}
 
+	b.flush()
 	b.done = true
 	logger.Printf("%s done", b.name)
 	return true
 }
 
+// spillRecs moves the records held in memory to the spill file.
+func (b *breader) spillRecs() {
+
+	if b.spill == nil {
+		b.spill = newSpillFile(fmt.Sprintf("%s_%d", b.name, win))
+	}
+	for _, r := range b.recs {
+		b.spill.add(r)
+	}
+	b.recs = b.recs[0:0]
+}
+
+// flush completes the spill file at the end of a block, if the block
+// was written to disk.
+func (b *breader) flush() {
+	if b.spill != nil {
+		b.spillRecs()
+		b.spill.close()
+	}
+}
+
+// block returns the records of the current block.
+func (b *breader) block() *recSet {
+	if b.spill != nil {
+		return &recSet{file: b.spill}
+	}
+	return &recSet{recs: rcpy(b.recs)}
+}
+
 // cdiff returns the number of unequal values in two byte sequences
 func cdiff(x, y []byte) int {
 	var c int
@@ -161,6 +283,13 @@ func cdiff(x, y []byte) int {
 type qrect struct {
 	mismatch int
 	gob      []byte
+
+	// The position of the read in the source block.
+	src int
+
+	// The batch of reads holding the read, for a block compared in
+	// batches (see blockMatches).
+	batch int
 }
 
 // searchpairs considers all reads and all genes that share a given
@@ -171,13 +300,43 @@ type qrect struct {
 func searchpairs(source, match []*rec, limit chan bool) {
 
 	defer func() { <-limit }()
+
+	qvals, nfound, passed, truncated := comparePairs(source, match)
+	if truncated || nfound > len(qvals) {
+		atomic.AddInt64(&nmaxed, 1)
+	}
+	if passed != nil {
+		setStatus(readIds(source), keptReads(len(source), qvals), passed, truncated)
+	}
+	for _, v := range qvals {
+		rsltChan <- v.gob
+	}
+}
+
+// comparePairs compares each read in source to each candidate in
+// match, and returns at most MaxMatches of the matches, the number of
+// matches that were found, whether each read had a match within
+// PMatch (if UnmatchedReasons is set), and whether the comparisons
+// stopped early at MaxMatches.
+func comparePairs(source, match []*rec) ([]*qrect, int, []bool, bool) {
+
 	if len(match)*len(source) > 100000 {
 		logger.Printf("searching %d %d ...", len(match), len(source))
 	}
 
 	var qvals []*qrect
+	var nfound int
 
 	first := config.MatchMode == "first"
+	pmatch := config.WindowPMatchFor(win)
+
+	// The reads with at least one match within PMatch, and whether
+	// the comparisons stopped at MaxMatches matches.
+	var passed []bool
+	var truncated bool
+	if config.UnmatchedReasons {
+		passed = make([]bool, len(source))
+	}
 
 	var stag []byte
 	for _, mrec := range match {
@@ -188,26 +347,56 @@ func searchpairs(source, match []*rec, limit chan bool) {
 		mgene := mrec.fields[3]
 		mpos := mrec.fields[4]
 
-		for _, srec := range source {
+		for si, srec := range source {
 
 			stag = srec.fields[0] // must equal mtag
 			slft := srec.fields[1]
 			srgt := srec.fields[2]
 
-			// Allowed number of mismatches
-			nmiss := int((1 - config.PMatch) * float64(len(stag)+len(slft)+len(srgt)))
+			// With WindowAnchor=end, the left tail of the target
+			// is long enough for the longest read, and is cut
+			// back to the length of this read.
+			mlft := mlft
+			if len(mlft) != len(slft) {
+				if len(mlft) < len(slft) {
+					// Gene starts before read would start.
+					continue
+				}
+				mlft = mlft[len(mlft)-len(slft):]
+			}
 
-			// Gene ends before read would end, can't match.
-			if len(srgt) > len(mrgt) {
-				continue
+			// The number of read bases aligned to the gene
+			mk := len(srgt)
+			if mk > len(mrgt) {
+				// Gene ends before read would end.
+				if config.ReadThrough == 0 {
+					continue
+				}
+				mk = len(mrgt)
+				if len(stag)+len(slft)+mk < config.ReadThrough {
+					continue
+				}
 			}
 
+			// Allowed number of mismatches
+			nmiss := int((1 - pmatch) * float64(len(stag)+len(slft)+mk))
+
 			// Count differences
-			mk := len(srgt)
 			nx := cdiff(mlft, slft)
-			nx += cdiff(mrgt[0:mk], srgt)
-			if nx > nmiss {
-				continue
+			nx += cdiff(mrgt[0:mk], srgt[0:mk])
+			if costs == nil {
+				if nx > nmiss {
+					refinePair(srec, mrec)
+					continue
+				}
+			} else {
+				// The allowed cost is not rounded, which is
+				// equivalent to rounding for integer costs.
+				c := costs.Cost(slft, mlft) + costs.Cost(srgt[0:mk], mrgt[0:mk])
+				if c > (1-pmatch)*float64(len(stag)+len(slft)+mk) {
+					refinePair(srec, mrec)
+					continue
+				}
 			}
 
 			// unavoidable []byte to string copy
@@ -218,22 +407,21 @@ func searchpairs(source, match []*rec, limit chan bool) {
 			}
 
 			// Found a match, pass to output
-			var bbuf bytes.Buffer
-			bbuf.Write(slft)
-			bbuf.Write(stag)
-			bbuf.Write(srgt)
-			bbuf.Write([]byte("\t"))
-			bbuf.Write(mlft)
-			bbuf.Write(mtag)
-			bbuf.Write(mrgt[0:mk])
-			x := fmt.Sprintf("\t%d\t%d\t%s\n", mposi-len(mlft), nx, mgene)
-			bbuf.Write([]byte(x))
-
-			qq := &qrect{mismatch: nx, gob: bbuf.Bytes()}
+			gob := formatMatch(slft, stag, srgt, mlft, mtag, mrgt[0:mk], mposi-len(mlft), nx, mgene)
+
+			qq := &qrect{mismatch: nx, gob: gob, src: si}
+			nfound++
+			if passed != nil {
+				passed[si] = true
+			}
 			if first {
 				// Make no attempt to rank matches, just keep first ones.
 				qvals = append(qvals, qq)
 				if len(qvals) > config.MaxMatches {
+					// The extra match only shows that there
+					// are more than MaxMatches.
+					qvals = qvals[0:config.MaxMatches]
+					truncated = true
 					goto E
 				}
 			} else {
@@ -244,8 +432,158 @@ func searchpairs(source, match []*rec, limit chan bool) {
 	}
 
 E:
-	for _, v := range qvals {
-		rsltChan <- v.gob
+	return qvals, nfound, passed, truncated
+}
+
+// formatMatch returns the line of the rmatch file for a match: the
+// read, the matching target sequence, its position in the target, the
+// number of mismatches and the target number.  The read and target
+// sequences are given as the parts to the left of the window, in the
+// window, and to the right of the window.
+func formatMatch(slft, stag, srgt, mlft, mtag, mrgt []byte, pos, nx int, mgene []byte) []byte {
+	n := len(slft) + len(stag) + len(srgt) + len(mlft) + len(mtag) + len(mrgt) + len(mgene) + 32
+	gob := make([]byte, 0, n)
+	gob = append(gob, slft...)
+	gob = append(gob, stag...)
+	gob = append(gob, srgt...)
+	gob = append(gob, '\t')
+	gob = append(gob, mlft...)
+	gob = append(gob, mtag...)
+	gob = append(gob, mrgt...)
+	gob = append(gob, '\t')
+	gob = strconv.AppendInt(gob, int64(pos), 10)
+	gob = append(gob, '\t')
+	gob = strconv.AppendInt(gob, int64(nx), 10)
+	gob = append(gob, '\t')
+	gob = append(gob, mgene...)
+	return append(gob, '\n')
+}
+
+// refinePair passes a read and a candidate target that did not agree
+// to within PMatch to the refine file, if RefineCommand is set.
+func refinePair(srec, mrec *rec) {
+
+	if refineChan == nil {
+		return
+	}
+
+	mlft, mtag, mrgt := mrec.fields[1], mrec.fields[0], mrec.fields[2]
+	mposi, err := strconv.Atoi(strings.TrimRight(string(mrec.fields[4]), " "))
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+
+	n := len(srec.buf) + len(mrec.buf) + 16
+	buf := make([]byte, 0, n)
+	buf = append(buf, srec.fields[1]...)
+	buf = append(buf, srec.fields[0]...)
+	buf = append(buf, srec.fields[2]...)
+	buf = append(buf, '\t')
+	buf = append(buf, mlft...)
+	buf = append(buf, mtag...)
+	buf = append(buf, mrgt...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(mposi-len(mlft)), 10)
+	buf = append(buf, '\t')
+	buf = append(buf, mrec.fields[3]...)
+	buf = append(buf, '\n')
+
+	refineChan <- buf
+}
+
+// writeRefine writes the pairs received on refineChan to
+// refine_k.txt.sz.
+func writeRefine(done chan bool) {
+
+	fname := path.Join(tmpdir, fmt.Sprintf("refine_%d.txt.sz", win))
+	fid, err := os.Create(fname)
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	wtr := utils.NewSnappyWriter(fid, config.WriterBufferSize)
+
+	for buf := range refineChan {
+		if _, err := wtr.Write(buf); err != nil {
+			logger.Print(err)
+			panic(err)
+		}
+	}
+
+	for _, c := range []io.Closer{wtr, fid} {
+		if err := c.Close(); err != nil {
+			logger.Print(err)
+			panic(err)
+		}
+	}
+	done <- true
+}
+
+// readIds returns the sequence numbers of the reads in a source
+// block.
+func readIds(source []*rec) []int {
+
+	ids := make([]int, len(source))
+	for i, srec := range source {
+		id, err := strconv.Atoi(string(srec.fields[4]))
+		if err != nil {
+			logger.Print(err)
+			panic(err)
+		}
+		ids[i] = id
+	}
+
+	return ids
+}
+
+// keptReads returns which of the n reads of a source block have a
+// match among the kept matches.
+func keptReads(n int, qvals []*qrect) []bool {
+
+	kept := make([]bool, n)
+	for _, q := range qvals {
+		kept[q.src] = true
+	}
+
+	return kept
+}
+
+// setStatus records the status of the reads with the given sequence
+// numbers, given the reads that have a kept match, the reads that had
+// at least one match, and whether the comparisons stopped early at
+// MaxMatches.  A read that was not compared to every candidate may
+// have matched one of them, so it is counted as dropped by
+// MaxMatches.
+func setStatus(ids []int, kept, passed []bool, truncated bool) {
+
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	for i, id := range ids {
+		st := utils.StatusRejected
+		switch {
+		case kept[i]:
+			st = utils.StatusMatched
+		case passed[i] || truncated:
+			st = utils.StatusMaxMatches
+		}
+
+		for len(status) <= id {
+			status = append(status, utils.StatusTooShort)
+		}
+		if st > status[id] {
+			status[id] = st
+		}
+	}
+}
+
+// writeStatus saves the status of the reads to readstatus_confirm_k.bin.
+func writeStatus() {
+	fname := path.Join(tmpdir, fmt.Sprintf("readstatus_confirm_%d.bin", win))
+	if err := utils.WriteReadStatus(fname, status); err != nil {
+		logger.Print(err)
+		panic(err)
 	}
 }
 
@@ -258,6 +596,46 @@ func setupLog(win int) {
 	logger = log.New(fid, "", log.Ltime)
 }
 
+// writeConfirmInfo saves the number of matches found in the window to
+// confirminfo_k.json in the log directory, so that the filter used to
+// remove duplicate matches when the windows are combined can be sized.
+func writeConfirmInfo(nmatch *int) {
+
+	fid, err := os.Create(path.Join(config.LogDir, fmt.Sprintf("confirminfo_%d.json", win)))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+
+	info := struct{ Matches int }{*nmatch}
+	if err := json.NewEncoder(fid).Encode(info); err != nil {
+		logger.Print(err)
+	}
+}
+
+// saveWarnings records the blocks whose matches were cut at
+// MaxMatches, once all of the blocks have been compared.
+func saveWarnings() {
+
+	n := int(atomic.LoadInt64(&nmaxed))
+	if n > 0 {
+		logger.Printf("%d window sequences had more than MaxMatches=%d matches", n, config.MaxMatches)
+	}
+	if config.MatchMode == "first" {
+		warnings.AddN(n, "max_matches", utils.SeverityWarning,
+			"Window sequences of window %d had more than MaxMatches=%d matches, only the first ones were kept",
+			win, config.MaxMatches)
+	} else {
+		warnings.AddN(n, "max_matches", utils.SeverityWarning,
+			"Window sequences of window %d had more than MaxMatches=%d matches, those with the most mismatches were dropped",
+			win, config.MaxMatches)
+	}
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
+	}
+}
+
 // rcpy deeply copies its argument.
 func rcpy(r []*rec) []*rec {
 	x := make([]*rec, len(r))
@@ -272,17 +650,19 @@ func rcpy(r []*rec) []*rec {
 
 func main() {
 
-	if len(os.Args) != 3 && len(os.Args) != 4 {
+	defer utils.ExitOnPanic("muscato_confirm")
+
+	if len(os.Args) != 3 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments", os.Args[0]))
 		os.Exit(1)
 	}
 
 	config = utils.ReadConfig(os.Args[1])
 
-	if config.TempDir == "" {
-		tmpdir = os.Args[3]
-	} else {
-		tmpdir = config.TempDir
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
 	}
 
 	var err error
@@ -291,6 +671,21 @@ func main() {
 		log.Fatal(err)
 	}
 	setupLog(win)
+	warnings = utils.NewWarnings(fmt.Sprintf("muscato_confirm_%d", win))
+
+	if len(config.MismatchCosts) > 0 {
+		costs, err = utils.NewCostMatrix(config.MismatchCosts)
+		if err != nil {
+			logger.Print(err)
+			panic(err)
+		}
+		logger.Printf("Using MismatchCosts %v", config.MismatchCosts)
+	}
+
+	concurrency = config.ConfirmConcurrency
+	if concurrency == 0 {
+		concurrency = utils.DefaultConfirmConcurrency()
+	}
 
 	if doProfile && win == 0 {
 		p := profile.Start(profile.ProfilePath("."))
@@ -309,6 +704,40 @@ func main() {
 	outfile := path.Join(tmpdir, f)
 	logger.Printf("outfile: %s", outfile)
 
+	// The window, left and right columns of the source sequences
+	// are used.
+	lay, err := utils.ReadLayout(sourcefile, utils.WindowColumns)
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	cols := []string{"window", "left", "right"}
+	if config.UnmatchedReasons {
+		cols = append(cols, "count", "readid")
+	}
+	for j, c := range cols {
+		if k, err := lay.Column(c); err != nil || k != j+1 {
+			msg := fmt.Sprintf("%s does not have the %s column in position %d, it may have been written by an incompatible version of Muscato", sourcefile, c, j+1)
+			logger.Print(msg)
+			panic(msg)
+		}
+	}
+
+	// All of the columns of the candidate matches are used, in
+	// the order of CandidateColumns.
+	mlay, err := utils.ReadLayout(matchfile, utils.CandidateColumns)
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	for j, c := range utils.CandidateColumns {
+		if k, err := mlay.Column(c); err != nil || k != j+1 {
+			msg := fmt.Sprintf("%s does not have the %s column in position %d, it may have been written by an incompatible version of Muscato", matchfile, c, j+1)
+			logger.Print(msg)
+			panic(msg)
+		}
+	}
+
 	// Read source sequences
 	fid, err := os.Open(sourcefile)
 	if err != nil {
@@ -318,7 +747,11 @@ func main() {
 	defer fid.Close()
 	szr := snappy.NewReader(fid)
 	scanner := bufio.NewScanner(szr)
-	source := &breader{scanner: scanner, name: "source"}
+	source := &breader{scanner: scanner, name: "source", maxrecs: config.ConfirmBlockSize, schema: &utils.RecordSchema{
+		File:    sourcefile,
+		Stage:   "sortWindows",
+		Columns: cols,
+	}}
 
 	// Read candidate match sequences
 	gid, err := os.Open(matchfile)
@@ -329,7 +762,11 @@ func main() {
 	defer gid.Close()
 	szq := snappy.NewReader(gid)
 	scanner = bufio.NewScanner(szq)
-	match := &breader{scanner: scanner, name: "match"}
+	match := &breader{scanner: scanner, name: "match", maxrecs: config.ConfirmBlockSize, schema: &utils.RecordSchema{
+		File:    matchfile,
+		Stage:   "sortBloom",
+		Columns: utils.CandidateColumns,
+	}}
 
 	// Place to write results
 	fi, err := os.Create(outfile)
@@ -338,13 +775,42 @@ func main() {
 		panic(err)
 	}
 	defer fi.Close()
-	out := snappy.NewBufferedWriter(fi)
+	out := utils.NewSnappyWriter(fi, config.WriterBufferSize)
 	defer out.Close()
+	if err := utils.WriteLayout(outfile, utils.MatchColumns); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+
+	// Remove the spill files of the final blocks.
+	defer func() {
+		for _, b := range []*breader{source, match} {
+			if b.spill != nil {
+				b.spill.remove()
+			}
+		}
+	}()
+
+	// The number of matches written, which is saved once all of
+	// the results have been harvested.
+	var nmatch int
+	defer writeConfirmInfo(&nmatch)
+	defer saveWarnings()
+	if config.UnmatchedReasons {
+		defer writeStatus()
+	}
 
 	rsltChan = make(chan []byte, 5*concurrency)
 	limit := make(chan bool, concurrency)
 	alldone = make(chan bool)
 
+	var refineDone chan bool
+	if config.RefineCommand != "" {
+		refineChan = make(chan []byte, 5*concurrency)
+		refineDone = make(chan bool)
+		go writeRefine(refineDone)
+	}
+
 	defer func() {
 		logger.Print("clearing channel")
 		for k := 0; k < cap(limit); k++ {
@@ -352,6 +818,10 @@ func main() {
 		}
 		close(rsltChan)
 		<-alldone
+		if refineChan != nil {
+			close(refineChan)
+			<-refineDone
+		}
 	}()
 
 	ms := source.Next()
@@ -368,10 +838,17 @@ func main() {
 			if err != nil {
 				panic(err)
 			}
+			nmatch += bytes.Count(r, []byte("\n"))
 		}
 		alldone <- true
 	}()
 
+	// A window may have no reads or no candidate matches.
+	if source.key == nil || match.key == nil {
+		logger.Printf("No reads or candidate matches for window %d, done.", win)
+		return
+	}
+
 lp:
 	for ii := 0; ; ii++ {
 
@@ -379,9 +856,7 @@ lp:
 			logger.Printf("%d", ii)
 		}
 
-		s := source.recs[0].fields[0]
-		m := match.recs[0].fields[0]
-		c := bytes.Compare(s, m)
+		c := bytes.Compare(source.key, match.key)
 
 		ms := true
 		mb := true
@@ -389,8 +864,12 @@ lp:
 		switch {
 		case c == 0:
 			// Window sequences match, check if it is a real match.
-			limit <- true
-			go searchpairs(rcpy(source.recs), rcpy(match.recs), limit)
+			if source.spill == nil && match.spill == nil {
+				limit <- true
+				go searchpairs(rcpy(source.recs), rcpy(match.recs), limit)
+			} else {
+				searchLarge(source, match, limit)
+			}
 			ms = source.Next()
 			mb = match.Next()
 			if !(ms || mb) {
@@ -418,30 +897,48 @@ lp:
 	logger.Print("done")
 }
 
-// qinsert inserts a into the array q, maintaining a heap structure on
-// q in which the heap is ordered by decreasing mismatch values.  The
-// length of the heap is limited to MaxMatches.
+// qinsert inserts a into q, which holds the matches with the fewest
+// mismatches found so far, up to MaxMatches of them.  q is a heap in
+// which each match has at least as many mismatches as its children, so
+// that the match with the most mismatches is q[0].  Once q is full, a
+// new match replaces q[0] if it has fewer mismatches, and is otherwise
+// discarded.
 func qinsert(q []*qrect, a *qrect) []*qrect {
 
-	q = append(q, a)
-	ii := len(q) - 1 // Position of just-inserted node
-
-	for ii > 0 {
-		// Position of parent
-		jj := (ii - 1) / 2
-
-		if q[jj].mismatch > q[ii].mismatch {
+	if len(q) < config.MaxMatches {
+		q = append(q, a)
+		ii := len(q) - 1 // Position of just-inserted node
+		for ii > 0 {
+			// Position of parent
+			jj := (ii - 1) / 2
+			if q[jj].mismatch >= q[ii].mismatch {
+				break
+			}
 			q[jj], q[ii] = q[ii], q[jj]
 			ii = jj
-		} else {
-			break
 		}
+		return q
 	}
 
-	// Not guaranteed to retain the best matches, but approximate
-	// and fast.
-	if len(q) > config.MaxMatches {
-		q = q[0:config.MaxMatches]
+	if a.mismatch >= q[0].mismatch {
+		return q
+	}
+
+	// Replace the root and move it down to its place.
+	q[0] = a
+	ii := 0
+	for {
+		jj := ii
+		for _, c := range []int{2*ii + 1, 2*ii + 2} {
+			if c < len(q) && q[c].mismatch > q[jj].mismatch {
+				jj = c
+			}
+		}
+		if jj == ii {
+			break
+		}
+		q[jj], q[ii] = q[ii], q[jj]
+		ii = jj
 	}
 
 	return q
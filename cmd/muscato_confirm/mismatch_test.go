@@ -0,0 +1,47 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// BenchmarkMismatch measures the comparison of a read to a candidate
+// target, by counting mismatches (cdiff) and with MismatchCosts.
+func BenchmarkMismatch(b *testing.B) {
+
+	rng := rand.New(rand.NewSource(1))
+	x := make([]byte, 150)
+	y := make([]byte, len(x))
+	for i := range x {
+		x[i] = "ACGT"[rng.Intn(4)]
+		y[i] = x[i]
+		if rng.Float64() < 0.05 {
+			y[i] = "ACGT"[rng.Intn(4)]
+		}
+	}
+
+	b.Run("cdiff", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(x)))
+		for i := 0; i < b.N; i++ {
+			cdiff(x, y)
+		}
+	})
+
+	b.Run("CostMatrix", func(b *testing.B) {
+		cm, err := utils.NewCostMatrix(map[string]float64{"transition": 0.5})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.SetBytes(int64(len(x)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			cm.Cost(x, y)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// bestBrute returns the mismatch counts of the maxm matches with the
+// fewest mismatches, found by sorting.
+func bestBrute(q []*qrect, maxm int) []int {
+	var m []int
+	for _, a := range q {
+		m = append(m, a.mismatch)
+	}
+	sort.Ints(m)
+	if len(m) > maxm {
+		m = m[0:maxm]
+	}
+	return m
+}
+
+func TestQinsert(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	for _, maxm := range []int{1, 2, 3, 10, 50} {
+		// Fewer, as many and more matches than maxm, with
+		// few distinct mismatch counts so that there are ties.
+		for _, n := range []int{0, 1, maxm - 1, maxm, maxm + 1, 5 * maxm, 200} {
+			for _, nval := range []int{1, 3, 20} {
+				config = new(utils.Config)
+				config.MaxMatches = maxm
+
+				var all, q []*qrect
+				for i := 0; i < n; i++ {
+					a := &qrect{mismatch: rng.Intn(nval), src: i}
+					all = append(all, a)
+					q = qinsert(q, a)
+				}
+
+				// Each kept match is distinct.
+				seen := make(map[*qrect]bool)
+				for _, a := range q {
+					if seen[a] {
+						t.Fatalf("maxm=%d n=%d: match %d kept twice", maxm, n, a.src)
+					}
+					seen[a] = true
+				}
+
+				want := bestBrute(all, maxm)
+				got := bestBrute(q, maxm)
+				if len(got) != len(want) {
+					t.Fatalf("maxm=%d n=%d: kept %d matches, expected %d", maxm, n, len(got), len(want))
+				}
+				for i := range want {
+					if got[i] != want[i] {
+						t.Fatalf("maxm=%d n=%d: kept mismatches %v, expected %v", maxm, n, got, want)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"hash/fnv"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// The number of parts that a large block is divided into when
+// ConfirmFlank is set.
+const flankBuckets = 64
+
+// spillFile holds the records of a block that is too large to keep in
+// memory, one record per line.
+type spillFile struct {
+	fid *os.File
+	wtr *bufio.Writer
+	n   int
+}
+
+func newSpillFile(label string) *spillFile {
+
+	fid, err := os.CreateTemp(tmpdir, "confirm_"+label+"_*.txt")
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+
+	return &spillFile{fid: fid, wtr: bufio.NewWriter(fid)}
+}
+
+func (sf *spillFile) add(r *rec) {
+	sf.wtr.Write(r.buf)
+	if err := sf.wtr.WriteByte('\n'); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	sf.n++
+}
+
+func (sf *spillFile) close() {
+	if err := sf.wtr.Flush(); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	if err := sf.fid.Close(); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+}
+
+func (sf *spillFile) remove() {
+	os.Remove(sf.fid.Name())
+}
+
+// recSet is the set of records on one side of a block, held either in
+// memory or in a spill file.
+type recSet struct {
+	recs []*rec
+	file *spillFile
+}
+
+func (rs *recSet) size() int {
+	if rs.file != nil {
+		return rs.file.n
+	}
+	return len(rs.recs)
+}
+
+// each calls f on successive batches of at most n records.  Records
+// held in memory are passed in a single batch.  Each batch is newly
+// allocated, so f may retain it.
+func (rs *recSet) each(n int, f func([]*rec)) {
+
+	if rs.file == nil {
+		f(rs.recs)
+		return
+	}
+
+	fid, err := os.Open(rs.file.fid.Name())
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	defer fid.Close()
+
+	var batch []*rec
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		bb := scanner.Bytes()
+		rx := &rec{buf: make([]byte, len(bb))}
+		copy(rx.buf, bb)
+		rx.setfields()
+		batch = append(batch, rx)
+		if len(batch) >= n {
+			f(batch)
+			batch = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	if len(batch) > 0 {
+		f(batch)
+	}
+}
+
+// partition divides a set of records according to the first flank
+// bases following the window.  Records with fewer than flank bases
+// following the window are placed into every part if dup is true,
+// otherwise they are returned separately.
+func (rs *recSet) partition(label string, flank int, dup bool) ([]*recSet, *recSet) {
+
+	parts := make([]*spillFile, flankBuckets)
+	for i := range parts {
+		parts[i] = newSpillFile(label)
+	}
+	short := newSpillFile(label)
+
+	rs.each(config.ConfirmBlockSize, func(batch []*rec) {
+		for _, r := range batch {
+			rgt := r.fields[2]
+			if len(rgt) < flank {
+				if !dup {
+					short.add(r)
+					continue
+				}
+				for _, p := range parts {
+					p.add(r)
+				}
+				continue
+			}
+			h := fnv.New32a()
+			h.Write(rgt[0:flank])
+			parts[h.Sum32()%flankBuckets].add(r)
+		}
+	})
+
+	var sets []*recSet
+	for _, p := range parts {
+		p.close()
+		sets = append(sets, &recSet{file: p})
+	}
+	short.close()
+
+	return sets, &recSet{file: short}
+}
+
+func (rs *recSet) remove() {
+	if rs.file != nil {
+		rs.file.remove()
+	}
+}
+
+// blockMatches collects the matches of a block that is compared in
+// batches, so that at most MaxMatches matches are kept for the whole
+// block, as when it is compared at once.  With MatchMode=best, these
+// are the matches with the fewest mismatches over all batches.
+type blockMatches struct {
+	mu sync.Mutex
+	wg sync.WaitGroup
+
+	qvals     []*qrect
+	nfound    int
+	truncated bool
+
+	// The sequence numbers of the reads in each batch, and whether
+	// each had a match within PMatch, if UnmatchedReasons is set.
+	ids    [][]int
+	passed [][]bool
+}
+
+// addBatch records a batch of reads, and returns its position.
+func (bm *blockMatches) addBatch(source []*rec) int {
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	if config.UnmatchedReasons {
+		bm.ids = append(bm.ids, readIds(source))
+		bm.passed = append(bm.passed, make([]bool, len(source)))
+	}
+
+	return len(bm.ids) - 1
+}
+
+// full returns true if there is no need to compare further batches,
+// since MaxMatches matches have been found with MatchMode=first.
+func (bm *blockMatches) full() bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.truncated
+}
+
+// merge adds the results of comparing the reads of a batch to a batch
+// of candidates.
+func (bm *blockMatches) merge(batch int, qvals []*qrect, nfound int, passed []bool, truncated bool) {
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	bm.nfound += nfound
+	for _, q := range qvals {
+		q.batch = batch
+		if config.MatchMode != "first" {
+			bm.qvals = qinsert(bm.qvals, q)
+		} else if len(bm.qvals) < config.MaxMatches {
+			bm.qvals = append(bm.qvals, q)
+		} else {
+			truncated = true
+		}
+	}
+	if truncated {
+		bm.truncated = true
+	}
+
+	if passed != nil {
+		for i, p := range passed {
+			if p {
+				bm.passed[batch][i] = true
+			}
+		}
+	}
+}
+
+// finish waits for the comparisons of the block to complete, and
+// passes on the kept matches.
+func (bm *blockMatches) finish() {
+
+	bm.wg.Wait()
+
+	if bm.truncated || bm.nfound > len(bm.qvals) {
+		atomic.AddInt64(&nmaxed, 1)
+	}
+
+	if config.UnmatchedReasons {
+		kept := make([][]bool, len(bm.ids))
+		for b := range bm.ids {
+			kept[b] = make([]bool, len(bm.ids[b]))
+		}
+		for _, q := range bm.qvals {
+			kept[q.batch][q.src] = true
+		}
+		for b := range bm.ids {
+			setStatus(bm.ids[b], kept[b], bm.passed[b], bm.truncated)
+		}
+	}
+
+	for _, q := range bm.qvals {
+		rsltChan <- q.gob
+	}
+}
+
+// searchBatches compares all records in s to all records in m, in
+// batches of at most ConfirmBlockSize records from each, adding the
+// matches to bm.
+func searchBatches(s, m *recSet, bm *blockMatches, limit chan bool) {
+
+	if s.size() == 0 || m.size() == 0 {
+		return
+	}
+
+	s.each(config.ConfirmBlockSize, func(sb []*rec) {
+		// Reads that are not compared since the block is full
+		// are counted as dropped by MaxMatches.
+		b := bm.addBatch(sb)
+		m.each(config.ConfirmBlockSize, func(mb []*rec) {
+			if bm.full() {
+				return
+			}
+			limit <- true
+			bm.wg.Add(1)
+			go func() {
+				defer bm.wg.Done()
+				defer func() { <-limit }()
+				qvals, nfound, passed, truncated := comparePairs(sb, mb)
+				bm.merge(b, qvals, nfound, passed, truncated)
+			}()
+		})
+	})
+}
+
+// searchLarge compares the reads and candidate matches in a block
+// where at least one side was too large to hold in memory.  The
+// batches are compared concurrently, and the matches are passed on
+// once all of them are done.
+func searchLarge(source, match *breader, limit chan bool) {
+
+	ss, ms := source.block(), match.block()
+	logger.Printf("Block %s has %d reads and %d candidate matches, comparing in batches",
+		source.key, ss.size(), ms.size())
+
+	bm := new(blockMatches)
+	defer bm.finish()
+
+	if config.ConfirmFlank == 0 {
+		searchBatches(ss, ms, bm, limit)
+		return
+	}
+
+	// Reads with a short flank are compared to every part of the
+	// targets, targets with a short flank are compared to all
+	// reads.
+	sp, sshort := ss.partition("source", config.ConfirmFlank, true)
+	mp, mshort := ms.partition("match", config.ConfirmFlank, false)
+	sshort.remove()
+	for i := range sp {
+		searchBatches(sp[i], mp[i], bm, limit)
+		sp[i].remove()
+		mp[i].remove()
+	}
+	searchBatches(ss, mshort, bm, limit)
+	mshort.remove()
+}
@@ -0,0 +1,100 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// spilledSet returns a set of records held in a spill file.
+func spilledSet(label string, lines []string) *recSet {
+	sf := newSpillFile(label)
+	for _, line := range lines {
+		sf.add(&rec{buf: []byte(line)})
+	}
+	sf.close()
+	return &recSet{file: sf}
+}
+
+// TestSearchBatches compares a block in batches, and checks that at
+// most MaxMatches matches are kept for the whole block.  Read i
+// differs from target j at i+j positions, so with MatchMode=best the
+// kept matches are read 0 with targets 0 and 1, and read 1 with target
+// 0.  The block is counted once for the max_matches warning.
+func TestSearchBatches(t *testing.T) {
+
+	const tag = "ACGTACGTAC"
+	var reads, targets []string
+	for i := 0; i < 5; i++ {
+		r := strings.Repeat("C", i) + strings.Repeat("A", 10-i)
+		reads = append(reads, fmt.Sprintf("%s\t\t%s\t%d\t%d", tag, r, 100, i))
+		g := strings.Repeat("A", 10-i) + strings.Repeat("G", i)
+		targets = append(targets, fmt.Sprintf("%s\t\t%s\t%d\t%d", tag, g, i, 0))
+	}
+
+	for _, mode := range []string{"best", "first"} {
+
+		config = new(utils.Config)
+		config.MatchMode = mode
+		config.MaxMatches = 3
+		config.ConfirmBlockSize = 2
+		config.PMatch = 0.5
+		config.UnmatchedReasons = true
+		logger = log.New(io.Discard, "", 0)
+		tmpdir = t.TempDir()
+		status = nil
+		nmaxed = 0
+		rsltChan = make(chan []byte, 100)
+
+		bm := new(blockMatches)
+		searchBatches(spilledSet("source", reads), spilledSet("match", targets), bm, make(chan bool, 2))
+		bm.finish()
+		close(rsltChan)
+		if nmaxed != 1 {
+			t.Errorf("%s: %d blocks counted as cut at MaxMatches, expected 1", mode, nmaxed)
+		}
+
+		var nx []int
+		for r := range rsltChan {
+			f := bytes.Split(r, []byte("\t"))
+			x, err := strconv.Atoi(string(f[3]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nx = append(nx, x)
+		}
+		sort.Ints(nx)
+
+		if len(nx) != config.MaxMatches {
+			t.Errorf("%s: kept %d matches, expected %d", mode, len(nx), config.MaxMatches)
+			continue
+		}
+		if mode == "first" {
+			for i := range status {
+				if status[i] != utils.StatusMatched && status[i] != utils.StatusMaxMatches {
+					t.Errorf("first: read %d has status %v", i, status[i])
+				}
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(nx, []int{0, 1, 1}) {
+			t.Errorf("best: kept matches with %v mismatches, expected [0 1 1]", nx)
+		}
+		want := []utils.ReadStatus{utils.StatusMatched, utils.StatusMatched,
+			utils.StatusMaxMatches, utils.StatusMaxMatches, utils.StatusMaxMatches}
+		if !reflect.DeepEqual(status, want) {
+			t.Errorf("best: read status %v, expected %v", status, want)
+		}
+	}
+}
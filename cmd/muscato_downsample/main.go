@@ -0,0 +1,350 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+// muscato_downsample limits the number of matches kept for each
+// target to GeneSampleSize, so that a few very abundant targets do not
+// dominate the size of the results.  The matches in
+// matches_sg.txt.sz, which are sorted by target, are read, and for
+// each target with more than GeneSampleSize matches, a simple random
+// sample of GeneSampleSize of them is drawn by reservoir sampling
+// (using RandomSeed).  The retained matches are written back to
+// matches_sg.txt.sz in their original order.
+//
+// The file given after the configuration file receives one line for
+// each downsampled target, with tab-delimited columns giving the
+// target identifier, the number of matches, the number of retained
+// matches, and the scale factor (matches / retained) by which counts
+// based on the retained matches should be multiplied.  The read
+// sequences of the dropped matches are written to
+// downsampled_reads.txt.sz, so that muscato_nonmatch does not treat
+// them as unmatched, and the totals are saved to downsampleinfo.json
+// in the log directory.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/utils"
+)
+
+var (
+	logger *log.Logger
+
+	config *utils.Config
+
+	tmpdir string
+)
+
+// sampled is a retained match, with its position among the matches to
+// its target.
+type sampled struct {
+	pos  int
+	line []byte
+}
+
+// geneCount is the number of matches to a downsampled target.
+type geneCount struct {
+	gene     string
+	matches  int
+	retained int
+}
+
+// downsampler draws the reservoir sample for each target.
+type downsampler struct {
+	size int
+	rng  *rand.Rand
+
+	// The column positions (counting from 0) of the target and
+	// read sequence.
+	gcol, rcol int
+
+	// The current target, the number of its matches seen so far,
+	// and the reservoir.
+	gene      []byte
+	n         int
+	reservoir []sampled
+
+	out     io.Writer
+	dropped io.Writer
+
+	counts []geneCount
+}
+
+// add includes one match, which is written or added to the reservoir.
+func (ds *downsampler) add(line []byte) error {
+
+	fields := bytes.Split(line, []byte("\t"))
+	if len(fields) <= ds.gcol || len(fields) <= ds.rcol {
+		return fmt.Errorf("match has only %d fields", len(fields))
+	}
+	gene := fields[ds.gcol]
+	if !bytes.Equal(gene, ds.gene) {
+		if err := ds.flush(); err != nil {
+			return err
+		}
+		ds.gene = append(ds.gene[0:0], gene...)
+	}
+
+	ds.n++
+	if len(ds.reservoir) < ds.size {
+		ds.reservoir = append(ds.reservoir, sampled{ds.n - 1, append([]byte(nil), line...)})
+		return nil
+	}
+
+	// The new match replaces a random member of the reservoir with
+	// probability size/n.
+	j := ds.rng.Intn(ds.n)
+	if j >= ds.size {
+		return ds.drop(line)
+	}
+	if err := ds.drop(ds.reservoir[j].line); err != nil {
+		return err
+	}
+	ds.reservoir[j] = sampled{ds.n - 1, append([]byte(nil), line...)}
+	return nil
+}
+
+// drop records the read sequence of a match that is not retained.
+func (ds *downsampler) drop(line []byte) error {
+	fields := bytes.Split(line, []byte("\t"))
+	if _, err := ds.dropped.Write(fields[ds.rcol]); err != nil {
+		return err
+	}
+	_, err := ds.dropped.Write([]byte("\n"))
+	return err
+}
+
+// flush writes the retained matches of the current target, in their
+// original order.
+func (ds *downsampler) flush() error {
+
+	if ds.n > ds.size {
+		ds.counts = append(ds.counts, geneCount{string(ds.gene), ds.n, ds.size})
+	}
+
+	sort.Slice(ds.reservoir, func(i, j int) bool { return ds.reservoir[i].pos < ds.reservoir[j].pos })
+	for _, s := range ds.reservoir {
+		if _, err := ds.out.Write(s.line); err != nil {
+			return err
+		}
+		if _, err := ds.out.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+
+	ds.n = 0
+	ds.reservoir = ds.reservoir[0:0]
+	return nil
+}
+
+// geneNames returns the identifiers of the downsampled targets,
+// indexed by their padded target numbers.
+func geneNames(counts []geneCount) (map[string]string, error) {
+
+	names := make(map[string]string)
+	for _, c := range counts {
+		names[c.gene] = ""
+	}
+
+	rdr, err := utils.OpenTargets(config.GeneIdFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		f := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(f) < 2 {
+			continue
+		}
+		if _, ok := names[f[0]]; ok {
+			names[f[0]] = f[1]
+		}
+	}
+
+	return names, scanner.Err()
+}
+
+// writeScales writes the number of matches and the scale factor for
+// each downsampled target.
+func writeScales(outname string, counts []geneCount) error {
+
+	names, err := geneNames(counts)
+	if err != nil {
+		return err
+	}
+
+	out, err := utils.CreateResult(outname, config.CompressResults, config.SyncResults)
+	if err != nil {
+		return err
+	}
+	wtr := bufio.NewWriter(out)
+	for _, c := range counts {
+		scale := float64(c.matches) / float64(c.retained)
+		if _, err := fmt.Fprintf(wtr, "%s\t%d\t%d\t%.6f\n", names[c.gene], c.matches, c.retained, scale); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := wtr.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// writeInfo saves the number of downsampled targets, and the total
+// and retained number of their matches, to downsampleinfo.json in the
+// log directory.
+func writeInfo(counts []geneCount) error {
+
+	var info struct {
+		Genes    int
+		Matches  int
+		Retained int
+	}
+	for _, c := range counts {
+		info.Genes++
+		info.Matches += c.matches
+		info.Retained += c.retained
+	}
+	logger.Printf("Downsampled %d targets from %d to %d matches", info.Genes, info.Matches, info.Retained)
+
+	fid, err := os.Create(path.Join(config.LogDir, "downsampleinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	return json.NewEncoder(fid).Encode(info)
+}
+
+func run(outname string) error {
+
+	inname := path.Join(tmpdir, "matches_sg.txt.sz")
+	lay, err := utils.ReadLayout(inname, utils.MatchColumns)
+	if err != nil {
+		return err
+	}
+	gcol, err := lay.Column("gene")
+	if err != nil {
+		return err
+	}
+	rcol, err := lay.Column("read")
+	if err != nil {
+		return err
+	}
+
+	fid, err := os.Open(inname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	tmpname := path.Join(tmpdir, "matches_ds.txt.sz")
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	wtr := utils.NewSnappyWriter(out, config.WriterBufferSize)
+
+	dname := path.Join(tmpdir, "downsampled_reads.txt.sz")
+	dout, err := os.Create(dname)
+	if err != nil {
+		return err
+	}
+	defer dout.Close()
+	dwtr := utils.NewSnappyWriter(dout, config.WriterBufferSize)
+
+	ds := &downsampler{
+		size:    config.GeneSampleSize,
+		rng:     rand.New(rand.NewSource(config.RandomSeed)),
+		gcol:    gcol - 1,
+		rcol:    rcol - 1,
+		out:     wtr,
+		dropped: dwtr,
+	}
+	schema := lay.Schema("sortByGeneId")
+	for jj := 0; scanner.Scan(); jj++ {
+		if jj == 0 {
+			if err := schema.Check(scanner.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := ds.add(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := ds.flush(); err != nil {
+		return err
+	}
+
+	for _, c := range []io.Closer{wtr, out, dwtr, dout} {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpname, inname); err != nil {
+		return err
+	}
+
+	if err := writeScales(outname, ds.counts); err != nil {
+		return err
+	}
+
+	return writeInfo(ds.counts)
+}
+
+func setupLog() {
+	logname := path.Join(config.LogDir, "muscato_downsample.log")
+	fid, err := os.Create(logname)
+	if err != nil {
+		panic(err)
+	}
+	logger = log.New(fid, "", log.Ltime)
+}
+
+func main() {
+
+	defer utils.ExitOnPanic("muscato_downsample")
+
+	if len(os.Args) != 3 {
+		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
+		os.Exit(1)
+	}
+
+	config = utils.ReadConfig(os.Args[1])
+
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
+	}
+
+	setupLog()
+
+	if err := run(os.Args[2]); err != nil {
+		logger.Print(err)
+		log.Fatal(err)
+	}
+}
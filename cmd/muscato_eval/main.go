@@ -0,0 +1,245 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+// muscato_eval compares the results of a Muscato run to the true
+// origins of the reads, as written to truth.txt by muscato_gendat.
+//
+// usage: muscato_eval [-postol=n] truth.txt results.txt
+//
+// A match is correct if it is to the true gene, on the true strand,
+// at a position within postol bases of the true position (so that
+// reads with indels, whose matches are shifted, can be counted).
+// Matches to the reverse complement targets added by
+// muscato_prep_targets -rev are converted to positions on the forward
+// strand, using the target length and the read length.  The results
+// may be compressed, and may include the columns added by
+// ForwardStrand and TargetCoords.
+//
+// The output contains one line per statistic, with tab-delimited
+// columns name and value:
+//
+// Sensitivity: the proportion of the reads drawn from the genes that
+// have a correct match
+//
+// Read precision: the proportion of the reads with any match that
+// have a correct match
+//
+// Match precision: the proportion of all matches that are correct
+//
+// Results with truncated read name lists (see MaxNameList) cannot be
+// fully evaluated, so the number of omitted reads is reported, and
+// these reads are treated as unmatched.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// origin is a true location of a read.
+type origin struct {
+	gene   string
+	pos    int
+	strand byte
+}
+
+// readInfo is the truth about one read, and how it was matched.
+type readInfo struct {
+	origins []origin
+	matched bool
+	correct bool
+}
+
+var postol int
+
+func (ri *readInfo) isCorrect(gene string, pos int, strand byte) bool {
+	for _, o := range ri.origins {
+		if o.gene != gene || o.strand != strand {
+			continue
+		}
+		d := pos - o.pos
+		if d >= -postol && d <= postol {
+			return true
+		}
+	}
+	return false
+}
+
+func readTruth(fname string) (map[string]*readInfo, error) {
+
+	fid, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	truth := make(map[string]*readInfo)
+	scanner := bufio.NewScanner(fid)
+	for lnum := 1; scanner.Scan(); lnum++ {
+		if lnum == 1 {
+			// Header
+			continue
+		}
+		f := strings.Split(scanner.Text(), "\t")
+		if len(f) < 4 {
+			return nil, fmt.Errorf("%s, line %d: expected at least 4 columns", fname, lnum)
+		}
+		ri, ok := truth[f[0]]
+		if !ok {
+			ri = new(readInfo)
+			truth[f[0]] = ri
+		}
+		if f[1] == "*" {
+			continue
+		}
+		pos, err := strconv.Atoi(f[2])
+		if err != nil || len(f[3]) != 1 {
+			return nil, fmt.Errorf("%s, line %d: invalid position or strand", fname, lnum)
+		}
+		ri.origins = append(ri.origins, origin{f[1], pos, f[3][0]})
+	}
+
+	return truth, scanner.Err()
+}
+
+// location returns the gene, forward strand position and strand of a
+// match in the results.
+func location(f []string) (string, int, byte, error) {
+
+	pos, err := strconv.Atoi(f[2])
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	gene := f[4]
+	switch {
+	case strings.HasSuffix(gene, "_r"):
+		tlen, err := strconv.Atoi(f[5])
+		if err != nil {
+			return "", 0, 0, err
+		}
+		return strings.TrimSuffix(gene, "_r"), tlen - pos - len(f[0]), '-', nil
+	case len(f) > 8 && f[8] == "-":
+		// Already converted by ForwardStrand
+		return gene, pos, '-', nil
+	}
+
+	return gene, pos, '+', nil
+}
+
+func main() {
+
+	defer utils.ExitOnPanic("muscato_eval")
+
+	flag.IntVar(&postol, "postol", 5, "Matches within this many bases of the true position are correct")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		os.Stderr.WriteString("usage: muscato_eval [-postol=n] truth.txt results.txt\n")
+		os.Exit(1)
+	}
+
+	truth, err := readTruth(flag.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+
+	fid, err := utils.OpenResult(flag.Arg(1))
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+
+	var nmatch, ncorrect, nomitted, nunknown int
+	scanner := bufio.NewScanner(fid)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+		if len(f) < 8 {
+			panic(fmt.Sprintf("%s: expected at least 8 columns", flag.Arg(1)))
+		}
+
+		gene, pos, strand, err := location(f)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, name := range strings.Split(f[7], ";") {
+			if strings.HasPrefix(name, "...+") {
+				n, _ := strconv.Atoi(name[4:])
+				nomitted += n
+				continue
+			}
+			name = strings.TrimPrefix(name, "\\")
+			name = strings.TrimPrefix(name, "@")
+			ri, ok := truth[name]
+			if !ok {
+				nunknown++
+				continue
+			}
+			nmatch++
+			ri.matched = true
+			if ri.isCorrect(gene, pos, strand) {
+				ncorrect++
+				ri.correct = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	var nsource, nrandom, nmapped, nrightmapped, nrandmapped int
+	for _, ri := range truth {
+		if len(ri.origins) == 0 {
+			nrandom++
+			if ri.matched {
+				nrandmapped++
+			}
+			continue
+		}
+		nsource++
+		if ri.matched {
+			nmapped++
+		}
+		if ri.correct {
+			nrightmapped++
+		}
+	}
+
+	ratio := func(x, y int) float64 {
+		if y == 0 {
+			return 0
+		}
+		return float64(x) / float64(y)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	out := func(name string, v interface{}) {
+		fmt.Fprintf(w, "%s\t%v\n", name, v)
+	}
+	out("Reads from genes", nsource)
+	out("Reads from genes with a match", nmapped)
+	out("Reads from genes with a correct match", nrightmapped)
+	out("Random reads", nrandom)
+	out("Random reads with a match", nrandmapped)
+	out("Matches", nmatch)
+	out("Correct matches", ncorrect)
+	out("Sensitivity", fmt.Sprintf("%.4f", ratio(nrightmapped, nsource)))
+	out("Read precision", fmt.Sprintf("%.4f", ratio(nrightmapped, nmapped+nrandmapped)))
+	out("Match precision", fmt.Sprintf("%.4f", ratio(ncorrect, nmatch)))
+	if nomitted > 0 {
+		out("Reads omitted from truncated name lists", nomitted)
+		io.WriteString(os.Stderr, "Some read name lists were truncated, increase MaxNameList to evaluate all reads\n")
+	}
+	if nunknown > 0 {
+		out("Matched reads not in the truth file", nunknown)
+	}
+}
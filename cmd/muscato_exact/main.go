@@ -0,0 +1,386 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+// muscato_exact is the exact-match tier of Muscato, which is run
+// before the reads are windowed if ExactTier is set.  Every distinct
+// read sequence is hashed, and the target sequences are scanned with
+// a rolling hash of the same width as each read length, so that the
+// reads that occur exactly (with no mismatches) in at least one target
+// are found in a single pass through the targets.
+//
+// The exact matches are written to rmatch_exact.txt.sz, in the same
+// format as the confirmed matches written by muscato_confirm, and are
+// combined with them by muscato_combine_windows.  The ids of the
+// resolved reads (their positions in reads_sorted.txt.sz, counting
+// from 0) are written in increasing order to exact_reads.txt.sz, and
+// are skipped by muscato_window_reads, so that only the remaining
+// reads go through the screen and confirm stages.  The number of
+// resolved sequences, the number of reads that they represent, and
+// the number of exact matches are saved to exactinfo.json in the log
+// directory.
+//
+// Only reads that are long enough to cover at least one window are
+// considered, so that the same reads are matched with or without the
+// exact tier.  As in muscato_confirm, at most MaxMatches matches are
+// kept for each read.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chmduquesne/rollinghash/buzhash64"
+	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/utils"
+)
+
+var (
+	logger *log.Logger
+
+	config *utils.Config
+
+	tmpdir string
+
+	// The distinct read sequences that are long enough to cover a
+	// window, their ids and counts, and the number of exact
+	// matches found for each of them.
+	seqs    []string
+	ids     []int
+	counts  []int
+	nmatch  []int32
+	lengths []int
+
+	// The positions in seqs of the sequences with each hash.
+	index map[uint64][]int32
+
+	warnings = utils.NewWarnings("muscato_exact")
+)
+
+// hashSeq returns the hash of a complete sequence, which agrees with
+// the rolling hash of a target subsequence of the same length.
+func hashSeq(seq []byte) uint64 {
+	ha := buzhash64.New()
+	ha.Write(seq)
+	return ha.Sum64()
+}
+
+// readSeqs loads the distinct read sequences from the sorted read
+// file, and indexes them by hash.
+func readSeqs() error {
+
+	// The shortest read that covers a window.
+	minlen := -1
+	for _, q := range config.Windows {
+		if minlen == -1 || q+config.WindowWidth < minlen {
+			minlen = q + config.WindowWidth
+		}
+	}
+
+	fname := path.Join(tmpdir, "reads_sorted.txt.sz")
+	logger.Printf("Reading reads from %s", fname)
+	fid, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	index = make(map[uint64][]int32)
+	lens := make(map[int]bool)
+	for jj := 0; scanner.Scan(); jj++ {
+
+		if jj == 0 {
+			utils.ReadsSortedSchema.Require(scanner.Bytes(), logger)
+		}
+		toks := bytes.SplitN(scanner.Bytes(), []byte("\t"), 3)
+		if len(toks) < 2 {
+			return fmt.Errorf("line %d of %s has %d fields, expected at least 2", jj+1, fname, len(toks))
+		}
+		seq := toks[0]
+		if len(seq) < minlen {
+			continue
+		}
+		cnt, err := strconv.Atoi(string(toks[1]))
+		if err != nil {
+			return fmt.Errorf("line %d of %s: %v", jj+1, fname, err)
+		}
+
+		h := hashSeq(seq)
+		index[h] = append(index[h], int32(len(seqs)))
+		seqs = append(seqs, string(seq))
+		ids = append(ids, jj)
+		counts = append(counts, cnt)
+		lens[len(seq)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for l := range lens {
+		lengths = append(lengths, l)
+	}
+	sort.Ints(lengths)
+	nmatch = make([]int32, len(seqs))
+	logger.Printf("Indexed %d read sequences with %d distinct lengths", len(seqs), len(lengths))
+
+	return nil
+}
+
+// processSeq finds the reads that occur exactly in one target
+// sequence, and sends the matches to the output channel.  If the
+// sequence is a segment of a longer target, offset is the position
+// of the segment within the target.
+func processSeq(seq []byte, genenum, offset int, outc chan []byte, limit chan bool) {
+
+	defer func() { <-limit }()
+
+	for _, l := range lengths {
+		if len(seq) < l {
+			break
+		}
+
+		ha := buzhash64.New()
+		ha.Write(seq[0:l])
+		for j := 0; ; j++ {
+			for _, i := range index[ha.Sum64()] {
+				if seqs[i] != string(seq[j:j+l]) {
+					// A hash collision
+					continue
+				}
+				if int(atomic.AddInt32(&nmatch[i], 1)) > config.MaxMatches {
+					continue
+				}
+
+				buf := make([]byte, 0, 2*l+32)
+				buf = append(buf, seqs[i]...)
+				buf = append(buf, '\t')
+				buf = append(buf, seqs[i]...)
+				buf = append(buf, '\t')
+				buf = strconv.AppendInt(buf, int64(offset+j), 10)
+				buf = append(buf, "\t0\t"...)
+				buf = utils.AppendPadded(buf, int64(genenum), 11)
+				buf = append(buf, '\n')
+				outc <- buf
+			}
+			if j+l >= len(seq) {
+				break
+			}
+			ha.Roll(seq[j+l])
+		}
+	}
+}
+
+// writeMatches writes the exact matches received on outc to
+// rmatch_exact.txt.sz.
+func writeMatches(outc chan []byte, done chan error) {
+
+	outname := path.Join(tmpdir, "rmatch_exact.txt.sz")
+	out, err := os.Create(outname)
+	if err != nil {
+		done <- err
+		return
+	}
+	wtr := utils.NewSnappyWriter(out, config.WriterBufferSize)
+
+	for buf := range outc {
+		if err == nil {
+			_, err = wtr.Write(buf)
+		}
+	}
+
+	if e := wtr.Close(); err == nil {
+		err = e
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = utils.WriteLayout(outname, utils.MatchColumns)
+	}
+	done <- err
+}
+
+// search scans the target sequences for exact matches to the reads.
+func search() error {
+
+	logger.Printf("Checking target sequences for exact matches...")
+
+	snr, err := utils.OpenTargets(config.GeneFileName)
+	if err != nil {
+		return err
+	}
+	defer snr.Close()
+
+	scanner := bufio.NewScanner(snr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	concurrency := config.ScreenConcurrency
+	if concurrency == 0 {
+		concurrency = utils.DefaultScreenConcurrency()
+	}
+	limit := make(chan bool, concurrency)
+	outc := make(chan []byte, 20000)
+	done := make(chan error)
+	go writeMatches(outc, done)
+
+	// The target lines are numbered as in muscato_screen.
+	var i, genenum int
+	for ; scanner.Scan(); i++ {
+
+		if i%1000000 == 0 {
+			logger.Printf("%dM\n", i/1000000)
+		}
+
+		toks := strings.Split(scanner.Text(), "\t")
+
+		var offset, gnum int
+		if len(toks) == 3 {
+			offset, err = strconv.Atoi(toks[1])
+			if err != nil {
+				return err
+			}
+			gnum, err = strconv.Atoi(toks[2])
+			if err != nil {
+				return err
+			}
+			genenum = gnum + 1
+		} else {
+			gnum = genenum
+			genenum++
+		}
+
+		limit <- true
+		go processSeq([]byte(toks[0]), gnum, offset, outc, limit)
+	}
+
+	if err := scanner.Err(); err != nil {
+		logger.Printf("Problem reading %s on line %d", config.GeneFileName, i)
+		return err
+	}
+
+	for k := 0; k < concurrency; k++ {
+		limit <- true
+	}
+	close(outc)
+
+	return <-done
+}
+
+// writeResolved writes the ids of the reads with at least one exact
+// match to exact_reads.txt.sz, and saves the counts to exactinfo.json
+// in the log directory.
+func writeResolved() error {
+
+	fid, err := os.Create(path.Join(tmpdir, "exact_reads.txt.sz"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	wtr := utils.NewSnappyWriter(fid, config.WriterBufferSize)
+
+	var exactinfo struct {
+		Seqs    int
+		Reads   int
+		Matches int
+	}
+
+	var buf []byte
+	var ncap int
+	for i, n := range nmatch {
+		if n == 0 {
+			continue
+		}
+		if int(n) > config.MaxMatches {
+			ncap++
+			n = int32(config.MaxMatches)
+		}
+		exactinfo.Seqs++
+		exactinfo.Reads += counts[i]
+		exactinfo.Matches += int(n)
+
+		buf = strconv.AppendInt(buf[0:0], int64(ids[i]), 10)
+		buf = append(buf, '\n')
+		if _, err := wtr.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := wtr.Close(); err != nil {
+		return err
+	}
+	if err := fid.Close(); err != nil {
+		return err
+	}
+
+	if ncap > 0 {
+		warnings.Add("exact_max_matches", utils.SeverityInfo,
+			"%d read sequences had more than MaxMatches=%d exact matches, only the first ones were kept", ncap, config.MaxMatches)
+	}
+	logger.Printf("%d sequences (%d reads) have %d exact matches", exactinfo.Seqs, exactinfo.Reads, exactinfo.Matches)
+
+	gid, err := os.Create(path.Join(config.LogDir, "exactinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer gid.Close()
+
+	return json.NewEncoder(gid).Encode(exactinfo)
+}
+
+func setupLog() {
+	logname := path.Join(config.LogDir, "muscato_exact.log")
+	fid, err := os.Create(logname)
+	if err != nil {
+		panic(err)
+	}
+	logger = log.New(fid, "", log.Ltime)
+}
+
+func main() {
+
+	defer utils.ExitOnPanic("muscato_exact")
+
+	if len(os.Args) != 2 {
+		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
+		os.Exit(1)
+	}
+
+	config = utils.ReadConfig(os.Args[1])
+
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
+	}
+
+	setupLog()
+
+	if err := readSeqs(); err != nil {
+		logger.Print(err)
+		log.Fatal(err)
+	}
+
+	if err := search(); err != nil {
+		logger.Print(err)
+		log.Fatal(err)
+	}
+
+	if err := writeResolved(); err != nil {
+		logger.Print(err)
+		log.Fatal(err)
+	}
+
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
+	}
+}
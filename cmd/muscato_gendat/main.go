@@ -3,12 +3,31 @@
 /*
 Generate simple data sets for testing.
 
-In the first half of the genes, gene i contains an exact copy of read
-i % 10, starting at position i % 10. The remainder of these gene sequences
-are random.
-
-The second half of the gene sequences are random and should contain
-few or no matches.
+With -Mode=embed (the default), in the first half of the genes, gene i
+contains an exact copy of read i % 10, starting at position i % 10. The
+remainder of these gene sequences are random.  The second half of the
+gene sequences are random and should contain few or no matches.
+
+With -Mode=sample, the genes are random, and each read is drawn from a
+random position of a random gene with probability -PMapped, and is
+otherwise random.  If -GeneFile is given, the genes are instead read
+from a fasta file (which may be gzip or snappy compressed), such as a
+public transcript collection downloaded by 'muscato fetch-testdata',
+keeping their ids, and the genes shorter than -ReadLen are skipped.
+-NumGene and -GeneLen are then ignored.
+
+In either mode, the reads can be given sequencing errors (-SubRate
+and -IndelRate give the probability of a substitution, and of an
+insertion or deletion, at each base), a proportion of the reads
+(-RevComp) can be reverse complemented, and each read can be
+duplicated, with -DupDist giving the probabilities of 1, 2, 3, ...
+copies.  The copies have different names.
+
+The true origin of each read is written to truth.txt, with columns
+read, gene, pos, strand, nsub and nindel.  Reads with several origins
+(in embed mode) have one line per origin, and random reads have gene
+"*".  The results of a Muscato run can be compared to the truth using
+muscato_eval.
 */
 
 package main
@@ -22,8 +41,11 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/utils"
 )
 
 var (
@@ -32,10 +54,116 @@ var (
 	numGene int
 	geneLen int
 	dir     string
+	seed    int64
+
+	mode      string
+	pMapped   float64
+	subRate   float64
+	indelRate float64
+	revComp   float64
+	dupDist   []float64
+
+	rng *rand.Rand
 
+	// The first 10 reads, before any errors, in embed mode.
 	reads []string
+
+	// The gene sequences, in sample mode.
+	genes [][]byte
+
+	// The gene ids, if the genes are read from geneFile.
+	geneFile  string
+	geneNames []string
 )
 
+// origin is the true location of a read.
+type origin struct {
+	gene   int
+	pos    int
+	strand byte
+}
+
+// mutate returns a copy of the sequence starting at src[0] with
+// sequencing errors, of length n (or shorter if src is too short),
+// and the numbers of substitutions and indels.
+func mutate(src []byte, n int) ([]byte, int, int) {
+
+	if subRate == 0 && indelRate == 0 {
+		if len(src) > n {
+			src = src[0:n]
+		}
+		return append([]byte{}, src...), 0, 0
+	}
+
+	out := make([]byte, 0, n)
+	var nsub, nindel int
+	for i := 0; len(out) < n && i < len(src); {
+		u := rng.Float64()
+		switch {
+		case u < indelRate/2:
+			// Insertion
+			out = append(out, randBase())
+			nindel++
+		case u < indelRate:
+			// Deletion
+			i++
+			nindel++
+		default:
+			b := src[i]
+			if rng.Float64() < subRate {
+				for b == src[i] {
+					b = randBase()
+				}
+				nsub++
+			}
+			out = append(out, b)
+			i++
+		}
+	}
+
+	return out, nsub, nindel
+}
+
+func randBase() byte {
+	return "ATGC"[rng.Intn(4)]
+}
+
+func revcomp(seq []byte) {
+	for i, j := 0, len(seq)-1; i <= j; i, j = i+1, j-1 {
+		seq[i], seq[j] = comp(seq[j]), comp(seq[i])
+	}
+}
+
+func comp(b byte) byte {
+	switch b {
+	case 'A':
+		return 'T'
+	case 'T':
+		return 'A'
+	case 'G':
+		return 'C'
+	case 'C':
+		return 'G'
+	}
+	return b
+}
+
+// numCopies returns the number of copies of a read, drawn from
+// dupDist.
+func numCopies() int {
+	if len(dupDist) == 1 {
+		return 1
+	}
+	u := rng.Float64()
+	for k, p := range dupDist {
+		if u < p {
+			return k + 1
+		}
+		u -= p
+	}
+	return len(dupDist)
+}
+
 func generateReads() {
 
 	fmt.Printf("Writing %d reads\n", numRead)
@@ -49,31 +177,74 @@ func generateReads() {
 	w := bufio.NewWriter(fid)
 	defer w.Flush()
 
+	tid, err := os.Create(path.Join(dir, "truth.txt"))
+	if err != nil {
+		panic(err)
+	}
+	defer tid.Close()
+	tw := bufio.NewWriter(tid)
+	defer tw.Flush()
+	io.WriteString(tw, "read\tgene\tpos\tstrand\tnsub\tnindel\n")
+
 	buf := new(bytes.Buffer)
 	seq := make([]byte, readLen+geneLen)
 
-	for i := 0; i < numRead; i++ {
-
-		buf.Reset()
-
-		io.WriteString(buf, fmt.Sprintf("read_%d\n", i))
-
-		seq = genRand(readLen, seq)
-		buf.Write(seq)
-
-		io.WriteString(buf, "\n+\n")
-		for j := 0; j < readLen; j++ {
-			io.WriteString(buf, "!")
+	for i := 0; i < numRead; {
+
+		// The sequence before any errors, and where it came from.
+		var src []byte
+		var orig []origin
+		switch {
+		case mode == "sample" && rng.Float64() < pMapped:
+			g := rng.Intn(numGene)
+			pos := rng.Intn(len(genes[g]) - readLen + 1)
+			src = genes[g][pos:]
+			orig = append(orig, origin{g, pos, '+'})
+		default:
+			seq = genRand(readLen, seq)
+			src = seq
+		}
+		if mode == "embed" && len(reads) < 10 {
+			reads = append(reads, string(src[0:readLen]))
+			r := len(reads) - 1
+			for g := r; g < numGene/2; g += 10 {
+				orig = append(orig, origin{g, r, '+'})
+			}
 		}
-		io.WriteString(buf, "\n")
 
-		_, err := w.Write(buf.Bytes())
-		if err != nil {
-			panic(err)
+		rseq, nsub, nindel := mutate(src, readLen)
+		if revComp > 0 && rng.Float64() < revComp {
+			revcomp(rseq)
+			for j := range orig {
+				orig[j].strand = '-'
+			}
 		}
 
-		if i < 10 {
-			reads = append(reads, string(seq))
+		for c := numCopies(); c > 0 && i < numRead; c-- {
+
+			name := fmt.Sprintf("read_%d", i)
+			i++
+
+			buf.Reset()
+			io.WriteString(buf, "@"+name+"\n")
+			buf.Write(rseq)
+			io.WriteString(buf, "\n+\n")
+			for j := 0; j < len(rseq); j++ {
+				io.WriteString(buf, "!")
+			}
+			io.WriteString(buf, "\n")
+
+			_, err := w.Write(buf.Bytes())
+			if err != nil {
+				panic(err)
+			}
+
+			if len(orig) == 0 {
+				fmt.Fprintf(tw, "%s\t*\t0\t+\t%d\t%d\n", name, nsub, nindel)
+			}
+			for _, o := range orig {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%c\t%d\t%d\n", name, geneName(o.gene), o.pos, o.strand, nsub, nindel)
+			}
 		}
 	}
 }
@@ -88,7 +259,7 @@ func genRand(n int, seq []byte) []byte {
 	seq = seq[0:n]
 
 	for j := 0; j < n; j++ {
-		x := rand.Float64()
+		x := rng.Float64()
 		k := int(4 * x)
 		seq[j] = bases[k]
 	}
@@ -96,6 +267,76 @@ func genRand(n int, seq []byte) []byte {
 	return seq
 }
 
+// makeGenes generates the random gene sequences used in sample mode.
+func makeGenes() {
+	for i := 0; i < numGene; i++ {
+		genes = append(genes, genRand(geneLen, nil))
+	}
+}
+
+// geneName returns the id of gene i.
+func geneName(i int) string {
+	if geneNames != nil {
+		return geneNames[i]
+	}
+	return fmt.Sprintf("gene_%d", i)
+}
+
+// readGenes reads the genes used in sample mode from geneFile, which
+// is in fasta format.  The id of each gene is the first word of its
+// header line, and the bases are converted to upper case.
+func readGenes() error {
+
+	rdr, err := utils.OpenResult(geneFile)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	var nshort int
+	var name string
+	var seq []byte
+	add := func() {
+		if name == "" {
+			return
+		}
+		if len(seq) < readLen {
+			nshort++
+			return
+		}
+		geneNames = append(geneNames, name)
+		genes = append(genes, bytes.ToUpper(seq))
+	}
+
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 && line[0] == '>' {
+			add()
+			name = ""
+			if f := strings.Fields(string(line[1:])); len(f) > 0 {
+				name = f[0]
+			}
+			seq = nil
+			continue
+		}
+		seq = append(seq, line...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	add()
+
+	if len(genes) == 0 {
+		return fmt.Errorf("%s has no sequences of length at least %d", geneFile, readLen)
+	}
+	numGene = len(genes)
+	fmt.Printf("Read %d genes from %s, skipped %d shorter than %d\n", numGene, geneFile, nshort, readLen)
+
+	return nil
+}
+
 func generateGenes() {
 
 	seq := make([]byte, geneLen+readLen)
@@ -112,16 +353,18 @@ func generateGenes() {
 	fmt.Printf("Writing %d genes\n", numGene)
 	for i := 0; i < numGene; i++ {
 
-		_, err := io.WriteString(w, fmt.Sprintf("gene_%d\t", i))
+		_, err := io.WriteString(w, geneName(i)+"\t")
 		if err != nil {
 			panic(err)
 		}
 
-		seq = genRand(geneLen, seq)
-
-		if i < numGene/2 {
-			j := i % 10
-			copy(seq[j:len(seq)], reads[j])
+		if mode == "sample" {
+			seq = genes[i]
+		} else {
+			seq = genRand(geneLen, seq)
+			if j := i % 10; i < numGene/2 && j < len(reads) {
+				copy(seq[j:len(seq)], reads[j])
+			}
 		}
 
 		if _, err := w.Write(seq); err != nil {
@@ -135,20 +378,80 @@ func generateGenes() {
 	}
 }
 
+// parseDupDist parses the comma-separated copy number probabilities,
+// which are scaled to sum to 1.
+func parseDupDist(s string) ([]float64, error) {
+	var p []float64
+	var tot float64
+	for _, x := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid probability '%s' in DupDist", x)
+		}
+		p = append(p, v)
+		tot += v
+	}
+	if tot <= 0 {
+		return nil, fmt.Errorf("the probabilities in DupDist must not all be zero")
+	}
+	for i := range p {
+		p[i] /= tot
+	}
+	return p, nil
+}
+
 func main() {
 
+	defer utils.ExitOnPanic("muscato_gendat")
+
 	flag.IntVar(&numRead, "NumRead", 10000, "Number of reads")
 	flag.IntVar(&readLen, "ReadLen", 100, "Read length")
 	flag.IntVar(&numGene, "NumGene", 10000, "Number of genes")
 	flag.IntVar(&geneLen, "GeneLen", 1000, "Gene length")
 	flag.StringVar(&dir, "Dir", ".", "Directory")
+	flag.Int64Var(&seed, "Seed", 1, "Random seed")
+	flag.StringVar(&mode, "Mode", "embed", "How the reads are placed in the genes, 'embed' or 'sample'")
+	flag.Float64Var(&pMapped, "PMapped", 0.9, "In sample mode, the proportion of reads drawn from the genes")
+	flag.Float64Var(&subRate, "SubRate", 0, "Probability of a substitution at each base of a read")
+	flag.Float64Var(&indelRate, "IndelRate", 0, "Probability of an insertion or deletion at each base of a read")
+	flag.Float64Var(&revComp, "RevComp", 0, "Proportion of reads that are reverse complemented")
+	dup := flag.String("DupDist", "1", "Probabilities of 1, 2, 3, ... copies of each read, e.g. '0.7,0.2,0.1'")
+	flag.StringVar(&geneFile, "GeneFile", "", "In sample mode, a fasta file of genes to use in place of random genes")
 
 	flag.Parse()
 
-	if numRead < 10 {
-		panic("numRead must be at least 10")
+	var err error
+	dupDist, err = parseDupDist(*dup)
+	if err != nil {
+		panic(err)
+	}
+
+	switch mode {
+	case "embed":
+		if numRead < 10 {
+			panic("numRead must be at least 10")
+		}
+	case "sample":
+		if geneLen < readLen && geneFile == "" {
+			panic("GeneLen must be at least ReadLen in sample mode")
+		}
+	default:
+		panic("Mode must be 'embed' or 'sample'")
 	}
+	if geneFile != "" && mode != "sample" {
+		panic("GeneFile can only be used in sample mode")
+	}
+
+	rng = rand.New(rand.NewSource(seed))
 
+	switch {
+	case geneFile != "":
+		if err := readGenes(); err != nil {
+			panic(err)
+		}
+	case mode == "sample":
+		makeGenes()
+	}
 	generateReads()
 	generateGenes()
 }
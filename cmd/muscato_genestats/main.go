@@ -1,23 +1,177 @@
 // Copyright 2017, Kerby Shedden and the Muscato contributors.
 
+// muscato_genestats calculates statistics for each target sequence
+// (gene), using a results file that is sorted by gene.
+//
+// The output contains one row per gene, with tab-delimited columns:
+//
+// 1. Gene identifier
+//
+// 2. Number of matches to the gene
+//
+// 3. Gene length
+//
+// 4. Coverage breadth: the proportion of positions in the gene that
+// are covered by at least one matching read
+//
+// 5. Mean depth: the total length of all matching reads divided by
+// the gene length
+//
+// 6. Number of matches per kilobase of gene length, per million
+// matches in total (RPKM)
+//
+// If the -weight flag is given, each match is weighted by the number
+// of reads having the matching sequence (column 7 of the results), so
+// that the statistics reflect the read depth rather than the number of
+// distinct sequences.
+//
+// If the -scale flag gives the file of scale factors written by
+// muscato_downsample, the number of matches and the depth of each
+// downsampled gene are multiplied by its scale factor, so that they
+// estimate the values for all of its matches.  The coverage breadth
+// is not scaled, and is a lower bound for these genes.
+
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
+
+	"github.com/kshedden/muscato/utils"
 )
 
+// geneStat contains the statistics for one gene.
+type geneStat struct {
+	gene    string
+	n       int
+	length  int
+	breadth float64
+	depth   float64
+}
+
+// geneAccum accumulates coverage information for a single gene.
+type geneAccum struct {
+	gene   []byte
+	n      int
+	length int
+
+	// Number of reads covering each position
+	cov []int
+
+	// Total number of aligned bases
+	nbase int
+}
+
+func (ga *geneAccum) reset(gene []byte, length int) {
+	ga.gene = append(ga.gene[0:0], gene...)
+	ga.n = 0
+	ga.length = length
+	ga.nbase = 0
+	if cap(ga.cov) < length {
+		ga.cov = make([]int, length)
+	}
+	ga.cov = ga.cov[0:length]
+	for i := range ga.cov {
+		ga.cov[i] = 0
+	}
+}
+
+// add includes w reads of length rlen matching at position pos.
+func (ga *geneAccum) add(pos, rlen, w int) {
+	ga.n += w
+	ga.nbase += w * rlen
+	for i := pos; i < pos+rlen; i++ {
+		if i >= 0 && i < len(ga.cov) {
+			ga.cov[i] += w
+		}
+	}
+}
+
+// stat returns the statistics for the gene, with the number of
+// matches and the depth multiplied by scale.
+func (ga *geneAccum) stat(scale float64) geneStat {
+
+	var nc int
+	for _, c := range ga.cov {
+		if c > 0 {
+			nc++
+		}
+	}
+
+	gs := geneStat{gene: string(ga.gene), n: int(math.Round(scale * float64(ga.n))), length: ga.length}
+	if ga.length > 0 {
+		gs.breadth = float64(nc) / float64(ga.length)
+		gs.depth = scale * float64(ga.nbase) / float64(ga.length)
+	}
+
+	return gs
+}
+
+// readScales reads the scale factor for each downsampled gene.
+func readScales(fname string) (map[string]float64, error) {
+
+	fid, err := utils.OpenResult(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	scales := make(map[string]float64)
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		f := bytes.Split(scanner.Bytes(), []byte("\t"))
+		if len(f) != 4 {
+			return nil, fmt.Errorf("%s: line has %d fields, expected 4", fname, len(f))
+		}
+		x, err := strconv.ParseFloat(string(f[3]), 64)
+		if err != nil {
+			return nil, err
+		}
+		scales[string(f[0])] = x
+	}
+
+	return scales, scanner.Err()
+}
+
 func main() {
 
+	defer utils.ExitOnPanic("muscato_genestats")
+
+	weight := flag.Bool("weight", false, "Weight each match by the number of reads with the matching sequence")
+	scalefile := flag.String("scale", "", "File of scale factors for downsampled genes")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		os.Stderr.WriteString("usage: muscato_genestats [-weight] [-scale file] results_file\n")
+		os.Exit(1)
+	}
+
+	var scales map[string]float64
+	if *scalefile != "" {
+		var err error
+		scales, err = readScales(*scalefile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	scale := func(gene []byte) float64 {
+		if x, ok := scales[string(gene)]; ok {
+			return x
+		}
+		return 1
+	}
+
 	var fid io.ReadCloser
-	if os.Args[1] == "-" {
+	if flag.Arg(0) == "-" {
 		fid = os.Stdin
 	} else {
 		var err error
-		fid, err = os.Open(os.Args[1])
+		fid, err = os.Open(flag.Arg(0))
 		if err != nil {
 			panic(err)
 		}
@@ -26,35 +180,74 @@ func main() {
 	scanner := bufio.NewScanner(fid)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
-	var oldgene, gene []byte
+	var stats []geneStat
+	var total int
 	var first bool = true
-	var n int
+	ga := new(geneAccum)
 
-	writeout := func(gene []byte) {
-		fmt.Printf("%s\t%d\t\n", gene, n)
+	schema := &utils.RecordSchema{
+		File:    "the results",
+		Stage:   "joinReadNames",
+		Columns: []string{"read", "target", "pos", "nmiss", "target_id", "target_len"},
+	}
+	if *weight {
+		schema.Columns = append(schema.Columns, "count")
 	}
-
 	for scanner.Scan() {
+		if first {
+			schema.Require(scanner.Bytes(), nil)
+		}
 		fields := bytes.Fields(scanner.Bytes())
-		gene = fields[4]
+		gene := fields[4]
 
-		if first {
-			oldgene = gene
+		if first || !bytes.Equal(gene, ga.gene) {
+			if !first {
+				stats = append(stats, ga.stat(scale(ga.gene)))
+			}
 			first = false
+			length, err := strconv.Atoi(string(fields[5]))
+			if err != nil {
+				panic(err)
+			}
+			ga.reset(gene, length)
 		}
 
-		if bytes.Compare(gene, oldgene) != 0 {
-			writeout(oldgene)
-			oldgene = []byte(string(gene))
-			n = 0
+		pos, err := strconv.Atoi(string(fields[2]))
+		if err != nil {
+			panic(err)
 		}
-
-		n++
+		w := 1
+		if *weight {
+			w, err = strconv.Atoi(string(fields[6]))
+			if err != nil {
+				panic(err)
+			}
+		}
+		ga.add(pos, len(fields[1]), w)
 	}
 
-	writeout(gene)
-
 	if err := scanner.Err(); err != nil {
 		panic(err)
 	}
+
+	if !first {
+		stats = append(stats, ga.stat(scale(ga.gene)))
+	}
+	for _, gs := range stats {
+		total += gs.n
+	}
+
+	wtr := bufio.NewWriter(os.Stdout)
+	defer wtr.Flush()
+
+	for _, gs := range stats {
+		var rpkm float64
+		if gs.length > 0 && total > 0 {
+			rpkm = float64(gs.n) / (float64(gs.length) / 1e3) / (float64(total) / 1e6)
+		}
+		_, err := wtr.WriteString(fmt.Sprintf("%s\t%d\t%d\t%.4f\t%.4f\t%.4f\n", gs.gene, gs.n, gs.length, gs.breadth, gs.depth, rpkm))
+		if err != nil {
+			panic(err)
+		}
+	}
 }
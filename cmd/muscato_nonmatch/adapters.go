@@ -0,0 +1,216 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// adapter is a sequence that commonly contaminates sequencing reads.
+type adapter struct {
+	Name string
+	Seq  string
+}
+
+// The adapters are identified by the same 12-mers as used by FastQC.
+var adapters = []adapter{
+	{"Illumina Universal Adapter", "AGATCGGAAGAG"},
+	{"Illumina Small RNA 3' Adapter", "TGGAATTCTCGG"},
+	{"Illumina Small RNA 5' Adapter", "GATCGTCGGACT"},
+	{"Nextera Transposase Sequence", "CTGTCTCTTATA"},
+	{"SOLID Small RNA Adapter", "CGCCTTGGCCGT"},
+	{"PolyA", "AAAAAAAAAAAA"},
+	{"PolyG", "GGGGGGGGGGGG"},
+}
+
+const (
+	// The length of the k-mers that are counted.
+	kmerLen = 12
+
+	// The most distinct unmatched sequences that are kept for
+	// counting k-mers.
+	maxSample = 20000
+
+	// The number of most frequent k-mers that are reported.
+	numTopKmers = 10
+
+	// Adapters found in at least this proportion of the unmatched
+	// reads give a warning.
+	adapterWarn = 0.05
+)
+
+// adapterHit is the number and proportion of the unmatched reads that
+// contain an adapter.
+type adapterHit struct {
+	Name     string
+	Sequence string
+	Reads    int
+	Fraction float64
+}
+
+// kmerCount is the number and proportion of the sampled unmatched
+// reads that contain a k-mer, and the adapter that it identifies, if
+// any.
+type kmerCount struct {
+	Kmer     string
+	Reads    int
+	Fraction float64
+	Adapter  string `json:",omitempty"`
+}
+
+// adapterInfo is saved to adapterinfo.json in the log directory.
+type adapterInfo struct {
+	UnmatchedReads int
+	Adapters       []adapterHit
+	SampledReads   int
+	TopKmers       []kmerCount
+}
+
+// contamScan looks for adapters in the unmatched reads, and keeps a
+// sample of the unmatched sequences, chosen by hashing the sequences
+// so that the sample is not affected by their (sorted) order.  The
+// sampling rate is halved whenever the sample becomes too large.
+type contamScan struct {
+	index  map[string]int
+	hits   []int
+	nreads int
+
+	level  uint
+	sample []sampled
+}
+
+type sampled struct {
+	seq  string
+	n    int
+	hash uint64
+}
+
+func newContamScan() *contamScan {
+	cs := &contamScan{
+		index: make(map[string]int),
+		hits:  make([]int, len(adapters)),
+	}
+	for i, a := range adapters {
+		cs.index[a.Seq] = i
+	}
+	return cs
+}
+
+// add records an unmatched sequence, with n reads.
+func (cs *contamScan) add(seq []byte, n int) {
+
+	cs.nreads += n
+
+	var found uint64
+	for i := 0; i+kmerLen <= len(seq); i++ {
+		if j, ok := cs.index[string(seq[i:i+kmerLen])]; ok && found&(1<<uint(j)) == 0 {
+			found |= 1 << uint(j)
+			cs.hits[j] += n
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write(seq)
+	hv := h.Sum64()
+	if hv&(1<<cs.level-1) != 0 {
+		return
+	}
+	cs.sample = append(cs.sample, sampled{string(seq), n, hv})
+	for len(cs.sample) > maxSample {
+		cs.level++
+		var keep []sampled
+		for _, s := range cs.sample {
+			if s.hash&(1<<cs.level-1) == 0 {
+				keep = append(keep, s)
+			}
+		}
+		cs.sample = keep
+	}
+}
+
+// summary returns the adapters found in the unmatched reads, and the
+// most frequent k-mers in the sample.
+func (cs *contamScan) summary() *adapterInfo {
+
+	ai := &adapterInfo{UnmatchedReads: cs.nreads}
+	for i, a := range adapters {
+		if cs.hits[i] == 0 {
+			continue
+		}
+		ai.Adapters = append(ai.Adapters, adapterHit{
+			Name:     a.Name,
+			Sequence: a.Seq,
+			Reads:    cs.hits[i],
+			Fraction: float64(cs.hits[i]) / float64(cs.nreads),
+		})
+	}
+	sort.SliceStable(ai.Adapters, func(i, j int) bool { return ai.Adapters[i].Reads > ai.Adapters[j].Reads })
+
+	// Count each k-mer once per sequence.
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, s := range cs.sample {
+		ai.SampledReads += s.n
+		for k := range seen {
+			delete(seen, k)
+		}
+		for i := 0; i+kmerLen <= len(s.seq); i++ {
+			km := s.seq[i : i+kmerLen]
+			if !seen[km] {
+				seen[km] = true
+				counts[km] += s.n
+			}
+		}
+	}
+
+	for km, n := range counts {
+		ai.TopKmers = append(ai.TopKmers, kmerCount{Kmer: km, Reads: n})
+	}
+	sort.Slice(ai.TopKmers, func(i, j int) bool {
+		a, b := ai.TopKmers[i], ai.TopKmers[j]
+		if a.Reads != b.Reads {
+			return a.Reads > b.Reads
+		}
+		return a.Kmer < b.Kmer
+	})
+	if len(ai.TopKmers) > numTopKmers {
+		ai.TopKmers = ai.TopKmers[0:numTopKmers]
+	}
+	for i := range ai.TopKmers {
+		ai.TopKmers[i].Fraction = float64(ai.TopKmers[i].Reads) / float64(ai.SampledReads)
+		if j, ok := cs.index[ai.TopKmers[i].Kmer]; ok {
+			ai.TopKmers[i].Adapter = adapters[j].Name
+		}
+	}
+
+	return ai
+}
+
+// writeAdapterInfo saves the adapters found in the unmatched reads to
+// adapterinfo.json in the log directory, and warns about those found
+// in many of the unmatched reads.
+func writeAdapterInfo(ai *adapterInfo) error {
+
+	for _, a := range ai.Adapters {
+		if a.Fraction >= adapterWarn {
+			warnings.Add("adapter_contamination", utils.SeverityWarning,
+				"%s (%s) was found in %.1f%% of the unmatched reads, consider trimming it from the reads",
+				a.Name, a.Sequence, 100*a.Fraction)
+		}
+	}
+
+	fid, err := os.Create(path.Join(config.LogDir, "adapterinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "    ")
+	return enc.Encode(ai)
+}
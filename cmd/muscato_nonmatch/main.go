@@ -3,10 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/golang/snappy"
@@ -20,10 +22,14 @@ var (
 	tmpdir string
 
 	logger *log.Logger
+
+	warnings = utils.NewWarnings("muscato_nonmatch")
 )
 
 func main() {
 
+	defer utils.ExitOnPanic("muscato_nonmatch")
+
 	if len(os.Args) != 2 && len(os.Args) != 3 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
 		os.Exit(1)
@@ -38,23 +44,26 @@ func main() {
 	}
 
 	// Reader for the match file
-	inf, err := os.Open(config.ResultsFileName)
+	res, err := utils.OpenResult(config.ResultsPath())
 	if err != nil {
 		if os.IsNotExist(err) {
-			msg := fmt.Sprintf("Cannot open file %s\n", config.ResultsFileName)
+			msg := fmt.Sprintf("Cannot open file %s\n", config.ResultsPath())
 			os.Stderr.WriteString(msg)
 			os.Exit(1)
 		}
 		log.Fatal(err)
 	}
-	defer inf.Close()
+	defer res.Close()
 
 	// Build a bloom filter based on the matched sequences
 	billion := uint(1000 * 1000 * 1000)
 	bf := bloom.New(4*billion, 5)
-	scanner := bufio.NewScanner(inf)
+	scanner := bufio.NewScanner(res)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	for scanner.Scan() {
+	for jj := 0; scanner.Scan(); jj++ {
+		if jj == 0 {
+			utils.ResultsSchema.Require(scanner.Bytes(), logger)
+		}
 		f := bytes.Fields(scanner.Bytes())
 		bf.Add(f[0])
 	}
@@ -62,14 +71,118 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Open the nonmatch output file
+	// Reads whose matches were all dropped by muscato_downsample
+	// are still matched.
+	if config.GeneSampleSize > 0 {
+		if err := addDownsampled(bf); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Count the matched and unmatched reads.
+	rfname := path.Join(config.TempDir, "reads_sorted.txt.sz")
+	inf, err := os.Open(rfname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer inf.Close()
+	rdr := snappy.NewReader(inf)
+	scanner = bufio.NewScanner(rdr)
+	var mi matchInfo
+	cs := newContamScan()
+	var rs *reasonScan
+	if config.UnmatchedReasons {
+		if rs, err = newReasonScan(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for jj := 0; scanner.Scan(); jj++ {
+		if jj == 0 {
+			utils.ReadsSortedSchema.Require(scanner.Bytes(), logger)
+		}
+		f := bytes.Fields(scanner.Bytes())
+		n, err := strconv.Atoi(string(f[1]))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if bf.Test(f[0]) {
+			mi.MatchedSeqs++
+			mi.MatchedReads += n
+		} else {
+			mi.UnmatchedSeqs++
+			mi.UnmatchedReads += n
+			cs.add(f[0], n)
+			if rs != nil {
+				var names []byte
+				if len(f) > 2 {
+					names = f[2]
+				}
+				if err := rs.add(jj, f[0], n, names); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if rs != nil {
+		if err := rs.close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	writeNonMatch(bf)
+
+	writeMatchInfo(&mi)
+
+	if err := writeAdapterInfo(cs.summary()); err != nil {
+		log.Fatal(err)
+	}
+	if err := warnings.Save(config.LogDir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// addDownsampled adds the read sequences of the matches dropped by
+// muscato_downsample to the Bloom filter of matched sequences.
+func addDownsampled(bf *bloom.BloomFilter) error {
+
+	fid, err := os.Open(path.Join(tmpdir, "downsampled_reads.txt.sz"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		bf.Add(scanner.Bytes())
+	}
+
+	return scanner.Err()
+}
+
+// resultsName returns the name of an output file derived from the
+// results file name, by inserting the tag before the extension, and
+// appending the suffix.
+func resultsName(tag, suffix string) string {
 	a, b := path.Split(config.ResultsFileName)
 	c := strings.Split(b, ".")
 	d := c[len(c)-1]
-	c[len(c)-1] = "nonmatch"
-	c = append(c, d+".fastq")
-	outname := path.Join(a, strings.Join(c, "."))
-	out, err := os.Create(outname)
+	c[len(c)-1] = tag
+	c = append(c, d+suffix)
+	return path.Join(a, strings.Join(c, "."))
+}
+
+// writeNonMatch copies the unmatched reads, with their original names
+// and quality scores, from the source fastq file to the nonmatch
+// output file.
+func writeNonMatch(bf *bloom.BloomFilter) {
+
+	// Open the nonmatch output file
+	outname := utils.CompressedName(resultsName("nonmatch", ".fastq"), config.CompressResults)
+	out, err := utils.CreateResult(outname, config.CompressResults, config.SyncResults)
 	if err != nil {
 		msg := fmt.Sprintf("Cannot create file %s.", outname)
 		if os.IsNotExist(err) {
@@ -82,34 +195,71 @@ func main() {
 	wtr := bufio.NewWriter(out)
 	defer wtr.Flush()
 
-	// Check each read to see if it was matched.
-	rfname := path.Join(config.TempDir, "reads_sorted.txt.sz")
-	inf, err = os.Open(rfname)
+	// Reads are matched using the sequence as modified by
+	// muscato_prep_reads (with any UMI removed).  Reads that were
+	// skipped for being too short are not included.
+	ris := utils.NewReadInSeq(config.ReadFileName, "")
+	umi, err := utils.ParseUMI(config.UMI)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer inf.Close()
-	rdr := snappy.NewReader(inf)
-	scanner = bufio.NewScanner(rdr)
-	var buf bytes.Buffer
-	for scanner.Scan() {
-		f := bytes.Fields(scanner.Bytes())
-		if !bf.Test(f[0]) {
-			buf.Reset()
-			buf.Write(f[2])
-			buf.WriteString("#")
-			buf.Write(f[1])
-			buf.WriteString("\n")
-			buf.Write(f[0])
-			buf.WriteString("\n+\n")
-			for k := 0; k < len(f[0]); k++ {
-				buf.WriteString("!")
-			}
-			buf.WriteString("\n")
-			_, err = wtr.Write(buf.Bytes())
-			if err != nil {
+	alpha, err := utils.NewAlphabet(config.SequenceAlphabet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var xseq []byte
+	for ris.Next() {
+		seq := ris.Seq
+		if umi != nil {
+			_, seq = umi.Extract(ris.Name, seq)
+		}
+		if len(seq) < config.MinReadLength {
+			continue
+		}
+		xseq = append(xseq[0:0], seq...)
+		alpha.SubX(xseq)
+		if len(xseq) > config.MaxReadLength {
+			xseq = xseq[0:config.MaxReadLength]
+		}
+		if bf.Test(xseq) {
+			continue
+		}
+
+		for _, x := range []string{ris.Name, "\n", ris.Seq, "\n+\n", ris.Qual, "\n"} {
+			if _, err := wtr.WriteString(x); err != nil {
 				log.Fatal(err)
 			}
 		}
 	}
+
+	if err := wtr.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// matchInfo contains the number of distinct sequences, and the number
+// of reads (including duplicates), that were or were not matched.
+type matchInfo struct {
+	MatchedSeqs    int
+	UnmatchedSeqs  int
+	MatchedReads   int
+	UnmatchedReads int
+}
+
+// writeMatchInfo saves the match counts to matchinfo.json in the log
+// directory.
+func writeMatchInfo(mi *matchInfo) {
+
+	fid, err := os.Create(path.Join(config.LogDir, "matchinfo.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	if err := enc.Encode(mi); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,121 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// The reason given for an unmatched read that was matched by
+// muscato_confirm, but whose matches were all removed later (e.g. for
+// lying outside of their target).
+const removedReason = "removed"
+
+// reasonCount is the number of unmatched read sequences and reads
+// with one reason.
+type reasonCount struct {
+	Reason string
+	Seqs   int
+	Reads  int
+}
+
+// reasonScan assigns a reason to each unmatched read, from the
+// statuses saved by muscato_window_reads and muscato_confirm, and
+// writes the reasons to the unmatched reasons file.
+type reasonScan struct {
+	status []utils.ReadStatus
+
+	out io.WriteCloser
+	wtr *bufio.Writer
+
+	// The counts for each reason, in the order of the statuses,
+	// followed by removedReason.
+	counts []reasonCount
+}
+
+func newReasonScan() (*reasonScan, error) {
+
+	status, err := utils.MergeReadStatus(path.Join(tmpdir, "readstatus_*.bin"))
+	if err != nil {
+		return nil, err
+	}
+
+	outname := utils.CompressedName(resultsName("unmatched", ""), config.CompressResults)
+	out, err := utils.CreateResult(outname, config.CompressResults, config.SyncResults)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &reasonScan{status: status, out: out, wtr: bufio.NewWriter(out)}
+	for _, name := range utils.ReadStatusNames() {
+		if name != utils.StatusMatched.String() {
+			rs.counts = append(rs.counts, reasonCount{Reason: name})
+		}
+	}
+	rs.counts = append(rs.counts, reasonCount{Reason: removedReason})
+
+	return rs, nil
+}
+
+// add records the reason that a read sequence, with the given id,
+// number of reads and names, was not matched.
+func (rs *reasonScan) add(id int, seq []byte, n int, names []byte) error {
+
+	st := utils.StatusTooShort
+	if id < len(rs.status) {
+		st = rs.status[id]
+	}
+	rc := &rs.counts[len(rs.counts)-1]
+	if st != utils.StatusMatched {
+		rc = &rs.counts[st]
+	}
+	rc.Seqs++
+	rc.Reads += n
+
+	rs.wtr.Write(seq)
+	rs.wtr.WriteString("\t")
+	rs.wtr.WriteString(strconv.Itoa(n))
+	rs.wtr.WriteString("\t")
+	rs.wtr.WriteString(rc.Reason)
+	rs.wtr.WriteString("\t")
+	rs.wtr.Write(names)
+	_, err := rs.wtr.WriteString("\n")
+
+	return err
+}
+
+// close completes the unmatched reasons file, and saves the counts
+// for each reason to unmatchedinfo.json in the log directory.
+func (rs *reasonScan) close() error {
+
+	if err := rs.wtr.Flush(); err != nil {
+		return err
+	}
+	if err := rs.out.Close(); err != nil {
+		return err
+	}
+
+	var info struct {
+		Reasons []reasonCount
+	}
+	for _, rc := range rs.counts {
+		if rc.Seqs > 0 {
+			info.Reasons = append(info.Reasons, rc)
+		}
+	}
+
+	fid, err := os.Create(path.Join(config.LogDir, "unmatchedinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	return json.NewEncoder(fid).Encode(info)
+}
@@ -3,11 +3,28 @@
 // muscato_prep_reads converts a source file of sequencing reads from
 // fastq format to a simple format with one sequence per row, used
 // internally by Muscato.
+//
+// If UMI is set, the unique molecular identifier of each read is
+// placed in a column between the sequence and the read name.  UMIs
+// found at the start of the read are removed from the sequence.
+// Reads for which no UMI is found are given their name as the UMI, so
+// that they are not treated as duplicates.
+//
+// If ReadGroup is set, the read group of each read is placed in a
+// column before the read name (following the UMI, if any).  The
+// number of reads in each group, and the number whose group was not
+// found, are saved to prepinfo.json.
+//
+// If Adapters or QualityTrim is set, low quality bases and adapters
+// are removed from the 3' end of each read (following the removal of
+// any UMI) before the length checks, and the number of reads and
+// bases trimmed are saved to prepinfo.json.
 
 package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -27,45 +44,92 @@ var (
 	tmpdir string
 
 	logger *log.Logger
-)
 
-// subx replaces non A/T/G/C with X
-func subx(seq []byte) {
-	for i, c := range seq {
-		switch c {
-		case 'A':
-		case 'T':
-		case 'C':
-		case 'G':
-		default:
-			seq[i] = 'X'
-		}
-	}
-}
+	// Letters not in the alphabet are replaced with X.
+	alpha *utils.Alphabet
+
+	warnings = utils.NewWarnings("muscato_prep_reads")
+)
 
 func source() {
 
 	ris := utils.NewReadInSeq(config.ReadFileName, "")
 
+	umi, err := utils.ParseUMI(config.UMI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rg, err := utils.ParseReadGroup(config.ReadGroup)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trim, err := utils.NewTrimmer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ts trimStats
+
+	// The number of reads in each read group, after skipping
+	var groups map[string]int
+	if rg != nil {
+		groups = make(map[string]int)
+	}
+
 	var bbuf bytes.Buffer
 
 	nskip := 0
+	nclip := 0
+	ntrunc := 0
+	numi := 0
+
+	// The length of the longest read, after clipping
+	maxlen := 0
+
+	// Shorter reads, including those that are trimmed away
+	// entirely, are skipped.
+	minlen := config.MinUsableLength()
+
+	// The number of reads of each length, after trimming and before
+	// clipping
+	lengths := make(map[int]int)
 
 	var lnum int
 	for lnum = 0; ris.Next(); lnum++ {
 
 		bbuf.Reset()
 
-		if len(ris.Seq) < config.MinReadLength {
+		seq := ris.Seq
+		var mi string
+		if umi != nil {
+			mi, seq = umi.Extract(ris.Name, seq)
+		}
+		if trim != nil {
+			// The quality scores of the bases following
+			// any UMI.
+			qual := ris.Qual
+			if len(qual) == len(ris.Seq) {
+				qual = qual[len(ris.Seq)-len(seq):]
+			}
+			n, nq, na := trim.Trim(seq, qual)
+			ts.add(nq, na, len(seq) >= minlen && n < minlen)
+			seq = seq[0:n]
+		}
+
+		lengths[len(seq)]++
+		if len(seq) < minlen {
 			nskip++
 			continue
 		}
 
-		xseq := []byte(ris.Seq)
-		subx(xseq)
+		xseq := []byte(seq)
+		alpha.SubX(xseq)
 
 		if len(xseq) > config.MaxReadLength {
 			xseq = xseq[0:config.MaxReadLength]
+			nclip++
+		}
+		if len(xseq) > maxlen {
+			maxlen = len(xseq)
 		}
 
 		_, err := bbuf.Write(append(xseq, '\t'))
@@ -76,7 +140,25 @@ func source() {
 		rn := ris.Name
 		if len(rn) > maxNameLen {
 			rn = rn[0:(maxNameLen-5)] + "..."
+			ntrunc++
 		}
+
+		if umi != nil {
+			if mi == "" {
+				mi = rn
+				numi++
+			}
+			bbuf.WriteString(mi)
+			bbuf.WriteString("\t")
+		}
+
+		if rg != nil {
+			g := rg.Extract(ris.Name)
+			groups[g]++
+			bbuf.WriteString(g)
+			bbuf.WriteString("\t")
+		}
+
 		bbuf.Write([]byte(rn))
 
 		bbuf.Write([]byte("\n"))
@@ -88,7 +170,107 @@ func source() {
 	}
 
 	logger.Printf("Processed %d reads", lnum)
-	logger.Printf("Skipped %d reads for being too short", nskip)
+	logger.Printf("Skipped %d reads for being shorter than %d", nskip, minlen)
+	logger.Printf("Clipped %d reads to MaxReadLength=%d", nclip, config.MaxReadLength)
+
+	var tsp *trimStats
+	if trim != nil {
+		tsp = &ts
+		logger.Printf("Trimmed %d bases from %d reads for low quality, and %d bases from %d reads for adapters, %d reads were too short after trimming",
+			ts.QualityBases, ts.QualityReads, ts.AdapterBases, ts.AdapterReads, ts.ShortReads)
+	}
+	writePrepInfo(lnum, nskip, maxlen, lengths, groups, tsp)
+
+	warnings.AddN(nskip, "short_reads", utils.SeverityInfo,
+		"Reads shorter than %d (MinReadLength=%d, or the end of the first window) were skipped",
+		minlen, config.MinReadLength)
+	warnings.AddN(nclip, "clipped_reads", utils.SeverityInfo,
+		"Reads longer than MaxReadLength=%d were clipped", config.MaxReadLength)
+	warnings.AddN(ntrunc, "read_names_truncated", utils.SeverityInfo,
+		"Read names longer than %d characters were truncated", maxNameLen)
+	if rg != nil {
+		n := groups[utils.UnknownReadGroup]
+		logger.Printf("Found %d read groups, no read group was found for %d reads", len(groups), n)
+		warnings.AddN(n, "read_group_missing", utils.SeverityWarning,
+			"No read group was found for reads using ReadGroup=%s, these reads are in the group '%s'",
+			config.ReadGroup, utils.UnknownReadGroup)
+	}
+	if umi != nil {
+		logger.Printf("No UMI was found for %d reads", numi)
+		warnings.AddN(numi, "umi_missing", utils.SeverityWarning,
+			"No UMI was found for reads using UMI=%s, these reads are not deduplicated", config.UMI)
+	}
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
+	}
+}
+
+// trimStats counts the reads and bases removed by trimming.
+type trimStats struct {
+
+	// The number of reads with low quality bases removed, and the
+	// number of bases removed.
+	QualityReads int
+	QualityBases int
+
+	// The number of reads with an adapter removed, and the number
+	// of bases removed.
+	AdapterReads int
+	AdapterBases int
+
+	// The number of reads that were skipped because they were too
+	// short after trimming, but not before.
+	ShortReads int
+}
+
+// add records the trimming of one read, and whether it was made too
+// short by the trimming.
+func (ts *trimStats) add(nqual, nadapt int, short bool) {
+	if nqual > 0 {
+		ts.QualityReads++
+		ts.QualityBases += nqual
+	}
+	if nadapt > 0 {
+		ts.AdapterReads++
+		ts.AdapterBases += nadapt
+	}
+	if short {
+		ts.ShortReads++
+	}
+}
+
+// writePrepInfo saves the number of input reads, the number that
+// were skipped, the length of the longest read, the number of reads
+// of each length, the number of reads in each read group (if
+// ReadGroup is set), and the trimming statistics (if trimming is
+// done), to prepinfo.json in the log directory.
+func writePrepInfo(ninput, nskip, maxlen int, lengths map[int]int, groups map[string]int, ts *trimStats) {
+
+	prepinfo := struct {
+		NumInput   int
+		NumSkipped int
+		MaxLength  int
+		Lengths    map[int]int
+		ReadGroups map[string]int `json:",omitempty"`
+		Trimming   *trimStats     `json:",omitempty"`
+	}{
+		NumInput:   ninput,
+		NumSkipped: nskip,
+		MaxLength:  maxlen,
+		Lengths:    lengths,
+		ReadGroups: groups,
+		Trimming:   ts,
+	}
+
+	fid, err := os.Create(path.Join(config.LogDir, "prepinfo.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	if err := json.NewEncoder(fid).Encode(prepinfo); err != nil {
+		logger.Print(err)
+	}
 }
 
 func setupLog() {
@@ -101,17 +283,26 @@ func setupLog() {
 }
 
 func main() {
-	if len(os.Args) != 2 && len(os.Args) != 3 {
+
+	defer utils.ExitOnPanic("muscato_prep_reads")
+
+	if len(os.Args) != 2 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
 		os.Exit(1)
 	}
 
 	config = utils.ReadConfig(os.Args[1])
 
-	if config.TempDir == "" {
-		tmpdir = os.Args[2]
-	} else {
-		tmpdir = config.TempDir
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
+	}
+
+	var err error
+	alpha, err = utils.NewAlphabet(config.SequenceAlphabet)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	setupLog()
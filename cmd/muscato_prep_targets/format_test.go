@@ -0,0 +1,50 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestWriteId(t *testing.T) {
+
+	var buf bytes.Buffer
+	writeId(&buf, 42, "ENST00000456328.2", "_r", 1657)
+	want := fmt.Sprintf("%011d\t%s_r\t%d\n", 42, "ENST00000456328.2", 1657)
+	if buf.String() != want {
+		t.Errorf("writeId wrote %q, expected %q", buf.String(), want)
+	}
+}
+
+func BenchmarkWriteId(b *testing.B) {
+
+	b.Run("writeId", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeId(io.Discard, i, "ENST00000456328.2", "", 1657)
+		}
+	})
+
+	b.Run("Sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Discard.Write([]byte(fmt.Sprintf("%011d\t%s\t%d\n", i, "ENST00000456328.2", 1657)))
+		}
+	})
+}
+
+func BenchmarkWriteSeq(b *testing.B) {
+
+	// A chromosome-like target split into many segments.
+	maxlen, overlap = 1000, 100
+	seq := bytes.Repeat([]byte("ACGT"), 250000)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(seq)))
+	for i := 0; i < b.N; i++ {
+		writeSeq(io.Discard, seq, i)
+	}
+}
@@ -7,7 +7,38 @@
 //
 // The input can be either a fasta file, or a text format with each
 // line containing an id followed by a tab followed by a sequence.
-// Letters other than A/T/G/C are replaced with X.
+// Files whose first line starts with '>' are treated as fasta.  The
+// input files may be compressed with gzip or snappy (indicated by a
+// .gz or .sz suffix).  If several input files are given, they are
+// merged into a single target database.  Letters other than A/T/G/C
+// are replaced with X.  With -alphabet=protein, the targets are amino
+// acid sequences, and letters other than the 20 standard amino acids
+// are replaced with X.  Muscato must then be run with
+// SequenceAlphabet set to "protein".
+//
+// Target sequences longer than the value of the -maxlen flag (e.g.
+// chromosomes) are split into overlapping segments, each placed on
+// its own line of the sequence file, followed by the offset of the
+// segment within the target and the target number.  The overlap
+// (set by the -overlap flag) should be at least as large as the
+// longest read.  Match positions are always reported relative to the
+// start of the full target sequence.
+//
+// For very large target databases, the -volsize flag splits the
+// sequence and id outputs into numbered volumes holding roughly the
+// given number of megabytes (before compression) each.  A JSON
+// manifest listing the volumes is written for each output, and the
+// manifest names are given to Muscato in place of the GeneFileName
+// and GeneIdFileName files.  Volumes always end on a line boundary.
+//
+// The targets are checked as they are read.  Targets with empty
+// sequences are skipped.  Duplicate target ids are an error unless
+// -dupids=rename is given, in which case the later targets are
+// renamed by adding _2, _3, etc. to the id.  If -maxseqlen is given,
+// longer sequences are an error.  The problems found are listed in a
+// tab-delimited report named after the sequence output, with the
+// suffix _problems.txt.  If any errors were found, the outputs are
+// removed and the program exits with a non-zero status.
 
 package main
 
@@ -15,6 +46,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -22,26 +54,39 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/utils"
 )
 
 const (
-	// Maximum sequence length.  If there are sequences longer
-	// than this, the program will exit with an error.
-	maxline int = 1024 * 1024
+	// Maximum line length in the input file.  If there are lines
+	// longer than this, the program will exit with an error.
+	maxline int = 1024 * 1024 * 1024
 )
 
 var (
-	// If true, data are fasta format, else they follow a format
-	// with one line per sequence, having format id<tab>sequence.
-	fasta bool
-
 	seqoutname string
 	idoutname  string
 
+	// Sequences longer than maxlen are split into segments of
+	// length maxlen, overlapping by overlap positions.
+	maxlen  int
+	overlap int
+
+	// If positive, the outputs are split into volumes of about
+	// volsize bytes each.
+	volsize int64
+
 	logger *log.Logger
+
+	// Letters not in the alphabet are replaced with X.
+	alpha *utils.Alphabet
+
+	// Workspace for formatting the records.
+	recbuf []byte
 )
 
 // revcomp reverse complements its argument.
@@ -65,27 +110,66 @@ func revcomp(seq []byte) []byte {
 	return b
 }
 
-// subx replaces non A/T/G/C with X
-func subx(seq []byte) {
-	for i, c := range seq {
-		switch c {
-		case 'A':
-		case 'T':
-		case 'C':
-		case 'G':
-		default:
-			seq[i] = 'X'
+// writeId writes the identifier line for target number lnum, with the
+// given name and suffix.
+func writeId(idout io.Writer, lnum int, name, suffix string, length int) {
+	recbuf = utils.AppendPadded(recbuf[0:0], int64(lnum), 11)
+	recbuf = append(recbuf, '\t')
+	recbuf = append(recbuf, name...)
+	recbuf = append(recbuf, suffix...)
+	recbuf = append(recbuf, '\t')
+	recbuf = strconv.AppendInt(recbuf, int64(length), 10)
+	recbuf = append(recbuf, '\n')
+	if _, err := idout.Write(recbuf); err != nil {
+		panic(err)
+	}
+}
+
+// writeSeq writes the sequence for target number lnum.  Long sequences
+// are split into overlapping segments.
+func writeSeq(seqout io.Writer, seq []byte, lnum int) {
+
+	if len(seq) <= maxlen {
+		_, err := seqout.Write(append(seq, '\n'))
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	for off := 0; ; off += maxlen - overlap {
+		end := off + maxlen
+		if end > len(seq) {
+			end = len(seq)
+		}
+		if _, err := seqout.Write(seq[off:end]); err != nil {
+			panic(err)
+		}
+		recbuf = append(recbuf[0:0], '\t')
+		recbuf = strconv.AppendInt(recbuf, int64(off), 10)
+		recbuf = append(recbuf, '\t')
+		recbuf = strconv.AppendInt(recbuf, int64(lnum), 10)
+		recbuf = append(recbuf, '\n')
+		if _, err := seqout.Write(recbuf); err != nil {
+			panic(err)
+		}
+		if end == len(seq) {
+			break
 		}
 	}
 }
 
-func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
+// processText reads targets in text format, numbering them starting
+// from lnum.  The next unused target number is returned.
+func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool, lnum int) int {
 
 	logger.Print("Processing text format file...")
 
-	var lnum int
+	var nline int
 	for scanner.Scan() {
 
+		nline++
+
 		if lnum%1000000 == 0 {
 			logger.Printf("%d\n", lnum)
 		}
@@ -102,34 +186,25 @@ func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 			os.Exit(0)
 		}
 
-		nam := toks[0]
 		seq := toks[1]
+		nam, ok := val.check(nline, string(toks[0]), seq, rev)
+		if !ok {
+			continue
+		}
 
-		subx(seq)
+		alpha.SubX(seq)
 
 		// Write the sequence
-		_, err := seqout.Write(append(seq, '\n'))
-		if err != nil {
-			panic(err)
-		}
+		writeSeq(seqout, seq, lnum)
 		if rev {
-			_, err := seqout.Write(append(revcomp(seq), '\n'))
-			if err != nil {
-				panic(err)
-			}
+			writeSeq(seqout, revcomp(seq), lnum+1)
 		}
 
 		// Write the gene id
-		_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s\t%d\n", lnum, nam, len(seq))))
-		if err != nil {
-			panic(err)
-		}
+		writeId(idout, lnum, nam, "", len(seq))
 		lnum++
 		if rev {
-			_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s_r\t%d\n", lnum, nam, len(seq))))
-			if err != nil {
-				panic(err)
-			}
+			writeId(idout, lnum, nam, "_r", len(seq))
 			lnum++
 		}
 	}
@@ -138,23 +213,24 @@ func processText(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 		logger.Printf("Failed on line %d", lnum)
 		panic(err)
 	}
+
+	return lnum
 }
 
-func processFasta(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
+// processFasta reads targets in fasta format, numbering them starting
+// from lnum.  The next unused target number is returned.
+func processFasta(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool, lnum int) int {
 
 	logger.Print("Processing FASTA format file...")
 
 	var seqname string
 	var seq []byte
-	var lnum int
+	var nline, hline int
 
 	flush := func(r bool) {
 
 		// Write the sequence
-		_, err := seqout.Write(append(seq, '\n'))
-		if err != nil {
-			panic(err)
-		}
+		writeSeq(seqout, seq, lnum)
 
 		// Write the gene id
 		x := ""
@@ -162,32 +238,45 @@ func processFasta(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 			x = "_r"
 		}
 
-		_, err = idout.Write([]byte(fmt.Sprintf("%011d\t%s%s\t%d\n", lnum, seqname, x, len(seq))))
-		if err != nil {
-			panic(err)
+		writeId(idout, lnum, seqname, x, len(seq))
+	}
+
+	// emit writes the current target, unless it is invalid.
+	emit := func() {
+		id, ok := val.check(hline, seqname, seq, rev)
+		if !ok {
+			return
+		}
+		seqname = id
+		alpha.SubX(seq)
+		flush(false)
+		lnum++
+		if rev {
+			seq = revcomp(seq)
+			flush(true)
+			lnum++
 		}
 	}
 
 	for scanner.Scan() {
 
+		nline++
+
 		if lnum%1000000 == 0 {
 			logger.Printf("%d\n", lnum)
 		}
 
 		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
 
 		if line[0] == '>' {
-			if len(seq) > 0 {
-				subx(seq)
-				flush(false)
-				lnum++
-				if rev {
-					seq = revcomp(seq)
-					flush(true)
-					lnum++
-				}
+			if seqname != "" {
+				emit()
 			}
 			seqname = string(line)
+			hline = nline
 			seq = seq[0:0]
 			continue
 		}
@@ -201,18 +290,41 @@ func processFasta(scanner *bufio.Scanner, idout, seqout io.Writer, rev bool) {
 		panic(err)
 	}
 
-	if len(seq) > 0 {
-		flush(false)
-		lnum++
-		if rev {
-			seq = revcomp(seq)
-			flush(true)
-			lnum++
+	if seqname != "" {
+		emit()
+	}
+
+	return lnum
+}
+
+// isFasta returns true if the first non-blank line read from rdr
+// starts with '>'.
+func isFasta(rdr *bufio.Reader) (bool, error) {
+	for {
+		b, err := rdr.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		switch b[0] {
+		case '\n', '\r', ' ', '\t':
+			if _, err := rdr.ReadByte(); err != nil {
+				return false, err
+			}
+		default:
+			return b[0] == '>', nil
 		}
 	}
 }
 
-func targets(rawgenefile, seqoutname, idoutname string, rev bool) {
+// addTargets reads one input file, writing the sequences and ids
+// starting at target number lnum.  The next unused target number is
+// returned.
+func addTargets(rawgenefile string, idout, seqout io.Writer, rev bool, lnum int) int {
+
+	logger.Printf("Reading %s", rawgenefile)
+	val.file = rawgenefile
 
 	// Setup for reading the input file
 	rc, err := os.Open(rawgenefile)
@@ -223,52 +335,174 @@ func targets(rawgenefile, seqoutname, idoutname string, rev bool) {
 	var rdr io.Reader = rc
 
 	// The input file is compressed
-	ext := filepath.Ext(rawgenefile)
-	if strings.ToLower(ext) == ".gz" {
+	ext := strings.ToLower(filepath.Ext(rawgenefile))
+	if ext == ".gz" {
 		logger.Printf("Reading gzipped gene sequence file")
 		rdr, err = gzip.NewReader(rdr)
 		if err != nil {
 			panic(err)
 		}
-		rawgenefile = strings.Replace(rawgenefile, ext, "", -1)
-		ext = filepath.Ext(rawgenefile)
-	} else if strings.ToLower(ext) == ".sz" {
+	} else if ext == ".sz" {
 		logger.Printf("Reading snappy compressed gene sequence file")
 		rdr = snappy.NewReader(rdr)
-		rawgenefile = strings.Replace(rawgenefile, ext, "", -1)
-		ext = filepath.Ext(rawgenefile)
 	}
 
-	// Setup for writing the sequence output
-	gid, err := os.Create(seqoutname)
-	if err != nil {
-		panic(err)
-	}
-	defer gid.Close()
-	seqout := snappy.NewBufferedWriter(gid)
-	defer seqout.Close()
-
-	// Setup for writing the identifier output
-	idwtr, err := os.Create(idoutname)
+	// Determine the format from the content
+	br := bufio.NewReader(rdr)
+	fasta, err := isFasta(br)
 	if err != nil {
 		panic(err)
 	}
-	defer idwtr.Close()
-	idout := snappy.NewBufferedWriter(idwtr)
-	defer idout.Close()
 
 	// Setup a scanner to read long lines
-	scanner := bufio.NewScanner(rdr)
+	scanner := bufio.NewScanner(br)
 	sbuf := make([]byte, 64*1024)
 	scanner.Buffer(sbuf, maxline)
 
 	if fasta {
-		processFasta(scanner, idout, seqout, rev)
-	} else {
-		processText(scanner, idout, seqout, rev)
+		return processFasta(scanner, idout, seqout, rev, lnum)
 	}
+	return processText(scanner, idout, seqout, rev, lnum)
+}
 
-	logger.Printf("Done processing targets")
+// volumeWriter writes snappy compressed output split into numbered
+// volumes, starting a new volume after a complete line once the
+// current volume holds at least volsize bytes.  Close writes a
+// manifest listing the volumes.
+type volumeWriter struct {
+	base string
+	fid  *os.File
+	wtr  *snappy.Writer
+	n    int64
+	vols []utils.TargetVolume
+}
+
+func (vw *volumeWriter) Write(p []byte) (int, error) {
+
+	if vw.wtr == nil {
+		name := fmt.Sprintf("%s.%03d.sz", vw.base, len(vw.vols))
+		fid, err := os.Create(name)
+		if err != nil {
+			return 0, err
+		}
+		vw.fid = fid
+		vw.wtr = snappy.NewBufferedWriter(fid)
+		vw.n = 0
+	}
+
+	n, err := vw.wtr.Write(p)
+	vw.n += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if vw.n >= volsize && len(p) > 0 && p[len(p)-1] == '\n' {
+		if err := vw.closeVolume(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (vw *volumeWriter) closeVolume() error {
+
+	if err := vw.wtr.Close(); err != nil {
+		return err
+	}
+	if err := vw.fid.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Base(vw.fid.Name())
+	vw.vols = append(vw.vols, utils.TargetVolume{File: name, Bytes: vw.n})
+	logger.Printf("Wrote %s (%d bytes)", name, vw.n)
+	vw.wtr = nil
+	vw.fid = nil
+
+	return nil
+}
+
+// Close finishes the last volume and writes the manifest.  There is
+// always at least one volume, which may be empty.
+func (vw *volumeWriter) Close() error {
+
+	if vw.wtr == nil && len(vw.vols) == 0 {
+		if _, err := vw.Write(nil); err != nil {
+			return err
+		}
+	}
+	if vw.wtr != nil {
+		if err := vw.closeVolume(); err != nil {
+			return err
+		}
+	}
+
+	fid, err := os.Create(vw.base + ".json")
+	if err != nil {
+		return err
+	}
+	m := utils.TargetManifest{Volumes: vw.vols}
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		fid.Close()
+		return err
+	}
+
+	return fid.Close()
+}
+
+// snappyFile is a snappy compressed output file.
+type snappyFile struct {
+	*snappy.Writer
+	fid *os.File
+}
+
+func (sf *snappyFile) Close() error {
+	if err := sf.Writer.Close(); err != nil {
+		return err
+	}
+	return sf.fid.Close()
+}
+
+// createOutput returns a writer for the output file with the given
+// base name (without the .sz or .json extension).
+func createOutput(base string) io.WriteCloser {
+
+	if volsize > 0 {
+		return &volumeWriter{base: base}
+	}
+
+	fid, err := os.Create(base + ".sz")
+	if err != nil {
+		panic(err)
+	}
+
+	return &snappyFile{Writer: snappy.NewBufferedWriter(fid), fid: fid}
+}
+
+func targets(rawgenefiles []string, seqbase, idbase string, rev bool) {
+
+	// Setup for writing the sequence output
+	seqout := createOutput(seqbase)
+
+	// Setup for writing the identifier output
+	idout := createOutput(idbase)
+
+	var lnum int
+	for _, f := range rawgenefiles {
+		lnum = addTargets(f, idout, seqout, rev, lnum)
+	}
+
+	if err := seqout.Close(); err != nil {
+		panic(err)
+	}
+	if err := idout.Close(); err != nil {
+		panic(err)
+	}
+
+	logger.Printf("Done processing %d targets", lnum)
 }
 
 func setupLog() {
@@ -281,17 +515,61 @@ func setupLog() {
 
 func main() {
 
+	defer utils.ExitOnPanic("muscato_prep_targets")
+
 	rev := flag.Bool("rev", false, "Include reverse complement sequences")
+	flag.IntVar(&maxlen, "maxlen", 500000, "Split sequences longer than this into segments")
+	flag.IntVar(&overlap, "overlap", 1000, "Overlap between segments of split sequences")
+	out := flag.String("out", "", "Name used to form the output file names (default is the first gene file)")
+	vs := flag.Int("volsize", 0, "Split the outputs into volumes of about this many megabytes (before compression)")
+	dupids := flag.String("dupids", "error", "'error' to reject duplicate target ids, or 'rename' to add a numeric suffix")
+	maxseqlen := flag.Int("maxseqlen", 0, "Reject target sequences longer than this (default is no limit)")
+	alphabet := flag.String("alphabet", "dna", "'dna' or 'protein' (the letters of the target sequences)")
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) != 1 {
+	if len(args) == 0 {
 		os.Stderr.WriteString("muscato_prep_targets: usage\n")
-		os.Stderr.WriteString("  muscato_prep_targets [-rev] genefile\n\n")
+		os.Stderr.WriteString("  muscato_prep_targets [-rev] [-maxlen=n] [-overlap=n] [-out=name] [-volsize=mb] [-dupids=error|rename] [-maxseqlen=n] [-alphabet=dna|protein] genefile...\n\n")
+		os.Exit(1)
+	}
+
+	if overlap >= maxlen {
+		os.Stderr.WriteString("muscato_prep_targets: overlap must be less than maxlen\n")
+		os.Exit(1)
+	}
+
+	if *vs < 0 {
+		os.Stderr.WriteString("muscato_prep_targets: volsize must not be negative\n")
+		os.Exit(1)
+	}
+	volsize = int64(*vs) * 1024 * 1024
+
+	if *dupids != "error" && *dupids != "rename" {
+		os.Stderr.WriteString("muscato_prep_targets: dupids must be 'error' or 'rename'\n")
+		os.Exit(1)
+	}
+	if *maxseqlen < 0 {
+		os.Stderr.WriteString("muscato_prep_targets: maxseqlen must not be negative\n")
+		os.Exit(1)
+	}
+	val = newValidator(*dupids, *maxseqlen)
+
+	var err error
+	alpha, err = utils.NewAlphabet(*alphabet)
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("muscato_prep_targets: %v\n", err))
+		os.Exit(1)
+	}
+	if *rev && alpha.Name == "protein" {
+		os.Stderr.WriteString("muscato_prep_targets: -rev cannot be used with protein targets\n")
 		os.Exit(1)
 	}
 
 	rawgenefile := args[0]
+	if *out != "" {
+		rawgenefile = *out
+	}
 
 	// Produce an output file name
 	dir, file := filepath.Split(rawgenefile)
@@ -302,7 +580,7 @@ func main() {
 	if strings.HasSuffix(strings.ToLower(file), ".sz") {
 		file = file[0 : len(file)-3]
 	}
-	seqoutname = path.Join(dir, file+".sz")
+	seqbase := path.Join(dir, file)
 
 	// Produce an output file name for the ids
 	dir, file = filepath.Split(rawgenefile)
@@ -313,21 +591,49 @@ func main() {
 	if strings.HasSuffix(strings.ToLower(file), ".sz") {
 		file = file[0 : len(file)-3]
 	}
-	idoutname = path.Join(dir, file+".sz")
+	idbase := path.Join(dir, file)
+
+	ext := ".sz"
+	if volsize > 0 {
+		ext = ".json"
+	}
+	seqoutname = seqbase + ext
+	idoutname = idbase + ext
 
 	os.Stderr.WriteString(fmt.Sprintf("Gene sequence file: %s\n", seqoutname))
 	os.Stderr.WriteString(fmt.Sprintf("Gene ids file: %s\n", idoutname))
 
-	gl := strings.ToLower(rawgenefile)
-	fasta = strings.HasSuffix(gl, "fasta")
-
 	setupLog()
+	logger.Printf("Sequence alphabet: %s", alpha.Name)
 	if *rev {
 		logger.Printf("Including reverse complements")
 	} else {
 		logger.Printf("Not including reverse complements")
 	}
 
-	targets(rawgenefile, seqoutname, idoutname, *rev)
+	targets(args, seqbase, idbase, *rev)
+
+	// Any problems with the targets are listed in a report next to
+	// the outputs, which are removed if there were errors.
+	report := seqbase + "_problems.txt"
+	os.Remove(report)
+	if len(val.problems) > 0 {
+		if err := val.writeReport(report); err != nil {
+			panic(err)
+		}
+		logger.Printf("Found %d problems with the targets (%d errors), see %s", len(val.problems), val.nfatal, report)
+	}
+	if val.nfatal > 0 {
+		removeOutput(seqbase)
+		removeOutput(idbase)
+		msg := fmt.Sprintf("muscato_prep_targets: %d targets were rejected, no output was written, see %s\n", val.nfatal, report)
+		os.Stderr.WriteString(msg)
+		os.Exit(1)
+	}
+	if len(val.problems) > 0 {
+		msg := fmt.Sprintf("muscato_prep_targets: %d targets were skipped or renamed, see %s\n", len(val.problems), report)
+		os.Stderr.WriteString(msg)
+	}
+
 	logger.Printf("Done")
 }
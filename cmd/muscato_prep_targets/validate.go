@@ -0,0 +1,146 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A problem is an issue found with one target.  Targets with fatal
+// problems cause the outputs to be rejected.
+type problem struct {
+	file   string
+	line   int
+	id     string
+	kind   string
+	detail string
+	fatal  bool
+}
+
+// validator checks the target ids and sequences as they are read.
+type validator struct {
+
+	// How to handle duplicate ids, either "error" or "rename".
+	dupids string
+
+	// If positive, sequences longer than this are rejected.
+	maxseqlen int
+
+	// The file currently being read.
+	file string
+
+	// The ids that have been written.
+	seen map[string]bool
+
+	problems []problem
+	nfatal   int
+}
+
+var val *validator
+
+func newValidator(dupids string, maxseqlen int) *validator {
+	return &validator{
+		dupids:    dupids,
+		maxseqlen: maxseqlen,
+		seen:      make(map[string]bool),
+	}
+}
+
+func (v *validator) add(line int, id, kind string, fatal bool, format string, args ...interface{}) {
+	v.problems = append(v.problems, problem{
+		file:   v.file,
+		line:   line,
+		id:     id,
+		kind:   kind,
+		detail: fmt.Sprintf(format, args...),
+		fatal:  fatal,
+	})
+	if fatal {
+		v.nfatal++
+	}
+}
+
+// check validates the target with the given id and sequence, read
+// from the given line of the current file.  It returns the id to use
+// for the target, which differs from the given id if the id is a
+// duplicate that was renamed, and false if the target should be
+// skipped.  If rev is true, the id of the reverse complement target
+// is also checked.
+func (v *validator) check(line int, id string, seq []byte, rev bool) (string, bool) {
+
+	if len(seq) == 0 {
+		v.add(line, id, "empty", false, "the sequence is empty, the target was skipped")
+		return id, false
+	}
+
+	if v.maxseqlen > 0 && len(seq) > v.maxseqlen {
+		v.add(line, id, "too_long", true, "the sequence has length %d, the maximum is %d", len(seq), v.maxseqlen)
+		return id, false
+	}
+
+	used := func(x string) bool {
+		return v.seen[x] || (rev && v.seen[x+"_r"])
+	}
+
+	if used(id) {
+		if v.dupids != "rename" {
+			v.add(line, id, "duplicate", true, "the id was used by an earlier target")
+		} else {
+			newid := id
+			for k := 2; used(newid); k++ {
+				newid = fmt.Sprintf("%s_%d", id, k)
+			}
+			v.add(line, id, "renamed", false, "the id was used by an earlier target, renamed to %s", newid)
+			id = newid
+		}
+	}
+
+	v.seen[id] = true
+	if rev {
+		v.seen[id+"_r"] = true
+	}
+
+	return id, true
+}
+
+// writeReport writes the problems to a tab-delimited file with one
+// problem per row, giving the input file, line number, target id, kind
+// of problem, whether it is an error, and a description.
+func (v *validator) writeReport(name string) error {
+
+	fid, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	wtr := bufio.NewWriter(fid)
+
+	wtr.WriteString("file\tline\tid\tproblem\tseverity\tdetail\n")
+	for _, p := range v.problems {
+		sev := "warning"
+		if p.fatal {
+			sev = "error"
+		}
+		fmt.Fprintf(wtr, "%s\t%d\t%s\t%s\t%s\t%s\n", p.file, p.line, p.id, p.kind, sev, p.detail)
+	}
+
+	if err := wtr.Flush(); err != nil {
+		fid.Close()
+		return err
+	}
+
+	return fid.Close()
+}
+
+// removeOutput removes the output files with the given base name,
+// including any volumes and manifest.
+func removeOutput(base string) {
+	os.Remove(base + ".sz")
+	os.Remove(base + ".json")
+	vols, _ := filepath.Glob(base + ".[0-9][0-9][0-9].sz")
+	for _, f := range vols {
+		os.Remove(f)
+	}
+}
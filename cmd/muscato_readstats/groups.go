@@ -0,0 +1,111 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// groupStat holds the matched reads of one read group.
+type groupStat struct {
+
+	// The number of matched reads, and the total number of
+	// mismatches in their best matches.
+	matched int
+	nbest   int
+}
+
+// groupSummary accumulates the matched reads in each read group, if
+// ReadGroup is set.
+type groupSummary map[string]*groupStat
+
+// add records the reads of a distinct matched sequence, given its
+// read group counts (as written by muscato_uniqify) and the fewest
+// mismatches in its matches.
+func (gs groupSummary) add(groups []byte, best int) error {
+	return utils.ParseReadGroups(string(groups), func(g string, n int) {
+		st, ok := gs[g]
+		if !ok {
+			st = new(groupStat)
+			gs[g] = st
+		}
+		st.matched += n
+		st.nbest += n * best
+	})
+}
+
+// readGroupSizes returns the number of input reads in each read
+// group, as recorded by muscato_prep_reads.
+func readGroupSizes() map[string]int {
+
+	var prepinfo struct {
+		ReadGroups map[string]int
+	}
+	fid, err := os.Open(path.Join(config.LogDir, "prepinfo.json"))
+	if err != nil {
+		logger.Print(err)
+		return nil
+	}
+	defer fid.Close()
+	if err := json.NewDecoder(fid).Decode(&prepinfo); err != nil {
+		logger.Print(err)
+	}
+
+	return prepinfo.ReadGroups
+}
+
+// write saves the summary as a tab-delimited file with a header, and
+// one row per read group giving the number of reads, the number and
+// proportion of them that matched, and the mean number of mismatches
+// in the best match of the matched reads.
+func (gs groupSummary) write(outfile string) error {
+
+	sizes := readGroupSizes()
+	var groups []string
+	for g := range sizes {
+		groups = append(groups, g)
+	}
+	for g := range gs {
+		if _, ok := sizes[g]; !ok {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	wtr := bufio.NewWriter(out)
+
+	fmt.Fprintf(wtr, "group\treads\tmatched_reads\tmatched_fraction\tmean_best_mismatches\n")
+	for _, g := range groups {
+		st := gs[g]
+		if st == nil {
+			st = new(groupStat)
+		}
+		var frac, best float64
+		if n := sizes[g]; n > 0 {
+			frac = float64(st.matched) / float64(n)
+		}
+		if st.matched > 0 {
+			best = float64(st.nbest) / float64(st.matched)
+		}
+		fmt.Fprintf(wtr, "%s\t%d\t%d\t%.6f\t%.6f\n", g, sizes[g], st.matched, frac, best)
+		logger.Printf("Read group %s: %d reads, %d matched", g, sizes[g], st.matched)
+	}
+
+	if err := wtr.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return utils.CloseFile(out, config.SyncResults)
+}
@@ -2,60 +2,209 @@
 //
 // readStats calculates statistics for each read, using a results
 // datafile that is sorted by read.
+//
+// A positional mismatch profile is also produced, giving the number
+// of aligned bases and the number of mismatches at each read
+// position, aggregated over all matches.  This can be used to detect
+// quality decay or adapter read-through at the 3' end of the reads,
+// and to choose trimming parameters.
+//
+// A quality control summary is written to the "_qc" file, giving the
+// read length distribution of the input reads, the distribution of
+// the number of genes matched by each matched read, the fraction of
+// matched reads that match more than one gene, and the mean number of
+// mismatches.
+//
+// If ReadGroup is set, a summary of each read group is written to the
+// "_readgroups" file, giving the number of reads in the group, the
+// number and proportion that matched, and the mean number of
+// mismatches in their best matches, for comparing sequencing lanes.
+//
+// Read name lists that were truncated by muscato_uniqify are replaced
+// with the complete lists from utils.NamesFileName.
 
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"strconv"
 
+	"github.com/golang/snappy"
 	"github.com/kshedden/muscato/utils"
 )
 
+const (
+	// Number of positions at each end of the reads that are
+	// summarized in the 5'/3' mismatch bias report.
+	biasWidth = 10
+)
+
 var (
 	config *utils.Config
 
 	tmpdir string
+
+	logger *log.Logger
 )
 
+// mmProfile accumulates the number of aligned bases and mismatches
+// at each read position.
+type mmProfile struct {
+	nbase []int
+	nmiss []int
+}
+
+// add updates the profile using a read sequence and the target
+// subsequence that it was matched to.
+func (mp *mmProfile) add(read, target []byte) {
+	for len(mp.nbase) < len(read) {
+		mp.nbase = append(mp.nbase, 0)
+		mp.nmiss = append(mp.nmiss, 0)
+	}
+	for i := range read {
+		if i >= len(target) {
+			break
+		}
+		mp.nbase[i]++
+		if read[i] != target[i] {
+			mp.nmiss[i]++
+		}
+	}
+}
+
+// rate returns the mismatch rate over positions i1 to i2 (exclusive).
+func (mp *mmProfile) rate(i1, i2 int) float64 {
+	var n, m int
+	for i := i1; i < i2; i++ {
+		n += mp.nbase[i]
+		m += mp.nmiss[i]
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(m) / float64(n)
+}
+
+// write saves the profile as a tab-delimited file with columns
+// position, number of aligned bases, number of mismatches, and
+// mismatch rate.
+func (mp *mmProfile) write(outfile string) error {
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+
+	for i := range mp.nbase {
+		_, err := out.WriteString(fmt.Sprintf("%d\t%d\t%d\t%.6f\n", i, mp.nbase[i], mp.nmiss[i], mp.rate(i, i+1)))
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	return utils.CloseFile(out, config.SyncResults)
+}
+
+// logBias writes a summary of the mismatch rates at the 5' and 3'
+// ends of the reads to the log.
+func (mp *mmProfile) logBias() {
+	m := len(mp.nbase)
+	w := biasWidth
+	if w > m {
+		w = m
+	}
+	logger.Printf("Overall mismatch rate: %.6f", mp.rate(0, m))
+	logger.Printf("5' mismatch rate (first %d positions): %.6f", w, mp.rate(0, w))
+	logger.Printf("3' mismatch rate (last %d positions): %.6f", w, mp.rate(m-w, m))
+}
+
+// outName returns the name of a statistics file derived from the
+// results file name.
+func outName(suffix string) string {
+	ext := path.Ext(config.ResultsFileName)
+	if ext != "" {
+		m := len(config.ResultsFileName)
+		return config.ResultsFileName[0:m-len(ext)] + suffix + ext
+	}
+	return config.ResultsFileName + suffix
+}
+
+// readNames returns the complete read name lists of the sequences
+// whose lists were truncated, keyed by sequence hash.
+func readNames() map[string]string {
+
+	names := make(map[string]string)
+
+	fid, err := os.Open(path.Join(tmpdir, utils.NamesFileName))
+	if err != nil {
+		logger.Print(err)
+		return names
+	}
+	defer fid.Close()
+
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		toks := bytes.SplitN(scanner.Bytes(), []byte("\t"), 2)
+		if len(toks) != 2 {
+			continue
+		}
+		names[string(toks[0])] = string(toks[1])
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Print(err)
+	}
+
+	return names
+}
+
+func setupLog() {
+	logname := path.Join(config.LogDir, "muscato_readstats.log")
+	fid, err := os.Create(logname)
+	if err != nil {
+		panic(err)
+	}
+	logger = log.New(fid, "", log.Ltime)
+}
+
 func main() {
 
-	if len(os.Args) != 2 && len(os.Args) != 3 {
+	defer utils.ExitOnPanic("muscato_readstats")
+
+	if len(os.Args) != 2 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments\n", os.Args[0]))
 		os.Exit(1)
 	}
 
 	config = utils.ReadConfig(os.Args[1])
 
-	if config.TempDir == "" {
-		tmpdir = os.Args[2]
-	} else {
-		tmpdir = config.TempDir
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
 	}
 
-	fid, err := os.Open(config.ResultsFileName)
+	setupLog()
+
+	fid, err := utils.OpenResult(config.ResultsPath())
 	if err != nil {
 		if os.IsNotExist(err) {
-			msg := fmt.Sprintf("Cannot open results file %s, see log files for details.\n", config.ResultsFileName)
+			msg := fmt.Sprintf("Cannot open results file %s, see log files for details.\n", config.ResultsPath())
 			os.Stderr.WriteString(msg)
 		}
 		log.Fatal(err)
 	}
 	defer fid.Close()
 
-	var outfile string
-	ext := path.Ext(config.ResultsFileName)
-	if ext != "" {
-		m := len(config.ResultsFileName)
-		outfile = config.ResultsFileName[0:m-len(ext)] + "_readstats" + ext
-	} else {
-		outfile = config.ResultsFileName + "_readstats"
-	}
-	out, err := os.Create(outfile)
+	outfile := utils.CompressedName(outName("_readstats"), config.CompressResults)
+	out, err := utils.CreateResult(outfile, config.CompressResults, config.SyncResults)
 	if err != nil {
 		msg := fmt.Sprintf("Cannot create %s, see log files for details.\n", outfile)
 		os.Stderr.WriteString(msg)
@@ -66,56 +215,172 @@ func main() {
 	scanner := bufio.NewScanner(fid)
 	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
-	var oldread, read []byte
+	fullnames := readNames()
+	logger.Printf("Read %d complete name lists", len(fullnames))
+
+	var oldread, read, oldseq, oldgroups []byte
 	var first bool = true
 	var n int
 	genes := make(map[string]bool)
+	mp := new(mmProfile)
+	qc := newQCSummary()
+	gs := make(groupSummary)
+
+	// The number of reads with the current name list, and the total
+	// and fewest mismatches over their matches.
+	var count, nmiss, best int
 
-	writeout := func(read []byte) error {
+	// Count the distinct matched read sequences, and the number of
+	// reads that they represent.
+	var lastseq []byte
+	var nseq, nreads int
+
+	writeout := func(read, seq []byte) error {
+		if na, ok := fullnames[utils.SeqHash(seq)]; ok {
+			read = []byte(na)
+		}
 		var buf bytes.Buffer
 		for g, _ := range genes {
 			buf.Write([]byte(g))
 			buf.Write([]byte(";"))
 		}
-		_, err := out.WriteString(fmt.Sprintf("%s\t%s\n", read, buf.String()))
+		_, err := io.WriteString(out, fmt.Sprintf("%s\t%s\n", read, buf.String()))
 		if err != nil {
 			return err
 		}
+		if n > 0 {
+			qc.add(count, len(genes), n, nmiss, best)
+			if config.ReadGroup != "" {
+				if err := gs.add(oldgroups, best); err != nil {
+					return err
+				}
+			}
+		}
 		return nil
 	}
 
 	for scanner.Scan() {
+		if first {
+			utils.ResultsSchema.Require(scanner.Bytes(), logger)
+		}
 		fields := bytes.Fields(scanner.Bytes())
 		read = fields[7]
 
 		if first {
 			oldread = read
+			oldseq = append(oldseq[0:0], fields[0]...)
 			first = false
 		}
 
 		if bytes.Compare(read, oldread) != 0 {
-			err := writeout(oldread)
+			err := writeout(oldread, oldseq)
 			if err != nil {
 				os.Stderr.WriteString("Error in readStats, see log files for details.\n")
 				log.Fatal(err)
 			}
 			oldread = []byte(string(read))
+			oldseq = append(oldseq[0:0], fields[0]...)
 			n = 0
+			nmiss = 0
 			genes = make(map[string]bool)
 		}
 
+		// The read group counts are in the last column.
+		if config.ReadGroup != "" {
+			oldgroups = append(oldgroups[0:0], fields[len(fields)-1]...)
+		}
+
+		c, err := strconv.Atoi(string(fields[6]))
+		if err != nil {
+			os.Stderr.WriteString("Error in readStats, see log files for details.\n")
+			log.Fatal(err)
+		}
+		m, err := strconv.Atoi(string(fields[3]))
+		if err != nil {
+			os.Stderr.WriteString("Error in readStats, see log files for details.\n")
+			log.Fatal(err)
+		}
+		if n == 0 || m < best {
+			best = m
+		}
+		count = c
+		nmiss += m
+
 		n++
 		genes[string(fields[4])] = true
+		mp.add(fields[0], fields[1])
+
+		// The results are sorted by read sequence, so each
+		// distinct matched sequence is counted once.
+		if !bytes.Equal(fields[0], lastseq) {
+			lastseq = append(lastseq[0:0], fields[0]...)
+			nseq++
+			nreads += c
+		}
 	}
 
-	err = writeout(read)
+	// With no matches there is nothing to write.
+	if !first {
+		err = writeout(read, oldseq)
+		if err != nil {
+			os.Stderr.WriteString("Error in readStats, see log files for details.\n")
+			log.Fatal(err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		os.Stderr.WriteString("Error in readStats, see log files for details.\n")
+		log.Fatal(err)
+	}
+
+	if err := out.Close(); err != nil {
+		os.Stderr.WriteString("Error in readStats, see log files for details.\n")
+		log.Fatal(err)
+	}
+
+	err = mp.write(outName("_mmprofile"))
 	if err != nil {
 		os.Stderr.WriteString("Error in readStats, see log files for details.\n")
 		log.Fatal(err)
 	}
+	mp.logBias()
 
-	if err := scanner.Err(); err != nil {
+	err = qc.write(outName("_qc"))
+	if err != nil {
 		os.Stderr.WriteString("Error in readStats, see log files for details.\n")
 		log.Fatal(err)
 	}
+
+	if config.ReadGroup != "" {
+		if err := gs.write(outName("_readgroups")); err != nil {
+			os.Stderr.WriteString("Error in readStats, see log files for details.\n")
+			log.Fatal(err)
+		}
+	}
+
+	writeReadInfo(nseq, nreads)
+}
+
+// writeReadInfo saves the number of distinct matched read sequences,
+// and the number of reads that they represent, to readinfo.json in
+// the log directory.
+func writeReadInfo(nseq, nreads int) {
+
+	readinfo := struct {
+		MatchedSeqs  int
+		MatchedReads int
+	}{
+		MatchedSeqs:  nseq,
+		MatchedReads: nreads,
+	}
+
+	fid, err := os.Create(path.Join(config.LogDir, "readinfo.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	if err := json.NewEncoder(fid).Encode(readinfo); err != nil {
+		logger.Print(err)
+	}
 }
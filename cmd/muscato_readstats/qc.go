@@ -0,0 +1,138 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// qcSummary accumulates quality control statistics for the matched
+// reads.  Each distinct read sequence is weighted by its number of
+// reads.
+type qcSummary struct {
+
+	// The number of reads matching each number of distinct genes.
+	genes map[int]int
+
+	// The number of matched reads and distinct sequences, and the
+	// number of reads matching more than one gene.
+	reads int
+	seqs  int
+	multi int
+
+	// The total number of mismatches over all matches, the number
+	// of matches, and the total number of mismatches in the best
+	// match of each read.
+	nmiss  float64
+	nmatch float64
+	nbest  float64
+}
+
+func newQCSummary() *qcSummary {
+	return &qcSummary{genes: make(map[int]int)}
+}
+
+// add records a distinct read sequence, with count reads, that
+// matched ngenes genes, with nmatch matches having a total of nmiss
+// mismatches, the fewest of which is best.
+func (qc *qcSummary) add(count, ngenes, nmatch, nmiss, best int) {
+	qc.seqs++
+	qc.reads += count
+	qc.genes[ngenes] += count
+	if ngenes > 1 {
+		qc.multi += count
+	}
+	qc.nmiss += float64(count * nmiss)
+	qc.nmatch += float64(count * nmatch)
+	qc.nbest += float64(count * best)
+}
+
+// sortedCounts returns the keys of a histogram in increasing order.
+func sortedCounts(m map[int]int) []int {
+	var keys []int
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// readLengths returns the number of input reads of each length, as
+// recorded by muscato_prep_reads.
+func readLengths() map[int]int {
+
+	var prepinfo struct {
+		Lengths map[int]int
+	}
+	fid, err := os.Open(path.Join(config.LogDir, "prepinfo.json"))
+	if err != nil {
+		logger.Print(err)
+		return nil
+	}
+	defer fid.Close()
+	if err := json.NewDecoder(fid).Decode(&prepinfo); err != nil {
+		logger.Print(err)
+	}
+
+	return prepinfo.Lengths
+}
+
+// write saves the summary as a tab-delimited file with columns
+// section, key and value.  The "summary" section contains the
+// overall statistics, the "read_length" section gives the number of
+// input reads of each length, and the "genes_per_read" section gives
+// the number of matched reads that matched each number of genes.
+func (qc *qcSummary) write(outfile string) error {
+
+	out, err := os.Create(outfile)
+	if err != nil {
+		return err
+	}
+	wtr := bufio.NewWriter(out)
+
+	ratio := func(x, y float64) float64 {
+		if y == 0 {
+			return 0
+		}
+		return x / y
+	}
+	multi := ratio(float64(qc.multi), float64(qc.reads))
+	meanMiss := ratio(qc.nmiss, qc.nmatch)
+	meanBest := ratio(qc.nbest, float64(qc.reads))
+	meanMatch := ratio(qc.nmatch, float64(qc.reads))
+
+	fmt.Fprintf(wtr, "summary\tmatched_reads\t%d\n", qc.reads)
+	fmt.Fprintf(wtr, "summary\tmatched_seqs\t%d\n", qc.seqs)
+	fmt.Fprintf(wtr, "summary\tmultimapped_fraction\t%.6f\n", multi)
+	fmt.Fprintf(wtr, "summary\tmean_matches\t%.6f\n", meanMatch)
+	fmt.Fprintf(wtr, "summary\tmean_mismatches\t%.6f\n", meanMiss)
+	fmt.Fprintf(wtr, "summary\tmean_best_mismatches\t%.6f\n", meanBest)
+
+	lengths := readLengths()
+	for _, k := range sortedCounts(lengths) {
+		fmt.Fprintf(wtr, "read_length\t%d\t%d\n", k, lengths[k])
+	}
+	for _, k := range sortedCounts(qc.genes) {
+		fmt.Fprintf(wtr, "genes_per_read\t%d\t%d\n", k, qc.genes[k])
+	}
+
+	if err := wtr.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := utils.CloseFile(out, config.SyncResults); err != nil {
+		return err
+	}
+
+	logger.Printf("Matched reads: %d, multi-mapped: %.4f, mean mismatches per match: %.4f, in the best match: %.4f",
+		qc.reads, multi, meanMiss, meanBest)
+
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecAppendTo(t *testing.T) {
+
+	r := rec{mseq: "ACGTACGTACGTACG", left: "TTGACCA", right: "GGCATCAGGA", tnum: 1234, pos: 567}
+	want := fmt.Sprintf("%s\t%s\t%s\t%011d\t%d\n", r.mseq, r.left, r.right, r.tnum, r.pos)
+	if got := string(r.appendTo(nil)); got != want {
+		t.Errorf("appendTo gave %q, expected %q", got, want)
+	}
+}
+
+func BenchmarkRecAppendTo(b *testing.B) {
+
+	r := rec{mseq: "ACGTACGTACGTACG", left: "TTGACCATTGACCATTGACC", right: "GGCATCAGGAGGCATCAGGAGGCATCAGGAGGCATCAGGAGGCATCAGGA", tnum: 1234, pos: 567}
+
+	b.Run("appendTo", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = r.appendTo(buf[0:0])
+		}
+	})
+
+	b.Run("Sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = append(buf[0:0], fmt.Sprintf("%s\t%s\t%s\t%011d\t%d\n", r.mseq, r.left, r.right, r.tnum, r.pos)...)
+		}
+	})
+}
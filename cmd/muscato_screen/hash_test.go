@@ -0,0 +1,61 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/chmduquesne/rollinghash"
+	"github.com/kshedden/muscato/internal/bloom"
+	"github.com/kshedden/muscato/utils"
+)
+
+// BenchmarkRollHash measures the inner loop of the screen: rolling
+// the hashes over a target sequence, and testing each window against
+// the Bloom filter of a window of the reads.
+func BenchmarkRollHash(b *testing.B) {
+
+	rng := rand.New(rand.NewSource(1))
+	seq := make([]byte, 100000)
+	for i := range seq {
+		seq[i] = "ACGT"[rng.Intn(4)]
+	}
+
+	for _, h64 := range []bool{false, true} {
+		name := "buzhash32"
+		if h64 {
+			name = "buzhash64"
+		}
+		b.Run(name, func(b *testing.B) {
+			config = new(utils.Config)
+			config.NumHash = 20
+			config.WindowWidth = 20
+			config.RandomSeed = 1
+			hash64 = h64
+			exact = nil
+			genTables()
+			smp = []*bloom.Filter{bloom.New(1 << 26)}
+			hashes := *hashPool.New().(*[]rollinghash.Hash64)
+			ix := make([]int, 1)
+			iw := make([]uint64, config.NumHash)
+			hlen := config.WindowWidth
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(seq)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, ha := range hashes {
+					ha.Reset()
+					ha.Write(seq[0:hlen])
+				}
+				for j := hlen; j < len(seq); j++ {
+					for _, ha := range hashes {
+						ha.Roll(seq[j])
+					}
+					ix = checkWin(ix, iw, hashes, seq[j-hlen+1:j+1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"bytes"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// targetLoc is the position of a subsequence in the target file, as
+// a line number and a position within the line.
+type targetLoc struct {
+	line uint32
+	pos  uint32
+}
+
+// targetIndex holds the target sequences, with the positions of all
+// their subsequences of length WindowWidth, keyed by a hash of the
+// subsequence.  It is used in place of the Bloom filters when
+// IndexSide is "targets", so that the targets are held in memory and
+// the window subsequences of the reads are streamed against them.
+type targetIndex struct {
+	seqs    [][]byte
+	gnums   []int
+	offsets []int
+
+	seed maphash.Seed
+	locs map[uint64][]targetLoc
+}
+
+// buildIndex reads the target file and indexes the subsequences of
+// length WindowWidth of each target.
+func buildIndex() (*targetIndex, error) {
+
+	logger.Printf("Building index of target collection...")
+
+	ti := &targetIndex{
+		seed: maphash.MakeSeed(),
+		locs: make(map[uint64][]targetLoc),
+	}
+
+	w := config.WindowWidth
+	var npos int
+	err := scanTargets(func(seq []byte, gnum, offset int) error {
+		line := uint32(len(ti.seqs))
+		ti.seqs = append(ti.seqs, seq)
+		ti.gnums = append(ti.gnums, gnum)
+		ti.offsets = append(ti.offsets, offset)
+		for j := 0; j+w <= len(seq); j++ {
+			h := maphash.Bytes(ti.seed, seq[j:j+w])
+			ti.locs[h] = append(ti.locs[h], targetLoc{line, uint32(j)})
+			npos++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("Indexed %d positions in %d target sequences", npos, len(ti.seqs))
+	return ti, nil
+}
+
+// lookup sends a candidate match to the k'th window's channel for
+// each occurrence of a window subsequence in the targets.
+func (ti *targetIndex) lookup(k int, win []byte) {
+
+	w := config.WindowWidth
+	for _, loc := range ti.locs[maphash.Bytes(ti.seed, win)] {
+		seq := ti.seqs[loc.line]
+		jx := int(loc.pos)
+		if !bytes.Equal(seq[jx:jx+w], win) {
+			// A hash collision
+			continue
+		}
+		if r, ok := hitRec(seq, k, jx, ti.gnums[loc.line], ti.offsets[loc.line]); ok {
+			hitchan[k] <- r
+		}
+	}
+}
+
+// searchReads is used in place of buildBloom and search when
+// IndexSide is "targets".  The targets are indexed, and the distinct
+// window subsequences of the reads for each window are looked up in
+// the index.  The candidate matches are the same as those found by
+// search using exact sets of the read windows.
+func searchReads() error {
+
+	ti, err := buildIndex()
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Checking read windows for matches...")
+
+	var wg sync.WaitGroup
+	startHarvest(&wg)
+
+	var sw sync.WaitGroup
+	errc := make(chan error, len(windows))
+	for k := range windows {
+		sw.Add(1)
+		go func(k int) {
+			defer sw.Done()
+			err := scanWindow(k, func(seq []byte) error {
+				if atomic.LoadInt32(&overflow) != 0 {
+					return checkOverflow()
+				}
+				ti.lookup(k, seq)
+				return nil
+			})
+			if err != nil {
+				errc <- err
+			}
+		}(k)
+	}
+	sw.Wait()
+
+	for k := 0; k < len(windows); k++ {
+		close(hitchan[k])
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errc:
+		return err
+	default:
+	}
+	if err := checkOverflow(); err != nil {
+		return err
+	}
+	logger.Printf("Done checking read windows for matches")
+
+	return nil
+}
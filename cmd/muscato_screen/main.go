@@ -15,15 +15,43 @@
 // and flanking sequences are saved for subequent checking against the
 // full read sequence.
 //
-// A simple entropy check is used to avoid considering subsequences
-// that could match large numbers of reads or genes (and hence would
-// be uninformative).  Currently, this check is based on the number of
-// distinct dinucleotide subsequences in the window (e.g. in the
-// 15-mer in the example above).
+// The Bloom filters use 32-bit rolling hashes (buzhash32), or 64-bit
+// hashes (buzhash64) if BloomHash is "buzhash64", or if it is "auto"
+// and the filters have more than 2^32 bits.
+//
+// If ScreenMethod is "exact", the window subsequences of the reads are
+// instead stored in a hash set for each window.  This uses more memory
+// than the Bloom filters, but does not produce false positives, so the
+// bmatch files are smaller and the confirmation step has less work to
+// do.
+//
+// The window subsequences of the reads are taken from the sorted
+// window files written by muscato_window_reads, so the Bloom filters
+// contain exactly the subsequences that are later confirmed.  A
+// simple entropy check is used by muscato_window_reads to avoid
+// considering subsequences that could match large numbers of reads or
+// genes (and hence would be uninformative).  Currently, this check is
+// based on the number of distinct dinucleotide subsequences in the
+// window (e.g. in the 15-mer in the example above).  If MaxKmerReads
+// is set, window subsequences shared by more than MaxKmerReads reads
+// are also left out, and listed in the blacklist_k.txt file in the
+// log directory.  If MaxCandidates is set, the screen stops with an
+// error when a window produces more than MaxCandidates candidate
+// matches.
 //
 // The results are saved in files named bmatch*.txt.sz, where * is the
 // window number.
 //
+// If IndexSide is "targets", the roles are swapped: the subsequences
+// of the targets are indexed in memory, and the window subsequences
+// of the reads are streamed against the index.  This uses less memory
+// when the targets have fewer subsequences than the reads, and gives
+// the same candidate matches as the exact sets.
+//
+// If the first and last window of a batch are given following the
+// configuration file, only the windows first, ..., last-1 are
+// screened, so that only their Bloom filters are held in memory.
+//
 // The format of the bmatch files is:
 //
 // (window sequence) (left tail) (right tail) (gene id) (position)
@@ -33,8 +61,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"path"
@@ -42,21 +72,21 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/chmduquesne/rollinghash"
 	"github.com/chmduquesne/rollinghash/buzhash32"
-	"github.com/golang-collections/go-datastructures/bitarray"
+	"github.com/chmduquesne/rollinghash/buzhash64"
 	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/internal/bloom"
 	"github.com/kshedden/muscato/utils"
 )
 
-const (
-	// Number of goroutines, around 5-10x the typical number of
-	// cores seems to work well.
-	concurrency int = 200
-)
-
 var (
+	// Number of goroutines used to process target sequences
+	concurrency int
+
 	// A log
 	logger *log.Logger
 
@@ -66,30 +96,71 @@ var (
 	// All working files are stored here
 	tmpdir string
 
-	// Bitarrays that back the Bloom filters
-	smp []bitarray.BitArray
+	// The windows being screened, which are all of config.Windows
+	// unless only the batch starting at first is screened.  The Bloom
+	// filters, sets and channels below are indexed by position in
+	// windows.
+	windows []int
+	first   int
+
+	// The Bloom filters, one per window
+	smp []*bloom.Filter
+
+	// The sets of window subsequences, one per window, used in place
+	// of the Bloom filters when ScreenMethod is "exact".
+	exact []map[string]struct{}
 
-	// Tables to produce independent running hashes
-	tables [][256]uint32
+	// If true, 64-bit rolling hashes are used for the Bloom
+	// filters (see BloomHash).
+	hash64 bool
+
+	// Tables to produce independent running hashes, with 32 or 64
+	// bit sums.
+	tables   [][256]uint32
+	tables64 [][256]uint64
 
 	// Communicate results back to driver
 	hitchan []chan rec
 
+	warnings = utils.NewWarnings("muscato_screen")
+
 	// Semaphore for limiting goroutines
 	limit chan bool
 
 	// Line length for output
 	bufsize int
+
+	// Set to one more than the index of a window that produced
+	// more than MaxCandidates candidate matches.
+	overflow int32
 )
 
 // genTables generates base hash functions for a collection of rolling hashes.
 func genTables() {
+	rng := rand.New(rand.NewSource(config.RandomSeed))
+	if hash64 {
+		tables64 = make([][256]uint64, config.NumHash)
+		for j := 0; j < config.NumHash; j++ {
+			mp := make(map[uint64]bool)
+			for i := 0; i < 256; i++ {
+				for {
+					x := rng.Uint64()
+					if !mp[x] {
+						tables64[j][i] = x
+						mp[x] = true
+						break
+					}
+				}
+			}
+		}
+		return
+	}
 	tables = make([][256]uint32, config.NumHash)
 	for j := 0; j < config.NumHash; j++ {
 		mp := make(map[uint32]bool)
 		for i := 0; i < 256; i++ {
 			for {
-				x := uint32(rand.Int63())
+				x := uint32(rng.Int63())
 				if !mp[x] {
 					tables[j][i] = x
 					mp[x] = true
@@ -100,109 +171,228 @@ func genTables() {
 	}
 }
 
+// hash32 is a rolling hash with a 32-bit sum, which is used as a
+// 64-bit sum.
+type hash32 struct {
+	rollinghash.Hash32
+}
+
+func (h hash32) Sum64() uint64 {
+	return uint64(h.Sum32())
+}
+
 // A pool containing arrays of hashes for use in the Bloom filter.
 var hashPool = sync.Pool{
 
 	New: func() interface{} {
-		hashes := make([]rollinghash.Hash32, config.NumHash)
+		hashes := make([]rollinghash.Hash64, config.NumHash)
 		for j := range hashes {
-			hashes[j] = buzhash32.NewFromUint32Array(tables[j])
+			if hash64 {
+				hashes[j] = buzhash64.NewFromUint64Array(tables64[j])
+			} else {
+				hashes[j] = hash32{buzhash32.NewFromUint32Array(tables[j])}
+			}
 		}
 		return &hashes
 	},
 }
 
-// buildBloom constructs bloom filters for each window
+// buildBloom constructs bloom filters (or exact sets) for each
+// window, from the window subsequences in the win_k_sorted files
+// written by muscato_window_reads (and sorted by the driver).  These
+// only contain the windows that lie within the reads and pass the
+// entropy check, so the checks are not repeated here.  The windows
+// are built concurrently, and if there are fewer windows than
+// ScreenConcurrency, the remaining goroutines are shared among the
+// Bloom filters (see addWindowSharded).
 func buildBloom() error {
 
 	logger.Printf("Building Bloom sketch of read collection...")
+	start := time.Now()
 
-	fname := path.Join(tmpdir, "reads_sorted.txt.sz")
-	fid, err := os.Open(fname)
-	if err != nil {
-		return err
+	nw := concurrency / len(windows)
+	if exact == nil && nw > 1 {
+		logger.Printf("Using %d goroutines for each Bloom filter", nw)
 	}
-	defer fid.Close()
-	snr := snappy.NewReader(fid)
-	scanner := bufio.NewScanner(snr)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
-	// Workspace for sequence diversity checker
-	wk := make([]int, 25)
-
-	// Build worker goroutines to handle each window.
 	var wg sync.WaitGroup
-	wc := make([]chan []byte, len(config.Windows))
-	for k := 0; k < len(config.Windows); k++ {
-
-		wc[k] = make(chan []byte, 100)
+	var nadd int64
+	errc := make(chan error, len(windows))
+	for k := range windows {
 		wg.Add(1)
-
-		// A worker for window k
 		go func(k int) {
+			defer wg.Done()
+			n, err := addWindow(k, nw)
+			if err != nil {
+				errc <- err
+			}
+			atomic.AddInt64(&nadd, int64(n))
+		}(k)
+	}
+	wg.Wait()
 
-			defer func() { wg.Done() }()
+	select {
+	case err := <-errc:
+		return err
+	default:
+	}
 
-			hashes := *hashPool.Get().(*[]rollinghash.Hash32)
-			defer func() { hashPool.Put(&hashes) }()
+	for k, mp := range exact {
+		logger.Printf("Window %d contains %d distinct sequences", first+k, len(mp))
+	}
 
-			for seq := range wc[k] {
-				for _, ha := range hashes {
-					ha.Reset()
-					if _, err := ha.Write(seq); err != nil {
-						panic(err)
-					}
-					x := uint64(ha.Sum32()) % config.BloomSize
-					if err := smp[k].SetBit(x); err != nil {
-						panic(err)
-					}
-				}
+	el := time.Since(start).Seconds()
+	logger.Printf("Done constructing Bloom filters, added %d sequences in %.1f seconds (%.2fM per second)",
+		nadd, el, float64(nadd)/1e6/math.Max(el, 1e-3))
+	return nil
+}
+
+// addWindow adds the window subsequences of the reads for the k'th
+// window being screened to its Bloom filter or exact set, and returns
+// the number of subsequences added.  If nw > 1, nw goroutines are
+// used to build the Bloom filter.
+func addWindow(k, nw int) (int, error) {
+
+	if exact == nil && nw > 1 {
+		return addWindowSharded(k, nw)
+	}
+
+	var hashes []rollinghash.Hash64
+	var iw []uint64
+	if exact == nil {
+		hashes = *hashPool.Get().(*[]rollinghash.Hash64)
+		defer func() { hashPool.Put(&hashes) }()
+		iw = make([]uint64, len(hashes))
+	}
+
+	var n int
+	err := scanWindow(k, func(seq []byte) error {
+		n++
+		if exact != nil {
+			exact[k][string(seq)] = struct{}{}
+			return nil
+		}
+		for i, ha := range hashes {
+			ha.Reset()
+			if _, err := ha.Write(seq); err != nil {
+				return err
 			}
-		}(k)
+			iw[i] = ha.Sum64()
+		}
+		smp[k].Add(iw)
+		return nil
+	})
+
+	return n, err
+}
+
+// scanWindow calls f once for each distinct window subsequence of the
+// reads for the k'th window being screened.  If MaxKmerReads is set,
+// subsequences shared by more than MaxKmerReads reads are left out,
+// and written to the window's blacklist file.
+func scanWindow(k int, f func(seq []byte) error) error {
+
+	fname := path.Join(tmpdir, fmt.Sprintf("win_%d_sorted.txt.sz", first+k))
+	fid, err := os.Open(fname)
+	if err != nil {
+		return err
 	}
+	defer fid.Close()
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
-	var j int
-	for ; scanner.Scan(); j++ {
+	lay, err := utils.ReadLayout(fname, utils.WindowColumns)
+	if err != nil {
+		return err
+	}
 
-		if j%1000000 == 0 {
-			logger.Printf("%d\n", j)
+	var ccol int
+	var black *bufio.Writer
+	if config.MaxKmerReads > 0 {
+		if ccol, err = lay.Column("count"); err != nil {
+			return err
+		}
+		ccol-- // Column counts from 1
+		bname := path.Join(config.LogDir, fmt.Sprintf("blacklist_%d.txt", first+k))
+		bid, err := os.Create(bname)
+		if err != nil {
+			return err
+		}
+		defer bid.Close()
+		black = bufio.NewWriter(bid)
+		defer black.Flush()
+	}
+
+	// The lines are sorted by window subsequence, so each
+	// subsequence is added once, after the number of reads sharing
+	// it has been summed over its run of lines.
+	var cur []byte
+	var nreads, nskip, nskipReads int
+	add := func() error {
+		if cur == nil {
+			return nil
 		}
+		if black != nil && nreads > config.MaxKmerReads {
+			nskip++
+			nskipReads += nreads
+			_, err := fmt.Fprintf(black, "%s\t%d\n", cur, nreads)
+			return err
+		}
+		return f(cur)
+	}
 
-		line := scanner.Bytes()
-		seq := bytes.Fields(line)[0]
+	var j int
+	for ; scanner.Scan(); j++ {
 
-		for k := 0; k < len(config.Windows); k++ {
-			q1 := config.Windows[k]
-			q2 := q1 + config.WindowWidth
-			if q2 > len(seq) {
-				continue
+		line := scanner.Bytes()
+		if j == 0 {
+			if err := lay.Schema("sortWindows").Check(line); err != nil {
+				return err
 			}
-			seqw := seq[q1:q2]
+		}
+		seq := line
+		if i := bytes.IndexByte(line, '\t'); i >= 0 {
+			seq = line[0:i]
+		}
 
-			// Check entropy
-			if utils.CountDinuc(seqw, wk) < config.MinDinuc {
-				continue
+		if cur == nil || !bytes.Equal(seq, cur) {
+			if err := add(); err != nil {
+				return err
 			}
+			cur = append(cur[0:0], seq...)
+			nreads = 0
+		}
 
-			seqz := make([]byte, len(seqw))
-			copy(seqz, seqw)
-			wc[k] <- seqz
+		if black != nil {
+			toks := bytes.Split(line, []byte("\t"))
+			if ccol >= len(toks) {
+				return fmt.Errorf("%s line %d: missing count column", fname, j+1)
+			}
+			n, err := strconv.Atoi(string(toks[ccol]))
+			if err != nil {
+				return err
+			}
+			nreads += n
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		msg := fmt.Sprintf("Problem reading reads_sorted.txt.sz on line %d\n", j)
+		msg := fmt.Sprintf("Problem reading %s on line %d\n", fname, j)
 		os.Stderr.WriteString(msg)
 		return err
 	}
 
-	for k := 0; k < len(config.Windows); k++ {
-		close(wc[k])
+	if err := add(); err != nil {
+		return err
 	}
 
-	wg.Wait()
+	if nskip > 0 {
+		logger.Printf("Window %d: skipped %d subsequences shared by more than %d reads (%d reads in total)",
+			first+k, nskip, config.MaxKmerReads, nskipReads)
+		warnings.Add("kmer_blacklist", utils.SeverityInfo,
+			"Window %d: %d subsequences shared by more than MaxKmerReads reads were not screened", first+k, nskip)
+	}
 
-	logger.Printf("Done constructing Bloom filters")
 	return nil
 }
 
@@ -214,50 +404,63 @@ type rec struct {
 	pos   uint32
 }
 
+// appendTo appends the candidate match to buf as a line of a bmatch
+// file (see utils.CandidateColumns).
+func (r *rec) appendTo(buf []byte) []byte {
+	buf = append(buf, r.mseq...)
+	buf = append(buf, '\t')
+	buf = append(buf, r.left...)
+	buf = append(buf, '\t')
+	buf = append(buf, r.right...)
+	buf = append(buf, '\t')
+	buf = utils.AppendPadded(buf, int64(r.tnum), 11)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(r.pos), 10)
+	return append(buf, '\n')
+}
+
 // checkWin returns the indices of the Bloom filters that match the
 // current state of the hashes.  iw is workspace and hashes contains
-// the hashes that define the Bloom filters.
-func checkWin(ix []int, iw []uint64, hashes []rollinghash.Hash32) ([]int, error) {
+// the hashes that define the Bloom filters.  If exact sets are used
+// instead of Bloom filters, the current window subsequence win is
+// looked up directly.
+func checkWin(ix []int, iw []uint64, hashes []rollinghash.Hash64, win []byte) []int {
+
+	if exact != nil {
+		ix = ix[0:0]
+		for k, mp := range exact {
+			if _, ok := mp[string(win)]; ok {
+				ix = append(ix, k)
+			}
+		}
+		return ix
+	}
 
 	// Get the hash states
 	for j, ha := range hashes {
-		iw[j] = uint64(ha.Sum32()) % config.BloomSize
+		iw[j] = ha.Sum64()
 	}
 
 	ix = ix[0:0]
 
 	// Loop over Bloom filters
-	for k, ba := range smp {
-
-		// Determine if the Bloom filter matches
-		g := true
-		for j := range hashes {
-			f, err := ba.GetBit(iw[j])
-			if err != nil {
-				return nil, err
-			}
-			if !f {
-				// This hash does not match, no need to check the
-				// remaining hashes
-				g = false
-				break
-			}
-		}
-		if g {
-			// All hashes match
+	for k, bf := range smp {
+		if bf.Test(iw) {
 			ix = append(ix, k)
 		}
 	}
 
-	return ix, nil
+	return ix
 }
 
-// process one target sequence, runs concurrently with main loop.
-func processSeq(seq []byte, genenum int, errc chan error) {
+// process one target sequence, runs concurrently with main loop.  If
+// the sequence is a segment of a longer target, offset is the
+// position of the segment within the target.
+func processSeq(seq []byte, genenum, offset int, errc chan error) {
 
 	defer func() { <-limit }()
 
-	hashes := *hashPool.Get().(*[]rollinghash.Hash32)
+	hashes := *hashPool.Get().(*[]rollinghash.Hash64)
 	for j := range hashes {
 		hashes[j].Reset()
 	}
@@ -278,104 +481,135 @@ func processSeq(seq []byte, genenum int, errc chan error) {
 	}
 
 	// Will contain the indices of the matching windows
-	ix := make([]int, len(smp))
+	ix := make([]int, len(windows))
 
 	// Workspace
 	iw := make([]uint64, config.NumHash)
 
 	// Check if the initial window is a match
-	var err error
-	ix, err = checkWin(ix, iw, hashes)
-	if err != nil {
-		errc <- err
-		return
+	ix = checkWin(ix, iw, hashes, seq[0:hlen])
+	for _, i := range ix {
+		if r, ok := hitRec(seq, i, 0, genenum, offset); ok {
+			hitchan[i] <- r
+		}
 	}
 
-	for _, i := range ix {
+	// Check the rest of the windows
+	for j := hlen; j < len(seq); j++ {
+
+		if exact == nil {
+			for _, ha := range hashes {
+				ha.Roll(seq[j])
+			}
+		}
+		ix = checkWin(ix, iw, hashes, seq[j-hlen+1:j+1])
+
+		// Process a match
+		for _, i := range ix {
+			if r, ok := hitRec(seq, i, j-hlen+1, genenum, offset); ok {
+				hitchan[i] <- r
+			}
+		}
+	}
+}
 
-		q1 := config.Windows[i]
+// hitRec returns the candidate match for the i'th window being
+// screened, when the window subsequence of a read matches the target
+// sequence seq at position jx.  The second return value is false if
+// the read would not fit in the target.  If WindowAnchor is "end",
+// the left tail is long enough for the longest read, since the reads
+// of each window can have different lengths.
+func hitRec(seq []byte, i, jx, genenum, offset int) (rec, bool) {
+
+	q1 := windows[i]
+	q2 := q1 + config.WindowWidth
+
+	// Matching sequence is jx:jy
+	jy := jx + config.WindowWidth
+
+	if config.WindowAnchor == "end" {
+		// The window is q1 bases from the end of the read, and
+		// the part of the read to its left can be up to
+		// MaxReadLength - q2 bases.  The left tail is cut back
+		// to the length of each read by muscato_confirm.
+		jw := jx - (config.MaxReadLength - q2)
+		if jw < 0 {
+			jw = 0
+		}
+		jz := jy + q1
+		if jz > len(seq) {
+			// May not be long enough to fit, but we don't know
+			// until we merge.
+			jz = len(seq)
+		}
+		return rec{
+			mseq:  string(seq[jx:jy]),
+			left:  string(seq[jw:jx]),
+			right: string(seq[jy:jz]),
+			tnum:  genenum,
+			pos:   uint32(offset + jx),
+		}, true
+	}
+
+	if jx == 0 {
 		if q1 != 0 {
 			// The only way the full read can match at the
 			// beginning of the target is if the first
 			// window starts at the beginning of the read.
-			continue
+			return rec{}, false
 		}
-		q2 := q1 + config.WindowWidth
-
 		jz := 100 - q2
 		if jz > len(seq) {
 			jz = len(seq)
 		}
-		hitchan[i] <- rec{
-			mseq:  string(seq[0:hlen]),
+		return rec{
+			mseq:  string(seq[0:jy]),
 			left:  "",
-			right: string(seq[hlen:jz]),
+			right: string(seq[jy:jz]),
 			tnum:  genenum,
-			pos:   0,
-		}
+			pos:   uint32(offset),
+		}, true
 	}
 
-	// Check the rest of the windows
-	for j := hlen; j < len(seq); j++ {
-
-		for _, ha := range hashes {
-			ha.Roll(seq[j])
-		}
-		ix, err = checkWin(ix, iw, hashes)
-		if err != nil {
-			errc <- err
-			return
-		}
-
-		// Process a match
-		for _, i := range ix {
-
-			q1 := config.Windows[i]
-			q2 := q1 + config.WindowWidth
-			if j < q2-1 {
-				// The read would not fit
-				continue
-			}
-
-			// Matching sequence is jx:jy
-			jx := j - hlen + 1
-			jy := j + 1
-
-			// Left tail is jw:jx
-			jw := jx - q1
-
-			// Right tail is jy:jz
-			jz := jy + config.MaxReadLength - q2
-			if jz > len(seq) {
-				// May not be long enough to fit, but
-				// we don't know until we merge.
-				jz = len(seq)
-			}
+	// Left tail is jw:jx
+	jw := jx - q1
+	if jw < 0 {
+		// The read would not fit
+		return rec{}, false
+	}
 
-			if jw >= 0 {
-				hitchan[i] <- rec{
-					mseq:  string(seq[jx:jy]),
-					left:  string(seq[jw:jx]),
-					right: string(seq[jy:jz]),
-					tnum:  genenum,
-					pos:   uint32(j - hlen + 1),
-				}
-			}
-		}
+	// Right tail is jy:jz
+	jz := jy + config.MaxReadLength - q2
+	if jz > len(seq) {
+		// May not be long enough to fit, but we don't know
+		// until we merge.
+		jz = len(seq)
 	}
+
+	return rec{
+		mseq:  string(seq[jx:jy]),
+		left:  string(seq[jw:jx]),
+		right: string(seq[jy:jz]),
+		tnum:  genenum,
+		pos:   uint32(offset + jx),
+	}, true
 }
 
 // harvest retrieves the results and writes them to disk
 func harvest(wg *sync.WaitGroup, ii int) {
 
-	f := fmt.Sprintf("bmatch_%d.txt.sz", ii)
+	f := fmt.Sprintf("bmatch_%d.txt.sz", first+ii)
 	outname := path.Join(tmpdir, f)
 	out, err := os.Create(outname)
 	if err != nil {
 		logger.Print(err)
 		panic(err)
 	}
-	wtr := snappy.NewBufferedWriter(out)
+	wtr := utils.NewSnappyWriter(out, config.WriterBufferSize)
+	if err := utils.WriteLayout(outname, utils.CandidateColumns); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
 
 	defer func() {
 		wtr.Close()
@@ -383,60 +617,66 @@ func harvest(wg *sync.WaitGroup, ii int) {
 		wg.Done()
 	}()
 
-	tab := []byte("\t")
-	newline := []byte("\n")
-
+	var buf []byte
+	var n int
 	for r := range hitchan[ii] {
 
-		wtr.Write([]byte(r.mseq))
-		wtr.Write(tab)
-		wtr.Write([]byte(r.left))
-		wtr.Write(tab)
-		wtr.Write([]byte(r.right))
-		wtr.Write(tab)
-		wtr.Write([]byte(fmt.Sprintf("%011d\t", r.tnum)))
-		wtr.Write([]byte(strconv.Itoa(int(r.pos))))
-		wtr.Write(newline)
+		// Once the window has too many candidates, the remaining
+		// ones are discarded, while search stops.
+		if config.MaxCandidates > 0 && n >= config.MaxCandidates {
+			atomic.CompareAndSwapInt32(&overflow, 0, int32(ii+1))
+			continue
+		}
+		n++
+
+		buf = r.appendTo(buf[0:0])
+		wtr.Write(buf)
 	}
 
-	logger.Printf("Exiting harvest %d", ii)
+	logger.Printf("Exiting harvest %d", first+ii)
 }
 
-// search loops through the target sequences, checking each window
-// within each target gene for possible matches to the read
-// collection.
-func search() error {
+// startHarvest creates the channels that receive the candidate
+// matches for each window, and starts the goroutines that write them
+// to disk, which call wg.Done when their channel is closed.
+func startHarvest(wg *sync.WaitGroup) {
 
-	logger.Printf("Checking target sequences for matches...")
+	for k := 0; k < len(windows); k++ {
+		// Channel tends to back up because producers generate
+		// results faster than we can write to disk in some
+		// cases; so make it pretty big.
+		hitchan = append(hitchan, make(chan rec, 20000))
+	}
 
-	fid, err := os.Open(config.GeneFileName)
+	for k := 0; k < len(windows); k++ {
+		wg.Add(1)
+		go harvest(wg, k)
+	}
+}
+
+// scanTargets calls f for each line of the target file, with the
+// sequence, the target number, and the offset of the sequence within
+// the target.  Long targets are split into overlapping segments by
+// muscato_prep_targets.  Each segment is on its own line, followed by
+// its offset within the target and the target number.  Other lines
+// contain only a sequence, and are numbered consecutively following
+// the previous target.
+func scanTargets(f func(seq []byte, gnum, offset int) error) error {
+
+	// The target file may be split into volumes, which are read in
+	// order as if they were a single file.
+	snr, err := utils.OpenTargets(config.GeneFileName)
 	if err != nil {
 		return err
 	}
-	defer fid.Close()
-	snr := snappy.NewReader(fid)
+	defer snr.Close()
 
 	// Target file contains some very long lines
 	scanner := bufio.NewScanner(snr)
 	sbuf := make([]byte, 1024*1024)
 	scanner.Buffer(sbuf, 1024*1024)
 
-	for k := 0; k < len(config.Windows); k++ {
-		// Channel tends to back up because producers generate
-		// results faster than we can write to disk in some
-		// cases; so make it pretty big.
-		hitchan = append(hitchan, make(chan rec, 20000))
-	}
-	limit = make(chan bool, concurrency)
-	errc := make(chan error, concurrency)
-
-	var wg sync.WaitGroup
-	for k := 0; k < len(config.Windows); k++ {
-		wg.Add(1)
-		go harvest(&wg, k)
-	}
-
-	var i int
+	var i, genenum int
 	for ; scanner.Scan(); i++ {
 
 		if i%1000000 == 0 {
@@ -448,8 +688,25 @@ func search() error {
 		toks := strings.Split(line, "\t")
 		seq := toks[0] // The sequence
 
-		limit <- true
-		go processSeq([]byte(seq), i, errc)
+		var offset, gnum int
+		if len(toks) == 3 {
+			offset, err = strconv.Atoi(toks[1])
+			if err != nil {
+				return err
+			}
+			gnum, err = strconv.Atoi(toks[2])
+			if err != nil {
+				return err
+			}
+			genenum = gnum + 1
+		} else {
+			gnum = genenum
+			genenum++
+		}
+
+		if err := f([]byte(seq), gnum, offset); err != nil {
+			return err
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -459,6 +716,52 @@ func search() error {
 		return err
 	}
 
+	if i == 0 {
+		logger.Printf("%s has no sequences", config.GeneFileName)
+		warnings.Add("no_targets", utils.SeverityWarning,
+			"The target file %s has no sequences, so no reads can be matched", config.GeneFileName)
+	}
+
+	return nil
+}
+
+// search loops through the target sequences, checking each window
+// within each target gene for possible matches to the read
+// collection.
+func search() error {
+
+	logger.Printf("Checking target sequences for matches...")
+
+	var wg sync.WaitGroup
+	startHarvest(&wg)
+	limit = make(chan bool, concurrency)
+	errc := make(chan error, concurrency)
+
+	var i int
+	err := scanTargets(func(seq []byte, gnum, offset int) error {
+
+		if i%100000 == 0 {
+			for k, hc := range hitchan {
+				if len(hc) > cap(hc)/2 {
+					warnings.Add("hitchan_backlog", utils.SeverityInfo,
+						"Output for window %d was more than half full, writing bmatch files is a bottleneck", first+k)
+				}
+			}
+		}
+		i++
+
+		if err := checkOverflow(); err != nil {
+			return err
+		}
+
+		limit <- true
+		go processSeq(seq, gnum, offset, errc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	for k := 0; k < concurrency; k++ {
 		limit <- true
 	}
@@ -470,18 +773,40 @@ func search() error {
 	default:
 	}
 
-	for k := 0; k < len(config.Windows); k++ {
+	for k := 0; k < len(windows); k++ {
 		close(hitchan[k])
 	}
 	wg.Wait()
+	if err := checkOverflow(); err != nil {
+		return err
+	}
 	logger.Printf("Done checking target sequences for matches")
 
 	return nil
 }
 
+// checkOverflow returns an error if a window has produced more than
+// MaxCandidates candidate matches.
+func checkOverflow() error {
+	k := atomic.LoadInt32(&overflow)
+	if k == 0 {
+		return nil
+	}
+	err := fmt.Errorf("window %d produced more than MaxCandidates=%d candidate matches, consider setting MaxKmerReads or raising MinDinuc",
+		first+int(k)-1, config.MaxCandidates)
+	logger.Print(err)
+	return err
+}
+
+// setupLogger opens the log, which is appended to by all batches but
+// the first.
 func setupLogger() error {
 	logname := path.Join(config.LogDir, "muscato_screen.log")
-	logfid, err := os.Create(logname)
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if first > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	logfid, err := os.OpenFile(logname, flags, 0666)
 	if err != nil {
 		return err
 	}
@@ -489,44 +814,82 @@ func setupLogger() error {
 	return nil
 }
 
+// estimateFullness determines the proportion of set bits in each
+// Bloom filter.  The fill rates are logged, and saved to
+// bloominfo.json in the log directory.  Except for the first batch,
+// the fill rates for the windows of the earlier batches are read from
+// the file and kept.
 func estimateFullness() error {
 
-	n := 1000
+	var bloominfo struct {
+		FillRates []float64
+	}
+
+	fname := path.Join(config.LogDir, "bloominfo.json")
+	if first > 0 {
+		if fid, err := os.Open(fname); err == nil {
+			json.NewDecoder(fid).Decode(&bloominfo)
+			fid.Close()
+		}
+	}
+	if len(bloominfo.FillRates) != len(config.Windows) {
+		bloominfo.FillRates = make([]float64, len(config.Windows))
+	}
+
 	logger.Printf("Bloom filter fill rates:\n")
 
-	for j, ba := range smp {
-		c := 0
-		for k := 0; k < n; k++ {
-			i := uint64(rand.Int63()) % config.BloomSize
-			f, err := ba.GetBit(i)
-			if err != nil {
-				return err
-			}
-			if f {
-				c++
+	for j, bf := range smp {
+		r := bf.FillRate()
+		logger.Printf("%3d %.3f\n", first+j, r)
+		bloominfo.FillRates[first+j] = r
+		if config.AutoBloom {
+			// A filter sized for BloomFPR is about half full, so
+			// compare its estimated false positive rate instead.
+			if fpr := math.Pow(r, float64(config.NumHash)); fpr > 2*config.BloomFPR {
+				warnings.Add("bloom_fill", utils.SeverityWarning,
+					"Bloom filter for window %d has an estimated false positive rate of %.3f, above BloomFPR", first+j, fpr)
 			}
+		} else if r > 0.5 {
+			warnings.Add("bloom_fill", utils.SeverityWarning,
+				"Bloom filter for window %d is %.0f%% full, consider increasing BloomSize", first+j, 100*r)
 		}
-		logger.Printf("%3d %.3f\n", j, float64(c)/float64(n))
 	}
 
-	return nil
+	fid, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	return enc.Encode(bloominfo)
 }
 
 func main() {
 
-	if len(os.Args) != 2 && len(os.Args) != 3 {
+	defer utils.ExitOnPanic("muscato_screen")
+
+	if len(os.Args) != 2 && len(os.Args) != 4 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments", os.Args[0]))
 		os.Exit(1)
 	}
 
 	config = utils.ReadConfig(os.Args[1])
 
-	if config.TempDir == "" {
-		tmpdir = os.Args[2]
-	} else {
-		tmpdir = config.TempDir
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
 	}
 
+	var last int
+	var err error
+	first, last, err = config.WindowRange(os.Args[2:])
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%s: %v\n", os.Args[0], err))
+		os.Exit(1)
+	}
+	windows = config.Windows[first:last]
+
 	if config.CPUProfile {
 		f, err := os.Create(path.Join(config.LogDir, "muscato_screen_cpu.prof"))
 		if err != nil {
@@ -539,16 +902,54 @@ func main() {
 
 	bufsize = config.MaxReadLength + 50
 
-	err := setupLogger()
+	concurrency = config.ScreenConcurrency
+	if concurrency == 0 {
+		concurrency = utils.DefaultScreenConcurrency()
+	}
+
+	err = setupLogger()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(windows) < len(config.Windows) {
+		logger.Printf("Screening windows %d to %d", first, last-1)
+		warnings = utils.NewWarnings(fmt.Sprintf("muscato_screen_%d", first))
+	}
+
+	if config.IndexSide == "targets" {
+		logger.Printf("Indexing the targets, and streaming the read windows")
+		if err := searchReads(); err != nil {
+			log.Fatal(err)
+		}
+		if err := warnings.Save(config.LogDir); err != nil {
+			logger.Print(err)
+		}
+		return
+	}
+
+	switch config.BloomHash {
+	case "buzhash64":
+		hash64 = true
+	case "auto", "":
+		hash64 = config.BloomSize > 1<<32
+	}
+	if hash64 {
+		logger.Printf("Using 64-bit rolling hashes for the Bloom filters")
+	}
 
 	genTables()
 
-	smp = make([]bitarray.BitArray, len(config.Windows))
-	for k := range smp {
-		smp[k] = bitarray.NewBitArray(config.BloomSize)
+	if config.ScreenMethod == "exact" {
+		logger.Printf("Using exact sets of window sequences")
+		exact = make([]map[string]struct{}, len(windows))
+		for k := range exact {
+			exact[k] = make(map[string]struct{})
+		}
+	} else {
+		smp = make([]*bloom.Filter, len(windows))
+		for k := range smp {
+			smp[k] = bloom.New(config.BloomSize)
+		}
 	}
 
 	err = buildBloom()
@@ -556,13 +957,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	err = estimateFullness()
-	if err != nil {
-		log.Fatal(err)
+	if exact == nil {
+		err = estimateFullness()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	err = search()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
+	}
 }
@@ -0,0 +1,132 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/chmduquesne/rollinghash"
+)
+
+// The number of window subsequences passed at once to the goroutines
+// that hash them, and the number of hashed values passed at once to
+// the goroutine that owns a shard of a Bloom filter.
+const shardBatch = 4096
+
+// seqBatch holds a batch of window subsequences, concatenated in
+// data, with the end of each subsequence in ends.
+type seqBatch struct {
+	data []byte
+	ends []int
+}
+
+// addWindowSharded adds the window subsequences of the reads for the
+// k'th window being screened to its Bloom filter using nw hashing
+// goroutines, and returns the number of subsequences added.  The
+// blocks of the filter are split into nw shards (see
+// bloom.Filter.Shard), each of which is updated by its own goroutine,
+// so that the goroutines do not contend for the same cache lines.
+func addWindowSharded(k, nw int) (int, error) {
+
+	bf := smp[k]
+	nh := config.NumHash
+
+	// The goroutines that own the shards.
+	shardc := make([]chan []uint64, nw)
+	var swg sync.WaitGroup
+	for s := range shardc {
+		shardc[s] = make(chan []uint64, 4)
+		swg.Add(1)
+		go func(c chan []uint64) {
+			defer swg.Done()
+			for hv := range c {
+				for j := 0; j < len(hv); j += nh {
+					bf.Add(hv[j : j+nh])
+				}
+			}
+		}(shardc[s])
+	}
+
+	// The goroutines that hash the subsequences.  After an error,
+	// the remaining batches are read but not hashed.
+	seqc := make(chan *seqBatch, nw)
+	errc := make(chan error, nw)
+	var hwg sync.WaitGroup
+	for i := 0; i < nw; i++ {
+		hwg.Add(1)
+		go func() {
+			defer hwg.Done()
+			hashes := *hashPool.Get().(*[]rollinghash.Hash64)
+			defer func() { hashPool.Put(&hashes) }()
+			iw := make([]uint64, nh)
+			bufs := make([][]uint64, nw)
+			var failed bool
+			for b := range seqc {
+				if failed {
+					continue
+				}
+				var pos int
+				for _, end := range b.ends {
+					for j, ha := range hashes {
+						ha.Reset()
+						if _, err := ha.Write(b.data[pos:end]); err != nil {
+							errc <- err
+							failed = true
+							break
+						}
+						iw[j] = ha.Sum64()
+					}
+					if failed {
+						break
+					}
+					pos = end
+					s := bf.Shard(iw, nw)
+					bufs[s] = append(bufs[s], iw...)
+					if len(bufs[s]) >= shardBatch*nh {
+						shardc[s] <- bufs[s]
+						bufs[s] = nil
+					}
+				}
+			}
+			for s, hv := range bufs {
+				if len(hv) > 0 {
+					shardc[s] <- hv
+				}
+			}
+		}()
+	}
+
+	// Read the subsequences in batches.
+	var n int
+	b := new(seqBatch)
+	err := scanWindow(k, func(seq []byte) error {
+		n++
+		b.data = append(b.data, seq...)
+		b.ends = append(b.ends, len(b.data))
+		if len(b.ends) == shardBatch {
+			seqc <- b
+			b = new(seqBatch)
+		}
+		return nil
+	})
+	if len(b.ends) > 0 {
+		seqc <- b
+	}
+	close(seqc)
+	hwg.Wait()
+	for _, c := range shardc {
+		close(c)
+	}
+	swg.Wait()
+
+	if err != nil {
+		return n, err
+	}
+	select {
+	case err := <-errc:
+		return n, err
+	default:
+	}
+
+	return n, nil
+}
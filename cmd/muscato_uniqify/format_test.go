@@ -0,0 +1,44 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAppendRow(t *testing.T) {
+
+	seq := []byte("ACGTTGCAACGTTGCAACGTTGCA")
+	if got, want := string(appendRow(nil, seq, 3, "r1;r2;r3")), fmt.Sprintf("%s\t3\tr1;r2;r3\n", seq); got != want {
+		t.Errorf("appendRow gave %q, expected %q", got, want)
+	}
+	if got, want := string(appendRow(nil, seq, 1, "r1", "L001:1")), fmt.Sprintf("%s\t1\tr1\tL001:1\n", seq); got != want {
+		t.Errorf("appendRow gave %q, expected %q", got, want)
+	}
+}
+
+func BenchmarkAppendRow(b *testing.B) {
+
+	seq := []byte("ACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCAACGTTGCA")
+	names := "SRR0000001.1;SRR0000001.7;SRR0000001.12"
+
+	b.Run("appendRow", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = appendRow(buf[0:0], seq, 3, names)
+		}
+	})
+
+	b.Run("Sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = append(buf[0:0], seq...)
+			buf = append(buf, fmt.Sprintf("\t%d\t", 3)...)
+			buf = append(buf, names...)
+			buf = append(buf, '\n')
+		}
+	})
+}
@@ -1,6 +1,34 @@
 // Copyright 2017, Kerby Shedden and the Muscato contributors.
 
 // muscato_uniqify is a simple stream processor...
+//
+// The names of all reads with the same sequence are joined into a
+// semicolon-delimited list.  Lists longer than MaxNameList characters
+// are truncated after the last name that fits, and a final element of
+// the form "...+n" is added, where n is the number of names that were
+// omitted.  Names that begin with "..." or "\" are escaped by
+// prefixing them with "\", so that the final element can always be
+// distinguished from a read name.
+//
+// The complete name lists of the truncated sequences are written to
+// utils.NamesFileName in TempDir, so that muscato_readstats can report
+// every read name.
+//
+// If UMI is set, each input line also contains the UMI of the read
+// (between the sequence and the name), and the count for each
+// sequence is the number of distinct UMIs, rather than the number of
+// reads, so that reads with the same sequence and UMI are counted as
+// a single molecule.  The names of all the reads are retained.
+//
+// If ReadGroup is set, each input line also contains the read group
+// (before the name), and a fourth column is added to the output,
+// giving the number of reads with the sequence in each read group
+// (see utils.FormatReadGroups).  The number of reads in each group is
+// also saved in seqinfo.json.
+//
+// The number of distinct sequences, and a histogram of the number of
+// reads with each distinct sequence (the duplication levels), are
+// saved in seqinfo.json in the log directory.
 
 package main
 
@@ -13,6 +41,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/golang/snappy"
@@ -23,8 +52,119 @@ var (
 	logger *log.Logger
 
 	config *utils.Config
+
+	warnings = utils.NewWarnings("muscato_uniqify")
+
+	// The number of sequences whose name lists were truncated, and
+	// the total number of names omitted from them.
+	ntrunc   int
+	nomitted int
+
+	// The number of reads that were counted as duplicates of
+	// another read with the same sequence and UMI.
+	ndup int
+
+	// The histogram of the number of reads per distinct sequence.
+	dups []dupBin
+
+	// The number of reads in each read group, if ReadGroup is set.
+	readGroups map[string]int
 )
 
+// dupLimits are the largest numbers of reads per sequence in each bin
+// of the duplication histogram.  The last bin has no upper limit.
+var dupLimits = []int{1, 2, 3, 4, 10, 100, 1000, 10000}
+
+// dupBin is one bin of the duplication histogram, containing the
+// sequences with between MinReads and MaxReads reads.  MaxReads is
+// zero for the last bin.
+type dupBin struct {
+	MinReads int
+	MaxReads int
+	Seqs     int
+	Reads    int
+}
+
+func newDupBins() []dupBin {
+	var bins []dupBin
+	lo := 1
+	for _, hi := range dupLimits {
+		bins = append(bins, dupBin{MinReads: lo, MaxReads: hi})
+		lo = hi + 1
+	}
+	return append(bins, dupBin{MinReads: lo})
+}
+
+// addDup records a sequence with n reads in the duplication
+// histogram.
+func addDup(n int) {
+	i := 0
+	for i < len(dupLimits) && n > dupLimits[i] {
+		i++
+	}
+	dups[i].Seqs++
+	dups[i].Reads += n
+}
+
+// escapeName escapes a read name so that it cannot be mistaken for
+// the marker of a truncated name list.
+func escapeName(name string) string {
+	if strings.HasPrefix(name, "...") || strings.HasPrefix(name, "\\") {
+		return "\\" + name
+	}
+	return name
+}
+
+// joinNames joins the read names into a list, truncating the list if
+// it is longer than maxlen characters.  The second returned value is
+// true if the list was truncated.
+func joinNames(names []string, maxlen int) (string, bool) {
+
+	var buf strings.Builder
+	for i, na := range names {
+		na = escapeName(na)
+		if i > 0 {
+			na = ";" + na
+		}
+
+		// Leave room for the truncation marker
+		rem := len(names) - i
+		mark := fmt.Sprintf(";...+%d", rem)
+		if i == 0 {
+			mark = mark[1:]
+		}
+		last := i == len(names)-1
+		if (last && buf.Len()+len(na) > maxlen) || (!last && buf.Len()+len(na)+len(mark) > maxlen) {
+			buf.WriteString(mark)
+			ntrunc++
+			nomitted += rem
+			return buf.String(), true
+		}
+		buf.WriteString(na)
+	}
+
+	return buf.String(), false
+}
+
+// writeNames writes the complete name list of a sequence to the names
+// file.
+func writeNames(w io.Writer, seq []byte, names []string) error {
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(utils.SeqHash(seq))
+	for i, na := range names {
+		if i == 0 {
+			bw.WriteString("\t")
+		} else {
+			bw.WriteString(";")
+		}
+		bw.WriteString(escapeName(na))
+	}
+	bw.WriteString("\n")
+
+	return bw.Flush()
+}
+
 func setupLog() {
 	logname := path.Join(config.LogDir, "muscato_uniqify.log")
 	fid, err := os.Create(logname)
@@ -34,8 +174,24 @@ func setupLog() {
 	logger = log.New(fid, "", log.Ltime)
 }
 
+// appendRow appends a line of the unique reads to buf: the sequence,
+// the number of reads with it, and the further fields (the read names,
+// and the read groups if ReadGroup is set), separated by tabs.
+func appendRow(buf, seq []byte, count int, fields ...string) []byte {
+	buf = append(buf, seq...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(count), 10)
+	for _, f := range fields {
+		buf = append(buf, '\t')
+		buf = append(buf, f...)
+	}
+	return append(buf, '\n')
+}
+
 func main() {
 
+	defer utils.ExitOnPanic("muscato_uniqify")
+
 	if len(os.Args) != 3 {
 		msg := fmt.Sprintf("%s: wrong number of arguments", os.Args[0])
 		os.Stderr.WriteString(msg)
@@ -43,6 +199,9 @@ func main() {
 	}
 
 	config = utils.ReadConfig(os.Args[1])
+	if config.MaxNameList == 0 {
+		config.MaxNameList = 1000
+	}
 
 	setupLog()
 
@@ -65,13 +224,22 @@ func main() {
 	wtr := snappy.NewBufferedWriter(os.Stdout)
 	defer wtr.Close()
 
+	nfid, err := os.Create(path.Join(config.TempDir, utils.NamesFileName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nfid.Close()
+	nwtr := snappy.NewBufferedWriter(nfid)
+
 	// Try to read one line to prime the pipeline.
 	if !scanner.Scan() {
-		// Can't read even one line
 		if err := scanner.Err(); err != nil {
 			log.Fatal(err)
 		}
-		log.Fatal(fmt.Errorf("%s: no input from %s", os.Args[0], os.Args[2]))
+		// There are no reads (e.g. all were too short), so the
+		// output is empty.
+		noInput(nwtr, nfid)
+		return
 	}
 
 	// Current read sequence
@@ -80,32 +248,77 @@ func main() {
 	// All names matching the current read sequence
 	var names []string
 
+	// The number of distinct UMIs for the current read sequence,
+	// and the most recent UMI.
+	var numi int
+	var umi []byte
+
+	// The number of reads in each read group for the current read
+	// sequence.
+	groups := make(map[string]int)
+
+	// The columns of the prepared reads.
+	schema := &utils.RecordSchema{File: "the prepared reads", Stage: "prepReads", Columns: []string{"seq"}}
+	if config.UMI != "" {
+		schema.Columns = append(schema.Columns, "umi")
+	}
+	if config.ReadGroup != "" {
+		schema.Columns = append(schema.Columns, "group")
+		readGroups = make(map[string]int)
+	}
+	schema.Columns = append(schema.Columns, "name")
+	ncol := len(schema.Columns)
+
+	// addName adds a read to the current sequence.  The reads with
+	// each sequence are sorted by UMI.
+	addName := func(toks [][]byte) {
+		if len(toks) < ncol {
+			log.Fatalf("prepared read has %d fields, expected %d", len(toks), ncol)
+		}
+		names = append(names, string(toks[ncol-1]))
+		if config.ReadGroup != "" {
+			groups[string(toks[ncol-2])]++
+			readGroups[string(toks[ncol-2])]++
+		}
+		if config.UMI == "" {
+			return
+		}
+		if len(names) == 1 || !bytes.Equal(toks[1], umi) {
+			numi++
+			umi = append(umi[0:0], toks[1]...)
+		}
+	}
+
 	line := scanner.Bytes()
+	schema.Require(line, logger)
 	toks := bytes.Split(line, []byte("\t"))
 
 	seq = append(seq, toks[0]...)
-	names = append(names, string(toks[1]))
+	addName(toks)
 
+	var recbuf []byte
+	dups = newDupBins()
 	printrow := func(seq []byte, names []string) {
-		na := strings.Join(names, ";")
-		if len(na) > 1000 {
-			na = na[0:996] + "..."
+		addDup(len(names))
+		count := len(names)
+		if config.UMI != "" {
+			count = numi
+			ndup += len(names) - numi
 		}
 
-		_, err := wtr.Write(seq)
-		if err != nil {
-			panic(err)
-		}
-		_, err = wtr.Write([]byte(fmt.Sprintf("\t%d\t", len(names))))
-		if err != nil {
-			panic(err)
+		na, trunc := joinNames(names, config.MaxNameList)
+		if trunc {
+			if err := writeNames(nwtr, seq, names); err != nil {
+				panic(err)
+			}
 		}
-		_, err = wtr.Write([]byte(na))
-		if err != nil {
-			panic(err)
+
+		if config.ReadGroup != "" {
+			recbuf = appendRow(recbuf[0:0], seq, count, na, utils.FormatReadGroups(groups))
+		} else {
+			recbuf = appendRow(recbuf[0:0], seq, count, na)
 		}
-		_, err = wtr.Write([]byte("\n"))
-		if err != nil {
+		if _, err := wtr.Write(recbuf); err != nil {
 			panic(err)
 		}
 	}
@@ -122,9 +335,11 @@ func main() {
 			nunq++
 			seq = seq[0:0]
 			names = names[0:0]
+			numi = 0
+			groups = make(map[string]int)
 			seq = append(seq, toks[0]...)
 		}
-		names = append(names, string(toks[1]))
+		addName(toks)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -138,17 +353,67 @@ func main() {
 	os.Stderr.WriteString(fmt.Sprintf("Found %d total sequences\n", nseq))
 	os.Stderr.WriteString(fmt.Sprintf("Found %d unique sequences\n", nunq))
 
+	if err := nwtr.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := nfid.Close(); err != nil {
+		log.Fatal(err)
+	}
+
 	writeSeqInfo(nseq, nunq)
+
+	if config.UMI != "" {
+		logger.Printf("Found %d reads with the same sequence and UMI as another read", ndup)
+	}
+	logger.Printf("Truncated the name lists of %d sequences, omitting %d names", ntrunc, nomitted)
+	warnings.AddN(ntrunc, "names_truncated", utils.SeverityInfo,
+		"Read name lists longer than MaxNameList=%d characters were truncated", config.MaxNameList)
+
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
+	}
+}
+
+// noInput finishes a run with no reads, writing an empty names file
+// and zero counts.
+func noInput(nwtr io.WriteCloser, nfid io.Closer) {
+
+	if err := nwtr.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := nfid.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	dups = newDupBins()
+	writeSeqInfo(0, 0)
+
+	logger.Printf("No reads were read from %s", os.Args[2])
+	warnings.Add("no_reads", utils.SeverityWarning,
+		"There are no reads to match, the input is empty or every read was skipped, so the results are empty")
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
+	}
 }
 
 func writeSeqInfo(nseq, nunq int) {
 
 	seqinfo := struct {
-		NumUnique int
-		NumTotal  int
+		NumUnique       int
+		NumTotal        int
+		NumTruncated    int
+		NumNamesOmitted int
+		NumDuplicates   int
+		Duplication     []dupBin
+		ReadGroups      map[string]int `json:",omitempty"`
 	}{
-		NumUnique: nunq,
-		NumTotal:  nseq,
+		NumUnique:       nunq,
+		NumTotal:        nseq,
+		NumTruncated:    ntrunc,
+		NumNamesOmitted: nomitted,
+		NumDuplicates:   ndup,
+		Duplication:     dups,
+		ReadGroups:      readGroups,
 	}
 
 	fid, err := os.Create(path.Join(config.LogDir, "seqinfo.json"))
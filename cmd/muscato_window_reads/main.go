@@ -1,24 +1,49 @@
 // Copyright 2017, Kerby Shedden and the Muscato contributors.
 
 // muscato_window_reads takes the read collection (after sorting and
-// deduplication), and generates a new file in which each row has
-// three fields separated by tab characters.  The first field is a
-// subsequence of the original full sequence, beginning and ending at
-// positions provided by command-line arguments.  The second field is
-// the full original sequence, the third field is the count of the
-// full read.  If the full read ends before the end of the selected
-// window, it is skipped.
+// deduplication), and generates a file for each window in which each
+// row has five fields separated by tab characters (see
+// utils.WindowColumns).  The first field is the subsequence of the
+// read in the window, the second and third fields are the parts of
+// the read to the left and right of the window, the fourth field is
+// the number of reads with the sequence, and the fifth field is the
+// read id, which is the position of the sequence in the sorted read
+// file (counting from 0).  If the read does not cover the full
+// window, it is skipped.  If WindowAnchor is "end", the windows are
+// positioned relative to the end of each read (see
+// utils.Config.WindowStart), so that the left part is longer for
+// longer reads and the right part has the same length for all reads.
+//
+// The number of distinct sequences covering each window, and the
+// number of sequences and reads too short to cover it, are saved to
+// windowinfo.json in the log directory.
+//
+// If ExactTier is set, the reads listed in exact_reads.txt.sz, which
+// were resolved by muscato_exact, are also skipped.  They are still
+// counted among the reads covering each window.
+//
+// If UnmatchedReasons is set, the status of each read after
+// windowing (too short for the windows of the batch, low entropy in
+// all of them, or written to at least one window file) is saved to
+// readstatus_win_first.bin, for muscato_nonmatch.
+//
+// If the first and last window of a batch are given following the
+// configuration file, only the windows first, ..., last-1 are
+// processed.
 
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/golang/snappy"
 	"github.com/kshedden/muscato/utils"
@@ -30,11 +55,121 @@ var (
 	tmpdir string
 
 	config *utils.Config
+
+	// The windows first, ..., last-1 are processed.
+	first, last int
+
+	warnings = utils.NewWarnings("muscato_window_reads")
 )
 
+// shortCount is the number of distinct sequences, and of reads, that
+// are too short to cover each window.
+type shortCount struct {
+	seqs  []int
+	reads []int
+}
+
+func newShortCount(nwin int) *shortCount {
+	return &shortCount{
+		seqs:  make([]int, nwin),
+		reads: make([]int, nwin),
+	}
+}
+
+// add counts a sequence, with cnt reads, that is too short to cover
+// window k.
+func (sc *shortCount) add(k int, cnt []byte) {
+	n, err := strconv.Atoi(string(bytes.TrimSpace(cnt)))
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	sc.seqs[k]++
+	sc.reads[k] += n
+}
+
+// writeWindowInfo saves the number of distinct reads that are long
+// enough to cover each window, and the number of distinct sequences
+// and reads that are too short to cover it, to windowinfo.json in the
+// log directory.  Except for the first batch, the counts for the
+// windows of the earlier batches are read from the file and kept.
+func writeWindowInfo(nread []int, short *shortCount) {
+
+	var windowinfo struct {
+		WindowSeqs []int
+		ShortSeqs  []int
+		ShortReads []int
+	}
+
+	fname := path.Join(config.LogDir, "windowinfo.json")
+	if first > 0 {
+		if fid, err := os.Open(fname); err == nil {
+			json.NewDecoder(fid).Decode(&windowinfo)
+			fid.Close()
+		}
+	}
+	if len(windowinfo.WindowSeqs) != len(nread) || len(windowinfo.ShortSeqs) != len(nread) || len(windowinfo.ShortReads) != len(nread) {
+		windowinfo.WindowSeqs = make([]int, len(nread))
+		windowinfo.ShortSeqs = make([]int, len(nread))
+		windowinfo.ShortReads = make([]int, len(nread))
+	}
+	for k := first; k < last; k++ {
+		windowinfo.WindowSeqs[k] = nread[k]
+		windowinfo.ShortSeqs[k] = short.seqs[k]
+		windowinfo.ShortReads[k] = short.reads[k]
+	}
+
+	fid, err := os.Create(fname)
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	if err := json.NewEncoder(fid).Encode(windowinfo); err != nil {
+		logger.Print(err)
+	}
+}
+
+// readResolved returns the ids of the reads resolved by the exact
+// tier, in increasing order.
+func readResolved() []int {
+
+	fname := path.Join(tmpdir, "exact_reads.txt.sz")
+	fid, err := os.Open(fname)
+	if err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	defer fid.Close()
+
+	var ids []int
+	scanner := bufio.NewScanner(snappy.NewReader(fid))
+	for scanner.Scan() {
+		id, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			logger.Print(err)
+			panic(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Print(err)
+		panic(err)
+	}
+	logger.Printf("Skipping %d reads resolved by the exact tier", len(ids))
+
+	return ids
+}
+
+// setupLog opens the log, which is appended to by all batches but the
+// first.
 func setupLog() {
 	logname := path.Join(config.LogDir, "muscato_window_reads.log")
-	fid, err := os.Create(logname)
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if first > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	fid, err := os.OpenFile(logname, flags, 0666)
 	if err != nil {
 		panic(err)
 	}
@@ -43,20 +178,33 @@ func setupLog() {
 
 func main() {
 
-	if len(os.Args) != 2 && len(os.Args) != 3 {
+	defer utils.ExitOnPanic("muscato_window_reads")
+
+	if len(os.Args) != 2 && len(os.Args) != 4 {
 		os.Stderr.WriteString(fmt.Sprintf("%s: wrong number of arguments", os.Args[0]))
 		os.Exit(1)
 	}
 
 	config = utils.ReadConfig(os.Args[1])
 
-	if config.TempDir == "" {
-		tmpdir = os.Args[2]
-	} else {
-		tmpdir = config.TempDir
+	tmpdir = config.TempDir
+	if tmpdir == "" {
+		os.Stderr.WriteString(fmt.Sprintf("%s: TempDir is not set in %s\n", os.Args[0], os.Args[1]))
+		os.Exit(1)
+	}
+
+	var err error
+	first, last, err = config.WindowRange(os.Args[2:])
+	if err != nil {
+		os.Stderr.WriteString(fmt.Sprintf("%s: %v\n", os.Args[0], err))
+		os.Exit(1)
 	}
 
 	setupLog()
+	if last-first < len(config.Windows) {
+		logger.Printf("Processing windows %d to %d", first, last-1)
+		warnings = utils.NewWarnings(fmt.Sprintf("muscato_window_reads_%d", first))
+	}
 
 	// Setup input reader
 	fname := path.Join(tmpdir, "reads_sorted.txt.sz")
@@ -75,7 +223,7 @@ func main() {
 
 	// Setup output writers
 	var wtrs []io.Writer
-	for k := 0; k < len(config.Windows); k++ {
+	for k := first; k < last; k++ {
 		f := fmt.Sprintf("win_%d.txt.sz", k)
 		outfile := path.Join(tmpdir, f)
 		gid, err := os.Create(outfile)
@@ -83,14 +231,26 @@ func main() {
 			panic(err)
 		}
 		defer gid.Close()
-		wtr := snappy.NewBufferedWriter(gid)
+		wtr := utils.NewSnappyWriter(gid, config.WriterBufferSize)
 		defer wtr.Close()
 		wtrs = append(wtrs, wtr)
+		if err := utils.WriteLayout(outfile, utils.WindowColumns); err != nil {
+			panic(err)
+		}
+	}
+
+	wk := make([]int, utils.DinucSize)
+
+	var resolved []int
+	if config.ExactTier {
+		resolved = readResolved()
 	}
 
-	wk := make([]int, 25) // 25 = 5^2 = number of dinucleotides
+	// The status of each read, if UnmatchedReasons is set.
+	var status []utils.ReadStatus
 
 	nread := make([]int, len(config.Windows))
+	short := newShortCount(len(config.Windows))
 	for jj := 0; scanner.Scan(); jj++ {
 
 		if jj%1000000 == 0 {
@@ -98,24 +258,53 @@ func main() {
 		}
 
 		line := scanner.Bytes() // don't need copy
-		seq := bytes.Fields(line)[0]
+		if jj == 0 {
+			utils.ReadsSortedSchema.Require(line, logger)
+		}
+		toks := bytes.SplitN(line, []byte("\t"), 3)
+		if len(toks) < 2 {
+			msg := fmt.Sprintf("line %d of %s has %d fields, expected at least 2", jj+1, fname, len(toks))
+			logger.Print(msg)
+			panic(msg)
+		}
+		seq, cnt := toks[0], toks[1]
+		readid := strconv.Itoa(jj)
+
+		// The resolved read ids are in increasing order.
+		skip := len(resolved) > 0 && resolved[0] == jj
+		if skip {
+			resolved = resolved[1:]
+		}
+
+		st := utils.StatusTooShort
+		if skip {
+			st = utils.StatusMatched
+		}
 
 		var bbuf bytes.Buffer
-		for k := 0; k < len(config.Windows); k++ {
+		for k := first; k < last; k++ {
 
-			q1 := config.Windows[k]
+			q1 := config.WindowStart(k, len(seq))
 			q2 := q1 + config.WindowWidth
 
 			// Sequence is too short
-			if len(seq) < q2 {
+			if q1 < 0 || len(seq) < q2 {
+				short.add(k, cnt)
 				continue
 			}
 			nread[k]++
+			if skip {
+				continue
+			}
 
 			key := seq[q1:q2]
 			if utils.CountDinuc(key, wk) < config.MinDinuc {
+				if st < utils.StatusLowEntropy {
+					st = utils.StatusLowEntropy
+				}
 				continue
 			}
+			st = utils.StatusNoCandidate
 
 			bbuf.Reset()
 			_, err1 := bbuf.Write(key)
@@ -123,30 +312,75 @@ func main() {
 			_, err3 := bbuf.Write(seq[0:q1])
 			_, err4 := bbuf.WriteString("\t")
 			_, err5 := bbuf.Write(seq[q2:len(seq)])
-			_, err6 := bbuf.Write([]byte("\n"))
+			_, err6 := bbuf.WriteString("\t")
+			_, err7 := bbuf.Write(cnt)
+			_, err8 := bbuf.WriteString("\t")
+			_, err9 := bbuf.WriteString(readid)
+			_, err10 := bbuf.Write([]byte("\n"))
 
-			for _, e := range []error{err1, err2, err3, err4, err5, err6} {
+			for _, e := range []error{err1, err2, err3, err4, err5, err6, err7, err8, err9, err10} {
 				if e != nil {
 					logger.Print(e)
 					panic(e)
 				}
 			}
 
-			_, err := wtrs[k].Write(bbuf.Bytes())
+			_, err := wtrs[k-first].Write(bbuf.Bytes())
 			if err != nil {
 				logger.Print(err)
 				panic(err)
 			}
 		}
+
+		if config.UnmatchedReasons {
+			status = append(status, st)
+		}
 	}
 
-	for k, n := range nread {
-		logger.Printf("Window %d produced %d valid reads", k, n)
+	writeWindowInfo(nread, short)
+
+	if config.UnmatchedReasons {
+		fname := path.Join(tmpdir, fmt.Sprintf("readstatus_win_%d.bin", first))
+		if err := utils.WriteReadStatus(fname, status); err != nil {
+			logger.Print(err)
+			panic(err)
+		}
+	}
 
+	// A window that no read is long enough to cover cannot match
+	// anything, but the other windows can.
+	var empty []int
+	for k := first; k < last; k++ {
+		n := nread[k]
+		logger.Printf("Window %d produced %d valid reads", k, n)
 		if n == 0 {
-			msg := fmt.Sprintf("Window %d produced no valid reads, exiting", k)
-			os.Stderr.WriteString(msg)
-			os.Exit(1)
+			empty = append(empty, k)
+		}
+	}
+	if len(empty) > 0 {
+		warnings.Add("empty_window", utils.SeverityWarning,
+			"No reads are long enough to cover windows %v, which produced no matches", empty)
+	}
+
+	// The windows that some, but not all, reads are too short to
+	// cover.  These reads can only be matched through their other
+	// windows.
+	var partial []string
+	for k := first; k < last; k++ {
+		if nread[k] > 0 && short.seqs[k] > 0 {
+			logger.Printf("Window %d: %d sequences (%d reads) are too short to cover it", k, short.seqs[k], short.reads[k])
+			partial = append(partial, fmt.Sprintf("window %d: %d reads", k, short.reads[k]))
+		}
+	}
+	if len(partial) > 0 {
+		msg := "Some reads are too short to cover every window, and can only be matched through the windows they cover (%s)"
+		if config.WindowAnchor == "start" {
+			msg += ", consider WindowAnchor=end for reads of varying length"
 		}
+		warnings.Add("short_reads", utils.SeverityInfo, msg, strings.Join(partial, ", "))
+	}
+
+	if err := warnings.Save(config.LogDir); err != nil {
+		logger.Print(err)
 	}
 }
@@ -0,0 +1,270 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// A lineFunc appends a transformed version of one line of results
+// (given as its tab-separated fields) to out.  The fields may be
+// modified.  If a nil slice is returned, the line is removed from the
+// results.
+type lineFunc func(fields [][]byte, out []byte) ([]byte, error)
+
+// columnWriter applies a sequence of transformations to each line of
+// results written to it, before passing the lines on to w.
+type columnWriter struct {
+	w     io.Writer
+	funcs []lineFunc
+
+	// A partial line left over from the previous write.
+	line []byte
+
+	out []byte
+	buf []byte
+}
+
+func (cw *columnWriter) Write(p []byte) (int, error) {
+
+	n := len(p)
+	cw.out = cw.out[0:0]
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			cw.line = append(cw.line, p...)
+			break
+		}
+		cw.line = append(cw.line, p[0:i]...)
+		if err := cw.appendLine(); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+
+	if _, err := cw.w.Write(cw.out); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// appendLine transforms the current line and adds it to the output
+// buffer.
+func (cw *columnWriter) appendLine() error {
+
+	line := cw.line
+	for _, f := range cw.funcs {
+		fields := bytes.Split(line, []byte("\t"))
+		if len(fields) < 6 {
+			return fmt.Errorf("results line has %d fields, expected at least 6", len(fields))
+		}
+		var err error
+		cw.buf, err = f(fields, cw.buf[0:0])
+		if err != nil {
+			return err
+		}
+		if cw.buf == nil {
+			cw.line = line[0:0]
+			return nil
+		}
+		line = append(line[0:0], cw.buf...)
+	}
+
+	cw.out = append(cw.out, line...)
+	cw.out = append(cw.out, '\n')
+	cw.line = line[0:0]
+
+	return nil
+}
+
+// Flush writes any final line that was not terminated by a newline.
+func (cw *columnWriter) Flush() error {
+
+	if len(cw.line) == 0 {
+		return nil
+	}
+
+	cw.out = cw.out[0:0]
+	if err := cw.appendLine(); err != nil {
+		return err
+	}
+	_, err := cw.w.Write(cw.out)
+	return err
+}
+
+// boundsChecker removes matches that do not lie within their target,
+// according to the target lengths in the id file.  Such matches can
+// only come from a coordinate error, e.g. in the positions of the
+// segments of long targets.  They are written to a diagnostics file
+// that is created when the first one is found, with columns read,
+// target id, position, match length and target length.  check must
+// run before the other transformations, which may change the
+// positions.
+type boundsChecker struct {
+	name string
+	fid  *os.File
+	n    int
+}
+
+func (bc *boundsChecker) check(fields [][]byte, out []byte) ([]byte, error) {
+
+	pos, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return nil, err
+	}
+	glen, err := strconv.Atoi(string(fields[5]))
+	if err != nil {
+		return nil, err
+	}
+
+	if pos >= 0 && pos+len(fields[1]) <= glen {
+		return append(out, bytes.Join(fields, []byte("\t"))...), nil
+	}
+
+	bc.n++
+	if bc.fid == nil {
+		if bc.fid, err = os.Create(bc.name); err != nil {
+			return nil, err
+		}
+	}
+	_, err = fmt.Fprintf(bc.fid, "%s\t%s\t%d\t%d\t%d\n", fields[0], fields[4], pos, len(fields[1]), glen)
+	return nil, err
+}
+
+// Close closes the diagnostics file, if it was created.
+func (bc *boundsChecker) Close() error {
+	if bc.fid == nil {
+		return nil
+	}
+	err := bc.fid.Close()
+	bc.fid = nil
+	return err
+}
+
+// forwardStrand converts positions on reverse complemented targets
+// (those with names ending in "_r") to positions on the forward
+// strand of the original target, removes the "_r" suffix, and appends
+// a strand column.
+func forwardStrand(fields [][]byte, out []byte) ([]byte, error) {
+
+	strand := []byte("+")
+	name := fields[4]
+	if bytes.HasSuffix(name, []byte("_r")) {
+		pos, err := strconv.Atoi(string(fields[2]))
+		if err != nil {
+			return nil, err
+		}
+		glen, err := strconv.Atoi(string(fields[5]))
+		if err != nil {
+			return nil, err
+		}
+		fields[2] = strconv.AppendInt(nil, int64(glen-pos-len(fields[1])), 10)
+		fields[4] = name[0 : len(name)-2]
+		strand = []byte("-")
+	}
+
+	out = append(out, bytes.Join(fields, []byte("\t"))...)
+	out = append(out, '\t')
+	out = append(out, strand...)
+
+	return out, nil
+}
+
+// readThrough appends a column containing the number of read bases
+// that extend beyond the end of the target.  Long targets are split
+// into segments, so a match that extends beyond the end of a segment
+// but not the end of the target is removed; the read is also matched
+// to the following segment.  If ForwardStrand is set, this must run
+// after forwardStrand.
+func readThrough(fields [][]byte, out []byte) ([]byte, error) {
+
+	n := len(fields[0]) - len(fields[1])
+	if n > 0 {
+		pos, err := strconv.Atoi(string(fields[2]))
+		if err != nil {
+			return nil, err
+		}
+		glen, err := strconv.Atoi(string(fields[5]))
+		if err != nil {
+			return nil, err
+		}
+		end := pos+len(fields[1]) == glen
+		if config.ForwardStrand && string(fields[len(fields)-1]) == "-" {
+			// The end of the reverse complement target
+			end = pos == 0
+		}
+		if !end {
+			return nil, nil
+		}
+	}
+
+	out = append(out, bytes.Join(fields, []byte("\t"))...)
+	out = append(out, '\t')
+	out = strconv.AppendInt(out, int64(len(fields[0])-len(fields[1])), 10)
+	return out, nil
+}
+
+// targetCoords appends the strand and the 1-based start and end
+// positions (inclusive) of the match on the forward strand of the
+// original target.  If ForwardStrand is set, the strand column and
+// forward strand position have already been added by forwardStrand,
+// and only the start and end are appended.
+func targetCoords(fields [][]byte, out []byte) ([]byte, error) {
+
+	pos, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return nil, err
+	}
+	n := len(fields[1])
+
+	var strand []byte
+	if !config.ForwardStrand {
+		strand = []byte("+")
+		if bytes.HasSuffix(fields[4], []byte("_r")) {
+			glen, err := strconv.Atoi(string(fields[5]))
+			if err != nil {
+				return nil, err
+			}
+			pos = glen - pos - n
+			strand = []byte("-")
+		}
+	}
+
+	out = append(out, bytes.Join(fields, []byte("\t"))...)
+	if strand != nil {
+		out = append(out, '\t')
+		out = append(out, strand...)
+	}
+	out = append(out, '\t')
+	out = strconv.AppendInt(out, int64(pos+1), 10)
+	out = append(out, '\t')
+	out = strconv.AppendInt(out, int64(pos+n), 10)
+
+	return out, nil
+}
+
+// readGroupColumn moves the read group counts, which follow the read
+// names in reads_sorted.txt.sz, to the end of the results, so that
+// the columns appended by the other transformations keep their
+// positions.  It must run after the other transformations.
+func readGroupColumn(fields [][]byte, out []byte) ([]byte, error) {
+
+	if len(fields) < 9 {
+		return nil, fmt.Errorf("results line has %d fields, expected the read groups in field 9", len(fields))
+	}
+
+	out = append(out, bytes.Join(fields[0:8], []byte("\t"))...)
+	for _, f := range fields[9:] {
+		out = append(out, '\t')
+		out = append(out, f...)
+	}
+	out = append(out, '\t')
+	out = append(out, fields[8]...)
+
+	return out, nil
+}
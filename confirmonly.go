@@ -0,0 +1,204 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// readScreenConfig reads the configuration saved in the temporary
+// directory of the earlier run named by ConfirmOnly.
+func readScreenConfig() (*utils.Config, error) {
+
+	fid, err := os.Open(path.Join(config.ConfirmOnly, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("ConfirmOnly: %s does not contain config.json, it must be the TempDir of an earlier run made with NoCleanTemp: %w",
+			config.ConfirmOnly, err)
+	}
+	defer fid.Close()
+
+	old := new(utils.Config)
+	if err := json.NewDecoder(fid).Decode(old); err != nil {
+		return nil, fmt.Errorf("ConfirmOnly: %w", err)
+	}
+
+	return old, nil
+}
+
+// sameFile returns true if the two names refer to the same file.
+func sameFile(a, b string) bool {
+	fa, err1 := os.Stat(a)
+	fb, err2 := os.Stat(b)
+	if err1 != nil || err2 != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return os.SameFile(fa, fb)
+}
+
+// reuseScreen places the screening results of the earlier run named
+// by ConfirmOnly into TempDir and LogDir, in place of running the
+// screening stages.  The screening parameters are taken from the
+// earlier run, so that the later stages interpret its files
+// correctly.
+func reuseScreen() error {
+
+	io.WriteString(os.Stderr, "Reusing the screening results in ConfirmOnly...\n")
+
+	old, err := readScreenConfig()
+	if err != nil {
+		return err
+	}
+
+	if !sameFile(old.ReadFileName, config.ReadFileName) || !sameFile(old.GeneFileName, config.GeneFileName) {
+		return fmt.Errorf("ConfirmOnly: the earlier run in %s used the reads %s and targets %s",
+			config.ConfirmOnly, old.ReadFileName, old.GeneFileName)
+	}
+
+	config.Windows = old.Windows
+	config.WindowStride = old.WindowStride
+	config.WindowWidth = old.WindowWidth
+	config.WindowAnchor = old.WindowAnchor
+	config.BloomSize = old.BloomSize
+	config.NumHash = old.NumHash
+	config.AutoBloom = old.AutoBloom
+	config.BloomFPR = old.BloomFPR
+	config.BloomHash = old.BloomHash
+	config.ScreenMethod = old.ScreenMethod
+	config.IndexSide = old.IndexSide
+	config.MinDinuc = old.MinDinuc
+	config.MaxKmerReads = old.MaxKmerReads
+	config.MinReadLength = old.MinReadLength
+	config.MaxReadLength = old.MaxReadLength
+	config.MaxNameList = old.MaxNameList
+	config.UMI = old.UMI
+	config.ReadGroup = old.ReadGroup
+	config.SequenceAlphabet = old.SequenceAlphabet
+	config.Adapters = old.Adapters
+	config.AdapterMinOverlap = old.AdapterMinOverlap
+	config.QualityTrim = old.QualityTrim
+	logger.Printf("Reusing the screening results of %s, with Windows=%v and WindowWidth=%d",
+		config.ConfirmOnly, config.Windows, config.WindowWidth)
+	if err := config.CheckWindowSettings(); err != nil {
+		return err
+	}
+
+	for _, f := range cachedTemp() {
+		src := path.Join(config.ConfirmOnly, f)
+		if _, err := os.Stat(src); err != nil {
+			return fmt.Errorf("ConfirmOnly: %w (the intermediate files must be kept with Retention=all)", err)
+		}
+		if err := linkWithLayout(src, path.Join(config.TempDir, f)); err != nil {
+			return err
+		}
+	}
+
+	if len(config.WindowSubset) > 0 {
+		if err := reuseConfirmed(old); err != nil {
+			return err
+		}
+	}
+
+	// The statistics of the earlier run, so that the run report
+	// and count checks are complete.
+	for _, f := range cachedLogs() {
+		src := path.Join(old.LogDir, f)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := linkOrCopy(src, path.Join(config.LogDir, f)); err != nil {
+			return err
+		}
+	}
+
+	return saveConfig(config)
+}
+
+// confirmSettings are the settings that affect the matches confirmed
+// in each window, which must not change when the confirmed matches of
+// an earlier run are reused with WindowSubset.
+var confirmSettings = []string{
+	"PMatch", "WindowPMatch", "MismatchCosts", "MaxMatches", "MatchMode", "RefineCommand",
+}
+
+// reusedWindows returns the windows that are not in WindowSubset,
+// whose confirmed matches are taken from the earlier run.
+func reusedWindows() []int {
+
+	if len(config.WindowSubset) == 0 {
+		return nil
+	}
+
+	sub := make(map[int]bool)
+	for _, k := range config.WindowSubset {
+		sub[k] = true
+	}
+
+	var wins []int
+	for _, k := range allWindows() {
+		if !sub[k] {
+			wins = append(wins, k)
+		}
+	}
+
+	return wins
+}
+
+// reuseConfirmed places the confirmed matches of the windows that are
+// not in WindowSubset into TempDir and LogDir, so that they are
+// combined with the matches of the windows that are confirmed again.
+func reuseConfirmed(old *utils.Config) error {
+
+	for _, k := range config.WindowSubset {
+		if k >= len(config.Windows) {
+			return fmt.Errorf("WindowSubset: window %d does not exist, the earlier run in %s has %d windows",
+				k, config.ConfirmOnly, len(config.Windows))
+		}
+	}
+
+	vo := reflect.ValueOf(old).Elem()
+	vn := reflect.ValueOf(config).Elem()
+	for _, name := range confirmSettings {
+		a, b := vo.FieldByName(name).Interface(), vn.FieldByName(name).Interface()
+		if !reflect.DeepEqual(a, b) {
+			return fmt.Errorf("WindowSubset: the earlier run in %s used %s=%v, but this run uses %v, so its confirmed matches cannot be reused",
+				config.ConfirmOnly, name, a, b)
+		}
+	}
+
+	wins := reusedWindows()
+	logger.Printf("Confirming windows %v, reusing the confirmed matches of windows %v", config.WindowSubset, wins)
+
+	for _, k := range wins {
+		files := []string{fmt.Sprintf("rmatch_%d.txt.sz", k)}
+		if config.RefineCommand != "" {
+			files = append(files, fmt.Sprintf("refine_%d.txt.sz", k))
+		}
+		for _, f := range files {
+			src := path.Join(config.ConfirmOnly, f)
+			if _, err := os.Stat(src); err != nil {
+				return fmt.Errorf("WindowSubset: window %d was not confirmed by the earlier run: %w (the intermediate files must be kept with Retention=all)", k, err)
+			}
+			if err := linkWithLayout(src, path.Join(config.TempDir, f)); err != nil {
+				return err
+			}
+		}
+
+		// The match count, used to size the duplicate filter.
+		f := fmt.Sprintf("confirminfo_%d.json", k)
+		if _, err := os.Stat(path.Join(old.LogDir, f)); err == nil {
+			if err := linkOrCopy(path.Join(old.LogDir, f), path.Join(config.LogDir, f)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
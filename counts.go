@@ -0,0 +1,134 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// countCheck compares the number of reads (or distinct read
+// sequences) reported at two points in the pipeline.
+type countCheck struct {
+
+	// A description of the quantity being compared.
+	Name string
+
+	Expected int
+	Observed int
+
+	OK bool
+}
+
+// checkCounts reconciles the read counts reported by the pipeline
+// stages, to detect reads that were silently lost (e.g. by a
+// truncated pipe) or misclassified (e.g. by a false positive in the
+// Bloom filter used to find the non-matching reads).  Any discrepancy
+// is recorded as a warning.
+func checkCounts() []countCheck {
+
+	var prepinfo struct {
+		NumInput   int
+		NumSkipped int
+	}
+	readInfo("prepinfo.json", &prepinfo)
+
+	var seqinfo struct {
+		NumUnique     int
+		NumTotal      int
+		NumDuplicates int
+	}
+	readInfo("seqinfo.json", &seqinfo)
+
+	var windowinfo struct {
+		WindowSeqs []int
+		ShortSeqs  []int
+	}
+	readInfo("windowinfo.json", &windowinfo)
+
+	var matchinfo struct {
+		MatchedSeqs    int
+		UnmatchedSeqs  int
+		MatchedReads   int
+		UnmatchedReads int
+	}
+	readInfo("matchinfo.json", &matchinfo)
+
+	var readinfo struct {
+		MatchedSeqs  int
+		MatchedReads int
+	}
+	readInfo("readinfo.json", &readinfo)
+
+	checks := []countCheck{
+		{
+			Name:     "reads after prep (input - skipped) vs reads counted by uniqify",
+			Expected: prepinfo.NumInput - prepinfo.NumSkipped,
+			Observed: seqinfo.NumTotal,
+		},
+		{
+			Name:     "matched + unmatched + skipped + duplicate reads vs input reads",
+			Expected: prepinfo.NumInput,
+			Observed: matchinfo.MatchedReads + matchinfo.UnmatchedReads + prepinfo.NumSkipped + seqinfo.NumDuplicates,
+		},
+		{
+			Name:     "matched + unmatched sequences vs distinct sequences",
+			Expected: seqinfo.NumUnique,
+			Observed: matchinfo.MatchedSeqs + matchinfo.UnmatchedSeqs,
+		},
+		{
+			Name:     "matched reads in results vs matched reads in nonmatch",
+			Expected: readinfo.MatchedReads,
+			Observed: matchinfo.MatchedReads,
+		},
+	}
+
+	// The matched and unmatched reads are counted from the
+	// per-read results.
+	if config.NoPerReadOutput {
+		checks = checks[0:1]
+	}
+
+	for i := range checks {
+		checks[i].OK = checks[i].Expected == checks[i].Observed
+	}
+
+	// Each window can contain at most one entry per distinct read.
+	for k, n := range windowinfo.WindowSeqs {
+		if n > seqinfo.NumUnique {
+			checks = append(checks, countCheck{
+				Name:     "sequences in window vs distinct sequences",
+				Expected: seqinfo.NumUnique,
+				Observed: n,
+			})
+			logger.Printf("Window %d has %d sequences, more than the %d distinct sequences", k, n, seqinfo.NumUnique)
+		}
+	}
+
+	// Each distinct read either covers a window or is too short for
+	// it.
+	if len(windowinfo.ShortSeqs) == len(windowinfo.WindowSeqs) {
+		for k, n := range windowinfo.WindowSeqs {
+			if m := n + windowinfo.ShortSeqs[k]; m != seqinfo.NumUnique {
+				checks = append(checks, countCheck{
+					Name:     fmt.Sprintf("sequences covering or too short for window %d vs distinct sequences", k),
+					Expected: seqinfo.NumUnique,
+					Observed: m,
+				})
+			}
+		}
+	}
+
+	for _, c := range checks {
+		if c.OK {
+			logger.Printf("Count check passed: %s (%d)", c.Name, c.Observed)
+			continue
+		}
+		logger.Printf("Count check failed: %s (expected %d, observed %d)", c.Name, c.Expected, c.Observed)
+		warnings.Add("count_mismatch", utils.SeverityError,
+			"Read counts do not reconcile: %s (expected %d, observed %d)", c.Name, c.Expected, c.Observed)
+	}
+
+	return checks
+}
@@ -0,0 +1,163 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// geneMatches prepares the matches used for the gene statistics when
+// NoPerReadOutput is set, in place of the results file.  The read
+// names are not joined to the matches.  If WeightGeneStats is set, the
+// number of reads with each sequence is joined, since the gene
+// statistics need it.  The matches are written to matches_gs.txt.sz
+// in TempDir.
+func geneMatches() error {
+
+	io.WriteString(os.Stderr, "Preparing matches for gene statistics...\n")
+
+	gn := path.Join(config.TempDir, "matches_sn.txt.sz")
+	outname := path.Join(config.TempDir, "matches_gs.txt.sz")
+
+	lay, err := matchLayout("matches_sn.txt.sz", utils.NamedMatchColumns)
+	if err != nil {
+		return err
+	}
+	cols := lay.Columns
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	// Compress the matches
+	cmdz := command("sztool", "-c", "-", outname)
+	cmdz.Stdin = pr
+	cmdz.Stderr = stderrTail
+	cmdz.Env = os.Environ()
+	if err := cmdz.Start(); err != nil {
+		return cmdErr(cmdz, err)
+	}
+
+	// The matches are counted under the same target names, and
+	// the spurious read-through matches are removed, as in the
+	// results.
+	cw := &columnWriter{w: pw}
+	if config.ForwardStrand {
+		cw.funcs = append(cw.funcs, forwardStrand)
+	}
+	if config.ReadThrough > 0 {
+		cw.funcs = append(cw.funcs, readThrough)
+	}
+
+	if config.WeightGeneStats {
+		if err := joinReadCounts(gn, len(cols), cw); err != nil {
+			return err
+		}
+		cols = append(cols, "count")
+	} else {
+		res, err := utils.OpenResult(gn)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(cw, res)
+		res.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cw.Flush(); err != nil {
+		return err
+	}
+	pw.Close()
+	pr.Close()
+
+	if err := cmdz.Wait(); err != nil {
+		return cmdErr(cmdz, err)
+	}
+
+	return utils.WriteLayout(outname, cols)
+}
+
+// joinReadCounts writes the matches in gn, which have ncol columns,
+// to w with the number of reads with each sequence appended.
+func joinReadCounts(gn string, ncol int, w io.Writer) error {
+
+	fn := path.Join(config.TempDir, "reads_sorted.txt.sz")
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	// Keep the columns of the matches and the count, but not the
+	// read names.
+	var outcols []string
+	for j := 1; j <= ncol; j++ {
+		outcols = append(outcols, fmt.Sprintf("1.%d", j))
+	}
+	outcols = append(outcols, "2.2")
+	cmd := command("join", "-1", "1", "-2", "1", "-t", "\t", "-o", strings.Join(outcols, ","))
+	cmd.Stdout = w
+
+	pa, err := newInputPipe(cmd, "matches_sn")
+	if err != nil {
+		return err
+	}
+	pb, err := newInputPipe(cmd, "reads_sorted")
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, pa.path, pb.path)
+
+	// Decompress the matches
+	cmd1 := command("sztool", "-d", gn)
+	cmd1.Stdout = pw1
+
+	// Sort the matches by read
+	args := []string{"-k1", sortmem, sortpar}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	args = append(args, "-")
+	cmd2 := command("sort", args...)
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pa.w
+
+	// Decompress the reads
+	cmd3 := command("sztool", "-d", fn)
+	cmd3.Stdout = pb.w
+
+	for _, c := range []*exec.Cmd{cmd1, cmd2, cmd3, cmd} {
+		c.Stderr = stderrTail
+		c.Env = os.Environ()
+		if err := c.Start(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+	pa.Close()
+	pb.Close()
+
+	if err := cmd1.Wait(); err != nil {
+		return cmdErr(cmd1, err)
+	}
+
+	pw1.Close()
+	pr1.Close()
+
+	for _, c := range []*exec.Cmd{cmd2, cmd3, cmd} {
+		if err := c.Wait(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// The errors returned (wrapped) by Run for the classes of failure
+// that are given their own exit status by muscato.  ErrWallTime is
+// another.
+var (
+	// An input file (the reads, genes or gene ids) cannot be read.
+	ErrMissingInput = errors.New("input file not found")
+
+	// One of the commands run by the pipeline failed.
+	ErrCommand = errors.New("command failed")
+
+	// TempDir does not have, or ran out of, space.
+	ErrDiskFull = errors.New("insufficient disk space")
+
+	// A panic in the muscato package.
+	errPanic = errors.New("panic")
+)
+
+// The exit status of muscato for each class of failure.
+const (
+	ExitFailure      = 1
+	ExitPanic        = 2
+	ExitPartial      = 3
+	ExitConfig       = 4
+	ExitMissingInput = 5
+	ExitCommand      = 6
+	ExitDiskFull     = 7
+)
+
+// The number of bytes of the stderr of the commands kept for
+// error.json.
+const stderrTailSize = 4096
+
+// CommandError is the error of a command run by the pipeline that
+// failed.  It matches ErrCommand with errors.Is.
+type CommandError struct {
+
+	// The command line.
+	Args []string
+
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %v", path.Base(e.Args[0]), e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CommandError) Is(target error) bool {
+	return target == ErrCommand
+}
+
+// tailWriter copies what is written to it to os.Stderr, and keeps the
+// last stderrTailSize bytes.
+type tailWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// stderrTail is the stderr of the commands run by the pipeline.
+var stderrTail = new(tailWriter)
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.buf = append(w.buf, p...)
+	if n := len(w.buf); n > stderrTailSize {
+		w.buf = append(w.buf[0:0], w.buf[n-stderrTailSize:]...)
+	}
+	w.mu.Unlock()
+	return os.Stderr.Write(p)
+}
+
+// reset discards the saved output, at the start of a run.
+func (w *tailWriter) reset() {
+	w.mu.Lock()
+	w.buf = w.buf[0:0]
+	w.mu.Unlock()
+}
+
+// lines returns the saved output as lines, dropping the first line
+// if it may be incomplete.
+func (w *tailWriter) lines() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := strings.TrimRight(string(w.buf), "\n")
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	if len(w.buf) == stderrTailSize && len(lines) > 1 {
+		lines = lines[1:]
+	}
+	return lines
+}
+
+// noSpace returns true if the saved output reports that a device is
+// full, in which case a failed command is treated as a disk space
+// failure.
+func (w *tailWriter) noSpace() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return bytes.Contains(w.buf, []byte("no space left on device")) ||
+		bytes.Contains(w.buf, []byte("No space left on device"))
+}
+
+// ErrorManifest describes the failure of a run.  It is written to
+// error.json in the log directory when a run fails, for workflow
+// systems that need to decide how to handle the failure.
+type ErrorManifest struct {
+
+	// One of "config", "missing_input", "command", "disk_full",
+	// "walltime", "panic", "interrupted" or "other".
+	Class string
+
+	// The exit status of muscato.
+	ExitCode int
+
+	// The stage that failed, if the failure occurred in a stage.
+	Stage string `json:",omitempty"`
+
+	// The command line of the failed command, for Class "command".
+	Command []string `json:",omitempty"`
+
+	Message string
+
+	// The last lines written to stderr by the commands of the run.
+	StderrTail []string `json:",omitempty"`
+
+	// Suggestions for resolving the failure.
+	Suggestions []string `json:",omitempty"`
+
+	Time time.Time
+}
+
+// The stage that was running when the run failed.
+var failedStage string
+
+// errorClass returns the class of a failure, and its exit status.
+func errorClass(err error) (string, int) {
+
+	var cerr *utils.ConfigError
+	switch {
+	case errors.Is(err, ErrWallTime):
+		return "walltime", ExitPartial
+	case errors.As(err, &cerr):
+		return "config", ExitConfig
+	case errors.Is(err, ErrDiskFull), errors.Is(err, syscall.ENOSPC), errors.Is(err, ErrCommand) && stderrTail.noSpace():
+		return "disk_full", ExitDiskFull
+	case errors.Is(err, ErrMissingInput):
+		return "missing_input", ExitMissingInput
+	case errors.Is(err, errPanic):
+		return "panic", ExitPanic
+	case errors.Is(err, ErrCommand):
+		return "command", ExitCommand
+	case errors.Is(err, context.Canceled):
+		return "interrupted", ExitFailure
+	}
+
+	return "other", ExitFailure
+}
+
+// ExitCode returns the exit status used by muscato for an error
+// returned by Run.
+func ExitCode(err error) int {
+	_, code := errorClass(err)
+	return code
+}
+
+// suggestions returns advice for a failure of the given class.
+func suggestions(class string, err error) []string {
+
+	switch class {
+	case "config":
+		return []string{"Check the configuration settings named in the message, see 'muscato --help'"}
+	case "missing_input":
+		return []string{"Check that ReadFileName, GeneFileName and GeneIdFileName exist and are readable",
+			"The gene files are made from a fasta file with muscato_prep_targets"}
+	case "disk_full":
+		return []string{"Use a TempDir (or WorkDir) with more free space, or set SortTemp to a different disk",
+			"Set EarlyDelete to remove intermediate files as soon as they are used",
+			"Run 'muscato gc' to remove the temporary files of old runs"}
+	case "walltime":
+		return []string{"Increase MaxWallTime, or reduce the work of the run (e.g. fewer Windows)"}
+	case "panic":
+		return []string{"See the Failures in status.json for the stack trace, and report the problem"}
+	case "command":
+		var cerr *CommandError
+		if errors.As(err, &cerr) && errors.Is(cerr.Err, exec.ErrNotFound) {
+			return []string{"Install the muscato_* tools with 'go install ./...', in $HOME/go/bin or on the PATH"}
+		}
+		s := []string{"See StderrTail and the log files of the stage in the log directory"}
+		if errors.As(err, &cerr) && path.Base(cerr.Args[0]) == "sort" {
+			s = append(s, "sort may have run out of temporary space, see SortTemp")
+		}
+		return s
+	case "interrupted":
+		return []string{"The run was cancelled, run it again to produce the results"}
+	}
+
+	return []string{"See the log files in the log directory for details"}
+}
+
+// writeErrorManifest saves a description of the failure of the run to
+// error.json in the log directory.
+func writeErrorManifest(err error) {
+
+	class, code := errorClass(err)
+	m := ErrorManifest{
+		Class:       class,
+		ExitCode:    code,
+		Stage:       failedStage,
+		Message:     err.Error(),
+		StderrTail:  stderrTail.lines(),
+		Suggestions: suggestions(class, err),
+		Time:        time.Now(),
+	}
+	var cerr *CommandError
+	if errors.As(err, &cerr) {
+		m.Command = cerr.Args
+	}
+
+	fid, err := os.Create(path.Join(config.LogDir, "error.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(&m); err != nil {
+		logger.Print(err)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+func TestExitCode(t *testing.T) {
+
+	cmdErr := &CommandError{Args: []string{"sort", "-k1"}, Err: errors.New("exit status 2")}
+	pathErr := &os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}
+
+	for _, d := range []struct {
+		err    error
+		stderr string
+		class  string
+		code   int
+	}{
+		{fmt.Errorf("confirm: %w", ErrWallTime), "", "walltime", ExitPartial},
+		{utils.NewConfigError("MaxMemory", utils.ErrConflict, "too large"), "", "config", ExitConfig},
+		{fmt.Errorf("screen: %w", utils.NewConfigError("PMatch", utils.ErrInvalid, "bad")), "", "config", ExitConfig},
+		{fmt.Errorf("%w: reads.fastq", ErrMissingInput), "", "missing_input", ExitMissingInput},
+		{fmt.Errorf("prepReads: %w", ErrDiskFull), "", "disk_full", ExitDiskFull},
+		{pathErr, "", "disk_full", ExitDiskFull},
+		{cmdErr, "sort: write failed: /tmp/x: No space left on device\n", "disk_full", ExitDiskFull},
+		{fmt.Errorf("%w: index out of range", errPanic), "", "panic", ExitPanic},
+		{fmt.Errorf("sortWindows failed: %w", cmdErr), "sort: invalid option\n", "command", ExitCommand},
+		{context.Canceled, "", "interrupted", ExitFailure},
+		{errors.New("something else"), "", "other", ExitFailure},
+	} {
+		stderrTail.reset()
+		stderrTail.buf = append(stderrTail.buf, d.stderr...)
+
+		class, code := errorClass(d.err)
+		if class != d.class || code != d.code {
+			t.Errorf("%v: class %s and exit status %d, expected %s and %d", d.err, class, code, d.class, d.code)
+		}
+		if c := ExitCode(d.err); c != d.code {
+			t.Errorf("%v: ExitCode is %d, expected %d", d.err, c, d.code)
+		}
+		if len(suggestions(class, d.err)) == 0 {
+			t.Errorf("%v: no suggestions", d.err)
+		}
+	}
+	stderrTail.reset()
+}
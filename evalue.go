@@ -0,0 +1,76 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// Parameters for ungapped nucleotide alignment, using the default
+// BLASTN scores (reward 1, penalty -3).
+const (
+	matchReward     = 1
+	mismatchPenalty = -3
+	lambda          = 1.374
+	kappa           = 0.711
+)
+
+// evalue returns the expected number of matches with at least the
+// observed score, for a read of length readlen with nmiss mismatches,
+// in a database of dbsize bases.  This follows the Karlin-Altschul
+// statistics used by BLAST, without any correction for edge effects.
+func evalue(readlen, nmiss int, dbsize float64) float64 {
+	score := float64((readlen-nmiss)*matchReward + nmiss*mismatchPenalty)
+	bits := (lambda*score - math.Log(kappa)) / math.Ln2
+	return float64(readlen) * dbsize * math.Pow(2, -bits)
+}
+
+// targetSize returns the total length of all target sequences, using
+// the lengths in the gene id file.
+func targetSize() (float64, error) {
+
+	rdr, err := utils.OpenTargets(config.GeneIdFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer rdr.Close()
+
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	var n float64
+	for scanner.Scan() {
+		f := bytes.Split(scanner.Bytes(), []byte("\t"))
+		if len(f) < 3 {
+			return 0, fmt.Errorf("%s: line has %d fields, expected 3", config.GeneIdFileName, len(f))
+		}
+		x, err := strconv.Atoi(string(f[2]))
+		if err != nil {
+			return 0, err
+		}
+		n += float64(x)
+	}
+
+	return n, scanner.Err()
+}
+
+// evalueColumn returns a lineFunc that appends an E-value column,
+// based on a database of dbsize bases.
+func evalueColumn(dbsize float64) lineFunc {
+	return func(fields [][]byte, out []byte) ([]byte, error) {
+		nmiss, err := strconv.Atoi(string(fields[3]))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bytes.Join(fields, []byte("\t"))...)
+		out = append(out, '\t')
+		out = strconv.AppendFloat(out, evalue(len(fields[1]), nmiss, dbsize), 'g', 3, 64)
+		return out, nil
+	}
+}
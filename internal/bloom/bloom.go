@@ -0,0 +1,152 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+// Package bloom implements a cache-blocked Bloom filter used by
+// muscato_screen to sketch the read collection.
+//
+// The bits of the filter are partitioned into blocks of 512 bits (one
+// typical cache line).  The first hash value selects a block, and all
+// bits for a given value are set or tested within that block.  This
+// means that each insertion or query touches a single cache line,
+// rather than NumHash randomly-placed cache lines as in a standard
+// Bloom filter.  For a given number of bits, the false positive rate
+// is slightly higher than for an unblocked filter.
+//
+// Bits are set using atomic operations on 64-bit words, so a Filter
+// can be updated from multiple goroutines without additional locking.
+// To build a large filter in parallel, the values can also be divided
+// among goroutines by Shard, so that each goroutine updates its own
+// part of the filter.
+package bloom
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+const (
+	// Number of 64-bit words per block
+	blockWords = 8
+
+	// Number of bits per block
+	blockBits = 64 * blockWords
+)
+
+// Filter is a blocked Bloom filter.  Values are identified by a slice
+// of hash values, which must have the same length for all calls to
+// Add and Test.
+type Filter struct {
+	words  []uint64
+	nblock uint64
+}
+
+// numBlocks returns the number of blocks in a filter with
+// approximately nbits bits.
+func numBlocks(nbits uint64) uint64 {
+	nblock := (nbits + blockBits - 1) / blockBits
+	if nblock == 0 {
+		nblock = 1
+	}
+	return nblock
+}
+
+// New returns a Filter with approximately nbits bits.  The size is
+// rounded up to a multiple of the block size.
+func New(nbits uint64) *Filter {
+
+	nblock := numBlocks(nbits)
+
+	return &Filter{
+		words:  make([]uint64, nblock*blockWords),
+		nblock: nblock,
+	}
+}
+
+// Bits returns the number of bits in the filter.
+func (f *Filter) Bits() uint64 {
+	return f.nblock * blockBits
+}
+
+// Bytes returns the memory used by the bits of a Filter created by
+// New(nbits).
+func Bytes(nbits uint64) uint64 {
+	return numBlocks(nbits) * blockWords * 8
+}
+
+// locate returns the position of the word and the bit mask within
+// the block that corresponds to the j^th hash value.
+func (f *Filter) locate(base uint64, h []uint64, j int) (uint64, uint64) {
+
+	var b uint64
+	if j == 0 {
+		// Use the high bits that did not determine the block.
+		b = (h[0] / f.nblock) % blockBits
+	} else {
+		b = h[j] % blockBits
+	}
+
+	return base + b/64, 1 << (b % 64)
+}
+
+// Add inserts the value with hash values h into the filter.
+func (f *Filter) Add(h []uint64) {
+
+	base := (h[0] % f.nblock) * blockWords
+	for j := range h {
+		i, mask := f.locate(base, h, j)
+		for {
+			old := atomic.LoadUint64(&f.words[i])
+			if old&mask != 0 || atomic.CompareAndSwapUint64(&f.words[i], old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// Shard returns which of n shards of the filter holds the bits of
+// the value with hash values h.  The shards are contiguous ranges of
+// blocks of nearly equal size, so values in different shards never
+// set bits in the same cache line.
+func (f *Filter) Shard(h []uint64, n int) int {
+	return int((h[0] % f.nblock) * uint64(n) / f.nblock)
+}
+
+// Test returns true if the value with hash values h may be in the
+// filter, and false if it is definitely not in the filter.
+func (f *Filter) Test(h []uint64) bool {
+
+	base := (h[0] % f.nblock) * blockWords
+	for j := range h {
+		i, mask := f.locate(base, h, j)
+		if atomic.LoadUint64(&f.words[i])&mask == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FillRate returns the proportion of bits in the filter that are set.
+func (f *Filter) FillRate() float64 {
+
+	var n int
+	for i := range f.words {
+		n += bits.OnesCount64(atomic.LoadUint64(&f.words[i]))
+	}
+
+	return float64(n) / float64(f.Bits())
+}
+
+// EstimateParameters returns the number of bits m and the number of
+// hash functions k that give false positive rate p for a standard
+// Bloom filter containing n distinct values.  This is the same
+// estimator used by github.com/willf/bloom (and therefore by
+// muscato_combine_filter).
+func EstimateParameters(n uint64, p float64) (uint64, int) {
+	if n == 0 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Ceil(math.Ln2 * m / float64(n))
+	return uint64(m), int(k)
+}
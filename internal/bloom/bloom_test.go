@@ -0,0 +1,161 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package bloom
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// bitArray is a standard (unblocked) Bloom filter, with each hash
+// value setting a bit anywhere in the array, as muscato_screen did
+// with a bitarray.BitArray before this package was added.  It uses the
+// same memory as a Filter of the same size.
+type bitArray []uint64
+
+func (a bitArray) add(h []uint64) {
+	n := uint64(len(a)) * 64
+	for _, x := range h {
+		x %= n
+		a[x/64] |= 1 << (x % 64)
+	}
+}
+
+func (a bitArray) test(h []uint64) bool {
+	n := uint64(len(a)) * 64
+	for _, x := range h {
+		x %= n
+		if a[x/64]&(1<<(x%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashValues returns n sets of k random hash values.
+func hashValues(n, k int, seed int64) [][]uint64 {
+	rng := rand.New(rand.NewSource(seed))
+	h := make([][]uint64, n)
+	for i := range h {
+		h[i] = make([]uint64, k)
+		for j := range h[i] {
+			h[i][j] = rng.Uint64()
+		}
+	}
+	return h
+}
+
+func TestFilter(t *testing.T) {
+
+	const n = 100000
+	nbits, k := EstimateParameters(n, 0.01)
+	f := New(nbits)
+	if f.Bits() < nbits || f.Bits()%blockBits != 0 {
+		t.Fatalf("Bits is %d for %d requested bits", f.Bits(), nbits)
+	}
+	if Bytes(nbits) != f.Bits()/8 {
+		t.Errorf("Bytes is %d, expected %d", Bytes(nbits), f.Bits()/8)
+	}
+
+	for _, h := range hashValues(n, k, 1) {
+		f.Add(h)
+	}
+	for _, h := range hashValues(n, k, 1) {
+		if !f.Test(h) {
+			t.Fatal("false negative")
+		}
+	}
+
+	// The blocked filter has a somewhat higher false positive rate
+	// than the target.
+	var nfp int
+	for _, h := range hashValues(n, k, 2) {
+		if f.Test(h) {
+			nfp++
+		}
+	}
+	if fpr := float64(nfp) / n; fpr > 0.03 {
+		t.Errorf("false positive rate is %.4f, expected about 0.01", fpr)
+	}
+	if r := f.FillRate(); r < 0.4 || r > 0.6 {
+		t.Errorf("fill rate is %.3f, expected about 0.5", r)
+	}
+}
+
+func TestShard(t *testing.T) {
+
+	// The shards are contiguous ranges of blocks, of nearly equal
+	// size.
+	f := New(1 << 20)
+	size := make([]int, 7)
+	last := 0
+	for block := uint64(0); block < f.nblock; block++ {
+		s := f.Shard([]uint64{block, 1, 2}, 7)
+		if s < last || s >= 7 {
+			t.Fatalf("block %d is in shard %d, following shard %d", block, s, last)
+		}
+		last = s
+		size[s]++
+	}
+	for _, n := range size {
+		if n < size[0]-1 || n > size[0]+1 {
+			t.Errorf("shard sizes %v are not nearly equal", size)
+		}
+	}
+}
+
+// The filters in the benchmarks are much larger than the CPU caches,
+// as in a real screen, with 20 hash values per window.
+const (
+	benchBits = 1 << 31
+	benchHash = 20
+)
+
+func BenchmarkAdd(b *testing.B) {
+
+	h := hashValues(1<<16, benchHash, 1)
+
+	b.Run("blocked", func(b *testing.B) {
+		f := New(benchBits)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f.Add(h[i%len(h)])
+		}
+	})
+
+	b.Run("bitarray", func(b *testing.B) {
+		a := make(bitArray, benchBits/64)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			a.add(h[i%len(h)])
+		}
+	})
+}
+
+func BenchmarkTest(b *testing.B) {
+
+	// Half of the tested values are in the filters.
+	h := hashValues(1<<16, benchHash, 1)
+	f := New(benchBits)
+	a := make(bitArray, benchBits/64)
+	for i := 0; i < len(h); i += 2 {
+		f.Add(h[i])
+		a.add(h[i])
+	}
+
+	b.Run("blocked", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.Test(h[i%len(h)])
+		}
+	})
+
+	b.Run("bitarray", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			a.test(h[i%len(h)])
+		}
+	})
+}
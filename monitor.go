@@ -0,0 +1,183 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// progress records how far the run has got, for the monitoring
+// server.
+type progress struct {
+	mu sync.Mutex
+
+	// The stage that is running, when it started, and the number
+	// of stages that have finished.
+	stage      string
+	stageStart time.Time
+	stagesDone int
+	numStages  int
+
+	// The jobs of the current stage that are run by runJobs (one
+	// per window in the confirm stage).
+	jobsDone  int
+	jobsTotal int
+
+	// The batch of windows being processed, if WindowBatch is set.
+	batch      int
+	numBatches int
+}
+
+var prog progress
+
+// monitorStatus is the response to /status.
+type monitorStatus struct {
+	State   string
+	PID     int
+	Host    string
+	Started time.Time
+
+	// The elapsed time of the run and of the current stage, in
+	// seconds.
+	Elapsed      float64
+	StageElapsed float64
+
+	Stage      string
+	StagesDone int
+	NumStages  int
+
+	JobsDone  int `json:",omitempty"`
+	JobsTotal int `json:",omitempty"`
+
+	Batch      int `json:",omitempty"`
+	NumBatches int `json:",omitempty"`
+
+	TempDir string
+	LogDir  string
+}
+
+// startProgress resets the progress at the start of a run with the
+// given number of stages.
+func startProgress(numStages int) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	prog.stage = ""
+	prog.stagesDone = 0
+	prog.numStages = numStages
+	prog.jobsDone, prog.jobsTotal = 0, 0
+	prog.batch, prog.numBatches = 0, 0
+}
+
+// progressStage records that a stage has started.
+func progressStage(stage string) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	prog.stage = stage
+	prog.stageStart = time.Now()
+	prog.jobsDone, prog.jobsTotal = 0, 0
+}
+
+// progressStageDone records that the current stage has finished.
+func progressStageDone() {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	prog.stagesDone++
+}
+
+// progressJobs records the number of jobs started by runJobs, and
+// the number that have finished.
+func progressJobs(done, total int) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	prog.jobsDone, prog.jobsTotal = done, total
+}
+
+// progressBatch records the batch of windows being processed.
+func progressBatch(batch, numBatches int) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+	prog.batch, prog.numBatches = batch, numBatches
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+
+	prog.mu.Lock()
+	st := monitorStatus{
+		State:      status.State,
+		PID:        status.PID,
+		Host:       status.Host,
+		Started:    status.Started,
+		Elapsed:    time.Since(status.Started).Seconds(),
+		Stage:      prog.stage,
+		StagesDone: prog.stagesDone,
+		NumStages:  prog.numStages,
+		JobsDone:   prog.jobsDone,
+		JobsTotal:  prog.jobsTotal,
+		Batch:      prog.batch,
+		NumBatches: prog.numBatches,
+		TempDir:    status.TempDir,
+		LogDir:     config.LogDir,
+	}
+	if prog.stage != "" {
+		st.StageElapsed = time.Since(prog.stageStart).Seconds()
+	}
+	prog.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(&st)
+}
+
+// serveConfig serves the configuration saved in the log directory,
+// which includes the settings chosen during the run, such as the
+// windows chosen using WindowStride.
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, path.Join(config.LogDir, "config.json"))
+}
+
+// startMonitor starts the HTTP server on MonitorPort of localhost,
+// which reports the progress of the run at /status, the
+// configuration at /config, and profiling data for the muscato
+// process at /debug/pprof/.  The returned function stops the server,
+// and may be called more than once.  It must be called after
+// startStatus, and the server must be stopped before finishStatus.
+func startMonitor() (func(), error) {
+
+	if config.MonitorPort == 0 {
+		return func() {}, nil
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", config.MonitorPort))
+	if err != nil {
+		return nil, fmt.Errorf("MonitorPort: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/config", serveConfig)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/pprof", http.RedirectHandler("/debug/pprof/", http.StatusMovedPermanently))
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	msg := fmt.Sprintf("Monitoring server listening on http://%s/status\n", ln.Addr())
+	io.WriteString(os.Stderr, msg)
+	logger.Print(msg)
+
+	return func() { srv.Close() }, nil
+}
@@ -0,0 +1,512 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+// Package muscato runs the Muscato pipeline, which matches a large
+// collection of sequencing reads against a large collection of target
+// sequences.  It is used by the muscato command, and can also be used
+// to embed Muscato in other Go programs, e.g.
+//
+//	config := &utils.Config{ReadFileName: "reads.fastq", ...}
+//	result, err := muscato.Run(context.Background(), config)
+//
+// The stages of the pipeline are carried out by the muscato_*
+// commands, which must be installed in the PATH or in $HOME/go/bin.
+// The pipeline stages share process-wide state, so only one run can
+// take place at a time in a process.  Concurrent calls to Run are
+// carried out one after another.
+package muscato
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kshedden/muscato/utils"
+)
+
+var (
+	configFilePath string
+
+	config *utils.Config
+
+	// Flag for setting the tmp file location for sorting.
+	sortTmpFlag string
+
+	logger *log.Logger
+
+	// The file underlying logger
+	logfid *os.File
+
+	sortpar string
+	sortmem string
+
+	// Only one run can take place at a time.
+	runMutex sync.Mutex
+
+	// The context of the current run.  All external commands are
+	// killed when it is cancelled.
+	runCtx context.Context
+)
+
+// Hooks contains functions that are called as the pipeline runs.
+// Either function may be nil.
+type Hooks struct {
+
+	// BeforeStage is called before each stage of the pipeline is
+	// run.  If it returns an error, the run is stopped.
+	BeforeStage func(stage string) error
+
+	// AfterStage is called after each stage of the pipeline
+	// completes, with the time taken by the stage and the error
+	// returned by the stage, if any.
+	AfterStage func(stage string, elapsed time.Duration, err error)
+}
+
+// Run carries out all stages of the Muscato pipeline using the given
+// configuration, and returns a summary of the run.  Defaults are
+// filled into config, and TempDir and LogDir are set to the
+// directories used by the run.  The temporary files are removed when
+// Run returns (unless NoCleanTemp is set), whether or not an error
+// occurred.  If ctx is cancelled, all running commands are killed,
+// the temporary files are removed, and an error wrapping ctx.Err() is
+// returned.  If the run fails once LogDir has been created, the
+// failure is described in error.json in LogDir (see ErrorManifest).
+func Run(ctx context.Context, config *utils.Config) (*RunResult, error) {
+	return RunWithHooks(ctx, config, nil)
+}
+
+// RunWithHooks is like Run, but calls the given hooks before and
+// after each stage of the pipeline.  The hooks may be nil.
+func RunWithHooks(ctx context.Context, cfg *utils.Config, hooks *Hooks) (res *RunResult, err error) {
+
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	config = cfg
+	runCtx = ctx
+	report = RunResult{}
+	warnings = utils.NewWarnings("muscato")
+	removed = make(map[string]manifestEntry)
+	timings = nil
+	stageCmds = nil
+	screenWindows = nil
+	failedStage = ""
+	stderrTail.reset()
+
+	if err := checkConfig(); err != nil {
+		return nil, err
+	}
+	if err := setupEnvs(); err != nil {
+		return nil, err
+	}
+	netfsNotes := checkNetworkFS()
+	if err := checkPipeDir(); err != nil {
+		return nil, err
+	}
+	if err := checkTempSpace(); err != nil {
+		return nil, err
+	}
+	if err := makeTemp(); err != nil {
+		return nil, err
+	}
+	defer cleanTmp()
+	defer cleanPipes()
+
+	// The logger is not available until after makeTemp runs.
+	if err := setupLog(); err != nil {
+		return nil, err
+	}
+	defer logfid.Close()
+	defer writeManifest()
+	defer writeTimings()
+	for _, msg := range netfsNotes {
+		logger.Print(msg)
+	}
+	logger.Printf("Using TempDir %s, from %s (the TempDir setting is used if given, then WorkDir, then $TMPDIR, then the current directory)\n",
+		config.TempDir, tempSource)
+	logger.Printf("Using %d CPUs: SortPar=%d, ScreenConcurrency=%d, ConfirmConcurrency=%d, MaxConfirmProcs=%d\n",
+		utils.NumCPU(), config.SortPar, config.ScreenConcurrency, config.ConfirmConcurrency, config.MaxConfirmProcs)
+
+	// The run is also cancelled if TempDir runs out of space.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	runCtx = ctx
+	stopMonitor := monitorTempSpace(cancel)
+	defer stopMonitor()
+
+	// Describe a failure for workflow systems.  This runs after
+	// recoverPanic, so that panics are included.
+	defer func() {
+		if err != nil {
+			writeErrorManifest(err)
+		}
+	}()
+
+	startStatus()
+	defer recoverPanic(&err)
+	stopServer, err := startMonitor()
+	if err != nil {
+		finishStatus(err)
+		return nil, err
+	}
+	// The deferred call closes the listener if runStages panics.
+	defer stopServer()
+	startWallClock()
+	err = runStages(ctx, hooks)
+	stopServer()
+	if err == nil && config.CheckCounts {
+		report.CountChecks = checkCounts()
+	}
+	report.Warnings = collectWarnings()
+	finishStatus(err)
+	if err != nil {
+		return nil, err
+	}
+
+	writeReport()
+	reportDuplication()
+
+	result := report
+	return &result, nil
+}
+
+// runStages runs the stages of the pipeline in order, stopping at
+// the first error that remains after any retries, unless the stage is
+// optional and AllowStatsFailure is set.
+func runStages(ctx context.Context, hooks *Hooks) error {
+
+	// Once the confirm stage, the first batch of windows, or the
+	// screen report (with ScreenOnly) has started, the run
+	// continues to the end even if MaxWallTime passes.
+	var atConfirm bool
+	sts := stages()
+	startProgress(len(sts))
+	for _, st := range sts {
+		failedStage = st.name
+		if st.name == "confirm" || st.name == "windowBatches" || st.name == "screenReport" {
+			atConfirm = true
+		}
+		if !atConfirm {
+			if err := checkWallTime(st.name); err != nil {
+				logger.Print(err)
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			err := context.Cause(ctx)
+			logger.Printf("Run cancelled before %s: %v", st.name, err)
+			return err
+		}
+		if hooks != nil && hooks.BeforeStage != nil {
+			if err := hooks.BeforeStage(st.name); err != nil {
+				logger.Printf("Run stopped before %s: %v", st.name, err)
+				return err
+			}
+		}
+		progressStage(st.name)
+		elapsed, err := runWithRetry(ctx, st)
+		noteFailures(st.name)
+		if hooks != nil && hooks.AfterStage != nil {
+			hooks.AfterStage(st.name, elapsed, err)
+		}
+		if ctx.Err() != nil {
+			// The error from the stage is usually just that
+			// a command was killed.
+			logger.Printf("%s interrupted: %v", st.name, err)
+			return fmt.Errorf("%s interrupted: %w", st.name, context.Cause(ctx))
+		}
+		if err != nil && !skipFailure(st.name, err) {
+			logger.Printf("%s failed: %v", st.name, err)
+			return fmt.Errorf("%s failed: %w", st.name, err)
+		}
+		releaseIntermediates(st.name)
+		progressStageDone()
+	}
+	failedStage = ""
+
+	return nil
+}
+
+// command is like exec.Command, but the process is killed if the
+// run is cancelled.  Each command is run in its own process group, so
+// that any processes that it starts are killed along with it.
+func command(name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(runCtx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	trackCommand(cmd)
+	return cmd
+}
+
+// stage is a named step of the pipeline.
+type stage struct {
+	name string
+	f    func() error
+}
+
+// stages returns the stages of the pipeline, in the order that they
+// are run.
+func stages() []stage {
+
+	st := []stage{
+		{"saveConfig", func() error { return saveConfig(config) }},
+	}
+	if config.ConfirmOnly != "" {
+		st = append(st, stage{"reuseScreen", reuseScreen})
+	} else if config.CacheDir != "" && cacheHit() {
+		st = append(st, stage{"restoreCache", restoreCache})
+	} else {
+		st = append(st, stage{"prepReads", prepReads})
+		if config.ExactTier {
+			st = append(st, stage{"exactTier", exactTier})
+		}
+		if config.WindowStride > 0 {
+			st = append(st, stage{"strideWindows", strideWindows})
+		}
+		if config.IndexSide == "auto" {
+			st = append(st, stage{"chooseIndexSide", chooseIndexSide})
+		}
+		if config.AutoBloom {
+			st = append(st, stage{"sizeBloom", sizeBloom})
+		}
+		if config.WindowBatch > 0 {
+			st = append(st, stage{"windowBatches", windowBatches})
+		} else if config.Streaming {
+			st = append(st, []stage{
+				{"streamWindows", func() error { return streamWindows(allWindows()) }},
+				{"streamScreen", func() error { return streamScreen(allWindows()) }},
+			}...)
+		} else {
+			st = append(st, []stage{
+				{"windowReads", func() error { return windowReads(allWindows()) }},
+				{"sortWindows", func() error { return sortWindows(allWindows()) }},
+				{"screen", func() error { return screen(allWindows()) }},
+				{"sortBloom", func() error { return sortBloom(allWindows()) }},
+			}...)
+		}
+		if config.CacheDir != "" {
+			st = append(st, stage{"saveCache", saveCache})
+		}
+	}
+	if config.ScreenOnly {
+		return append(st, stage{"screenReport", screenReport})
+	}
+	if config.WindowBatch == 0 {
+		st = append(st, stage{"confirm", confirm})
+	}
+	if config.RefineCommand != "" {
+		st = append(st, stage{"refine", refine})
+	}
+	st = append(st, stage{"combineWindows", combineWindows})
+	if config.BestHitFile != "" {
+		st = append(st, stage{"bestHits", bestHits})
+	}
+	st = append(st, stage{"sortByGeneId", sortByGeneId})
+	if config.GeneSampleSize > 0 {
+		st = append(st, stage{"downsampleGenes", downsampleGenes})
+	}
+	st = append(st, stage{"joinGeneNames", joinGeneNames})
+	if config.NoPerReadOutput {
+		st = append(st, stage{"geneMatches", geneMatches})
+	} else {
+		st = append(st, []stage{
+			{"joinReadNames", joinReadNames},
+			{"writeNonMatch", writeNonMatch},
+			{"genReadStats", genReadStats},
+		}...)
+	}
+	st = append(st, stage{"geneStats", geneStats})
+	if config.IndexResults {
+		st = append(st, stage{"indexResults", indexResults})
+	}
+	if config.PanelFileName != "" {
+		st = append(st, stage{"panelReport", panelReport})
+	}
+	if config.AssignMode != "" {
+		st = append(st, stage{"assignReads", assignReads})
+	}
+
+	return st
+}
+
+// saveConfig saves the configuration file in json format into the log
+// directory, and into the temporary directory so that its files can
+// be reused with ConfirmOnly.
+func saveConfig(config *utils.Config) error {
+
+	for _, dir := range []string{config.TempDir, config.LogDir} {
+		fid, err := os.Create(path.Join(dir, "config.json"))
+		if err != nil {
+			return err
+		}
+		err = json.NewEncoder(fid).Encode(config)
+		fid.Close()
+		if err != nil {
+			return err
+		}
+	}
+	configFilePath = path.Join(config.LogDir, "config.json")
+
+	return nil
+}
+
+func setupLog() error {
+	logname := path.Join(config.LogDir, "muscato.log")
+	fid, err := os.Create(logname)
+	if err != nil {
+		return err
+	}
+	logfid = fid
+	logger = log.New(fid, "", log.Ltime)
+
+	return nil
+}
+
+// checkConfig confirms that the required configuration parameters
+// are present and valid, and fills in defaults for the others (see
+// utils.Config.Validate), then sets up the locations used by the run.
+func checkConfig() error {
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if err := checkInputs(); err != nil {
+		return err
+	}
+
+	resolveTempDir()
+	if config.WorkDir != "" {
+		if err := useWorkDir(); err != nil {
+			return err
+		}
+	}
+	if !strings.HasSuffix(config.ReadFileName, ".fastq") {
+		msg := fmt.Sprintf("Warning: %s may not be a fastq file, continuing anyway\n",
+			config.ReadFileName)
+		os.Stderr.WriteString(msg)
+		warnings.Add("not_fastq", utils.SeverityWarning, "%s may not be a fastq file", config.ReadFileName)
+	}
+	if err := checkRetention(); err != nil {
+		return err
+	}
+
+	sortpar = fmt.Sprintf("--parallel=%d", config.SortPar)
+	sortmem = fmt.Sprintf("-S %s", config.SortMem)
+
+	// Configure the temporary directory for sort.
+	sortTmpFlag = ""
+	if config.SortTemp != "" {
+		if err := os.MkdirAll(config.SortTemp, os.ModePerm); err != nil {
+			return fmt.Errorf("cannot create SortTemp directory %s: %w", config.SortTemp, err)
+		}
+		sortTmpFlag = fmt.Sprintf("--temporary-directory=%s", config.SortTemp)
+	}
+
+	return nil
+}
+
+// checkInputs confirms that the read, gene and gene id files (and the
+// volumes of the gene files) exist.
+func checkInputs() error {
+
+	names := []string{config.ReadFileName}
+	for _, name := range []string{config.GeneFileName, config.GeneIdFileName} {
+		files, err := utils.TargetFiles(name)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMissingInput, err)
+		}
+		names = append(names, files...)
+	}
+
+	for _, name := range names {
+		if _, err := os.Stat(name); err != nil {
+			return fmt.Errorf("%w: %v", ErrMissingInput, err)
+		}
+	}
+
+	return nil
+}
+
+func setupEnvs() error {
+	err := os.Setenv("LC_ALL", "C")
+	if err != nil {
+		return err
+	}
+	if m := config.MemoryBytes(); m > 0 {
+		// The soft memory limit of the tools.
+		if err := os.Setenv("GOMEMLIMIT", strconv.FormatUint(m, 10)); err != nil {
+			return err
+		}
+	}
+	home := os.Getenv("HOME")
+	gopath := path.Join(home, "go")
+	err = os.Setenv("GOPATH", gopath)
+	if err != nil {
+		return err
+	}
+	return os.Setenv("PATH", os.Getenv("PATH")+":"+home+"/go/bin")
+}
+
+// Create the directory for all temporary files, if needed
+func makeTemp() error {
+
+	// temp files, log files, etc. are stored in directories defined by this unique id.
+	xuid, err := uuid.NewUUID()
+	if err != nil {
+		return err
+	}
+	uid := xuid.String()
+
+	// Overwrite the TempDir root with a subdirectory.
+	config.TempDir = path.Join(config.TempDir, uid)
+	err = os.MkdirAll(config.TempDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory %s: %w", config.TempDir, err)
+	}
+	if err := checkWritable(config.TempDir); err != nil {
+		return err
+	}
+
+	// Setup the directory for logging.
+	if config.LogDir == "" {
+		config.LogDir = "muscato_logs"
+	}
+	config.LogDir = path.Join(config.LogDir, uid)
+
+	err = os.MkdirAll(config.LogDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("cannot create log directory %s: %w", config.LogDir, err)
+	}
+
+	if err := makePipeDir(uid); err != nil {
+		return err
+	}
+
+	return workScratch()
+}
+
+// cleanTmp removes the temporary directory unless NoCleanTemp is set.
+// It is run whether or not the pipeline succeeds.
+func cleanTmp() {
+
+	if config.NoCleanTemp {
+		return
+	}
+
+	err := os.RemoveAll(config.TempDir)
+	if err != nil {
+		msg := fmt.Sprintf("Unable to remove temporary directory %s: %v\n", config.TempDir, err)
+		os.Stderr.WriteString(msg)
+	}
+}
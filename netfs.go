@@ -0,0 +1,71 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// existingDir returns the closest directory at or above p that
+// exists, so that the file system can be checked before the
+// directories are created.
+func existingDir(p string) string {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		q := path.Dir(p)
+		if q == p {
+			return p
+		}
+		p = q
+	}
+}
+
+// checkNetworkFS looks for results, temporary files or pipes placed
+// on a network file system such as NFS or AFS.  FIFOs are unreliable
+// or unsupported on these file systems, so FIFOs are replaced with
+// anonymous pipes.  Write errors may not be reported until a file is
+// synced, so result files are synced before they are closed.  The
+// returned messages are written to the log once it is available.
+func checkNetworkFS() []string {
+
+	var notes []string
+	note := func(msg string) {
+		os.Stderr.WriteString(msg + "\n")
+		notes = append(notes, msg)
+		warnings.Add("network_fs", utils.SeverityWarning, "%s", msg)
+	}
+
+	resdir := existingDir(path.Dir(config.ResultsFileName))
+	if fs := utils.NetworkFS(resdir); fs != "" {
+		note(fmt.Sprintf("ResultsFileName %s is on a network file system (%s)", config.ResultsFileName, fs))
+		if !config.SyncResults {
+			config.SyncResults = true
+			note("Setting SyncResults=true so that write errors are not silently lost")
+		}
+	}
+
+	tempdir := config.TempDir
+	if tempdir == "" {
+		tempdir = "."
+	}
+	if fs := utils.NetworkFS(existingDir(tempdir)); fs != "" {
+		note(fmt.Sprintf("TempDir %s is on a network file system (%s), file renaming and locking may be "+
+			"unreliable and performance may be poor, consider using a local disk", tempdir, fs))
+	}
+
+	if config.PipeDir != "" {
+		if fs := utils.NetworkFS(existingDir(config.PipeDir)); fs != "" {
+			note(fmt.Sprintf("PipeDir %s is on a network file system (%s), which may not support FIFOs", config.PipeDir, fs))
+			note("Using anonymous pipes instead of FIFOs")
+			config.PipeDir = ""
+		}
+	}
+
+	return notes
+}
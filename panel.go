@@ -0,0 +1,137 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// panelSummary counts the genes in a panel by their status.
+type panelSummary struct {
+	NumGenes   int
+	NumOK      int
+	NumLow     int
+	NumMissing int
+}
+
+// readPanel returns the gene identifiers in PanelFileName, one per
+// line.  Blank lines and lines starting with '#' are skipped.
+func readPanel() ([]string, error) {
+
+	fid, err := os.Open(config.PanelFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	var genes []string
+	scanner := bufio.NewScanner(fid)
+	for scanner.Scan() {
+		g := strings.TrimSpace(scanner.Text())
+		if g == "" || strings.HasPrefix(g, "#") {
+			continue
+		}
+		genes = append(genes, g)
+	}
+
+	return genes, scanner.Err()
+}
+
+// panelReport compares the gene statistics to the expected genes in
+// PanelFileName, and writes a file with one row per expected gene,
+// giving its number of matches, coverage breadth, mean depth, and its
+// status: "ok", "low" (fewer than PanelMinCount matches) or "missing"
+// (no matches).
+func panelReport() error {
+
+	io.WriteString(os.Stderr, "Checking gene panel...\n")
+
+	panel, err := readPanel()
+	if err != nil {
+		return err
+	}
+
+	rdr, err := utils.OpenResult(resultName("_genestats"))
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	// The genestats columns that are reported, by gene.
+	stats := make(map[string][][]byte)
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		f := bytes.Split(scanner.Bytes(), []byte("\t"))
+		if len(f) < 5 {
+			return fmt.Errorf("genestats line has %d fields, expected at least 5", len(f))
+		}
+		stats[string(f[0])] = [][]byte{
+			append([]byte(nil), f[1]...),
+			append([]byte(nil), f[3]...),
+			append([]byte(nil), f[4]...),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	out, err := utils.CreateResult(resultName("_panel"), config.CompressResults, config.SyncResults)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	wtr := bufio.NewWriter(out)
+
+	var ps panelSummary
+	for _, g := range panel {
+
+		n, breadth, depth := "0", "0.0000", "0.0000"
+		if st, ok := stats[g]; ok {
+			n, breadth, depth = string(st[0]), string(st[1]), string(st[2])
+		}
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			return err
+		}
+
+		var status string
+		switch {
+		case count == 0:
+			status = "missing"
+			ps.NumMissing++
+		case count < config.PanelMinCount:
+			status = "low"
+			ps.NumLow++
+		default:
+			status = "ok"
+			ps.NumOK++
+		}
+		ps.NumGenes++
+
+		if _, err := fmt.Fprintf(wtr, "%s\t%s\t%s\t%s\t%s\n", g, n, breadth, depth, status); err != nil {
+			return err
+		}
+	}
+
+	if err := wtr.Flush(); err != nil {
+		return err
+	}
+
+	logger.Printf("Panel: %d genes, %d ok, %d low, %d missing", ps.NumGenes, ps.NumOK, ps.NumLow, ps.NumMissing)
+	warnings.AddN(ps.NumMissing, "panel_missing", utils.SeverityWarning,
+		"Genes in the panel %s had no matches", config.PanelFileName)
+	warnings.AddN(ps.NumLow, "panel_low", utils.SeverityWarning,
+		"Genes in the panel %s had fewer than %d matches", config.PanelFileName, config.PanelMinCount)
+	report.Panel = &ps
+
+	return out.Close()
+}
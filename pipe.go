@@ -0,0 +1,139 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+)
+
+var (
+	// The FIFOs created by the current stage, removed by
+	// removeFifos when the stage ends.
+	fifos []string
+
+	// The subdirectory of PipeDir holding the FIFOs of the run,
+	// removed by cleanPipes.
+	pipeRunDir string
+)
+
+// inputPipe passes the standard output of one process to a
+// command-line file argument of another process.  This is needed for
+// commands like join that read from more than one input stream.
+//
+// By default, an anonymous OS pipe is used, and the consumer opens
+// it through /dev/fd.  If PipeDir is set, a named pipe (FIFO) in a
+// subdirectory of PipeDir for the run is used instead, so that
+// concurrent runs sharing a PipeDir do not collide.
+type inputPipe struct {
+
+	// The producer writes to this file
+	w *os.File
+
+	// The read end of an anonymous pipe, nil for a FIFO
+	r *os.File
+
+	// The consumer reads from this path
+	path string
+}
+
+// newInputPipe creates a pipe that can be read by the consumer
+// command, which must not yet have been started.  The name is used
+// to name the FIFO if FIFOs are used.
+func newInputPipe(consumer *exec.Cmd, name string) (*inputPipe, error) {
+
+	if config.PipeDir == "" {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		// ExtraFiles are numbered starting from 3 in the child.
+		consumer.ExtraFiles = append(consumer.ExtraFiles, r)
+		p := fmt.Sprintf("/dev/fd/%d", 2+len(consumer.ExtraFiles))
+		return &inputPipe{w: w, r: r, path: p}, nil
+	}
+
+	p := path.Join(config.PipeDir, name)
+	if err := syscall.Mkfifo(p, 0600); err != nil {
+		return nil, err
+	}
+	fifos = append(fifos, p)
+
+	// Opening a FIFO write-only blocks until it has a reader,
+	// opening it read-write does not.
+	w, err := os.OpenFile(p, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inputPipe{w: w, path: p}, nil
+}
+
+// Close releases the parent process's references to the pipe.  It
+// should be called once both the producer and consumer have started.
+func (p *inputPipe) Close() {
+	p.w.Close()
+	if p.r != nil {
+		p.r.Close()
+	}
+}
+
+// checkPipeDir confirms that FIFOs can be created in PipeDir, if it
+// is set.  Some network file systems do not support FIFOs.
+func checkPipeDir() error {
+
+	if config.PipeDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(config.PipeDir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create PipeDir %s: %w", config.PipeDir, err)
+	}
+
+	p := path.Join(config.PipeDir, fmt.Sprintf("muscato_check_%d", os.Getpid()))
+	if err := syscall.Mkfifo(p, 0600); err != nil {
+		return fmt.Errorf("unable to create a FIFO in PipeDir %s: %w", config.PipeDir, err)
+	}
+	os.Remove(p)
+
+	return nil
+}
+
+// makePipeDir replaces PipeDir, if it is set, with a subdirectory
+// named by the unique id of the run, and creates it.
+func makePipeDir(uid string) error {
+
+	if config.PipeDir == "" {
+		return nil
+	}
+
+	config.PipeDir = path.Join(config.PipeDir, uid)
+	if err := os.MkdirAll(config.PipeDir, os.ModePerm); err != nil {
+		return fmt.Errorf("unable to create PipeDir %s: %w", config.PipeDir, err)
+	}
+	pipeRunDir = config.PipeDir
+
+	return nil
+}
+
+// removeFifos removes the FIFOs that have been created, so that they
+// can be created again if the stage that used them is run again.
+func removeFifos() {
+	for _, p := range fifos {
+		os.Remove(p)
+	}
+	fifos = fifos[0:0]
+}
+
+// cleanPipes removes any FIFOs that were created during the run, and
+// the subdirectory of PipeDir that held them.
+func cleanPipes() {
+	removeFifos()
+	if pipeRunDir != "" {
+		os.Remove(pipeRunDir)
+		pipeRunDir = ""
+	}
+}
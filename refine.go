@@ -0,0 +1,195 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/utils"
+)
+
+// refineSummary is the number of read x gene pairs passed to
+// RefineCommand, and the number of matches that it accepted.
+type refineSummary struct {
+	Pairs   int
+	Matches int
+}
+
+// refineFiles returns the names of the files of pairs written by
+// muscato_confirm for the confirmed windows.
+func refineFiles() []string {
+	var names []string
+	for _, j := range confirmed {
+		names = append(names, fmt.Sprintf("refine_%d.txt.sz", j))
+	}
+	return names
+}
+
+// feedRefine writes the pairs in the refine files to w, and returns
+// the number of pairs.
+func feedRefine(w io.WriteCloser) (int, error) {
+
+	defer w.Close()
+
+	var n int
+	for _, name := range refineFiles() {
+		fid, err := os.Open(path.Join(config.TempDir, name))
+		if err != nil {
+			return n, err
+		}
+		scanner := bufio.NewScanner(snappy.NewReader(fid))
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		for scanner.Scan() {
+			n++
+			if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+				fid.Close()
+				return n, err
+			}
+		}
+		fid.Close()
+		if err := scanner.Err(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// parseRefined checks one line written by RefineCommand, and returns
+// it in the format of the confirmed matches, with the target number
+// padded.
+func parseRefined(line []byte, buf []byte) ([]byte, error) {
+
+	f := bytes.Split(line, []byte("\t"))
+	if len(f) != 5 {
+		return nil, fmt.Errorf("line has %d fields, expected 5 (read, target, position, mismatches, target number)", len(f))
+	}
+	if len(f[0]) == 0 || len(f[1]) == 0 {
+		return nil, fmt.Errorf("line has an empty read or target sequence")
+	}
+	for _, j := range []int{2, 3} {
+		if _, err := strconv.Atoi(string(f[j])); err != nil {
+			return nil, fmt.Errorf("field %d is not an integer: %v", j+1, err)
+		}
+	}
+	gene, err := strconv.ParseInt(string(f[4]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("target number is not an integer: %v", err)
+	}
+
+	buf = buf[0:0]
+	for j := 0; j < 4; j++ {
+		buf = append(buf, f[j]...)
+		buf = append(buf, '\t')
+	}
+	buf = utils.AppendPadded(buf, gene, 11)
+	return append(buf, '\n'), nil
+}
+
+// refine passes the read x gene pairs that did not agree to within
+// PMatch in muscato_confirm to RefineCommand, which is run by the
+// shell, and writes the matches that it accepts to
+// rmatch_refine.txt.sz, to be combined with the other matches.
+func refine() error {
+
+	io.WriteString(os.Stderr, "Refining candidate pairs...\n")
+
+	cmd := command("sh", "-c", config.RefineCommand)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	outname := path.Join(config.TempDir, "rmatch_refine.txt.sz")
+	out, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	wtr := utils.NewSnappyWriter(out, config.WriterBufferSize)
+
+	if err := cmd.Start(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	type fed struct {
+		n   int
+		err error
+	}
+	fc := make(chan fed, 1)
+	go func() {
+		n, err := feedRefine(stdin)
+		fc <- fed{n, err}
+	}()
+
+	var info refineSummary
+	var buf []byte
+	var perr error
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for lnum := 1; scanner.Scan(); lnum++ {
+		if perr != nil {
+			continue
+		}
+		buf, perr = parseRefined(scanner.Bytes(), buf)
+		if perr != nil {
+			perr = fmt.Errorf("RefineCommand output line %d: %w", lnum, perr)
+			continue
+		}
+		if _, perr = wtr.Write(buf); perr == nil {
+			info.Matches++
+		}
+	}
+	if err := scanner.Err(); err != nil && perr == nil {
+		perr = err
+	}
+
+	f := <-fc
+	info.Pairs = f.n
+	if err := cmd.Wait(); err != nil {
+		return cmdErr(cmd, err)
+	}
+	if perr != nil {
+		return perr
+	}
+	// The command need not read all of the pairs.
+	if f.err != nil && !errors.Is(f.err, syscall.EPIPE) {
+		return f.err
+	}
+
+	if err := wtr.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := utils.WriteLayout(outname, utils.MatchColumns); err != nil {
+		return err
+	}
+
+	logger.Printf("RefineCommand accepted %d matches from %d pairs", info.Matches, info.Pairs)
+
+	fid, err := os.Create(path.Join(config.LogDir, "refineinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	return json.NewEncoder(fid).Encode(info)
+}
@@ -0,0 +1,405 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// stageTime records the wall-clock time used by one stage of the
+// pipeline.
+type stageTime struct {
+	Stage   string
+	Seconds float64
+}
+
+// RunResult consolidates the statistics produced by the various
+// stages of a Muscato run.  It is returned by Run, and is written to
+// run_report.json in the log directory when the run completes.
+type RunResult struct {
+
+	// The number of reads in the input file, and the number that
+	// were skipped for being too short.
+	NumInput   int
+	NumSkipped int
+
+	// The number of reads and bases removed by trimming, if
+	// Adapters or QualityTrim is set.
+	Trimming *trimSummary `json:",omitempty"`
+
+	// The total number of reads, including duplicates.
+	NumReads int
+
+	// The number of distinct read sequences.
+	NumUnique int
+
+	// The number of reads with the same sequence and UMI as another
+	// read, if UMI is set.  The read counts below count these reads
+	// once.
+	NumDuplicates int
+
+	// The proportion of the reads with distinct sequences
+	// (NumUnique / NumReads), and the histogram of the number of
+	// reads with each distinct sequence.  A low proportion
+	// suggests a library with many PCR duplicates.
+	UniqueFraction float64
+	Duplication    []duplicationBin `json:",omitempty"`
+
+	// The estimated fill rate of the Bloom filter for each window.
+	BloomFillRates []float64
+
+	// The estimated memory in bytes used by the Bloom filters in
+	// muscato_screen.
+	BloomMemory uint64 `json:",omitempty"`
+
+	// The collection held in memory by muscato_screen, "reads" or
+	// "targets" (see IndexSide).
+	IndexSide string `json:",omitempty"`
+
+	// The number of distinct read sequences that were, or were
+	// not matched to at least one target.
+	MatchedSeqs   int
+	UnmatchedSeqs int
+
+	// The number of reads (including duplicates) that were, or
+	// were not matched to at least one target.
+	MatchedReads   int
+	UnmatchedReads int
+
+	// The number of distinct read sequences and reads matched by
+	// each tier, and the proportion of all reads that they
+	// represent, if ExactTier is set.  The "exact" tier holds the
+	// reads resolved by muscato_exact, and the "approximate" tier
+	// holds the other matched reads.
+	Tiers []tierSummary `json:",omitempty"`
+
+	// The number of targets with more than GeneSampleSize
+	// matches, and the total and retained number of their
+	// matches, if GeneSampleSize is set.
+	Downsampling *downsampleSummary `json:",omitempty"`
+
+	// The number of read x gene pairs passed to RefineCommand,
+	// and the number of matches that it accepted, if RefineCommand
+	// is set.
+	Refine *refineSummary `json:",omitempty"`
+
+	// The number of matches that did not lie within their target
+	// and were removed from the results.  These indicate a
+	// coordinate error, and are listed in position_violations.txt
+	// in the log directory.
+	PositionViolations int `json:",omitempty"`
+
+	// Partial is true if MaxWallTime passed during the confirm
+	// stage, so that the windows in SkippedWindows were not
+	// confirmed, and the results only contain the matches found
+	// in the other windows.
+	Partial        bool  `json:",omitempty"`
+	SkippedWindows []int `json:",omitempty"`
+
+	// The optional stages that failed, if AllowStatsFailure is
+	// set, so that their outputs are missing or incomplete.
+	FailedStages []string `json:",omitempty"`
+
+	// The wall-clock time of each stage.
+	Stages []stageTime
+
+	// The reconciliation of read counts between stages, if
+	// CheckCounts is set.
+	CountChecks []countCheck `json:",omitempty"`
+
+	// The number of unmatched distinct read sequences and reads
+	// with each reason, and the proportion of the unmatched reads
+	// that they represent, if UnmatchedReasons is set.
+	UnmatchedReasons []reasonSummary `json:",omitempty"`
+
+	// The known adapter sequences found in the unmatched reads,
+	// and the most frequent k-mers among them.
+	Contamination *contamination `json:",omitempty"`
+
+	// The candidate matches found by the screen, and the work
+	// needed to confirm them, if ScreenOnly is set.
+	Screen *screenSummary `json:",omitempty"`
+
+	// The number of genes in the panel with each status, if
+	// PanelFileName is set.
+	Panel *panelSummary `json:",omitempty"`
+
+	// The warnings noted during the run.
+	Warnings []utils.Warning
+
+	// The configuration used for the run.
+	Config *utils.Config
+}
+
+var report RunResult
+
+// duplicationBin is one bin of the histogram of the number of reads
+// with each distinct sequence, counting the sequences with between
+// MinReads and MaxReads reads (with no upper limit if MaxReads is
+// zero), and their reads.
+type duplicationBin struct {
+	MinReads int
+	MaxReads int
+	Seqs     int
+	Reads    int
+}
+
+// tierSummary is the number of read sequences and reads matched by
+// one matching tier.
+type tierSummary struct {
+	Tier     string
+	Seqs     int
+	Reads    int
+	Fraction float64
+}
+
+// reasonSummary is the number of unmatched read sequences and reads
+// with one reason, written by muscato_nonmatch.
+type reasonSummary struct {
+	Reason   string
+	Seqs     int
+	Reads    int
+	Fraction float64
+}
+
+// downsampleSummary is the summary of the targets downsampled by
+// muscato_downsample.
+type downsampleSummary struct {
+	Genes    int
+	Matches  int
+	Retained int
+}
+
+// trimSummary is the number of reads trimmed by muscato_prep_reads,
+// and the number of bases removed, for low quality and for adapters,
+// along with the number of reads skipped for being too short after
+// trimming.
+type trimSummary struct {
+	QualityReads int
+	QualityBases int
+	AdapterReads int
+	AdapterBases int
+	ShortReads   int
+}
+
+// contamination is the summary of the adapters in the unmatched reads
+// written by muscato_nonmatch.
+type contamination struct {
+
+	// The total number of unmatched reads.
+	UnmatchedReads int
+
+	// The number and proportion of the unmatched reads containing
+	// each adapter that was found.
+	Adapters []struct {
+		Name     string
+		Sequence string
+		Reads    int
+		Fraction float64
+	}
+
+	// The most frequent k-mers in a sample of the unmatched reads,
+	// with the number and proportion of the sampled reads that
+	// contain them, and the adapter that they identify, if any.
+	SampledReads int
+	TopKmers     []struct {
+		Kmer     string
+		Reads    int
+		Fraction float64
+		Adapter  string `json:",omitempty"`
+	}
+}
+
+// runStage runs one stage of the pipeline and records its wall-clock
+// time and resource usage.
+func runStage(name string, f func() error) (time.Duration, error) {
+	logger.Printf("Starting %s...\n", name)
+	ru := selfUsage()
+	start := time.Now()
+	err := f()
+	elapsed := time.Since(start)
+	report.Stages = append(report.Stages, stageTime{name, elapsed.Seconds()})
+	recordUsage(name, elapsed, ru)
+	return elapsed, err
+}
+
+// readInfo reads a JSON file written into the log directory by one of
+// the pipeline stages.
+func readInfo(name string, v interface{}) {
+	fid, err := os.Open(path.Join(config.LogDir, name))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	if err := json.NewDecoder(fid).Decode(v); err != nil {
+		logger.Print(err)
+	}
+}
+
+// writeReport collects the statistics saved by the pipeline stages
+// and writes run_report.json into the log directory.
+func writeReport() {
+
+	var prepinfo struct {
+		NumInput   int
+		NumSkipped int
+		Trimming   *trimSummary
+	}
+	readInfo("prepinfo.json", &prepinfo)
+	report.NumInput = prepinfo.NumInput
+	report.NumSkipped = prepinfo.NumSkipped
+	report.Trimming = prepinfo.Trimming
+
+	var seqinfo struct {
+		NumUnique     int
+		NumTotal      int
+		NumDuplicates int
+		Duplication   []duplicationBin
+	}
+	readInfo("seqinfo.json", &seqinfo)
+	report.NumReads = seqinfo.NumTotal
+	report.NumUnique = seqinfo.NumUnique
+	report.NumDuplicates = seqinfo.NumDuplicates
+	report.Duplication = seqinfo.Duplication
+	if report.NumReads > 0 {
+		report.UniqueFraction = float64(report.NumUnique) / float64(report.NumReads)
+	}
+
+	var bloominfo struct {
+		FillRates []float64
+	}
+	readInfo("bloominfo.json", &bloominfo)
+	report.BloomFillRates = bloominfo.FillRates
+	if config.IndexSide != "auto" {
+		report.IndexSide = config.IndexSide
+	}
+
+	var matchinfo struct {
+		MatchedSeqs    int
+		UnmatchedSeqs  int
+		MatchedReads   int
+		UnmatchedReads int
+	}
+	readInfo("matchinfo.json", &matchinfo)
+	report.MatchedSeqs = matchinfo.MatchedSeqs
+	report.UnmatchedSeqs = matchinfo.UnmatchedSeqs
+	report.MatchedReads = matchinfo.MatchedReads
+	report.UnmatchedReads = matchinfo.UnmatchedReads
+
+	if config.ExactTier {
+		reportTiers()
+	}
+
+	if config.RefineCommand != "" {
+		report.Refine = new(refineSummary)
+		readInfo("refineinfo.json", report.Refine)
+	}
+
+	if config.GeneSampleSize > 0 {
+		report.Downsampling = new(downsampleSummary)
+		readInfo("downsampleinfo.json", report.Downsampling)
+	}
+
+	if config.UnmatchedReasons {
+		var unmatchedinfo struct {
+			Reasons []reasonSummary
+		}
+		readInfo("unmatchedinfo.json", &unmatchedinfo)
+		for i := range unmatchedinfo.Reasons {
+			if report.UnmatchedReads > 0 {
+				unmatchedinfo.Reasons[i].Fraction = float64(unmatchedinfo.Reasons[i].Reads) / float64(report.UnmatchedReads)
+			}
+		}
+		report.UnmatchedReasons = unmatchedinfo.Reasons
+	}
+
+	if _, err := os.Stat(path.Join(config.LogDir, "adapterinfo.json")); err == nil {
+		report.Contamination = new(contamination)
+		readInfo("adapterinfo.json", report.Contamination)
+	}
+
+	report.Config = config
+
+	fid, err := os.Create(path.Join(config.LogDir, "run_report.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(&report); err != nil {
+		logger.Print(err)
+	}
+}
+
+// reportTiers fills in the number of reads matched by each tier.  The
+// approximate tier is only included if the matched reads were counted
+// by muscato_nonmatch.
+func reportTiers() {
+
+	var exactinfo struct {
+		Seqs  int
+		Reads int
+	}
+	readInfo("exactinfo.json", &exactinfo)
+
+	tiers := []tierSummary{{Tier: "exact", Seqs: exactinfo.Seqs, Reads: exactinfo.Reads}}
+	if report.MatchedReads > 0 {
+		tiers = append(tiers, tierSummary{
+			Tier:  "approximate",
+			Seqs:  report.MatchedSeqs - exactinfo.Seqs,
+			Reads: report.MatchedReads - exactinfo.Reads,
+		})
+	}
+	for i := range tiers {
+		if report.NumReads > 0 {
+			tiers[i].Fraction = float64(tiers[i].Reads) / float64(report.NumReads)
+		}
+		logger.Printf("The %s tier matched %d sequences (%d reads, %.4f of all reads)",
+			tiers[i].Tier, tiers[i].Seqs, tiers[i].Reads, tiers[i].Fraction)
+	}
+	report.Tiers = tiers
+}
+
+// reportDuplication prints the proportion of distinct read sequences
+// and the duplication histogram, and adds them to the log.
+func reportDuplication() {
+
+	if report.NumReads == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Read duplication: %d reads with %d distinct sequences (%.1f%% distinct)\n",
+		report.NumReads, report.NumUnique, 100*report.UniqueFraction)
+	if len(report.Duplication) > 0 {
+		buf.WriteString("Reads per sequence\tSequences\tReads\n")
+	}
+	for _, b := range report.Duplication {
+		if b.Seqs == 0 {
+			continue
+		}
+		switch {
+		case b.MaxReads == 0:
+			fmt.Fprintf(&buf, ">%d", b.MinReads-1)
+		case b.MinReads == b.MaxReads:
+			fmt.Fprintf(&buf, "%d", b.MinReads)
+		default:
+			fmt.Fprintf(&buf, "%d-%d", b.MinReads, b.MaxReads)
+		}
+		fmt.Fprintf(&buf, "\t%d\t%d\n", b.Seqs, b.Reads)
+	}
+
+	io.WriteString(os.Stderr, buf.String())
+	logger.Print(buf.String())
+}
@@ -0,0 +1,215 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// manifestEntry describes one intermediate file in the manifest.
+type manifestEntry struct {
+
+	// The file name, relative to TempDir.
+	File string
+
+	// The kind of intermediate file.
+	Kind string
+
+	// The size of the file in bytes, when it was removed or at the
+	// end of the run.
+	Bytes int64
+
+	// True if the file was removed before the end of the run.
+	Removed bool
+
+	// The point in the run after which the file was removed.
+	RemovedAfter string `json:",omitempty"`
+}
+
+// Intermediate files that were removed before the end of the run,
+// indexed by file name.
+var removed = make(map[string]manifestEntry)
+
+// intermediate is a kind of intermediate file written to TempDir.
+type intermediate struct {
+
+	// The name of the kind, as used in Config.Retention.
+	kind string
+
+	// The stage after which the files are no longer needed.
+	lastUse string
+
+	// The names of the files, relative to TempDir.
+	files func() []string
+}
+
+// perWindow returns the names of the files for one kind of
+// per-window intermediate file.
+func perWindow(format string) func() []string {
+	return func() []string {
+		var files []string
+		for k := range config.Windows {
+			files = append(files, fmt.Sprintf(format, k))
+		}
+		return files
+	}
+}
+
+// single returns the name of an intermediate file that is not
+// specific to a window.
+func single(name string) func() []string {
+	return func() []string {
+		return []string{name}
+	}
+}
+
+// readStatusFiles returns the names of the read status files written
+// if UnmatchedReasons is set, one for each batch of windows by
+// muscato_window_reads, and one for each window by muscato_confirm.
+// The files that were already removed are included.
+func readStatusFiles() []string {
+	names, _ := filepath.Glob(path.Join(config.TempDir, "readstatus_*.bin"))
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	for name := range removed {
+		if strings.HasPrefix(name, "readstatus_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+var intermediates = []intermediate{
+	{"reads_sorted", "writeNonMatch", single("reads_sorted.txt.sz")},
+	{"win", "sortWindows", perWindow("win_%d.txt.sz")},
+	{"win_sorted", "confirm", perWindow("win_%d_sorted.txt.sz")},
+	{"bmatch", "sortBloom", perWindow("bmatch_%d.txt.sz")},
+	{"smatch", "confirm", perWindow("smatch_%d.txt.sz")},
+	{"rmatch", "combineWindows", perWindow("rmatch_%d.txt.sz")},
+	{"exact", "combineWindows", func() []string { return []string{"exact_reads.txt.sz", "rmatch_exact.txt.sz"} }},
+	{"refine", "combineWindows", func() []string { return append(perWindow("refine_%d.txt.sz")(), "rmatch_refine.txt.sz") }},
+	{"besthit", "bestHits", single("besthit.txt.sz")},
+	{"readstatus", "writeNonMatch", readStatusFiles},
+	{"matches", "sortByGeneId", single("matches.txt.sz")},
+	{"matches_sg", "joinGeneNames", single("matches_sg.txt.sz")},
+	{"downsampled", "writeNonMatch", single("downsampled_reads.txt.sz")},
+	{"matches_sn", "joinReadNames", single("matches_sn.txt.sz")},
+	{"matches_gs", "geneStats", single("matches_gs.txt.sz")},
+}
+
+// checkRetention confirms that Config.Retention is a comma-separated
+// list of "all", "none", or intermediate kinds.
+func checkRetention() error {
+
+	if config.Retention == "" {
+		config.Retention = "all"
+	}
+
+	for _, r := range strings.Split(config.Retention, ",") {
+		r = strings.TrimSpace(r)
+		if r == "all" || r == "none" {
+			continue
+		}
+		var ok bool
+		for _, im := range intermediates {
+			if im.kind == r {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return utils.NewConfigError("Retention", utils.ErrInvalid, "unknown intermediate file kind '%s' in Retention", r)
+		}
+	}
+
+	return nil
+}
+
+// retained returns true if the files of the given kind should be
+// kept until the end of the run.
+func retained(kind string) bool {
+	for _, r := range strings.Split(config.Retention, ",") {
+		r = strings.TrimSpace(r)
+		if r == "all" || r == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseIntermediates deletes the intermediate files that are no
+// longer needed once the given stage has completed, unless they are
+// retained.
+func releaseIntermediates(stage string) {
+
+	for _, im := range intermediates {
+		if im.lastUse != stage || retained(im.kind) {
+			continue
+		}
+		for _, f := range im.files() {
+			removeIntermediate(im.kind, f, stage)
+		}
+	}
+}
+
+// removeIntermediate deletes one file from TempDir, and records the
+// deletion in the manifest.  Failure to delete the file is not an
+// error, since the file will be removed with the rest of TempDir at
+// the end of the run.
+func removeIntermediate(kind, name, after string) {
+	fn := path.Join(config.TempDir, name)
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(fn); err != nil {
+		logger.Printf("Unable to remove %s: %v", fn, err)
+		return
+	}
+	logger.Printf("Removed %s", fn)
+	removed[name] = manifestEntry{File: name, Kind: kind, Bytes: fi.Size(), Removed: true, RemovedAfter: after}
+}
+
+// writeManifest writes intermediate_manifest.json into the log
+// directory, listing every intermediate file produced by the run,
+// its size, and whether and when it was removed early.  It must be
+// called before TempDir is removed.
+func writeManifest() {
+
+	var entries []manifestEntry
+	for _, im := range intermediates {
+		for _, f := range im.files() {
+			if e, ok := removed[f]; ok {
+				entries = append(entries, e)
+				continue
+			}
+			fi, err := os.Stat(path.Join(config.TempDir, f))
+			if err != nil {
+				continue
+			}
+			entries = append(entries, manifestEntry{File: f, Kind: im.kind, Bytes: fi.Size()})
+		}
+	}
+
+	fid, err := os.Create(path.Join(config.LogDir, "intermediate_manifest.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(entries); err != nil {
+		logger.Print(err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// optionalStages are the stages that are not needed for the results,
+// whose failure is only a warning if AllowStatsFailure is set.
+var optionalStages = map[string]bool{
+	"genReadStats": true,
+	"geneStats":    true,
+	"panelReport":  true,
+}
+
+// retryable returns true if a stage error is likely to be transient,
+// so that running the stage again may succeed.  These are commands
+// that were killed by a signal (SIGKILL from the out-of-memory
+// killer, SIGTERM, or SIGPIPE when the next command in a pipeline was
+// killed), and commands that could not be started for lack of memory
+// or processes.  Commands that exited with an error status fail the
+// same way when run again, so they are fatal.
+func retryable(err error) bool {
+
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		ws, ok := ee.Sys().(syscall.WaitStatus)
+		if !ok || !ws.Signaled() {
+			return false
+		}
+		switch ws.Signal() {
+		case syscall.SIGKILL, syscall.SIGTERM, syscall.SIGPIPE:
+			return true
+		}
+		return false
+	}
+
+	return errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.EAGAIN)
+}
+
+// runPipeline starts a pipeline of commands connected by the given
+// pipes, and waits for all of them to finish.  The pipe ends held by
+// this process are closed once the commands have started, so that if
+// one command is killed, its neighbors see the broken pipe and exit
+// rather than waiting forever.  The first error is returned, except
+// that a command killed by SIGPIPE is only reported if no other
+// command failed, since the cause is usually a failure further along
+// the pipeline.
+func runPipeline(cmds []*exec.Cmd, pipes ...*os.File) error {
+
+	var err error
+	var started []*exec.Cmd
+	for _, cmd := range cmds {
+		if err = cmd.Start(); err != nil {
+			err = cmdErr(cmd, err)
+			break
+		}
+		started = append(started, cmd)
+	}
+
+	for _, p := range pipes {
+		p.Close()
+	}
+
+	var pipeErr error
+	for _, cmd := range started {
+		e := cmd.Wait()
+		if e == nil {
+			continue
+		}
+		e = cmdErr(cmd, e)
+		var ee *exec.ExitError
+		if errors.As(e, &ee) {
+			if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE {
+				if pipeErr == nil {
+					pipeErr = e
+				}
+				continue
+			}
+		}
+		if err == nil {
+			err = e
+		}
+	}
+	if err == nil {
+		err = pipeErr
+	}
+
+	return err
+}
+
+// runWithRetry runs a stage, running it again up to StageRetries
+// times if it fails with a retryable error.  The wait before the
+// first retry is RetryDelay, and is doubled before each further
+// retry.  Every stage writes its outputs from the beginning, and the
+// FIFOs of a stage (if PipeDir is set) are removed after each attempt,
+// so it can be run again after a failure.
+func runWithRetry(ctx context.Context, st stage) (time.Duration, error) {
+
+	delay, _ := time.ParseDuration(config.RetryDelay)
+	for attempt := 1; ; attempt++ {
+		elapsed, err := runStage(st.name, st.f)
+		removeFifos()
+		if err == nil || ctx.Err() != nil || attempt > config.StageRetries || !retryable(err) {
+			return elapsed, err
+		}
+
+		msg := fmt.Sprintf("%s failed (%v), retrying in %v (retry %d of %d)", st.name, err, delay, attempt, config.StageRetries)
+		logger.Print(msg)
+		io.WriteString(os.Stderr, msg+"\n")
+		warnings.Add("stage_retry", utils.SeverityWarning, "%s failed with a retryable error (%v) and was run again", st.name, err)
+
+		select {
+		case <-ctx.Done():
+			return elapsed, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// skipFailure returns true if the failure of a stage can be recorded
+// as a warning, so that the run continues.
+func skipFailure(name string, err error) bool {
+
+	if !config.AllowStatsFailure || !optionalStages[name] {
+		return false
+	}
+
+	logger.Printf("%s failed, continuing since AllowStatsFailure is set: %v", name, err)
+	io.WriteString(os.Stderr, fmt.Sprintf("%s failed, continuing without it: %v\n", name, err))
+	warnings.Add("stage_failed", utils.SeverityWarning, "%s failed (%v), its output is missing or incomplete", name, err)
+	report.FailedStages = append(report.FailedStages, name)
+
+	return true
+}
@@ -0,0 +1,56 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// TestRetryFifo retries a stage that uses a FIFO, after it fails with
+// a command killed by SIGKILL.
+func TestRetryFifo(t *testing.T) {
+
+	config = new(utils.Config)
+	config.PipeDir = t.TempDir()
+	config.StageRetries = 2
+	config.RetryDelay = "1ms"
+	logger = log.New(io.Discard, "", 0)
+	warnings = utils.NewWarnings("muscato")
+	if err := makePipeDir("run"); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanPipes()
+
+	var attempts int
+	var fifo string
+	f := func() error {
+		attempts++
+		p, err := newInputPipe(exec.Command("cat"), "matches_sg")
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		fifo = p.path
+		if attempts == 1 {
+			return exec.Command("sh", "-c", "kill -9 $$").Run()
+		}
+		return nil
+	}
+
+	if _, err := runWithRetry(context.Background(), stage{"joinGeneNames", f}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("the stage was run %d times, expected 2", attempts)
+	}
+	if _, err := os.Stat(fifo); !os.IsNotExist(err) {
+		t.Errorf("the FIFO %s was not removed after the stage: %v", fifo, err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+)
+
+// A job is one external command run by runJobs.  The work is an
+// estimate of the time the job takes, in arbitrary units.
+type job struct {
+	name string
+	work int64
+	cmd  func() *exec.Cmd
+}
+
+// runJobs runs the jobs, with at most maxprocs running at once.  The
+// jobs with the most work are started first, and a new job is started
+// as soon as any job finishes, so that a large job does not start
+// near the end and run alone.  If a job fails, no further jobs are
+// started, and the first error is returned once the running jobs have
+// finished.  If stop is not nil, it is called before each job is
+// started, and once it returns true no further jobs are started; the
+// jobs that were not started are returned.
+func runJobs(jobs []job, maxprocs int, stop func() bool) ([]job, error) {
+
+	if maxprocs < 1 {
+		maxprocs = 1
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].work > jobs[j].work })
+	progressJobs(0, len(jobs))
+
+	type result struct {
+		name    string
+		cmd     *exec.Cmd
+		err     error
+		elapsed time.Duration
+	}
+	results := make(chan result)
+
+	var running, done int
+	var first error
+	var skipped []job
+	for i := 0; i < len(jobs) || running > 0; {
+
+		if first == nil && i < len(jobs) && running < maxprocs {
+			if stop != nil && stop() {
+				logger.Printf("Not starting the remaining %d jobs\n", len(jobs)-i)
+				skipped = jobs[i:]
+				i = len(jobs)
+				continue
+			}
+			j := jobs[i]
+			i++
+			cmd := j.cmd()
+			logger.Printf("Starting %s (estimated work %d)\n", j.name, j.work)
+			if err := cmd.Start(); err != nil {
+				first = cmdErr(cmd, err)
+				continue
+			}
+			running++
+			go func() {
+				start := time.Now()
+				err := cmd.Wait()
+				results <- result{j.name, cmd, err, time.Since(start)}
+			}()
+			continue
+		}
+
+		if running == 0 {
+			// A job failed to start, and none are running.
+			break
+		}
+
+		r := <-results
+		running--
+		done++
+		progressJobs(done, len(jobs))
+		if r.err != nil {
+			if first == nil {
+				first = cmdErr(r.cmd, r.err)
+			}
+			continue
+		}
+		logger.Printf("%s done in %.1f seconds\n", r.name, r.elapsed.Seconds())
+	}
+
+	return skipped, first
+}
+
+// fileSize returns the size of a file, or zero if it cannot be
+// determined.
+func fileSize(name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
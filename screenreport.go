@@ -0,0 +1,230 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// windowScreen describes the candidate matches found by the screen
+// for one window, and the work that confirming them would take.
+type windowScreen struct {
+	Window int
+
+	// The number of distinct read sequences with a subsequence in
+	// the window (the lines of the sorted window file).
+	Seqs int
+
+	// The number of candidate matches in the targets.
+	Candidates int
+
+	// The number of candidate matches whose window subsequence is
+	// not that of any read, which are false positives of the Bloom
+	// filter.
+	FalsePositives int
+
+	// The number of read and candidate pairs with the same window
+	// subsequence, each of which is compared by muscato_confirm.
+	Comparisons int64
+
+	// The total size in bytes of the files read by muscato_confirm.
+	Bytes int64
+}
+
+// screenSummary is the result of a run with ScreenOnly set.
+type screenSummary struct {
+	Windows []windowScreen
+
+	Candidates     int
+	FalsePositives int
+	Comparisons    int64
+	Bytes          int64
+}
+
+var (
+	screenMu      sync.Mutex
+	screenWindows []windowScreen
+)
+
+// keyGroups reads a sorted intermediate file, and counts the lines
+// with each distinct key (the text before the first tab).
+type keyGroups struct {
+	scanner *bufio.Scanner
+	pending []byte
+	more    bool
+
+	key []byte
+	n   int
+}
+
+func newKeyGroups(r io.Reader) *keyGroups {
+	kg := &keyGroups{scanner: bufio.NewScanner(r)}
+	kg.scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	kg.more = kg.scan()
+	return kg
+}
+
+// scan reads the key of the next line into pending.
+func (kg *keyGroups) scan() bool {
+	if !kg.scanner.Scan() {
+		return false
+	}
+	line := kg.scanner.Bytes()
+	if i := bytes.IndexByte(line, '\t'); i >= 0 {
+		line = line[0:i]
+	}
+	kg.pending = append(kg.pending[0:0], line...)
+	return true
+}
+
+// next advances to the next key, returning false when there are no
+// more keys.
+func (kg *keyGroups) next() bool {
+	if !kg.more {
+		return false
+	}
+	kg.key = append(kg.key[0:0], kg.pending...)
+	kg.n = 1
+	for {
+		if kg.more = kg.scan(); !kg.more {
+			break
+		}
+		if !bytes.Equal(kg.pending, kg.key) {
+			break
+		}
+		kg.n++
+	}
+	return true
+}
+
+// screenWindow merges the sorted window file and sorted candidate
+// matches of window k in the same way as muscato_confirm, but only
+// counts the pairs that would be compared.
+func screenWindow(k int) (windowScreen, error) {
+
+	ws := windowScreen{Window: k}
+	wname := path.Join(config.TempDir, fmt.Sprintf("win_%d_sorted.txt.sz", k))
+	mname := path.Join(config.TempDir, fmt.Sprintf("smatch_%d.txt.sz", k))
+	ws.Bytes = fileSize(wname) + fileSize(mname)
+
+	wf, err := utils.OpenResult(wname)
+	if err != nil {
+		return ws, err
+	}
+	defer wf.Close()
+	mf, err := utils.OpenResult(mname)
+	if err != nil {
+		return ws, err
+	}
+	defer mf.Close()
+
+	wg := newKeyGroups(wf)
+	mg := newKeyGroups(mf)
+	wok, mok := wg.next(), mg.next()
+	for wok || mok {
+		var c int
+		switch {
+		case !mok:
+			c = -1
+		case !wok:
+			c = 1
+		default:
+			c = bytes.Compare(wg.key, mg.key)
+		}
+		switch {
+		case c < 0:
+			ws.Seqs += wg.n
+			wok = wg.next()
+		case c > 0:
+			ws.Candidates += mg.n
+			ws.FalsePositives += mg.n
+			mok = mg.next()
+		default:
+			ws.Seqs += wg.n
+			ws.Candidates += mg.n
+			ws.Comparisons += int64(wg.n) * int64(mg.n)
+			wok, mok = wg.next(), mg.next()
+		}
+	}
+	if err := wg.scanner.Err(); err != nil {
+		return ws, err
+	}
+	return ws, mg.scanner.Err()
+}
+
+// screenCounts counts the candidate matches of the given windows,
+// with up to MaxConfirmProcs windows at once.
+func screenCounts(wins []int) error {
+
+	io.WriteString(os.Stderr, "Counting candidate matches...\n")
+
+	sem := make(chan bool, config.MaxConfirmProcs)
+	errs := make(chan error, len(wins))
+	var wg sync.WaitGroup
+	for _, k := range wins {
+		wg.Add(1)
+		sem <- true
+		go func(k int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ws, err := screenWindow(k)
+			if err != nil {
+				errs <- fmt.Errorf("window %d: %w", k, err)
+				return
+			}
+			screenMu.Lock()
+			screenWindows = append(screenWindows, ws)
+			screenMu.Unlock()
+		}(k)
+	}
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// screenReport is the final stage of a run with ScreenOnly set.  It
+// counts the candidate matches in each window, if this was not done
+// for each batch of windows, and reports them in place of the
+// results.
+func screenReport() error {
+
+	if config.WindowBatch == 0 {
+		if err := screenCounts(allWindows()); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(screenWindows, func(i, j int) bool { return screenWindows[i].Window < screenWindows[j].Window })
+	sm := &screenSummary{Windows: screenWindows}
+	var buf bytes.Buffer
+	buf.WriteString("Window\tStart\tSeqs\tCandidates\tFalsePositives\tComparisons\n")
+	for _, ws := range screenWindows {
+		sm.Candidates += ws.Candidates
+		sm.FalsePositives += ws.FalsePositives
+		sm.Comparisons += ws.Comparisons
+		sm.Bytes += ws.Bytes
+		fmt.Fprintf(&buf, "%d\t%d\t%d\t%d\t%d\t%d\n", ws.Window, config.Windows[ws.Window],
+			ws.Seqs, ws.Candidates, ws.FalsePositives, ws.Comparisons)
+	}
+	fmt.Fprintf(&buf, "Total\t\t\t%d\t%d\t%d\n", sm.Candidates, sm.FalsePositives, sm.Comparisons)
+	report.Screen = sm
+
+	logger.Printf("Candidate matches by window:\n%s", buf.String())
+	io.WriteString(os.Stderr, buf.String())
+	msg := fmt.Sprintf("ScreenOnly is set, so the candidates were not confirmed.  Confirming them would compare %d pairs of sequences, reading %.2f GB.\n",
+		sm.Comparisons, float64(sm.Bytes)/1e9)
+	io.WriteString(os.Stderr, msg)
+	logger.Print(msg)
+
+	return nil
+}
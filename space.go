@@ -0,0 +1,159 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// If the free space in TempDir falls below lowSpace bytes during a
+// run, a warning is issued, or the run is stopped if SpaceCheck is
+// "error".  The free space is checked every spaceInterval.
+var (
+	lowSpace      uint64 = 1 << 30
+	spaceInterval        = 30 * time.Second
+)
+
+// gigabytes formats a number of bytes for messages.
+func gigabytes(n uint64) string {
+	return fmt.Sprintf("%.1fGB", float64(n)/1e9)
+}
+
+// tempRoot returns the directory whose file system holds TempDir.
+func tempRoot() string {
+	if config.TempDir != "" {
+		return existingDir(config.TempDir)
+	}
+	return existingDir("muscato_tmp")
+}
+
+// estimateTempSpace returns a rough upper bound on the space needed
+// in TempDir.  The sorted reads take less space than the read file,
+// since the quality scores are dropped and duplicates are merged.
+// Each window has an unsorted and a sorted copy of the read windows,
+// and of the candidate matches, which are assumed to take less space
+// than the read and target files respectively.
+func estimateTempSpace() (uint64, error) {
+
+	fi, err := os.Stat(config.ReadFileName)
+	if err != nil {
+		return 0, err
+	}
+	nread := uint64(fi.Size())
+
+	files, err := utils.TargetFiles(config.GeneFileName)
+	if err != nil {
+		return 0, err
+	}
+	var ngene uint64
+	for _, f := range files {
+		fi, err = os.Stat(f)
+		if err != nil {
+			return 0, err
+		}
+		ngene += uint64(fi.Size())
+	}
+
+	perWindow := nread + ngene
+	if config.EarlyDelete || config.Streaming {
+		// Only one of the unsorted and sorted copies is
+		// present at a time, or with Streaming only the sorted
+		// copy is written.
+		perWindow /= 2
+	}
+
+	// With ConfirmOnly, the per-window files are linked from the
+	// earlier run.
+	nwin := len(config.Windows)
+	if nwin == 0 && config.WindowStride > 0 {
+		// With WindowStride, the windows are not known until the
+		// reads have been read.
+		nwin = len(windowsByStride(config.MaxReadLength))
+	}
+
+	return nread + uint64(nwin)*perWindow, nil
+}
+
+// checkTempSpace compares the estimated space needed in TempDir to
+// the space that is available, before the run starts.
+func checkTempSpace() error {
+
+	if config.SpaceCheck == "off" {
+		return nil
+	}
+
+	dir := tempRoot()
+	free, ok := utils.FreeSpace(dir)
+	if !ok {
+		return nil
+	}
+	need, err := estimateTempSpace()
+	if err != nil {
+		// The input files are checked later.
+		return nil
+	}
+
+	if need <= free {
+		return nil
+	}
+
+	msg := fmt.Sprintf("the run may need up to %s of temporary space, but only %s is available in %s",
+		gigabytes(need), gigabytes(free), dir)
+	if config.SpaceCheck == "error" {
+		return fmt.Errorf("%w: %s (use a larger TempDir, or set SpaceCheck to 'warn' to run anyway)", ErrDiskFull, msg)
+	}
+	os.Stderr.WriteString(fmt.Sprintf("Warning: %s\n", msg))
+	warnings.Add("low_temp_space", utils.SeverityWarning, "%s", msg)
+
+	return nil
+}
+
+// monitorTempSpace periodically checks the free space in TempDir while
+// the pipeline runs.  If SpaceCheck is "error" and the free space runs
+// low, the run is cancelled using cancel.  The returned function stops
+// the monitoring.
+func monitorTempSpace(cancel context.CancelCauseFunc) func() {
+
+	if config.SpaceCheck == "off" {
+		return func() {}
+	}
+
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(spaceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			free, ok := utils.FreeSpace(config.TempDir)
+			if !ok || free >= lowSpace {
+				continue
+			}
+
+			msg := fmt.Sprintf("only %s of space remains in TempDir %s", gigabytes(free), config.TempDir)
+			logger.Print(msg)
+			warnings.Add("low_temp_space", utils.SeverityWarning, "%s", msg)
+			if config.SpaceCheck == "error" {
+				os.Stderr.WriteString(fmt.Sprintf("Stopping: %s\n", msg))
+				cancel(fmt.Errorf("%w: %s", ErrDiskFull, msg))
+				return
+			}
+			os.Stderr.WriteString(fmt.Sprintf("Warning: %s\n", msg))
+
+			// Only warn once.
+			<-done
+			return
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,1178 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/internal/bloom"
+	"github.com/kshedden/muscato/utils"
+)
+
+// resultName returns the name of a file of results, formed by adding
+// a suffix to ResultsFileName before its extension, and adding the
+// suffix for CompressResults.
+func resultName(suffix string) string {
+	return utils.CompressedName(resultBase(suffix), config.CompressResults)
+}
+
+// resultBase is like resultName, but does not add a compression
+// suffix.
+func resultBase(suffix string) string {
+	ext := path.Ext(config.ResultsFileName)
+	if ext != "" {
+		m := len(config.ResultsFileName)
+		return config.ResultsFileName[0:m-len(ext)] + suffix + ext
+	}
+	return config.ResultsFileName + suffix
+}
+
+// geneStats
+func geneStats() error {
+
+	io.WriteString(os.Stderr, "Generating gene statistics...\n")
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	// The results may be compressed, so they are passed to sort
+	// through stdin.  Without the results, the matches prepared by
+	// geneMatches are used.
+	src := config.ResultsPath()
+	if config.NoPerReadOutput {
+		src = path.Join(config.TempDir, "matches_gs.txt.sz")
+	}
+	res, err := utils.OpenResult(src)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	args := []string{sortmem, sortpar, "-k5"}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	args = append(args, "-")
+	cmd1 := command("sort", args...)
+	cmd1.Stdin = res
+	cmd1.Stderr = stderrTail
+	cmd1.Env = os.Environ()
+	cmd1.Stdout = pw1
+
+	outfile := resultName("_genestats")
+
+	args = nil
+	if config.WeightGeneStats {
+		args = append(args, "-weight")
+	}
+	if config.GeneSampleSize > 0 {
+		args = append(args, "-scale", resultName("_downsampling"))
+	}
+	args = append(args, "-")
+	cmd2 := command("muscato_genestats", args...)
+	cmd2.Stdin = pr1
+	cmd2.Stderr = stderrTail
+	cmd2.Env = os.Environ()
+	out, err := utils.CreateResult(outfile, config.CompressResults, config.SyncResults)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	cmd2.Stdout = out
+
+	if err := runPipeline([]*exec.Cmd{cmd1, cmd2}, pw1, pr1); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+func prepReads() error {
+
+	io.WriteString(os.Stderr, "Preparing reads...\n")
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr2, pw2, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	// The destination file
+	outfinal := path.Join(config.TempDir, "reads_sorted.txt.sz")
+	fid, err := os.Create(outfinal)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	// Run muscato_prep_reads
+	cmd1 := command("muscato_prep_reads", configFilePath)
+	cmd1.Stdout = pw1
+	cmd1.Env = os.Environ()
+	cmd1.Stderr = stderrTail
+
+	// Sort the output of muscato_prep_reads
+	args := []string{sortmem, sortpar}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	cmd2 := command("sort", args...)
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pw2
+	cmd2.Env = os.Environ()
+	cmd2.Stderr = stderrTail
+
+	// Uniqify and count duplicates
+	cmd3 := command("muscato_uniqify", configFilePath, "-")
+	cmd3.Stdin = pr2
+	cmd3.Stdout = fid
+	cmd3.Env = os.Environ()
+	cmd3.Stderr = stderrTail
+
+	return runPipeline([]*exec.Cmd{cmd1, cmd2, cmd3}, pw1, pr1, pw2, pr2)
+}
+
+// exactTier runs muscato_exact, which finds the reads that occur
+// exactly in a target, so that they can be left out of the windows.
+func exactTier() error {
+
+	io.WriteString(os.Stderr, "Finding exact matches...\n")
+
+	cmd := command("muscato_exact", configFilePath)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+func windowReads(wins []int) error {
+
+	io.WriteString(os.Stderr, "Windowing reads...\n")
+
+	cmd := windowReadsCommand(wins)
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+// windowReadsCommand returns the muscato_window_reads command for a
+// batch of windows.
+func windowReadsCommand(wins []int) *exec.Cmd {
+	cmd := command("muscato_window_reads", append([]string{configFilePath}, batchArgs(wins)...)...)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	return cmd
+}
+
+func sortWindows(wins []int) error {
+
+	for _, k := range wins {
+
+		io.WriteString(os.Stderr, fmt.Sprintf("Sorting windows %d...\n", k))
+
+		fn := path.Join(config.TempDir, fmt.Sprintf("win_%d.txt.sz", k))
+		lay, err := utils.ReadLayout(fn, utils.WindowColumns)
+		if err != nil {
+			return err
+		}
+
+		sfn := strings.Replace(fn, ".txt.sz", "_sorted.txt.sz", 1)
+		if err := sortFile(command("sztool", "-d", fn), sfn, sortmem); err != nil {
+			return err
+		}
+		if err := utils.WriteLayout(sfn, lay.Columns); err != nil {
+			return err
+		}
+
+		if config.EarlyDelete {
+			removeIntermediate("win", fmt.Sprintf("win_%d.txt.sz", k), "sortWindows")
+		}
+	}
+
+	return nil
+}
+
+// sortFile sorts the output of the decompression command cmd1 by its
+// first column, and writes the result to dst, compressed.  The sort
+// uses memory as given by mem, a -S argument for sort.
+func sortFile(cmd1 *exec.Cmd, dst, mem string) error {
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr2, pw2, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	cmd1.Stdout = pw1
+
+	// Sort
+	args := []string{mem, sortpar, "-k1"}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	args = append(args, "-")
+	cmd2 := command("sort", args...)
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pw2
+
+	// Compress
+	cmd3 := command("sztool", "-c", "-", dst)
+	cmd3.Stdin = pr2
+
+	cmds := []*exec.Cmd{cmd1, cmd2, cmd3}
+	for _, cmd := range cmds {
+		cmd.Stderr = stderrTail
+		cmd.Env = os.Environ()
+	}
+
+	return runPipeline(cmds, pw1, pr1, pw2, pr2)
+}
+
+// sizeBloom sets BloomSize and NumHash to give false positive rate
+// BloomFPR, based on the number of distinct reads reported by
+// muscato_uniqify.  Each window has its own filter, containing at
+// most one value per distinct read.
+func sizeBloom() error {
+
+	if config.IndexSide == "targets" {
+		// No Bloom filters are used.
+		return nil
+	}
+
+	var seqinfo struct {
+		NumUnique int
+	}
+	fid, err := os.Open(path.Join(config.LogDir, "seqinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	if err := json.NewDecoder(fid).Decode(&seqinfo); err != nil {
+		return err
+	}
+
+	m, k := bloom.EstimateParameters(uint64(seqinfo.NumUnique), config.BloomFPR)
+	config.BloomSize = m
+	config.NumHash = k
+	msg := fmt.Sprintf("AutoBloom: %d distinct reads, BloomFPR=%g, using BloomSize=%d, NumHash=%d\n",
+		seqinfo.NumUnique, config.BloomFPR, m, k)
+	io.WriteString(os.Stderr, msg)
+	logger.Print(msg)
+
+	// The later stages read the updated configuration.
+	return saveConfig(config)
+}
+
+// chooseIndexSide resolves IndexSide "auto", by comparing the number
+// of window subsequences of the reads (at most the number of distinct
+// reads reported by muscato_uniqify times the number of windows) to
+// the number of subsequences of the targets.  The targets are only
+// read until they are found to have more subsequences than the reads.
+func chooseIndexSide() error {
+
+	var seqinfo struct {
+		NumUnique int
+	}
+	fid, err := os.Open(path.Join(config.LogDir, "seqinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	if err := json.NewDecoder(fid).Decode(&seqinfo); err != nil {
+		return err
+	}
+	nread := int64(seqinfo.NumUnique) * int64(len(config.Windows))
+
+	ntarget, err := countTargetKmers(nread)
+	if err != nil {
+		return err
+	}
+
+	cmp := fmt.Sprintf("more than %d", nread)
+	config.IndexSide = "reads"
+	if ntarget <= nread {
+		cmp = fmt.Sprintf("%d", ntarget)
+		config.IndexSide = "targets"
+	}
+	msg := fmt.Sprintf("IndexSide: at most %d read window subsequences and %s target subsequences, indexing the %s\n",
+		nread, cmp, config.IndexSide)
+	io.WriteString(os.Stderr, msg)
+	logger.Print(msg)
+
+	// The later stages read the updated configuration.
+	return saveConfig(config)
+}
+
+// countTargetKmers returns the number of subsequences of length
+// WindowWidth in the target sequences, or a value greater than limit
+// once the count exceeds limit.
+func countTargetKmers(limit int64) (int64, error) {
+
+	rdr, err := utils.OpenTargets(config.GeneFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer rdr.Close()
+
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	var n int64
+	for scanner.Scan() {
+		seq := scanner.Bytes()
+		if i := bytes.IndexByte(seq, '\t'); i >= 0 {
+			seq = seq[0:i]
+		}
+		if m := len(seq) - config.WindowWidth + 1; m > 0 {
+			n += int64(m)
+		}
+		if n > limit {
+			break
+		}
+	}
+
+	return n, scanner.Err()
+}
+
+// windowsByStride returns windows placed at every WindowStride
+// positions of reads of length maxlen.
+func windowsByStride(maxlen int) []int {
+	var windows []int
+	for w := 0; w+config.WindowWidth <= maxlen; w += config.WindowStride {
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// strideWindows sets Windows using WindowStride, based on the length
+// of the longest read reported by muscato_prep_reads.
+func strideWindows() error {
+
+	var prepinfo struct {
+		MaxLength int
+	}
+	fid, err := os.Open(path.Join(config.LogDir, "prepinfo.json"))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	if err := json.NewDecoder(fid).Decode(&prepinfo); err != nil {
+		return err
+	}
+
+	config.Windows = windowsByStride(prepinfo.MaxLength)
+	if len(config.Windows) == 0 {
+		return fmt.Errorf("the longest read has length %d, which is less than WindowWidth=%d",
+			prepinfo.MaxLength, config.WindowWidth)
+	}
+	msg := fmt.Sprintf("WindowStride: longest read has length %d, using %d windows: %v\n",
+		prepinfo.MaxLength, len(config.Windows), config.Windows)
+	io.WriteString(os.Stderr, msg)
+	logger.Print(msg)
+
+	// The later stages read the updated configuration.
+	return saveConfig(config)
+}
+
+// bloomMemory returns the memory in bytes used by the Bloom filters
+// in muscato_screen, which holds one filter per window of a batch.
+func bloomMemory(nwin int) uint64 {
+	if config.ScreenMethod != "bloom" || config.IndexSide == "targets" {
+		return 0
+	}
+	return uint64(nwin) * bloom.Bytes(config.BloomSize)
+}
+
+func screen(wins []int) error {
+
+	io.WriteString(os.Stderr, "Screening...\n")
+
+	cmd, err := screenCommand(wins)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+// screenCommand returns the muscato_screen command for a batch of
+// windows.  A ConfigError is returned if the Bloom filters would use
+// more than MaxMemory.
+func screenCommand(wins []int) (*exec.Cmd, error) {
+
+	report.BloomMemory = bloomMemory(len(wins))
+	if report.BloomMemory > 0 {
+		logger.Printf("The Bloom filters use about %s of memory", utils.FormatBytes(report.BloomMemory))
+	}
+	if m := config.MemoryBytes(); m > 0 && report.BloomMemory > m {
+		return nil, utils.NewConfigError("MaxMemory", utils.ErrConflict,
+			"the Bloom filters for %d windows would use %s of memory, more than MaxMemory=%s; reduce BloomSize or set WindowBatch",
+			len(wins), utils.FormatBytes(report.BloomMemory), config.MaxMemory)
+	}
+
+	cmd := command("muscato_screen", append([]string{configFilePath}, batchArgs(wins)...)...)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	return cmd, nil
+}
+
+func sortBloom(wins []int) error {
+
+	for _, k := range wins {
+
+		io.WriteString(os.Stderr, fmt.Sprintf("Sorting Bloom %d...\n", k))
+
+		fn := path.Join(config.TempDir, fmt.Sprintf("bmatch_%d.txt.sz", k))
+		lay, err := utils.ReadLayout(fn, utils.CandidateColumns)
+		if err != nil {
+			return err
+		}
+
+		sfn := path.Join(config.TempDir, fmt.Sprintf("smatch_%d.txt.sz", k))
+		if err := sortFile(command("sztool", "-d", fn), sfn, sortmem); err != nil {
+			return err
+		}
+		if err := utils.WriteLayout(sfn, lay.Columns); err != nil {
+			return err
+		}
+
+		if config.EarlyDelete {
+			removeIntermediate("bmatch", fmt.Sprintf("bmatch_%d.txt.sz", k), "sortBloom")
+		}
+	}
+
+	return nil
+}
+
+// confirm runs muscato_confirm for each window, with up to
+// MaxConfirmProcs windows at once.  The work for each window is
+// estimated by the sizes of its sorted reads and candidate matches,
+// and the windows with the most work are started first.
+//
+// With WindowSubset, only the windows in the subset are confirmed,
+// and the matches of the other windows are reused (see
+// reuseConfirmed).
+func confirm() error {
+	confirmed = confirmed[0:0]
+	wins := allWindows()
+	if len(config.WindowSubset) > 0 {
+		wins = config.WindowSubset
+	}
+	skipped, err := confirmWindows(wins)
+	if err != nil {
+		return err
+	}
+	confirmed = append(confirmed, reusedWindows()...)
+	sort.Ints(confirmed)
+	return checkConfirmed(skipped)
+}
+
+// confirmWindows confirms the given windows, and adds them to
+// confirmed.  The windows that were not started because MaxWallTime
+// passed are returned.
+func confirmWindows(wins []int) ([]int, error) {
+
+	io.WriteString(os.Stderr, "Confirming...\n")
+
+	var jobs []job
+	window := make(map[string]int)
+	for _, k := range wins {
+		k := k
+		window[fmt.Sprintf("confirm %d", k)] = k
+		work := fileSize(path.Join(config.TempDir, fmt.Sprintf("smatch_%d.txt.sz", k)))
+		work += fileSize(path.Join(config.TempDir, fmt.Sprintf("win_%d_sorted.txt.sz", k)))
+		jobs = append(jobs, job{
+			name: fmt.Sprintf("confirm %d", k),
+			work: work,
+			cmd: func() *exec.Cmd {
+				cmd := command("muscato_confirm", configFilePath, fmt.Sprintf("%d", k))
+				cmd.Stderr = stderrTail
+				cmd.Env = os.Environ()
+				return cmd
+			},
+		})
+	}
+
+	skipped, err := runJobs(jobs, config.MaxConfirmProcs, wallTimeUp)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[int]bool)
+	var skipwin []int
+	for _, j := range skipped {
+		skip[window[j.name]] = true
+		skipwin = append(skipwin, window[j.name])
+	}
+	for _, k := range wins {
+		if !skip[k] {
+			confirmed = append(confirmed, k)
+		}
+	}
+
+	return skipwin, nil
+}
+
+// checkConfirmed returns an error if no window was confirmed, and
+// otherwise marks the results as partial if some windows were
+// skipped.
+func checkConfirmed(skipped []int) error {
+	if len(confirmed) == 0 {
+		return fmt.Errorf("%w before any window was confirmed, no results were written", ErrWallTime)
+	}
+	if len(skipped) > 0 {
+		sort.Ints(skipped)
+		markPartial(skipped)
+	}
+	return nil
+}
+
+// catSnappy writes the decompressed contents of the given snappy
+// compressed files to w.
+func catSnappy(w io.Writer, files []string) error {
+
+	for _, f := range files {
+		fid, err := os.Open(f)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, snappy.NewReader(fid))
+		fid.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", f, err)
+		}
+	}
+
+	return nil
+}
+
+// catWindowMatches writes the lines of the Snappy compressed match
+// files to w, as catSnappy does, appending the MMTol of the window
+// that found each match (see WindowMMTol) as a final column.
+func catWindowMatches(w io.Writer, files []string, tols []int) error {
+
+	bw := bufio.NewWriter(w)
+	for i, f := range files {
+		fid, err := os.Open(f)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(snappy.NewReader(fid))
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		tol := strconv.Itoa(tols[i])
+		for scanner.Scan() {
+			bw.Write(scanner.Bytes())
+			bw.WriteString("\t")
+			bw.WriteString(tol)
+			bw.WriteString("\n")
+		}
+		err = scanner.Err()
+		fid.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", f, err)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// numMatches returns the number of matches found in the confirmed
+// windows, as recorded by muscato_confirm, and by muscato_exact if
+// ExactTier is set, for sizing the Bloom filter used by
+// muscato_combine_filter.  If a count is missing, 100 million matches
+// are assumed.
+func numMatches() int {
+
+	var infos []string
+	for _, j := range confirmed {
+		infos = append(infos, fmt.Sprintf("confirminfo_%d.json", j))
+	}
+	if config.ExactTier {
+		infos = append(infos, "exactinfo.json")
+	}
+	if config.RefineCommand != "" {
+		infos = append(infos, "refineinfo.json")
+	}
+
+	var n int
+	for _, name := range infos {
+		var info struct {
+			Matches int
+		}
+		fid, err := os.Open(path.Join(config.LogDir, name))
+		if err != nil {
+			logger.Print(err)
+			return 100000000
+		}
+		err = json.NewDecoder(fid).Decode(&info)
+		fid.Close()
+		if err != nil {
+			logger.Print(err)
+			return 100000000
+		}
+		n += info.Matches
+	}
+	if n == 0 {
+		n = 1
+	}
+
+	return n
+}
+
+func combineWindows() error {
+
+	io.WriteString(os.Stderr, "Combining windows...\n")
+
+	// The matches for all windows are combined, so they must have
+	// the same layout.
+	var names []string
+	var tols []int
+	for _, j := range confirmed {
+		names = append(names, fmt.Sprintf("rmatch_%d.txt.sz", j))
+		tols = append(tols, config.WindowMMTolFor(j))
+	}
+	if config.ExactTier {
+		names = append(names, "rmatch_exact.txt.sz")
+		tols = append(tols, config.MMTol)
+	}
+	if config.RefineCommand != "" {
+		names = append(names, "rmatch_refine.txt.sz")
+		tols = append(tols, config.MMTol)
+	}
+	lay, err := matchLayout(names[0], utils.MatchColumns)
+	if err != nil {
+		return err
+	}
+	for _, name := range names[1:] {
+		lj, err := matchLayout(name, utils.MatchColumns)
+		if err != nil {
+			return err
+		}
+		if err := lay.Same(lj); err != nil {
+			return err
+		}
+	}
+
+	pr0, pw0, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr2, pw2, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for _, name := range names {
+		files = append(files, path.Join(config.TempDir, name))
+	}
+
+	// Concatenate everything, excluding duplicates.  The Bloom
+	// filter passes no duplicates, so the sort only needs to
+	// remove them with ExactCombine, in which case the matches are
+	// decompressed here.  With WindowMMTol, the matches are also
+	// decompressed here to append the MMTol of their window, so
+	// that the same match found by several windows is not a
+	// duplicate, and muscato_combine_windows removes it.
+	var cmd0 *exec.Cmd
+	sargs := []string{sortmem, sortpar}
+	if sortTmpFlag != "" {
+		sargs = append(sargs, sortTmpFlag)
+	}
+	if config.ExactCombine || len(config.WindowMMTol) > 0 {
+		sargs = append(sargs, "-u")
+	} else {
+		n := numMatches()
+		logger.Printf("Removing duplicates from %d matches with CombineFPR=%g", n, config.CombineFPR)
+		cc := []string{strconv.Itoa(n), strconv.FormatFloat(config.CombineFPR, 'g', -1, 64), "run"}
+		cmd0 = command("muscato_combine_filter", append(cc, files...)...)
+		cmd0.Env = os.Environ()
+		cmd0.Stderr = stderrTail
+		cmd0.Stdout = pw0
+	}
+
+	// Pipe everything into one sort, grouping the matches by read
+	cmd1 := command("sort", append(sargs, "-")...)
+	cmd1.Env = os.Environ()
+	cmd1.Stderr = stderrTail
+	cmd1.Stdin = pr0
+	cmd1.Stdout = pw1
+
+	cmd2 := command("muscato_combine_windows", configFilePath)
+	cmd2.Env = os.Environ()
+	cmd2.Stderr = stderrTail
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pw2
+
+	outname := path.Join(config.TempDir, "matches.txt.sz")
+	cmd3 := command("sztool", "-c", "-", outname)
+	cmd3.Env = os.Environ()
+	cmd3.Stderr = stderrTail
+	cmd3.Stdin = pr2
+
+	cmds := []*exec.Cmd{cmd1, cmd2, cmd3}
+	if cmd0 != nil {
+		cmds = append([]*exec.Cmd{cmd0}, cmds...)
+	}
+	for _, cmd := range cmds {
+		cmd.Stderr = stderrTail
+		if err := cmd.Start(); err != nil {
+			return cmdErr(cmd, err)
+		}
+	}
+
+	if cmd0 != nil {
+		if err := cmd0.Wait(); err != nil {
+			return cmdErr(cmd0, err)
+		}
+	} else {
+		if len(config.WindowMMTol) > 0 {
+			err = catWindowMatches(pw0, files, tols)
+		} else {
+			err = catSnappy(pw0, files)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	pw0.Close()
+	pr0.Close()
+
+	if err := cmd1.Wait(); err != nil {
+		return cmdErr(cmd1, err)
+	}
+	pw1.Close()
+	pr1.Close()
+
+	if err := cmd2.Wait(); err != nil {
+		return cmdErr(cmd2, err)
+	}
+	pw2.Close()
+	pr2.Close()
+
+	if err := cmd3.Wait(); err != nil {
+		return cmdErr(cmd3, err)
+	}
+
+	return utils.WriteLayout(outname, lay.Columns)
+}
+
+// matchLayout returns the layout of a match file in TempDir, using
+// the given columns if the layout was not recorded.
+func matchLayout(name string, dflt []string) (*utils.Layout, error) {
+	return utils.ReadLayout(path.Join(config.TempDir, name), dflt)
+}
+
+func sortByGeneId() error {
+
+	io.WriteString(os.Stderr, "Sorting by gene id...\n")
+
+	inname := path.Join(config.TempDir, "matches.txt.sz")
+	outname := path.Join(config.TempDir, "matches_sg.txt.sz")
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr2, pw2, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	// Sort by gene number
+	cmd1 := command("sztool", "-d", inname)
+	cmd1.Stdout = pw1
+	cmd1.Env = os.Environ()
+	cmd1.Stderr = stderrTail
+
+	lay, err := matchLayout("matches.txt.sz", utils.MatchColumns)
+	if err != nil {
+		return err
+	}
+	gcol, err := lay.Column("gene")
+	if err != nil {
+		return err
+	}
+
+	args := []string{sortmem, sortpar, fmt.Sprintf("-k%d", gcol)}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	args = append(args, "-")
+	cmd2 := command("sort", args...)
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pw2
+	cmd2.Env = os.Environ()
+	cmd2.Stderr = stderrTail
+
+	// Compress the results
+	cmd3 := command("sztool", "-c", "-", outname)
+	cmd3.Stdin = pr2
+	cmd3.Env = os.Environ()
+	cmd3.Stderr = stderrTail
+
+	if err := runPipeline([]*exec.Cmd{cmd1, cmd2, cmd3}, pw1, pr1, pw2, pr2); err != nil {
+		return err
+	}
+
+	return utils.WriteLayout(outname, lay.Columns)
+}
+
+// downsampleGenes runs muscato_downsample, which keeps at most
+// GeneSampleSize matches for each target, and writes the scale factors
+// of the downsampled targets.
+func downsampleGenes() error {
+
+	io.WriteString(os.Stderr, "Downsampling abundant targets...\n")
+
+	cmd := command("muscato_downsample", configFilePath, resultName("_downsampling"))
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+func joinGeneNames() error {
+
+	io.WriteString(os.Stderr, "Joining gene names...\n")
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	pr2, pw2, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	lay, err := matchLayout("matches_sg.txt.sz", utils.MatchColumns)
+	if err != nil {
+		return err
+	}
+	gcol, err := lay.Column("gene")
+	if err != nil {
+		return err
+	}
+
+	// The join places the gene number first, followed by the other
+	// columns of the matches, then the gene name and length.  The
+	// gene number is then removed.
+	var cols []string
+	for _, c := range lay.Columns {
+		if c != "gene" {
+			cols = append(cols, c)
+		}
+	}
+	cols = append(cols, "target_id", "target_len")
+
+	// Join genes and matches
+	cmd1 := command("join", "-1", strconv.Itoa(gcol), "-2", "1", "-t", "\t")
+	cmd1.Stdout = pw1
+	cmd1.Env = os.Environ()
+	cmd1.Stderr = stderrTail
+
+	pa, err := newInputPipe(cmd1, "matches_sg")
+	if err != nil {
+		return err
+	}
+	pb, err := newInputPipe(cmd1, "gene_ids")
+	if err != nil {
+		return err
+	}
+	cmd1.Args = append(cmd1.Args, pa.path, pb.path)
+
+	// Decompress the matches
+	fn := path.Join(config.TempDir, "matches_sg.txt.sz")
+	cmda := command("sztool", "-d", fn)
+	cmda.Stdout = pa.w
+
+	// Cut out unwanted column
+	// The first argument after cur is -d(tab)
+	cmd2 := command("cut", "-d	", "-f1", "--complement", "-")
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pw2
+	cmd2.Env = os.Environ()
+	cmd2.Stderr = stderrTail
+
+	// Compress the result
+	cmd3 := command("sztool", "-c", "-", path.Join(config.TempDir, "matches_sn.txt.sz"))
+	cmd3.Stdin = pr2
+	cmd3.Stderr = stderrTail
+	cmd3.Env = os.Environ()
+
+	for _, cmd := range []*exec.Cmd{cmda, cmd1, cmd2, cmd3} {
+		cmd.Stderr = stderrTail
+		cmd.Env = os.Environ()
+		if err := cmd.Start(); err != nil {
+			return cmdErr(cmd, err)
+		}
+	}
+	pa.Close()
+	if pb.r != nil {
+		pb.r.Close()
+	}
+
+	// Decompress the gene ids, which may be split into volumes.
+	idc := make(chan error, 1)
+	go func() {
+		defer pb.w.Close()
+		rdr, err := utils.OpenTargets(config.GeneIdFileName)
+		if err != nil {
+			idc <- err
+			return
+		}
+		defer rdr.Close()
+		_, err = io.Copy(pb.w, rdr)
+		idc <- err
+	}()
+
+	for _, cmd := range []*exec.Cmd{cmda, cmd1} {
+		if err := cmd.Wait(); err != nil {
+			return cmdErr(cmd, err)
+		}
+	}
+	if err := <-idc; err != nil {
+		return fmt.Errorf("reading %s: %w", config.GeneIdFileName, err)
+	}
+
+	pw1.Close()
+	pr1.Close()
+
+	if err := cmd2.Wait(); err != nil {
+		return cmdErr(cmd2, err)
+	}
+
+	pw2.Close()
+	pr2.Close()
+
+	if err := cmd3.Wait(); err != nil {
+		return cmdErr(cmd3, err)
+	}
+
+	return utils.WriteLayout(path.Join(config.TempDir, "matches_sn.txt.sz"), cols)
+}
+
+func joinReadNames() error {
+
+	io.WriteString(os.Stderr, "Joining read names...\n")
+
+	fn := path.Join(config.TempDir, "reads_sorted.txt.sz")
+	gn := path.Join(config.TempDir, "matches_sn.txt.sz")
+
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		err := fmt.Errorf("reads_sorted.txt.sz does not exist")
+		return err
+	}
+
+	if _, err := os.Stat(gn); os.IsNotExist(err) {
+		err := fmt.Errorf("matches_sn.txt.sz does not exist")
+		return err
+	}
+
+	// The results columns follow the matches, starting with the
+	// read sequence used in the join.
+	lay, err := matchLayout("matches_sn.txt.sz", utils.NamedMatchColumns)
+	if err != nil {
+		return err
+	}
+	if err := lay.Same(&utils.Layout{Columns: utils.NamedMatchColumns, File: "the results"}); err != nil {
+		return err
+	}
+
+	pr1, pw1, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	out, err := utils.CreateResult(config.ResultsPath(), config.CompressResults, config.SyncResults)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Join the matches and the reads
+	cmd := command("join", "-1", "1", "-2", "1", "-t", "\t")
+
+	// Every match is checked against the length of its target,
+	// before the positions are transformed.
+	bc := &boundsChecker{name: path.Join(config.LogDir, "position_violations.txt")}
+	defer bc.Close()
+	cw := &columnWriter{w: out, funcs: []lineFunc{bc.check}}
+	cmd.Stdout = cw
+
+	if config.ForwardStrand {
+		cw.funcs = append(cw.funcs, forwardStrand)
+	}
+	if config.ReadThrough > 0 {
+		cw.funcs = append(cw.funcs, readThrough)
+	}
+	if config.EValues {
+		dbsize, err := targetSize()
+		if err != nil {
+			return err
+		}
+		logger.Printf("Total target length for E-values: %.0f", dbsize)
+		cw.funcs = append(cw.funcs, evalueColumn(dbsize))
+	}
+	if config.TargetCoords {
+		cw.funcs = append(cw.funcs, targetCoords)
+	}
+	if config.ReadGroup != "" {
+		cw.funcs = append(cw.funcs, readGroupColumn)
+	}
+
+	pa, err := newInputPipe(cmd, "matches_sn")
+	if err != nil {
+		return err
+	}
+	pb, err := newInputPipe(cmd, "reads_sorted")
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, pa.path, pb.path)
+
+	// Decompress the matches
+	cmd1 := command("sztool", "-d", gn)
+	cmd1.Stdout = pw1
+
+	// Sort the matches by read
+	args := []string{"-k1", sortmem, sortpar}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	args = append(args, "-")
+	cmd2 := command("sort", args...)
+	cmd2.Stdin = pr1
+	cmd2.Stdout = pa.w
+
+	// Decompress the reads
+	cmd3 := command("sztool", "-d", fn)
+	cmd3.Stdout = pb.w
+
+	for _, c := range []*exec.Cmd{cmd1, cmd2, cmd3, cmd} {
+		c.Stderr = stderrTail
+		c.Env = os.Environ()
+		if err := c.Start(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+	pa.Close()
+	pb.Close()
+
+	if err := cmd1.Wait(); err != nil {
+		return cmdErr(cmd1, err)
+	}
+
+	pw1.Close()
+	pr1.Close()
+
+	for _, c := range []*exec.Cmd{cmd2, cmd3, cmd} {
+		if err := c.Wait(); err != nil {
+			return cmdErr(c, err)
+		}
+	}
+
+	if err := cw.Flush(); err != nil {
+		return err
+	}
+
+	if err := bc.Close(); err != nil {
+		return err
+	}
+	report.PositionViolations = bc.n
+	if bc.n > 0 {
+		warnings.AddN(bc.n, "position_bounds", utils.SeverityError,
+			"A match does not lie within its target, the matches of this kind were removed and written to %s", bc.name)
+		logger.Printf("Removed %d matches that do not lie within their targets, see %s", bc.n, bc.name)
+	}
+
+	return out.Close()
+}
+
+func genReadStats() error {
+
+	io.WriteString(os.Stderr, "Generating read statistics...\n")
+
+	cmd := command("muscato_readstats", configFilePath)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+// assignReads resolves reads that match multiple genes, according to
+// AssignMode.
+func assignReads() error {
+
+	io.WriteString(os.Stderr, "Assigning reads to genes...\n")
+
+	cmd := command("muscato_assign", configFilePath)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+func writeNonMatch() error {
+
+	io.WriteString(os.Stderr, "Writing non-matching sequences...\n")
+
+	cmd := command("muscato_nonmatch", configFilePath)
+	cmd.Stderr = stderrTail
+	cmd.Env = os.Environ()
+	if err := cmd.Run(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	return nil
+}
+
+// cmdErr adds the command line of a failed command to its error.
+func cmdErr(cmd *exec.Cmd, err error) error {
+	return &CommandError{Args: cmd.Args, Err: err}
+}
@@ -0,0 +1,175 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// Status describes the state of a run.  It is written to status.json
+// in the log directory when the run starts, and updated when the run
+// finishes.
+type Status struct {
+
+	// Either "running", "completed", "partial" (completed, but
+	// with results that are incomplete due to MaxWallTime) or
+	// "failed".
+	State string
+
+	// The process id and host name of the muscato process.
+	PID  int
+	Host string
+
+	// The absolute path of the temporary directory used by the
+	// run.
+	TempDir string
+
+	Started  time.Time
+	Finished time.Time
+
+	// The error that stopped the run, if it failed.
+	Error string `json:",omitempty"`
+
+	// The panics in muscato or the muscato_* tools during the run,
+	// with the stage that was running.
+	Failures []utils.Failure `json:",omitempty"`
+}
+
+var (
+	status Status
+
+	// The failure files of the tools that have been added to
+	// status.Failures.
+	failureSeen map[string]bool
+)
+
+// writeStatus saves the status of the run to status.json in the log
+// directory.
+func writeStatus() {
+
+	fid, err := os.Create(path.Join(config.LogDir, "status.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(&status); err != nil {
+		logger.Print(err)
+	}
+}
+
+// startStatus records that the run has started.
+func startStatus() {
+	host, _ := os.Hostname()
+	tempdir, err := filepath.Abs(config.TempDir)
+	if err != nil {
+		tempdir = config.TempDir
+	}
+	failureSeen = make(map[string]bool)
+	status = Status{
+		State:   "running",
+		PID:     os.Getpid(),
+		Host:    host,
+		TempDir: tempdir,
+		Started: time.Now(),
+	}
+	writeStatus()
+}
+
+// finishStatus records that the run has completed, or failed with
+// the given error.
+func finishStatus(err error) {
+	status.Finished = time.Now()
+	if err != nil {
+		status.State = "failed"
+		status.Error = err.Error()
+	} else if report.Partial {
+		status.State = "partial"
+	} else {
+		status.State = "completed"
+	}
+	writeStatus()
+}
+
+// noteFailures adds the failures recorded by the tools run in the
+// given stage (see utils.ExitOnPanic) to the status.
+func noteFailures(stage string) {
+
+	names, err := filepath.Glob(path.Join(config.LogDir, "failure_*.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+
+	var fl []utils.Failure
+	for _, name := range names {
+		if failureSeen[name] {
+			continue
+		}
+		failureSeen[name] = true
+		fid, err := os.Open(name)
+		if err != nil {
+			logger.Print(err)
+			continue
+		}
+		var f utils.Failure
+		err = json.NewDecoder(fid).Decode(&f)
+		fid.Close()
+		if err != nil {
+			logger.Printf("%s: %v", name, err)
+			continue
+		}
+		f.Stage = stage
+		logger.Printf("%s panicked in %s at %s: %s", f.Tool, stage, f.Location, f.Message)
+		fl = append(fl, f)
+	}
+	sort.Slice(fl, func(i, j int) bool { return fl[i].Time.Before(fl[j].Time) })
+	status.Failures = append(status.Failures, fl...)
+}
+
+// recoverPanic is deferred by RunWithHooks once the run has started.
+// A panic in the pipeline is recorded as a failure of the stage that
+// was running, the run is marked as failed, and the panic is
+// returned as an error.
+func recoverPanic(err *error) {
+
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	f := utils.NewFailure("muscato", r)
+	prog.mu.Lock()
+	f.Stage = prog.stage
+	prog.mu.Unlock()
+	logger.Printf("panic in %s at %s: %s\n%s", f.Stage, f.Location, f.Message, f.Stack)
+
+	noteFailures(f.Stage)
+	status.Failures = append(status.Failures, *f)
+	*err = fmt.Errorf("%w in %s at %s: %s", errPanic, f.Stage, f.Location, f.Message)
+	finishStatus(*err)
+}
+
+// ReadStatus reads the status.json file from a log directory.
+func ReadStatus(logdir string) (*Status, error) {
+	fid, err := os.Open(path.Join(logdir, "status.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+	st := new(Status)
+	if err := json.NewDecoder(fid).Decode(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// streamWindows is used in place of windowReads and sortWindows when
+// Streaming is set.  The read windows are passed to the sorts through
+// pipes, so that the unsorted window files are never written.
+func streamWindows(wins []int) error {
+
+	io.WriteString(os.Stderr, "Windowing and sorting reads...\n")
+
+	if err := streamSorted(windowReadsCommand(wins), wins, "win_%d.txt.sz", "win_%d_sorted.txt.sz"); err != nil {
+		return err
+	}
+
+	for _, k := range wins {
+		fn := path.Join(config.TempDir, fmt.Sprintf("win_%d.txt.sz", k))
+		lay, err := utils.ReadLayout(fn, utils.WindowColumns)
+		if err != nil {
+			return err
+		}
+		sfn := path.Join(config.TempDir, fmt.Sprintf("win_%d_sorted.txt.sz", k))
+		if err := utils.WriteLayout(sfn, lay.Columns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// streamScreen is used in place of screen and sortBloom when
+// Streaming is set.  The candidate matches are passed to the sorts
+// through pipes, so that the unsorted bmatch files are never written.
+func streamScreen(wins []int) error {
+
+	io.WriteString(os.Stderr, "Screening and sorting candidates...\n")
+
+	cmd, err := screenCommand(wins)
+	if err != nil {
+		return err
+	}
+
+	return streamSorted(cmd, wins, "bmatch_%d.txt.sz", "smatch_%d.txt.sz")
+}
+
+// streamSorted runs producer, which writes one file per window named
+// by src.  Each of these files is replaced by a symbolic link to
+// /dev/fd/n, where n is a file descriptor of the producer that is the
+// write end of a pipe, read by sortFile.  The sorted results are
+// written to the files named by dst.  The sorts for all the windows
+// run at once, and share SortMem.
+func streamSorted(producer *exec.Cmd, wins []int, src, dst string) error {
+
+	var rs []*os.File
+	defer func() {
+		for _, r := range rs {
+			r.Close()
+		}
+		for _, w := range producer.ExtraFiles {
+			w.Close()
+		}
+		for _, k := range wins {
+			os.Remove(path.Join(config.TempDir, fmt.Sprintf(src, k)))
+		}
+	}()
+	for _, k := range wins {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		rs = append(rs, r)
+
+		// ExtraFiles are numbered starting from 3 in the child.
+		producer.ExtraFiles = append(producer.ExtraFiles, w)
+		fd := fmt.Sprintf("/dev/fd/%d", 2+len(producer.ExtraFiles))
+		fn := path.Join(config.TempDir, fmt.Sprintf(src, k))
+		os.Remove(fn)
+		if err := os.Symlink(fd, fn); err != nil {
+			return err
+		}
+	}
+
+	mem := splitSortMem(len(wins))
+	logger.Printf("Streaming %d windows to sort, using %s for each sort", len(wins), mem)
+
+	errs := make(chan error, len(wins))
+	var wg sync.WaitGroup
+	for i, k := range wins {
+		cmd1 := command("sztool", "-d", "/dev/stdin")
+		cmd1.Stdin = rs[i]
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			if err := sortFile(cmd1, path.Join(config.TempDir, fmt.Sprintf(dst, k)), mem); err != nil {
+				errs <- fmt.Errorf("window %d: %w", k, err)
+			}
+		}(k)
+	}
+
+	// Once the producer has started, it holds the only write ends
+	// of the pipes, so the sorts reach the end of their input when
+	// it exits, even if it fails.
+	perr := producer.Start()
+	for _, w := range producer.ExtraFiles {
+		w.Close()
+	}
+	if perr == nil {
+		perr = producer.Wait()
+	}
+	if perr != nil {
+		perr = cmdErr(producer, perr)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if perr != nil {
+		return perr
+	}
+	return <-errs
+}
+
+var sortMemRe = regexp.MustCompile(`^\s*([0-9.]+)\s*([%bKMGT]?)\s*$`)
+
+// splitSortMem returns the -S argument for sort that gives each of n
+// sorts running at once an equal share of SortMem.  Sizes are in KiB
+// if no unit is given, as for sort.  If SortMem can't be interpreted,
+// it is used for each sort.
+func splitSortMem(n int) string {
+
+	m := sortMemRe.FindStringSubmatch(config.SortMem)
+	if n <= 1 || m == nil {
+		return sortmem
+	}
+	x, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return sortmem
+	}
+	x /= float64(n)
+
+	if m[2] == "%" {
+		if x < 1 {
+			x = 1
+		}
+		return fmt.Sprintf("-S %d%%", int(x))
+	}
+
+	// Convert to KiB
+	switch m[2] {
+	case "b":
+		x /= 1024
+	case "M":
+		x *= 1024
+	case "G":
+		x *= 1024 * 1024
+	case "T":
+		x *= 1024 * 1024 * 1024
+	}
+	if x < 1 {
+		x = 1
+	}
+	return fmt.Sprintf("-S %dK", int64(x))
+}
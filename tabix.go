@@ -0,0 +1,120 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// indexResults writes a copy of the results sorted by target and
+// position, compressed with bgzip, and a tabix index for it, so that
+// the matches overlapping a region of a target can be retrieved with
+// htslib tools.  A final column is added containing the end position
+// (exclusive) of each match on the target.
+func indexResults() error {
+
+	io.WriteString(os.Stderr, "Indexing results...\n")
+
+	rdr, err := utils.OpenResult(config.ResultsPath())
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	// Sort by target, then by position.
+	args := []string{"-t", "\t", "-k5,5", "-k3,3n", sortmem, sortpar}
+	if sortTmpFlag != "" {
+		args = append(args, sortTmpFlag)
+	}
+	cmd := command("sort", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = rdr
+	cmd.Stderr = stderrTail
+	sorted, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	outname := resultBase("_sorted") + ".gz"
+	fid, err := os.Create(outname)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+	bw := bufio.NewWriter(fid)
+	zw := utils.NewBGZFWriter(bw)
+
+	idx := &utils.TabixIndex{ColSeq: 5, ColBeg: 3}
+	scanner := bufio.NewScanner(sorted)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	var line []byte
+	for scanner.Scan() {
+		fields := bytes.Split(scanner.Bytes(), []byte("\t"))
+		if len(fields) < 8 {
+			return fmt.Errorf("results line has %d fields, expected at least 8", len(fields))
+		}
+		if idx.ColEnd == 0 {
+			idx.ColEnd = len(fields) + 1
+		}
+		pos, err := strconv.Atoi(string(fields[2]))
+		if err != nil {
+			return err
+		}
+		end := pos + len(fields[1])
+
+		line = append(line[0:0], scanner.Bytes()...)
+		line = append(line, '\t')
+		line = strconv.AppendInt(line, int64(end), 10)
+		line = append(line, '\n')
+
+		voff := zw.Offset()
+		if _, err := zw.Write(line); err != nil {
+			return err
+		}
+		if err := idx.Add(string(fields[4]), pos, end, voff, zw.Offset()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return cmdErr(cmd, err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := utils.CloseFile(fid, config.SyncResults); err != nil {
+		return err
+	}
+
+	// The index is also compressed with bgzip.
+	ifid, err := os.Create(outname + ".tbi")
+	if err != nil {
+		return err
+	}
+	defer ifid.Close()
+	izw := utils.NewBGZFWriter(ifid)
+	if _, err := idx.WriteTo(izw); err != nil {
+		return err
+	}
+	if err := izw.Close(); err != nil {
+		return err
+	}
+
+	return utils.CloseFile(ifid, config.SyncResults)
+}
@@ -0,0 +1,57 @@
+#!/bin/bash
+
+# Accuracy benchmark on public transcript collections.  The data sets
+# are downloaded (once) by 'muscato fetch-testdata', reads with
+# sequencing errors are drawn from each collection by muscato_gendat,
+# and the results of Muscato are compared to the true origins of the
+# reads by muscato_eval.  Extra arguments are passed to muscato, so
+# that the effect of a change or a setting on the sensitivity and
+# precision can be seen, e.g.
+#
+#   tests/benchmark/bench.sh --PMatch=0.95
+#
+# The environment variables below can be set to change the work
+# directory, the data sets (MANIFEST is a JSON list of data sets to
+# use in place of the built-in list, and the data sets must be target
+# collections in fasta format), and the simulated reads.
+
+set -e
+
+TARGET=${TARGET:-/var/tmp/muscato_bench}
+DATASETS=${DATASETS:-"yeast_cdna yeast_ncrna"}
+MANIFEST=${MANIFEST:-}
+NUMREAD=${NUMREAD:-20000}
+READLEN=${READLEN:-100}
+SUBRATE=${SUBRATE:-0.01}
+INDELRATE=${INDELRATE:-0}
+
+mkdir -p ${TARGET}
+
+muscato fetch-testdata -dir=${TARGET}/cache ${MANIFEST:+-manifest=${MANIFEST}} ${DATASETS} > ${TARGET}/datasets.txt
+
+SUMMARY=${TARGET}/summary.txt
+: > ${SUMMARY}
+
+while IFS=$'\t' read -r NAME FILE; do
+
+    DIR=${TARGET}/${NAME}
+    rm -rf ${DIR}
+    mkdir -p ${DIR}
+    echo "Benchmark ${NAME}"
+
+    muscato_gendat -Mode=sample -GeneFile=${FILE} -NumRead=${NUMREAD} -ReadLen=${READLEN} \
+                   -SubRate=${SUBRATE} -IndelRate=${INDELRATE} -PMapped=0.9 -Seed=1 -Dir=${DIR}
+    muscato_prep_targets ${DIR}/genes.txt.sz
+
+    muscato --ReadFileName=${DIR}/reads.fastq --GeneFileName=${DIR}/musc_genes.txt.sz \
+            --GeneIdFileName=${DIR}/musc_ids_genes.txt.sz --WorkDir=${DIR} --ResultsFileName=results.txt \
+            --Windows=0,20,40,60,80 --WindowWidth=15 --MaxReadLength=${READLEN} --PMatch=0.95 \
+            --MinDinuc=5 --RandomSeed=1 "$@"
+
+    muscato_eval ${DIR}/truth.txt ${DIR}/results.txt > ${DIR}/eval.txt
+    sed "s/^/${NAME}\t/" ${DIR}/eval.txt >> ${SUMMARY}
+
+done < ${TARGET}/datasets.txt
+
+echo
+cat ${SUMMARY}
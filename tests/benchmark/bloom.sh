@@ -0,0 +1,44 @@
+#!/bin/bash
+
+# Throughput benchmark for building the Bloom filters in
+# muscato_screen.  A large collection of reads is generated by
+# muscato_gendat (100 million by default, drawn from a million random
+# genes so that nearly all are distinct, which needs about 30GB of
+# disk space), and Muscato is run with ScreenOnly for each value of
+# ScreenConcurrency in CONCURRENCY.  The number of window
+# subsequences added per second, as logged by muscato_screen, is
+# printed for each run.  Extra arguments are passed to muscato, e.g.
+#
+#   tests/benchmark/bloom.sh --BloomSize=8000000000 --NumHash=10
+#
+# With a single window, the goroutines of muscato_screen are all used
+# to build one Bloom filter, so the effect of sharding the filter is
+# seen directly.
+
+set -e
+
+TARGET=${TARGET:-/var/tmp/muscato_bloom_bench}
+NUMREAD=${NUMREAD:-100000000}
+READLEN=${READLEN:-100}
+CONCURRENCY=${CONCURRENCY:-"1 2 4 8 16"}
+
+mkdir -p ${TARGET}
+
+if [ ! -f ${TARGET}/reads.fastq ]; then
+    muscato_gendat -NumRead=${NUMREAD} -ReadLen=${READLEN} -NumGene=1000000 -Seed=1 -Dir=${TARGET}
+    muscato_prep_targets ${TARGET}/genes.txt.sz
+fi
+
+for C in ${CONCURRENCY}; do
+
+    rm -rf ${TARGET}/logs_${C}
+    muscato --ReadFileName=${TARGET}/reads.fastq --GeneFileName=${TARGET}/musc_genes.txt.sz \
+            --GeneIdFileName=${TARGET}/musc_ids_genes.txt.sz --WorkDir=${TARGET} \
+            --LogDir=logs_${C} --ResultsFileName=results.txt --ScreenOnly \
+            --Windows=0 --WindowWidth=20 --MaxReadLength=${READLEN} --BloomSize=4000000000 \
+            --NumHash=20 --ScreenConcurrency=${C} --RandomSeed=1 "$@"
+
+    RATE=$(grep -h "Done constructing Bloom filters" ${TARGET}/logs_${C}/*/muscato_screen*.log | sed 's/.*, added/added/')
+    echo -e "ScreenConcurrency=${C}\t${RATE}"
+
+done
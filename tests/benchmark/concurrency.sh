@@ -0,0 +1,48 @@
+#!/bin/bash
+
+# Scaling benchmark for the parallelism defaults of utils/cpu.go.
+# Synthetic reads are generated by muscato_gendat (10 million by
+# default), and the full pipeline is run once for each multiple in
+# MULTIPLES, with SortPar, ScreenConcurrency and ConfirmConcurrency
+# set to that multiple of the number of CPUs (NCPU), and once with
+# the defaults.  The wall-clock time of each stage, taken from
+# timings.json, is printed for each run.  Extra arguments are passed
+# to muscato, e.g.
+#
+#   MULTIPLES="1 4 8 16" tests/benchmark/concurrency.sh --MaxConfirmProcs=2
+
+set -e
+
+TARGET=${TARGET:-/var/tmp/muscato_concurrency_bench}
+NUMREAD=${NUMREAD:-10000000}
+READLEN=${READLEN:-100}
+NCPU=${NCPU:-$(nproc)}
+MULTIPLES=${MULTIPLES:-"1 2 4 8"}
+
+mkdir -p ${TARGET}
+
+if [ ! -f ${TARGET}/reads.fastq ]; then
+    muscato_gendat -NumRead=${NUMREAD} -ReadLen=${READLEN} -NumGene=100000 -Seed=1 -Dir=${TARGET}
+    muscato_prep_targets ${TARGET}/genes.txt.sz
+fi
+
+run() {
+    NAME=$1
+    shift
+    rm -rf ${TARGET}/logs_${NAME}
+    muscato --ReadFileName=${TARGET}/reads.fastq --GeneFileName=${TARGET}/musc_genes.txt.sz \
+            --GeneIdFileName=${TARGET}/musc_ids_genes.txt.sz --WorkDir=${TARGET} \
+            --LogDir=logs_${NAME} --ResultsFileName=results_${NAME}.txt \
+            --Windows=0,20,40,60,80 --WindowWidth=15 --MaxReadLength=${READLEN} \
+            --RandomSeed=1 "$@"
+
+    echo "${NAME}"
+    grep -hE '^        "(Stage|Seconds)"' ${TARGET}/logs_${NAME}/*/timings.json | sed 's/^ *"[A-Za-z]*": //; s/,$//' | paste - -
+}
+
+for M in ${MULTIPLES}; do
+    C=$((M * NCPU))
+    run x${M} --SortPar=${C} --ScreenConcurrency=${C} --ConfirmConcurrency=${C} "${@}"
+done
+
+run default "$@"
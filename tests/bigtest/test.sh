@@ -12,3 +12,4 @@ muscato -GeneIdFileName=${TARGET}/musc_ids_genes.txt.sz -GeneFileName=${TARGET}/
         -ReadFileName=${TARGET}/reads.fastq -WindowWidth=20 -Windows=10,30,50,70 -MaxReadLength=200 \
         -TempDir=${TARGET}/muscato_tmp -NoCleanTemp -ResultsFileName=${TARGET}/results.txt
 
+muscato_eval ${TARGET}/truth.txt ${TARGET}/results.txt
@@ -0,0 +1,62 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// testWriter passes the log messages of the test script to t.Log.
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// The commands run by the pipeline tests, directly or by muscato.
+var pipelineCommands = []string{
+	"muscato", "muscato_gendat", "muscato_prep_targets", "muscato_eval",
+	"muscato_prep_reads", "muscato_uniqify", "muscato_window_reads",
+	"muscato_screen", "muscato_confirm", "muscato_combine_windows",
+	"muscato_combine_filter", "muscato_nonmatch", "muscato_readstats",
+	"sztool",
+}
+
+// TestPipeline runs the Pipeline tests of tests.toml, as 'go run
+// test.go' does.  The muscato commands and sztool must be installed
+// on the PATH (e.g. with 'go install ./...'), otherwise the test is
+// skipped.
+func TestPipeline(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("the pipeline tests are not run in short mode")
+	}
+	for _, name := range pipelineCommands {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed: %v", name, err)
+		}
+	}
+
+	logger = log.New(testWriter{t}, "", 0)
+	_, _, ptests := getTests()
+
+	for _, pt := range ptests {
+		pt := pt
+		t.Run(pt.Name, func(t *testing.T) {
+			logger = log.New(testWriter{t}, "", 0)
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatal(fmt.Sprint(r))
+				}
+			}()
+			runPipeline([]PipelineTest{pt})
+		})
+	}
+}
@@ -6,22 +6,45 @@
 // To run the tests, use:
 //
 // go run test.go
+//
+// The Pipeline tests run the full muscato pipeline on reads generated
+// by muscato_gendat in a temporary directory, and compare the accuracy
+// reported by muscato_eval, and the read counts in run_report.json,
+// to the values recorded in tests.toml.  Since the data are generated
+// with a fixed seed, the runs are reproducible, and a change in
+// accuracy indicates a change in the behavior of the pipeline.
+//
+// The Memory tests check that the memory estimate for the Bloom
+// filters, which is reported in run_report.json, agrees with the
+// memory actually used.  Allocating full-size filters (e.g. several
+// windows of 4 billion bits) is not practical in a test, so the
+// filters are built at two reduced scales in child processes, and
+// the peak resident memory is extrapolated to the full size.
 
 package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
 	"github.com/golang/snappy"
+	"github.com/kshedden/muscato/internal/bloom"
 )
 
 var (
@@ -35,9 +58,63 @@ type Test struct {
 	Opts    []string
 	Args    []string
 	Files   [][2]string
+
+	// If provided, the command reads from this file in Base
+	// instead of from stdin.
+	Stdin string
+
+	// If provided, the standard output of the command is written
+	// to this file in Base.
+	Stdout string
+
+	// If true, the lines of each file are sorted before comparing.
+	// This is used for commands that write their output in a
+	// nondeterministic order.
+	Sorted bool
 }
 
-func getTests() []Test {
+// MemoryTest describes a Bloom filter configuration whose memory
+// estimate is checked.
+type MemoryTest struct {
+	Name      string
+	BloomSize uint64
+	Windows   int
+
+	// The filters are built with Scale and 2*Scale times BloomSize
+	// bits.
+	Scale float64
+
+	// The largest allowed relative difference between the
+	// extrapolated and estimated memory.
+	Tolerance float64
+}
+
+// PipelineTest describes an end-to-end run of Muscato on data
+// generated by muscato_gendat, whose accuracy is checked with
+// muscato_eval.
+type PipelineTest struct {
+	Name string
+
+	// The arguments of muscato_gendat, which writes into the
+	// temporary directory of the test.
+	Gendat []string
+
+	// The arguments of muscato, following those giving the
+	// generated reads and targets and the work directory.
+	Muscato []string
+
+	// The statistics reported by muscato_eval (e.g. "Sensitivity"
+	// or "Random reads with a match") that must be at least, or
+	// equal to, the given values.
+	Min   map[string]float64
+	Equal map[string]float64
+
+	// The values of numeric fields of run_report.json (e.g.
+	// "NumInput").
+	Report map[string]float64
+}
+
+func getTests() ([]Test, []MemoryTest, []PipelineTest) {
 
 	fid, err := os.Open("tests.toml")
 	if err != nil {
@@ -50,7 +127,9 @@ func getTests() []Test {
 	fid.Close()
 
 	type vd struct {
-		Test []Test
+		Test     []Test
+		Memory   []MemoryTest
+		Pipeline []PipelineTest
 	}
 
 	var v vd
@@ -59,9 +138,9 @@ func getTests() []Test {
 		panic(err)
 	}
 
-	logger.Printf("Found %d tests\n", len(v.Test))
+	logger.Printf("Found %d tests, %d memory tests and %d pipeline tests\n", len(v.Test), len(v.Memory), len(v.Pipeline))
 
-	return v.Test
+	return v.Test, v.Memory, v.Pipeline
 }
 
 // getScanner returns a scanner for reading the contents of a file.
@@ -88,6 +167,49 @@ func getScanner(f string) (*bufio.Scanner, []io.Closer) {
 	return s, toclose
 }
 
+// readSorted returns the lines of a file in sorted order.  Snappy
+// compression is handled automatically.
+func readSorted(f string) []string {
+
+	s, tc := getScanner(f)
+	var lines []string
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		panic(err)
+	}
+	for _, x := range tc {
+		x.Close()
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+// compareSorted returns true if and only if the files named by the
+// arguments f1 and f2 contain the same lines, possibly in different
+// orders.
+func compareSorted(f1, f2 string) bool {
+
+	v1 := readSorted(f1)
+	v2 := readSorted(f2)
+
+	if len(v1) != len(v2) {
+		msg := fmt.Sprintf("files %s and %s have different numbers of lines\n", f1, f2)
+		panic(msg)
+	}
+
+	for i := range v1 {
+		if v1[i] != v2[i] {
+			msg := fmt.Sprintf("%s\nin file %s\ndiffers from\n%v\nin file %s\n", v1[i], f1, v2[i], f2)
+			panic(msg)
+		}
+	}
+
+	return true
+}
+
 // compare returns true if and only if the contents of the files named
 // by the arguments f1 and f2 are identical.  Snappy compression is
 // handled automatically.
@@ -150,18 +272,237 @@ func run(tests []Test) {
 		logger.Printf("with arguments: %v\n", c[1:])
 		cmd := exec.Command(c[0], c[1:len(c)]...)
 		cmd.Stderr = os.Stderr
+		var toclose []io.Closer
+		if t.Stdin != "" {
+			fid, err := os.Open(path.Join(t.Base, t.Stdin))
+			if err != nil {
+				panic(err)
+			}
+			toclose = append(toclose, fid)
+			cmd.Stdin = fid
+		}
+		if t.Stdout != "" {
+			fid, err := os.Create(path.Join(t.Base, t.Stdout))
+			if err != nil {
+				panic(err)
+			}
+			toclose = append(toclose, fid)
+			cmd.Stdout = fid
+		}
 		err := cmd.Run()
 		if err != nil {
 			panic(err)
 		}
+		for _, x := range toclose {
+			x.Close()
+		}
 		for _, fp := range t.Files {
-			compare(path.Join(t.Base, fp[0]), path.Join(t.Base, fp[1]))
+			f1, f2 := path.Join(t.Base, fp[0]), path.Join(t.Base, fp[1])
+			if t.Sorted {
+				compareSorted(f1, f2)
+			} else {
+				compare(f1, f2)
+			}
 		}
 
 		logger.Printf("done\n\n")
 	}
 }
 
+// bloomChild builds nfilter Bloom filters with nbits bits each,
+// touching their memory as muscato_screen does, and prints the
+// increase in peak resident memory in bytes.  It is run in a child
+// process so that the peak is not affected by other tests.
+func bloomChild(nbits uint64, nfilter int) {
+
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	base := ru.Maxrss
+
+	rng := rand.New(rand.NewSource(1))
+	var filters []*bloom.Filter
+	h := make([]uint64, 20)
+	for k := 0; k < nfilter; k++ {
+		f := bloom.New(nbits)
+		for i := uint64(0); i < 2*nbits/512; i++ {
+			for j := range h {
+				h[j] = rng.Uint64()
+			}
+			f.Add(h)
+		}
+		filters = append(filters, f)
+	}
+
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+
+	// Maxrss is in kilobytes on Linux.
+	fmt.Println((ru.Maxrss - base) * 1024)
+	runtime.KeepAlive(filters)
+}
+
+// bloomPeak runs bloomChild in a child process and returns its result.
+func bloomPeak(nbits uint64, nfilter int) float64 {
+
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	out, err := exec.Command(exe, "-bloommem", fmt.Sprintf("%d", nbits), fmt.Sprintf("%d", nfilter)).Output()
+	if err != nil {
+		panic(err)
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		panic(err)
+	}
+
+	return x
+}
+
+// runMemory checks that the memory used by each Bloom filter
+// configuration, extrapolated from two reduced scales, is within the
+// tolerance of the estimate.
+func runMemory(tests []MemoryTest) {
+
+	for _, t := range tests {
+
+		logger.Printf("%s\n", t.Name)
+
+		n1 := uint64(t.Scale * float64(t.BloomSize))
+		n2 := 2 * n1
+		m1 := bloomPeak(n1, t.Windows)
+		m2 := bloomPeak(n2, t.Windows)
+
+		// The memory is linear in the number of bits, apart from
+		// fixed overhead.
+		slope := (m2 - m1) / float64(n2-n1)
+		full := m2 + slope*float64(t.BloomSize-n2)
+		est := float64(uint64(t.Windows) * bloom.Bytes(t.BloomSize))
+		logger.Printf("Peak memory %.0f at %d bits, %.0f at %d bits\n", m1, n1, m2, n2)
+		logger.Printf("Extrapolated %.0f, estimated %.0f\n", full, est)
+
+		if math.Abs(full-est) > t.Tolerance*est {
+			msg := fmt.Sprintf("%s: extrapolated memory %.0f differs from the estimate %.0f by more than %.0f%%\n",
+				t.Name, full, est, 100*t.Tolerance)
+			panic(msg)
+		}
+
+		logger.Printf("done\n\n")
+	}
+}
+
+// runCommand runs a command, logging its arguments, and returns its
+// standard output.
+func runCommand(name string, args ...string) []byte {
+
+	logger.Printf("Running command %s\n", name)
+	logger.Printf("with arguments: %v\n", args)
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		panic(fmt.Sprintf("%s: %v", name, err))
+	}
+
+	return out
+}
+
+// readEval parses the output of muscato_eval, which has one
+// tab-delimited statistic and value on each line.
+func readEval(out []byte) map[string]float64 {
+
+	stats := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		toks := strings.Split(line, "\t")
+		if len(toks) != 2 {
+			panic(fmt.Sprintf("unexpected muscato_eval output '%s'", line))
+		}
+		x, err := strconv.ParseFloat(toks[1], 64)
+		if err != nil {
+			panic(err)
+		}
+		stats[toks[0]] = x
+	}
+
+	return stats
+}
+
+// readReport returns the run report of the single run whose logs are
+// in the muscato_logs subdirectory of dir.
+func readReport(dir string) map[string]interface{} {
+
+	names, err := filepath.Glob(path.Join(dir, "muscato_logs", "*", "run_report.json"))
+	if err != nil {
+		panic(err)
+	}
+	if len(names) != 1 {
+		panic(fmt.Sprintf("found %d run reports in %s, expected 1", len(names), dir))
+	}
+
+	fid, err := os.Open(names[0])
+	if err != nil {
+		panic(err)
+	}
+	defer fid.Close()
+	report := make(map[string]interface{})
+	if err := json.NewDecoder(fid).Decode(&report); err != nil {
+		panic(err)
+	}
+
+	return report
+}
+
+// runPipeline runs each pipeline test in its own temporary directory,
+// which is removed if the test passes.
+func runPipeline(tests []PipelineTest) {
+
+	for _, t := range tests {
+
+		logger.Printf("%s\n", t.Name)
+
+		dir, err := ioutil.TempDir("", "muscato_pipeline_")
+		if err != nil {
+			panic(err)
+		}
+
+		runCommand("muscato_gendat", append(t.Gendat, "-Dir="+dir)...)
+		runCommand("muscato_prep_targets", path.Join(dir, "genes.txt.sz"))
+		args := []string{
+			"--ReadFileName=" + path.Join(dir, "reads.fastq"),
+			"--GeneFileName=" + path.Join(dir, "musc_genes.txt.sz"),
+			"--GeneIdFileName=" + path.Join(dir, "musc_ids_genes.txt.sz"),
+			"--WorkDir=" + dir,
+			"--ResultsFileName=results.txt",
+		}
+		runCommand("muscato", append(args, t.Muscato...)...)
+		stats := readEval(runCommand("muscato_eval", path.Join(dir, "truth.txt"), path.Join(dir, "results.txt")))
+
+		for name, v := range t.Min {
+			x, ok := stats[name]
+			if !ok || x < v {
+				panic(fmt.Sprintf("%s: %s is %v, expected at least %v (the files are in %s)", t.Name, name, x, v, dir))
+			}
+		}
+		for name, v := range t.Equal {
+			x, ok := stats[name]
+			if !ok || x != v {
+				panic(fmt.Sprintf("%s: %s is %v, expected %v (the files are in %s)", t.Name, name, x, v, dir))
+			}
+		}
+
+		report := readReport(dir)
+		for name, v := range t.Report {
+			x, ok := report[name].(float64)
+			if !ok || x != v {
+				panic(fmt.Sprintf("%s: %s in run_report.json is %v, expected %v (the files are in %s)", t.Name, name, report[name], v, dir))
+			}
+		}
+
+		os.RemoveAll(dir)
+		logger.Printf("done\n\n")
+	}
+}
+
 func setupLog() {
 	fid, err := os.Create("test.log")
 	if err != nil {
@@ -186,8 +527,23 @@ func clean(tests []Test) {
 
 func main() {
 
+	if len(os.Args) == 4 && os.Args[1] == "-bloommem" {
+		nbits, err := strconv.ParseUint(os.Args[2], 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		nfilter, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			panic(err)
+		}
+		bloomChild(nbits, nfilter)
+		return
+	}
+
 	setupLog()
-	tests := getTests()
+	tests, mtests, ptests := getTests()
 	clean(tests)
 	run(tests)
+	runMemory(mtests)
+	runPipeline(ptests)
 }
@@ -0,0 +1,145 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cmdUsage records the resources used by one command.
+type cmdUsage struct {
+	Command string
+
+	// The CPU time in user and system mode, in seconds.
+	UserSeconds   float64
+	SystemSeconds float64
+
+	// The maximum resident set size in kilobytes, as reported by
+	// getrusage.
+	MaxRSS int64
+}
+
+// stageUsage records the resources used by one stage of the
+// pipeline.  The CPU times are the totals over the commands run by
+// the stage, and MaxRSS is the largest of their maximum resident set
+// sizes.  Work done within the muscato process itself is reported as
+// a command named "muscato", whose MaxRSS is the peak for the process
+// up to the end of the stage.
+type stageUsage struct {
+	Stage         string
+	Seconds       float64
+	UserSeconds   float64
+	SystemSeconds float64
+	MaxRSS        int64
+	Commands      []cmdUsage
+}
+
+var (
+	// The commands started by the current stage.
+	stageCmds  []*exec.Cmd
+	stageMutex sync.Mutex
+
+	// The resource usage of the stages that have been run.
+	timings []stageUsage
+)
+
+// trackCommand adds a command to those started by the current stage.
+func trackCommand(cmd *exec.Cmd) {
+	stageMutex.Lock()
+	defer stageMutex.Unlock()
+	stageCmds = append(stageCmds, cmd)
+}
+
+func seconds(tv syscall.Timeval) float64 {
+	return time.Duration(tv.Nano()).Seconds()
+}
+
+// maxRSS returns the maximum resident set size in kilobytes.  It is
+// reported in kilobytes by Linux, but in bytes by macOS.
+func maxRSS(ru *syscall.Rusage) int64 {
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss) / 1024
+	}
+	return int64(ru.Maxrss)
+}
+
+// selfUsage returns the resource usage of the muscato process.
+func selfUsage() syscall.Rusage {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		logger.Print(err)
+	}
+	return ru
+}
+
+// recordUsage adds the resources used by a stage to the timings,
+// using the commands started by the stage that have exited, and the
+// usage of the muscato process at the start of the stage.
+func recordUsage(name string, elapsed time.Duration, start syscall.Rusage) {
+
+	stageMutex.Lock()
+	cmds := stageCmds
+	stageCmds = nil
+	stageMutex.Unlock()
+
+	su := stageUsage{Stage: name, Seconds: elapsed.Seconds()}
+	add := func(cu cmdUsage) {
+		su.UserSeconds += cu.UserSeconds
+		su.SystemSeconds += cu.SystemSeconds
+		if cu.MaxRSS > su.MaxRSS {
+			su.MaxRSS = cu.MaxRSS
+		}
+		su.Commands = append(su.Commands, cu)
+	}
+
+	for _, cmd := range cmds {
+		if cmd.ProcessState == nil {
+			continue
+		}
+		ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+		if !ok {
+			continue
+		}
+		add(cmdUsage{
+			Command:       path.Base(cmd.Path),
+			UserSeconds:   seconds(ru.Utime),
+			SystemSeconds: seconds(ru.Stime),
+			MaxRSS:        maxRSS(ru),
+		})
+	}
+
+	ru := selfUsage()
+	add(cmdUsage{
+		Command:       "muscato",
+		UserSeconds:   seconds(ru.Utime) - seconds(start.Utime),
+		SystemSeconds: seconds(ru.Stime) - seconds(start.Stime),
+		MaxRSS:        maxRSS(&ru),
+	})
+
+	timings = append(timings, su)
+}
+
+// writeTimings writes timings.json into the log directory, giving the
+// wall-clock time, CPU time and peak memory use of each stage that
+// was run.
+func writeTimings() {
+
+	fid, err := os.Create(path.Join(config.LogDir, "timings.json"))
+	if err != nil {
+		logger.Print(err)
+		return
+	}
+	defer fid.Close()
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(timings); err != nil {
+		logger.Print(err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import "fmt"
+
+// The letters of the sequence alphabets.  The protein alphabet is the
+// 20 standard amino acids.
+const (
+	DNALetters     = "ACGT"
+	ProteinLetters = "ACDEFGHIKLMNPQRSTVWY"
+)
+
+// Alphabet is the set of letters allowed in the read and target
+// sequences, as given by the SequenceAlphabet setting.
+type Alphabet struct {
+	Name  string
+	valid [256]bool
+}
+
+// NewAlphabet returns the alphabet with the given name, "dna" or
+// "protein".  An empty name is taken to be "dna".
+func NewAlphabet(name string) (*Alphabet, error) {
+
+	var letters string
+	switch name {
+	case "", "dna":
+		name = "dna"
+		letters = DNALetters
+	case "protein":
+		letters = ProteinLetters
+	default:
+		return nil, fmt.Errorf("unknown sequence alphabet '%s', use 'dna' or 'protein'", name)
+	}
+
+	a := &Alphabet{Name: name}
+	for _, c := range []byte(letters) {
+		a.valid[c] = true
+	}
+
+	return a, nil
+}
+
+// SubX replaces the letters of seq that are not in the alphabet with
+// X, in place.
+func (a *Alphabet) SubX(seq []byte) {
+	for i, c := range seq {
+		if !a.valid[c] {
+			seq[i] = 'X'
+		}
+	}
+}
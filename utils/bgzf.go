@@ -0,0 +1,125 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// The maximum amount of uncompressed data in a BGZF block.
+	// This is less than 64KiB so that the compressed block always
+	// fits in 64KiB.
+	bgzfBlockSize = 0xff00
+)
+
+// bgzfEOF is the empty block that marks the end of a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00,
+	0x42, 0x43, 0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+}
+
+// BGZFWriter writes data in the blocked gzip format (BGZF) used by
+// htslib.  The output is a valid gzip file, consisting of independently
+// compressed blocks, so that positions in the uncompressed data can be
+// located using virtual offsets (see Offset).
+type BGZFWriter struct {
+	w io.Writer
+
+	// The uncompressed data for the current block.
+	buf []byte
+
+	// The position in the file of the start of the current block.
+	coffset int64
+
+	zbuf bytes.Buffer
+	zw   *flate.Writer
+}
+
+// NewBGZFWriter returns a BGZFWriter that writes to w.
+func NewBGZFWriter(w io.Writer) *BGZFWriter {
+	zw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return &BGZFWriter{w: w, buf: make([]byte, 0, bgzfBlockSize), zw: zw}
+}
+
+// Offset returns the virtual offset of the next byte to be written:
+// the file position of its block shifted left by 16 bits, plus its
+// position within the uncompressed block.
+func (w *BGZFWriter) Offset() uint64 {
+	return uint64(w.coffset)<<16 | uint64(len(w.buf))
+}
+
+func (w *BGZFWriter) Write(p []byte) (int, error) {
+
+	n := len(p)
+	for len(p) > 0 {
+		m := bgzfBlockSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[0:m]...)
+		p = p[m:]
+		if len(w.buf) == bgzfBlockSize {
+			if err := w.flushBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// flushBlock compresses and writes the current block.
+func (w *BGZFWriter) flushBlock() error {
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	w.zbuf.Reset()
+	w.zw.Reset(&w.zbuf)
+	if _, err := w.zw.Write(w.buf); err != nil {
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+
+	// The gzip header, with the BC extra field giving the block
+	// size minus one.
+	bsize := 18 + w.zbuf.Len() + 8
+	hdr := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff, 0x06, 0x00, 'B', 'C', 0x02, 0x00, 0, 0}
+	binary.LittleEndian.PutUint16(hdr[16:], uint16(bsize-1))
+
+	var tail [8]byte
+	binary.LittleEndian.PutUint32(tail[0:], crc32.ChecksumIEEE(w.buf))
+	binary.LittleEndian.PutUint32(tail[4:], uint32(len(w.buf)))
+
+	for _, b := range [][]byte{hdr, w.zbuf.Bytes(), tail[:]} {
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	w.coffset += int64(bsize)
+	w.buf = w.buf[0:0]
+
+	return nil
+}
+
+// Close writes any remaining data and the end-of-file marker.  It
+// does not close the underlying writer.
+func (w *BGZFWriter) Close() error {
+
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+	_, err := w.w.Write(bgzfEOF)
+
+	return err
+}
@@ -0,0 +1,143 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/snappy"
+)
+
+// The first bytes of snappy (framing format) and gzip files.
+var (
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	gzipMagic   = []byte{0x1f, 0x8b}
+)
+
+// CompressedName returns the name of a file compressed using the
+// given method ("snappy", "gzip", or "" for no compression).
+func CompressedName(name, method string) string {
+	switch method {
+	case "snappy":
+		return name + ".sz"
+	case "gzip":
+		return name + ".gz"
+	default:
+		return name
+	}
+}
+
+// ResultsPath returns the path of the results file, including the
+// suffix for the compression method given by CompressResults.
+func (c *Config) ResultsPath() string {
+	return CompressedName(c.ResultsFileName, c.CompressResults)
+}
+
+// resultWriter compresses data written to a file.
+type resultWriter struct {
+	io.Writer
+	zw     io.WriteCloser
+	fid    *os.File
+	sync   bool
+	closed bool
+}
+
+// Close flushes the compressed data and closes the file.  Calling
+// Close more than once has no effect.
+func (w *resultWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	var err error
+	if w.zw != nil {
+		err = w.zw.Close()
+	}
+	if e := CloseFile(w.fid, w.sync); err == nil {
+		err = e
+	}
+	return err
+}
+
+// CreateResult creates a result file that is compressed using the
+// given method ("snappy", "gzip", or "" for no compression).  The
+// name should already include the compression suffix (see
+// CompressedName).  If sync is true, the file is synced when it is
+// closed (see CloseFile).
+func CreateResult(name, method string, sync bool) (io.WriteCloser, error) {
+
+	fid, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &resultWriter{fid: fid, sync: sync}
+	switch method {
+	case "snappy":
+		w.zw = NewSnappyWriter(fid, 0)
+	case "gzip":
+		w.zw = gzip.NewWriter(fid)
+	case "":
+		w.Writer = fid
+		return w, nil
+	default:
+		fid.Close()
+		return nil, fmt.Errorf("unknown compression method '%s'", method)
+	}
+	w.Writer = w.zw
+
+	return w, nil
+}
+
+// resultReader decompresses data read from a file.
+type resultReader struct {
+	io.Reader
+	fid *os.File
+}
+
+func (r *resultReader) Close() error {
+	return r.fid.Close()
+}
+
+// OpenResult opens a result file for reading.  Snappy and gzip
+// compressed files are recognized from their contents and
+// decompressed.
+func OpenResult(name string) (io.ReadCloser, error) {
+
+	fid, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rdr, err := decompress(fid)
+	if err != nil {
+		fid.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return &resultReader{Reader: rdr, fid: fid}, nil
+}
+
+// decompress returns a reader for the contents of a file, which may
+// be snappy or gzip compressed, or uncompressed.  The format is
+// recognized from the first bytes of the file.
+func decompress(fid *os.File) (io.Reader, error) {
+
+	br := bufio.NewReader(fid)
+	head, _ := br.Peek(len(snappyMagic))
+
+	switch {
+	case bytes.HasPrefix(head, snappyMagic):
+		return snappy.NewReader(br), nil
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	default:
+		return br, nil
+	}
+}
@@ -4,7 +4,10 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -13,40 +16,256 @@ type Config struct {
 	ReadFileName string
 
 	// The name of the fasta or plain text file containing the
-	// target sequences (genes).
+	// target sequences (genes).  This may be a manifest of volumes
+	// written by muscato_prep_targets -volsize.
 	GeneFileName string
 
 	// The name of the file containing the target sequence (gene)
-	// identifiers.
+	// identifiers, or a manifest of its volumes.
 	GeneIdFileName string
 
 	// The file path where the results are written.
 	ResultsFileName string
 
+	// If set, a file with one line for each matched read sequence
+	// is written to this path, giving its best match (the one with
+	// the fewest mismatches), the number of matches tied with it,
+	// and the read count and identifiers.  It is compressed as set
+	// by CompressResults.
+	BestHitFile string
+
+	// If set, the results file and the read statistics, gene
+	// statistics and non-matching read files are compressed.
+	// Either "snappy" or "gzip".  The suffix ".sz" or ".gz" is
+	// appended to the file names.
+	CompressResults string
+
+	// If true, a copy of the results sorted by target and position
+	// is written with bgzip compression, along with a tabix index.
+	IndexResults bool
+
+	// If true, matches to reverse complemented targets (with
+	// names ending in "_r") are reported using positions on the
+	// forward strand of the original target, and a strand column
+	// is appended to the results.
+	ForwardStrand bool
+
+	// If true, the strand of each match and its 1-based start and
+	// end positions on the forward strand of the original target
+	// are appended to the results.
+	TargetCoords bool
+
+	// If true, only the gene statistics (and the panel report) are
+	// written.  The per-read results, read statistics and
+	// non-matching reads are not produced, which avoids joining the
+	// read names to the matches.
+	NoPerReadOutput bool
+
+	// If true, the reason that each unmatched read sequence was not
+	// matched (too short, low entropy, no candidate, rejected by
+	// PMatch or dropped by MaxMatches) is written to a file whose
+	// name is derived from the results file name, and the number of
+	// unmatched sequences and reads with each reason is included in
+	// run_report.json.
+	UnmatchedReasons bool
+
+	// If true, the gene statistics count each matching read,
+	// rather than each distinct matching sequence.
+	WeightGeneStats bool
+
+	// A file listing the expected targets (e.g. the genes in a
+	// capture panel), one per line.  If set, a report is written
+	// showing which of the targets had fewer than PanelMinCount
+	// matches.
+	PanelFileName string
+
+	// The minimum number of matches for a target in the panel to
+	// be considered covered.  The default is 1.
+	PanelMinCount int
+
+	// If positive, reads that extend beyond the 3' end of a target
+	// are matched, provided that at least this many read bases are
+	// aligned to the target, and a column containing the number of
+	// read bases beyond the end of the target is appended to the
+	// results.
+	ReadThrough int
+
+	// If true, a column containing an E-value for each match is
+	// appended to the results.  The E-value is the expected number
+	// of matches at least as good in a random database of the same
+	// total length as the targets, computed as in BLAST for an
+	// ungapped alignment.
+	EValues bool
+
 	// The left end point of each window with a read.
 	Windows []int
 
+	// If positive, and Windows is not set, windows are placed at
+	// every WindowStride positions of the reads, starting at 0 and
+	// extending to the end of the longest read.
+	WindowStride int
+
 	// The width of each window.
 	WindowWidth int
 
+	// Where the window positions are measured from, either "start"
+	// (the default), in which case Windows gives the left end point
+	// of each window, or "end", in which case it gives the distance
+	// from the right end point of each window to the end of the
+	// read.  With "end", reads of varying lengths (e.g. after
+	// adapter trimming) all cover the windows near their ends, and
+	// a read is only left out of the windows that extend past its
+	// start.
+	WindowAnchor string
+
+	// If positive, the windows are screened and confirmed in
+	// batches of at most this many windows, each with its own pass
+	// over the reads and targets.  Only the Bloom filters for one
+	// batch are held in memory at once, and with Retention set to
+	// "none" only the intermediate files for one batch are kept in
+	// TempDir, at the cost of reading the targets once per batch.
+	// The default is to process all windows in one batch.
+	WindowBatch int
+
 	// The size of the Bloom filter in bits.
 	BloomSize uint64
 
 	// The number of hash functions to use in the Bloom filter.
 	NumHash int
 
+	// If true, BloomSize and NumHash are chosen after the reads
+	// are counted, to give a false positive rate of BloomFPR.
+	// This is the default when neither BloomSize nor NumHash is
+	// given.
+	AutoBloom bool
+
+	// The target false positive rate of the Bloom filters when
+	// AutoBloom is set.  The default is 0.01.
+	BloomFPR float64
+
+	// The rolling hash used for the Bloom filters, "buzhash32",
+	// "buzhash64", or "auto" (the default) to use buzhash64 for
+	// filters with more than 2^32 bits.  The blocks and bits of
+	// the filters are chosen from the hash values, so 32-bit hashes
+	// cannot address all of a larger filter, and its false
+	// positive rate is much higher than expected.
+	BloomHash string
+
+	// The method used to screen the targets for candidate
+	// matches, either "bloom" (the default) to use Bloom filters,
+	// or "exact" to use hash sets of the read windows, which uses
+	// more memory but produces no false positives.
+	ScreenMethod string
+
+	// The collection that is held in memory by the screen, either
+	// "reads" (the default) to sketch the read windows and stream
+	// the targets, "targets" to index the subsequences of the
+	// targets and stream the read windows, or "auto" to choose the
+	// collection with fewer subsequences after the reads have
+	// been counted.
+	IndexSide string
+
+	// If true, the reads that occur exactly in a target are found
+	// first, by hashing the complete reads, and only the remaining
+	// reads are passed to the screen and confirm stages.  This
+	// requires MMTol to be zero, so that a read with an exact match
+	// has no other matches in the results.
+	ExactTier bool
+
+	// If true, the run stops after the screen, and reports the
+	// number of candidate matches in each window and the number of
+	// comparisons needed to confirm them, so that the screening
+	// settings can be checked before running the confirm stage.
+	// No results are written.
+	ScreenOnly bool
+
+	// The seed for all random number generators, so that repeated
+	// runs with the same seed produce identical results.  If zero,
+	// a seed is chosen at random and recorded in the saved
+	// configuration.
+	RandomSeed int64
+
 	// The minimum allowed proportion of matching bases.
 	PMatch float64
 
+	// If set, the PMatch used in confirming the matches found by
+	// each window, in the order of Windows, in place of PMatch,
+	// e.g. stricter for a window at the 5' end of the reads than
+	// for windows affected by quality decay at the 3' end.
+	WindowPMatch []float64
+
+	// The costs of mismatched bases used with PMatch, e.g.
+	// {"transition": 0.5, "X": 0}.  By default every mismatch costs
+	// 1.  The keys are "transition", "transversion", "X" (any base
+	// compared to an X or N) and pairs of read and target bases
+	// such as "CT", which take precedence.  The total cost of a
+	// match may be at most 1 - PMatch times the read length.
+	MismatchCosts map[string]float64
+
 	// The exact-match subsequence must have this many distinct
-	// dinucleotide subsequences.
+	// dinucleotide subsequences (pairs of amino acids for protein
+	// sequences).
 	MinDinuc int
 
-	// Use this location to place temporary files.  If blank or
-	// missing, a temporary directory is generated of the form
-	// tmp/######## in the local directory.
+	// The letters of the read and target sequences, "dna" (the
+	// default) or "protein".  Letters that are not in the alphabet
+	// (A, C, G and T, or the 20 standard amino acids) are replaced
+	// with X.  Protein targets must be prepared with
+	// muscato_prep_targets -alphabet=protein.
+	SequenceAlphabet string
+
+	// If set, all files written during the run are placed in this
+	// directory: TempDir and LogDir default to its muscato_tmp and
+	// muscato_logs subdirectories, relative paths for TempDir,
+	// LogDir, PipeDir, SortTemp, CacheDir and ResultsFileName are
+	// relative to it, and sort and the other tools place their
+	// scratch files in TempDir.
+	WorkDir string
+
+	// Use this location to place temporary files.  Each run
+	// creates a subdirectory named by a unique id.  If blank or
+	// missing, the muscato_tmp subdirectory of WorkDir is used if
+	// WorkDir is set, otherwise that of $TMPDIR if it is set,
+	// otherwise that of the current directory.
 	TempDir string
 
+	// How to handle a shortage of space in TempDir: "warn" (the
+	// default) to warn if the estimated space needed is more than
+	// is available, or if the space runs low during the run,
+	// "error" to refuse to start or to stop the run in these
+	// cases, or "off" to not check.
+	SpaceCheck string
+
+	// If set, the results of the stages up to and including the
+	// screen are saved in this directory, and reused by later runs
+	// with the same inputs and screening parameters.  This avoids
+	// repeating the screen when only the confirmation parameters
+	// (e.g. PMatch or MMTol) are changed.
+	CacheDir string
+
+	// If set, the screening stages are not run, and the sorted
+	// reads, sorted windows and candidate matches are instead
+	// taken from this directory, which must be the TempDir of an
+	// earlier run with the same reads and targets that was kept
+	// using NoCleanTemp (e.g. a run with ScreenOnly).  The
+	// screening parameters (e.g. Windows) of the earlier run are
+	// used, and only the confirmation and later stages are run.
+	ConfirmOnly string
+
+	// If set with ConfirmOnly, only these windows (counting from
+	// 0) are confirmed, e.g. to rerun a window whose confirmation
+	// failed, and the confirmed matches of the other windows are
+	// taken from the earlier run, which must have confirmed them
+	// with the same settings (e.g. PMatch and MaxMatches).
+	WindowSubset []int
+
+	// If set, named pipes (FIFOs) are created in this directory
+	// to pass data to commands that read more than one input
+	// stream.  Each run creates its FIFOs in a subdirectory named
+	// by its unique id.  By default anonymous pipes are used,
+	// which are opened through /dev/fd.
+	PipeDir string
+
 	// The directory where log files are written.  By default the
 	// logs are placed into muscato_logs/###### in the local
 	// directory, where the number matches the default prefix of
@@ -59,29 +278,132 @@ type Config struct {
 	// Truncate all reads at this length.
 	MaxReadLength int
 
-	// The confirmatory matching step returns at most this many
-	// matches for each k-mer seqeunces.  Since a k-mer sequence
-	// may match many reads and many genes, setting MaxMatches to
-	// a low value may lead to some reads not being mapped, or not
-	// multi-mapping as well as possible.
-	MaxMatches int
+	// The location of the unique molecular identifier (UMI) of each
+	// read, either "read:n" (the first n bases of the read) or
+	// "header:c" (following the last c in the read name).  If set,
+	// reads with the same sequence and UMI are counted once.
+	UMI string
+
+	// Adapter sequences to remove from the 3' end of the reads
+	// before matching, e.g. ["AGATCGGAAGAGC"].  The first
+	// occurrence of any of the adapters in a read is removed along
+	// with the rest of the read, allowing one mismatch in ten
+	// bases.  An adapter running off the end of the read is
+	// removed if at least AdapterMinOverlap of its bases are
+	// present.
+	Adapters []string
+
+	// The minimum number of bases of an adapter that must be found
+	// at the end of a read to be removed (default 5).
+	AdapterMinOverlap int
+
+	// If positive, low quality bases are trimmed from the 3' end of
+	// the reads before the adapters are removed, cutting each read
+	// where the sum of QualityTrim minus the quality scores
+	// (Phred+33) of the removed bases is largest, as in BWA.
+	QualityTrim int
 
-	// The maximum number of confirmation processes that are run
-	// simultaneously.
-	MaxConfirmProcs int
+	// How the read group (e.g. the sequencing lane) of each read is
+	// found in its name: "lane" or "tile" for the flow cell and
+	// lane (and tile) of Illumina read names, or "regexp:re" for
+	// the part of the name matched by the regular expression re
+	// (its first parenthesized subexpression if it has one).  If
+	// set, the number of reads in each group is appended to the
+	// results, and a summary of the matched reads in each group is
+	// written.
+	ReadGroup string
+
+	// The limits on the work and resources of the run (see
+	// Limits).  Their fields appear directly in the configuration
+	// file, like the other settings.
+	Limits
+
+	// The number of times a stage is run again after failing with
+	// an error that is likely to be transient, such as a command
+	// killed by the out-of-memory killer.  The default is 0 (no
+	// retries).
+	StageRetries int
+
+	// The wait before retrying a failed stage, as a duration such
+	// as "30s", which is doubled before each further retry.  The
+	// default is 30 seconds.
+	RetryDelay string
+
+	// If true, a failure of the read and gene statistics or the
+	// panel report, which are not needed for the results, is
+	// recorded as a warning and the run continues.
+	AllowStatsFailure bool
+
+	// The number of goroutines used by muscato_screen to process
+	// target sequences.  The default is based on the number of
+	// available CPUs.
+	ScreenConcurrency int
+
+	// The number of goroutines used by each muscato_confirm
+	// process.  The default is based on the number of available
+	// CPUs.
+	ConfirmConcurrency int
+
+	// The maximum number of reads, or of candidate matches, sharing
+	// a window sequence that muscato_confirm holds in memory.
+	// Larger blocks are written to temporary files and compared in
+	// batches of this size.  The default is 1 million.
+	ConfirmBlockSize int
+
+	// If positive, blocks larger than ConfirmBlockSize are divided
+	// according to the ConfirmFlank bases following the window,
+	// and only reads and targets that agree on these bases are
+	// compared.  Matches with mismatches in these bases may then be
+	// missed.
+	ConfirmFlank int
+
+	// The false positive rate of the Bloom filter that removes
+	// the duplicate matches found in several windows, before the
+	// matches are sorted by read.  Each false positive removes a
+	// match that is not a duplicate.  The default is 1e-6.
+	CombineFPR float64
+
+	// If true, the duplicate matches are removed by sort, rather
+	// than by a Bloom filter, so that no matches are lost, at the
+	// cost of sorting all of the matches.
+	ExactCombine bool
 
 	// Number of additional mismatches beyond the best possible
 	// number of mismatches that are allowed when retaining the
 	// target sequence matches to each read.
 	MMTol int
 
+	// If set, the MMTol for the matches found by each window, in the
+	// order of Windows, in place of MMTol.  A match is retained if
+	// it has at most this many more mismatches than the best match
+	// of the read in any window.  If a match is found by several
+	// windows, the largest of their values is used.
+	WindowMMTol []int
+
+	// A shell command that is given the read x gene pairs that did
+	// not agree to within PMatch, and writes the matches that it
+	// accepts (e.g. after a gapped alignment), which are added to
+	// the results.  See the README for the input and output
+	// formats.
+	RefineCommand string
+
 	// Either "first" (default) or "best".  If first, returns the
 	// first MaxMatches matches for each window.  If best, returns
 	// the MaxMatches matches for each window with the fewest
-	// mismatched values.
+	// mismatched values (among matches with the same number of
+	// mismatches, the ones found first are preferred).
 	MatchMode string
 
-	// The number of parallel processes to use for sorting.
+	// If set, reads that match multiple targets are resolved
+	// after the matching is complete, and an abundance table is
+	// produced.  Either "unique" (only count reads that match a
+	// single target), "fractional" (divide each read equally among
+	// its targets), or "best" (assign each read to the target with
+	// the fewest mismatches).  If blank, no resolution is done.
+	AssignMode string
+
+	// The number of parallel processes to use for sorting.  The
+	// default is the number of available CPUs.
 	SortPar int
 
 	// The temporary directory for GNU sort.  If not specified,
@@ -91,6 +413,48 @@ type Config struct {
 	// The -S parameter for Gnu sort.
 	SortMem string
 
+	// The size in bytes of the buffer used when writing the
+	// compressed intermediate files (win, bmatch and rmatch).
+	// Larger values result in fewer, larger writes to the file
+	// system.  The default is 1MB.
+	WriterBufferSize int
+
+	// If true, result files are synced to stable storage before
+	// being closed.  This is enabled automatically when the
+	// results are written to a network file system.
+	SyncResults bool
+
+	// A comma-separated list of the kinds of intermediate files
+	// that are kept in TempDir until the end of the run.  The
+	// kinds are reads_sorted, win, win_sorted, bmatch, smatch,
+	// rmatch, matches, matches_sg and matches_sn.  Intermediate
+	// files that are not retained are deleted as soon as the stage
+	// that consumes them has finished, reducing the peak disk usage.
+	// "all" (the default) retains all intermediate files, "none"
+	// retains none of them.
+	Retention string
+
+	// If true, each window file (win_k) is deleted as soon as its
+	// sorted copy (win_k_sorted) has been written, and each Bloom
+	// match file (bmatch_k) is deleted as soon as its sorted copy
+	// (smatch_k) has been written, regardless of Retention.
+	EarlyDelete bool
+
+	// If true, the window files (win_k) and Bloom match files
+	// (bmatch_k) are not written.  Instead, the reads are windowed
+	// and the targets screened with the output for each window
+	// passed through a pipe to its sort, so that only the sorted
+	// copies are written to TempDir.  The sorts for all the windows
+	// of a batch run at once, sharing SortMem.  The pipes are
+	// passed to the producers through /dev/fd, even if PipeDir is
+	// set, so Streaming requires a system with /dev/fd.
+	Streaming bool
+
+	// If true, the numbers of reads reported by the stages of the
+	// pipeline are checked for consistency at the end of the run,
+	// and any discrepancies are reported as warnings.
+	CheckCounts bool
+
 	// If true, temporary files are not removed upon program
 	// completion.  If false, which is the default, the temporary
 	// files are removed.
@@ -98,20 +462,131 @@ type Config struct {
 
 	// If true, generate CPU profile data.
 	CPUProfile bool
+
+	// If positive, an HTTP server listening on this port of
+	// localhost reports the progress of the run at /status, the
+	// configuration at /config, and profiling data for the muscato
+	// process at /debug/pprof/, while the run is in progress.
+	MonitorPort int
 }
 
-func ReadConfig(filename string) *Config {
+// LoadConfig reads a configuration from a JSON file.  If the file
+// cannot be read, the error of os.Open is returned.  If it cannot be
+// parsed, the error is a ConfigError for ConfigFileName.
+func LoadConfig(filename string) (*Config, error) {
+
 	fid, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer fid.Close()
+	// Unknown keys are usually misspelled or renamed settings, which
+	// would otherwise be silently ignored.
 	dec := json.NewDecoder(fid)
+	dec.DisallowUnknownFields()
 	config := new(Config)
-	err = dec.Decode(config)
+	if err := dec.Decode(config); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			return nil, NewConfigError("ConfigFileName", ErrInvalid, "cannot parse configuration file %s: %v (use 'muscato config migrate' to update a configuration file from an earlier version)", filename, err)
+		}
+		return nil, NewConfigError("ConfigFileName", ErrInvalid, "cannot parse configuration file %s: %v", filename, err)
+	}
+
+	return config, nil
+}
+
+// ReadConfig reads the configuration file passed to a tool by
+// muscato, panicking if it cannot be read.
+func ReadConfig(filename string) *Config {
+
+	config, err := LoadConfig(filename)
 	if err != nil {
 		panic(err)
 	}
 
+	// A tool that panics records the failure in the log directory
+	// (see ExitOnPanic).
+	failureDir = config.LogDir
+
 	return config
 }
+
+// WindowRange returns the windows first, ..., last-1 to be processed
+// by a stage, given the command-line arguments that follow the
+// configuration file name.  The arguments are either empty, for all
+// windows, or the first and last window of a batch (see WindowBatch).
+func (c *Config) WindowRange(args []string) (int, int, error) {
+
+	if len(args) == 0 {
+		return 0, len(c.Windows), nil
+	}
+	if len(args) != 2 {
+		return 0, 0, fmt.Errorf("expected the first and last window of a batch, got %v", args)
+	}
+
+	first, err1 := strconv.Atoi(args[0])
+	last, err2 := strconv.Atoi(args[1])
+	if err1 != nil || err2 != nil || first < 0 || first >= last || last > len(c.Windows) {
+		return 0, 0, fmt.Errorf("invalid window batch %s:%s for %d windows", args[0], args[1], len(c.Windows))
+	}
+
+	return first, last, nil
+}
+
+// WindowPMatchFor returns the PMatch used in confirming the matches
+// found by window k.
+func (c *Config) WindowPMatchFor(k int) float64 {
+	if len(c.WindowPMatch) > 0 {
+		return c.WindowPMatch[k]
+	}
+	return c.PMatch
+}
+
+// WindowMMTolFor returns the MMTol of the matches found by window k.
+func (c *Config) WindowMMTolFor(k int) int {
+	if len(c.WindowMMTol) > 0 {
+		return c.WindowMMTol[k]
+	}
+	return c.MMTol
+}
+
+// WindowStart returns the position of the first base of window k in a
+// read of length n, which depends on WindowAnchor.  The window does
+// not fit in the read if the position is negative, or if the window
+// extends past the end of the read.
+func (c *Config) WindowStart(k, n int) int {
+	if c.WindowAnchor == "end" {
+		return n - c.Windows[k] - c.WindowWidth
+	}
+	return c.Windows[k]
+}
+
+// MinUsableLength returns the length of the shortest read that is
+// kept by muscato_prep_reads.  This is at least MinReadLength and
+// one, and unless ExactTier is set (which can match a read of any
+// length), at least the end of the window that ends first, since a
+// shorter read is not covered by any window.
+func (c *Config) MinUsableLength() int {
+
+	n := c.MinReadLength
+	if n < 1 {
+		n = 1
+	}
+	if c.ExactTier {
+		return n
+	}
+
+	// With WindowStride, the first window starts at the beginning
+	// of the read.
+	m := c.WindowWidth
+	for k, w := range c.Windows {
+		if k == 0 || w+c.WindowWidth < m {
+			m = w + c.WindowWidth
+		}
+	}
+	if m > n {
+		n = m
+	}
+
+	return n
+}
@@ -0,0 +1,119 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CostMatrix gives the cost of aligning a read base (the first index)
+// to a target base (the second index) when confirming matches.
+type CostMatrix [256][256]float64
+
+var bases = []byte("ACGTX")
+
+func isTransition(a, b byte) bool {
+	switch {
+	case a == 'A' && b == 'G', a == 'G' && b == 'A':
+		return true
+	case a == 'C' && b == 'T', a == 'T' && b == 'C':
+		return true
+	}
+	return false
+}
+
+// NewCostMatrix returns the costs given by the MismatchCosts setting.
+// By default equal bases cost 0 and unequal bases cost 1.  The
+// setting may contain the keys "transition" (A/G and C/T),
+// "transversion" (the other mismatches among A, C, G and T), "X"
+// (any comparison involving an X, which includes bases read as N),
+// and pairs of bases such as "CT" (a C in the read aligned to a T in
+// the target).  The keys are applied in this order, so the pairs
+// override the other keys.
+func NewCostMatrix(costs map[string]float64) (*CostMatrix, error) {
+
+	cm := new(CostMatrix)
+	for i := range cm {
+		for j := range cm[i] {
+			if i != j {
+				cm[i][j] = 1
+			}
+		}
+	}
+
+	pairs := make(map[string]float64)
+	for k, v := range costs {
+		if v < 0 {
+			return nil, fmt.Errorf("MismatchCosts: the cost for %s must not be negative", k)
+		}
+		switch k {
+		case "transition", "transversion", "X":
+			continue
+		}
+		p := strings.ReplaceAll(strings.ToUpper(k), "N", "X")
+		if len(p) != 2 || !strings.ContainsRune("ACGTX", rune(p[0])) || !strings.ContainsRune("ACGTX", rune(p[1])) {
+			return nil, fmt.Errorf("MismatchCosts: unknown key '%s', use 'transition', 'transversion', 'X', or a pair of bases such as 'CT'", k)
+		}
+		pairs[p] = v
+	}
+
+	for _, a := range bases[0:4] {
+		for _, b := range bases[0:4] {
+			if a == b {
+				continue
+			}
+			if v, ok := costs["transition"]; ok && isTransition(a, b) {
+				cm[a][b] = v
+			}
+			if v, ok := costs["transversion"]; ok && !isTransition(a, b) {
+				cm[a][b] = v
+			}
+		}
+	}
+
+	if v, ok := costs["X"]; ok {
+		for _, b := range bases {
+			cm['X'][b] = v
+			cm[b]['X'] = v
+		}
+	}
+
+	for p, v := range pairs {
+		cm[p[0]][p[1]] = v
+	}
+
+	return cm, nil
+}
+
+// Cost returns the total cost of aligning the read bases in x to the
+// target bases in y, which must be at least as long as x.
+func (cm *CostMatrix) Cost(x, y []byte) float64 {
+	var c float64
+	for i, v := range x {
+		c += cm[v][y[i]]
+	}
+	return c
+}
+
+// ParseMismatchCosts parses a comma-separated list of key=cost
+// entries, e.g. "transition=0.5,X=0", into the form used for the
+// MismatchCosts setting.
+func ParseMismatchCosts(s string) (map[string]float64, error) {
+
+	costs := make(map[string]float64)
+	for _, tok := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(tok), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("MismatchCosts: '%s' is not of the form key=cost", tok)
+		}
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("MismatchCosts: invalid cost '%s' for %s", kv[1], kv[0])
+		}
+		costs[kv[0]] = v
+	}
+
+	return costs, nil
+}
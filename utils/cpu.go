@@ -0,0 +1,113 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// readCgroupInt reads a single integer from a cgroup file.
+func readCgroupInt(fname string) (int64, bool) {
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// cgroupCPU returns the number of CPUs allowed by the cgroup CPU
+// quota, or zero if there is no quota.
+func cgroupCPU() int {
+
+	var quota, period int64
+
+	// cgroup v2
+	b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max")
+	if err == nil {
+		toks := strings.Fields(string(b))
+		if len(toks) != 2 || toks[0] == "max" {
+			return 0
+		}
+		quota, err = strconv.ParseInt(toks[0], 10, 64)
+		if err != nil {
+			return 0
+		}
+		period, err = strconv.ParseInt(toks[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+	} else {
+		// cgroup v1
+		var ok1, ok2 bool
+		quota, ok1 = readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		period, ok2 = readCgroupInt("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+		if !(ok1 && ok2) {
+			return 0
+		}
+	}
+
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+
+	// Round up, a quota of 1.5 CPUs can keep two CPUs partly busy.
+	return int((quota + period - 1) / period)
+}
+
+// NumCPU returns the number of CPUs available to Muscato.  This is
+// the number of CPUs usable by the current process, further limited
+// by the cgroup CPU quota if one is in effect (e.g. in a container or
+// under a cluster scheduler).
+func NumCPU() int {
+
+	n := runtime.NumCPU()
+	if c := cgroupCPU(); c > 0 && c < n {
+		n = c
+	}
+
+	return n
+}
+
+// The defaults below scale with NumCPU, but the multipliers are
+// heuristics that have not been measured against other choices.  The
+// script tests/benchmark/concurrency.sh runs the pipeline with
+// several multiples of the number of CPUs, for comparison.
+
+// DefaultSortPar returns the default number of parallel sort
+// processes.
+func DefaultSortPar() int {
+	return NumCPU()
+}
+
+// DefaultScreenConcurrency returns the default number of goroutines
+// used by muscato_screen to process target sequences.  More
+// goroutines than CPUs are used so that the CPUs are kept busy while
+// some goroutines wait to send their hits.
+func DefaultScreenConcurrency() int {
+	return 8 * NumCPU()
+}
+
+// DefaultConfirmConcurrency returns the default number of goroutines
+// used by each muscato_confirm process.  Several confirm processes
+// may be run simultaneously, so this is smaller than the screen
+// concurrency.
+func DefaultConfirmConcurrency() int {
+	return 4 * NumCPU()
+}
+
+// DefaultMaxConfirmProcs returns the default number of confirm
+// processes that are run simultaneously.
+func DefaultMaxConfirmProcs() int {
+	n := NumCPU() / 4
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -2,38 +2,27 @@
 
 package utils
 
-func CountDinuc(seq []byte, wk []int) int {
+// DinucSize is the length of the workspace used by CountDinuc, the
+// number of pairs of ASCII letters.
+const DinucSize = 128 * 128
 
-	for i, _ := range wk {
-		wk[i] = 0
-	}
+// CountDinuc returns the number of distinct dinucleotides (or more
+// generally pairs of adjacent letters) in seq.  Any ASCII alphabet
+// can be used.  The workspace wk must have length DinucSize and be
+// zero, it is returned to zero before returning.
+func CountDinuc(seq []byte, wk []int) int {
 
-	var last int
 	var n int
-	for i, x := range seq {
-
-		var v int
-		switch x {
-		case 'A':
-			v = 0
-		case 'T':
-			v = 1
-		case 'G':
-			v = 2
-		case 'C':
-			v = 3
-		default:
-			v = 4
+	for i := 1; i < len(seq); i++ {
+		k := 128*int(seq[i-1]&127) + int(seq[i]&127)
+		if wk[k] == 0 {
+			n++
 		}
+		wk[k]++
+	}
 
-		if i > 0 {
-			k := 5*last + v
-			if wk[k] == 0 {
-				n++
-			}
-			wk[k]++
-		}
-		last = v
+	for i := 1; i < len(seq); i++ {
+		wk[128*int(seq[i-1]&127)+int(seq[i]&127)] = 0
 	}
 
 	return n
@@ -0,0 +1,131 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// The exit status of a tool that panics, which is the status used by
+// Go for an unrecovered panic.
+const exitPanic = 2
+
+// The log directory of the configuration read by ReadConfig, where
+// the failure of a tool is recorded.
+var failureDir string
+
+// Failure describes a panic in muscato or one of the muscato_* tools.
+// A tool that panics writes it to failure_<tool>_<pid>.json in the
+// log directory, and muscato adds the failures of a run to
+// status.json, so that the failure can be reported without reading
+// the stack trace from stderr.
+type Failure struct {
+
+	// The tool that panicked.
+	Tool string
+
+	// The stage of the pipeline that was running, if known.
+	Stage string `json:",omitempty"`
+
+	// The command-line arguments of the tool, which include the
+	// window for the per-window tools.
+	Args []string
+
+	// The value passed to panic.
+	Message string
+
+	// The source file and line where the panic occurred.
+	Location string
+
+	Stack string
+
+	Time time.Time
+}
+
+// NewFailure returns a Failure describing the panic with value r.  It
+// must be called from the function that recovered the panic.
+func NewFailure(tool string, r interface{}) *Failure {
+	return &Failure{
+		Tool:     tool,
+		Args:     os.Args[1:],
+		Message:  fmt.Sprint(r),
+		Location: panicLocation(),
+		Stack:    string(debug.Stack()),
+		Time:     time.Now(),
+	}
+}
+
+// panicLocation returns the file and line of the function that
+// called panic, which follows runtime.gopanic on the stack.
+func panicLocation() string {
+
+	pc := make([]uintptr, 64)
+	n := runtime.Callers(2, pc)
+	frames := runtime.CallersFrames(pc[0:n])
+
+	var inPanic bool
+	for {
+		fr, more := frames.Next()
+		if fr.Function == "runtime.gopanic" {
+			inPanic = true
+		} else if inPanic && !strings.HasPrefix(fr.Function, "runtime.") {
+			return fmt.Sprintf("%s:%d", fr.File, fr.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// Save writes the failure to failure_<tool>_<pid>.json in the log
+// directory, and returns the name of the file.
+func (f *Failure) Save(logdir string) (string, error) {
+
+	name := path.Join(logdir, fmt.Sprintf("failure_%s_%d.json", f.Tool, os.Getpid()))
+	fid, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	defer fid.Close()
+
+	enc := json.NewEncoder(fid)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(f); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// ExitOnPanic is deferred at the start of the main function of each
+// tool.  If the tool panics, the panic is written to stderr, recorded
+// as a Failure in the log directory of the configuration read by
+// ReadConfig (if any), and the tool exits with status 2, as it would
+// following an unrecovered panic.  Panics in other goroutines are not
+// recovered.
+func ExitOnPanic(tool string) {
+
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	f := NewFailure(tool, r)
+	os.Stderr.WriteString(fmt.Sprintf("%s: panic: %s\n\n%s", tool, f.Message, f.Stack))
+	if failureDir != "" {
+		if name, err := f.Save(failureDir); err != nil {
+			os.Stderr.WriteString(fmt.Sprintf("%s: unable to record the failure: %v\n", tool, err))
+		} else {
+			os.Stderr.WriteString(fmt.Sprintf("%s: the failure is recorded in %s\n", tool, name))
+		}
+	}
+
+	os.Exit(exitPanic)
+}
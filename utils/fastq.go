@@ -8,12 +8,14 @@ import (
 	"path"
 )
 
-// ReadInSeq reads the sequencing reads, returns names and sequences
+// ReadInSeq reads the sequencing reads, returns names, sequences and
+// quality scores
 type ReadInSeq struct {
 	file    *os.File
 	scanner *bufio.Scanner
 	Name    string
 	Seq     string
+	Qual    string
 }
 
 func NewReadInSeq(seqfile, dpath string) *ReadInSeq {
@@ -50,6 +52,8 @@ func (ris *ReadInSeq) Next() bool {
 			ris.Name = ris.scanner.Text()
 		case 1:
 			ris.Seq = ris.scanner.Text()
+		case 3:
+			ris.Qual = ris.scanner.Text()
 		}
 
 		if err := ris.scanner.Err(); err != nil {
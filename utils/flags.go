@@ -0,0 +1,221 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"flag"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// configFlag is the command-line flag for a Config field of the same
+// name.
+type configFlag struct {
+	name  string
+	usage string
+}
+
+var configFlags = []configFlag{
+	{"ReadFileName", "Sequencing read file (fastq format)"},
+	{"GeneFileName", "Gene file name (processed form)"},
+	{"GeneIdFileName", "Gene ID file name (processed form)"},
+	{"ResultsFileName", "File name for results"},
+	{"BestHitFile", "Also write the best match for each read to this file"},
+	{"ForwardStrand", "Report positions on the forward strand of each target, with a strand column"},
+	{"TargetCoords", "Append the strand and 1-based start and end positions on the forward strand of each target"},
+	{"NoPerReadOutput", "Only write the gene statistics, not the per-read results"},
+	{"UnmatchedReasons", "Write the reason that each unmatched read sequence was not matched"},
+	{"WeightGeneStats", "Weight gene statistics by the number of reads with each sequence"},
+	{"PanelFileName", "File listing the expected targets, one per line, to report on"},
+	{"PanelMinCount", "Targets in the panel with fewer matches than this are reported as low (default 1)"},
+	{"ReadThrough", "Match reads extending beyond the end of a target if at least this many bases are aligned"},
+	{"EValues", "Append an E-value column to the results"},
+	{"IndexResults", "Also write the results sorted by target and position, with bgzip compression and a tabix index"},
+	{"CompressResults", "Compress the results files using 'snappy' or 'gzip'"},
+	{"Windows", "Starting position of each window"},
+	{"WindowWidth", "Width of each window"},
+	{"WindowAnchor", "'start' or 'end' (whether Windows are offsets from the start or the end of each read)"},
+	{"WindowStride", "Place windows at every this many positions of the reads, instead of using Windows"},
+	{"WindowBatch", "Screen and confirm the windows in batches of this many windows (default all at once)"},
+	{"BloomSize", "Size of Bloom filter, in bits"},
+	{"NumHash", "Number of hashses"},
+	{"AutoBloom", "Choose BloomSize and NumHash from the number of distinct reads (the default if neither is given)"},
+	{"BloomFPR", "Target Bloom filter false positive rate with AutoBloom (default 0.01)"},
+	{"BloomHash", "'buzhash32', 'buzhash64' or 'auto' (the rolling hash for the Bloom filters, default 'auto' uses buzhash64 above 2^32 bits)"},
+	{"ScreenMethod", "'bloom' or 'exact' (use Bloom filters or exact sets of read windows for screening)"},
+	{"IndexSide", "'reads', 'targets' or 'auto' (the collection held in memory by the screen)"},
+	{"ExactTier", "Resolve the reads with exact matches first, and screen only the remaining reads"},
+	{"ScreenOnly", "Stop after screening, and report the candidate matches in each window"},
+	{"RandomSeed", "Seed for random number generation (default is to choose a seed at random)"},
+	{"PMatch", "Required proportion of matching positions"},
+	{"WindowPMatch", "Comma-separated PMatch for each window, in place of PMatch"},
+	{"MismatchCosts", "Costs of mismatches used with PMatch, e.g. 'transition=0.5,X=0' (default 1 for every mismatch)"},
+	{"MinDinuc", "Minimum number of dinucleotides to check for match"},
+	{"SequenceAlphabet", "'dna' or 'protein' (the letters of the reads and targets, default 'dna')"},
+	{"TempDir", "Workspace for temporary files"},
+	{"WorkDir", "Directory for all files written during the run (temporary files, logs, pipes and results)"},
+	{"SpaceCheck", "'warn', 'error' or 'off' (action if TempDir may run out of space, default 'warn')"},
+	{"CacheDir", "Save and reuse screening results in this directory"},
+	{"ConfirmOnly", "Confirm the candidate matches in this TempDir of an earlier run, instead of screening"},
+	{"WindowSubset", "Comma-separated windows to confirm with ConfirmOnly, reusing the confirmed matches of the earlier run for the others"},
+	{"PipeDir", "Directory for named pipes (default is to use anonymous pipes)"},
+	{"MinReadLength", "Reads shorter than this length are skipped"},
+	{"MaxReadLength", "Reads longer than this length are truncated"},
+	{"Adapters", "Comma-separated adapter sequences to remove from the 3' end of the reads"},
+	{"AdapterMinOverlap", "Minimum number of adapter bases at the end of a read to be removed (default 5)"},
+	{"QualityTrim", "Trim bases with quality below this from the 3' end of the reads"},
+	{"UMI", "Location of the UMI, 'read:n' or 'header:c', reads with the same sequence and UMI are counted once"},
+	{"ReadGroup", "Read group of each read, 'lane' or 'tile' (from Illumina read names) or 'regexp:re' (from the part of the name matched by re)"},
+	{"StageRetries", "Retry a stage up to this many times if a command in it is killed (e.g. by the out-of-memory killer)"},
+	{"RetryDelay", "Wait this long (e.g. 30s) before retrying a failed stage, doubling for each further retry"},
+	{"AllowStatsFailure", "Continue with a warning if the read or gene statistics or the panel report fail"},
+	{"MMTol", "Number of mismatches allowed above best fit"},
+	{"WindowMMTol", "Comma-separated MMTol for each window, in place of MMTol"},
+	{"RefineCommand", "Shell command to align the pairs that fail PMatch, whose accepted matches are added to the results"},
+	{"AssignMode", "'unique', 'fractional' or 'best' (resolve reads matching multiple genes)"},
+	{"MatchMode", "'first' or 'best' (retain first/best 'MaxMatches' matches meeting criteria)"},
+	{"Retention", "Kinds of intermediate files kept until the end of the run, or 'all' or 'none'"},
+	{"EarlyDelete", "Delete each window and Bloom match file once it has been sorted"},
+	{"Streaming", "Pass the window and Bloom match files directly to sort, without writing them to TempDir"},
+	{"CheckCounts", "Check that the read counts reported by the stages are consistent"},
+	{"NoCleanTemp", "Do not delete temporary files from TempDir"},
+	{"SyncResults", "Sync result files to disk before closing them"},
+	{"SortPar", "Number of parallel sort processes (default is number of CPUs)"},
+	{"ScreenConcurrency", "Number of goroutines used in screening (default is based on number of CPUs)"},
+	{"ConfirmConcurrency", "Number of goroutines used by each confirm process (default is based on number of CPUs)"},
+	{"ConfirmBlockSize", "Compare reads and targets sharing a window in batches of this size (default 1 million)"},
+	{"ConfirmFlank", "Divide large blocks by this many bases following the window, comparing only reads and targets that agree on them"},
+	{"CombineFPR", "False positive rate of the Bloom filter removing duplicate matches (default 1e-6)"},
+	{"ExactCombine", "Remove duplicate matches with sort rather than a Bloom filter"},
+	{"SortTemp", "Directory to use for sort temp files"},
+	{"SortMem", "Gnu sort -S parameter"},
+	{"WriterBufferSize", "Buffer size in bytes for writing compressed intermediate files"},
+	{"CPUProfile", "Capture CPU profile data"},
+	{"MonitorPort", "Report the progress of the run over HTTP on this port of localhost"},
+}
+
+// allFlags returns configFlags followed by the flags for the limits,
+// whose usage is given by their help tags.
+func allFlags() []configFlag {
+	flags := append([]configFlag(nil), configFlags...)
+	for _, f := range limitFields() {
+		flags = append(flags, configFlag{f.Name, f.Tag.Get("help")})
+	}
+	return flags
+}
+
+// DefineFlags defines a flag in fs for each setting that can be given
+// on the command line, with the same name as the Config field.  The
+// flags are applied to a Config using FromFlags.
+func DefineFlags(fs *flag.FlagSet) {
+
+	t := reflect.TypeOf(Config{})
+	for _, cf := range allFlags() {
+		f, ok := t.FieldByName(cf.name)
+		if !ok {
+			panic("DefineFlags: no Config field " + cf.name)
+		}
+		switch f.Type.Kind() {
+		case reflect.Bool:
+			fs.Bool(cf.name, false, cf.usage)
+		case reflect.Int:
+			fs.Int(cf.name, 0, cf.usage)
+		case reflect.Int64:
+			fs.Int64(cf.name, 0, cf.usage)
+		case reflect.Uint64:
+			fs.Uint64(cf.name, 0, cf.usage)
+		case reflect.Float64:
+			fs.Float64(cf.name, 0, cf.usage)
+		default:
+			// Strings, and lists and maps given as text.
+			fs.String(cf.name, "", cf.usage)
+		}
+	}
+}
+
+// FromFlags sets the fields of c from the flags defined by DefineFlags
+// that were given on the command line.  The fields for the flags that
+// were not given are not changed, so that the flags override the
+// values read from a configuration file.
+func (c *Config) FromFlags(fs *flag.FlagSet) error {
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = c.setField(f.Name, f.Value.String())
+		}
+	})
+
+	return err
+}
+
+// setField sets the named field of c from its command-line form.
+// Flags that are not Config fields are ignored.
+func (c *Config) setField(name, val string) error {
+
+	v := reflect.ValueOf(c).Elem().FieldByName(name)
+	if !v.IsValid() {
+		return nil
+	}
+
+	// The flag package has already checked the numeric values.
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Bool:
+		b, _ := strconv.ParseBool(val)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		x, _ := strconv.ParseInt(val, 10, 64)
+		v.SetInt(x)
+	case reflect.Uint64:
+		x, _ := strconv.ParseUint(val, 10, 64)
+		v.SetUint(x)
+	case reflect.Float64:
+		x, _ := strconv.ParseFloat(val, 64)
+		v.SetFloat(x)
+	case reflect.Slice:
+		// Windows, and the per-window settings
+		if v.Type().Elem().Kind() == reflect.String {
+			var w []string
+			for _, x := range strings.Split(val, ",") {
+				w = append(w, strings.TrimSpace(x))
+			}
+			v.Set(reflect.ValueOf(w))
+			break
+		}
+		if v.Type().Elem().Kind() == reflect.Float64 {
+			var w []float64
+			for _, x := range strings.Split(val, ",") {
+				y, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+				if err != nil {
+					return invalid(name, "invalid %s '%s', expected a comma-separated list of numbers", name, val)
+				}
+				w = append(w, y)
+			}
+			v.Set(reflect.ValueOf(w))
+			break
+		}
+		var w []int
+		for _, x := range strings.Split(val, ",") {
+			y, err := strconv.Atoi(strings.TrimSpace(x))
+			if err != nil {
+				return invalid(name, "invalid %s '%s', expected a comma-separated list of integers", name, val)
+			}
+			w = append(w, y)
+		}
+		v.Set(reflect.ValueOf(w))
+	case reflect.Map:
+		// MismatchCosts
+		costs, err := ParseMismatchCosts(val)
+		if err != nil {
+			return invalid(name, "%v", err)
+		}
+		v.Set(reflect.ValueOf(costs))
+	default:
+		panic("setField: unsupported type for " + name)
+	}
+
+	return nil
+}
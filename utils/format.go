@@ -0,0 +1,28 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"strconv"
+)
+
+// AppendPadded appends the decimal form of x to dst, padded with
+// leading zeros (after the sign of a negative x) to at least the given
+// width, as formatted by fmt with "%0*d".  Numbers wider than width
+// are not truncated, and a width that is not positive gives no
+// padding.  It is used in place of fmt.Sprintf when writing the target
+// numbers of every record, so that no allocation is needed for each
+// record.
+func AppendPadded(dst []byte, x int64, width int) []byte {
+	var buf [20]byte
+	b := strconv.AppendInt(buf[0:0], x, 10)
+	if x < 0 {
+		dst = append(dst, '-')
+		b = b[1:]
+		width--
+	}
+	for i := len(b); i < width; i++ {
+		dst = append(dst, '0')
+	}
+	return append(dst, b...)
+}
@@ -0,0 +1,68 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestAppendPadded(t *testing.T) {
+
+	for _, x := range []int64{0, 1, -1, 7, -7, 42, 12345678901, 123456789012345,
+		-1234567890, -12345678901, math.MaxInt64, math.MinInt64} {
+		// Widths that pad, fit exactly, overflow, and are not
+		// positive.
+		for _, width := range []int{11, 20, 1, 0, -3} {
+			want := fmt.Sprintf("%0*d", width, x)
+			if width < 0 {
+				// fmt left-justifies with spaces.
+				want = fmt.Sprintf("%d", x)
+			}
+			got := string(AppendPadded([]byte("x"), x, width))
+			if got != "x"+want {
+				t.Errorf("AppendPadded(%d, %d) is %q, expected %q", x, width, got[1:], want)
+			}
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+
+	for _, d := range []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0B"},
+		{1000, "1000B"},
+		{1536, "1.5KB"},
+		{20 << 20, "20.0MB"},
+		{16 << 30, "16.0GB"},
+		{3 << 40, "3.0TB"},
+		{5000 << 40, "5000.0TB"},
+	} {
+		if s := FormatBytes(d.n); s != d.want {
+			t.Errorf("FormatBytes(%d) is %s, expected %s", d.n, s, d.want)
+		}
+	}
+}
+
+func BenchmarkAppendPadded(b *testing.B) {
+
+	b.Run("AppendPadded", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = AppendPadded(buf[0:0], int64(i), 11)
+		}
+	})
+
+	b.Run("Sprintf", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = append(buf[0:0], fmt.Sprintf("%011d", i)...)
+		}
+	})
+}
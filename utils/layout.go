@@ -0,0 +1,127 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LayoutVersion is the version of the intermediate file layouts
+// written by this version of Muscato.  Files without a layout are
+// assumed to have been written by an earlier version, and to use the
+// default columns for the file.
+const LayoutVersion = 1
+
+// MatchColumns are the columns of the match files written by
+// muscato_confirm and muscato_combine_windows.  The gene column holds
+// the target number, which is replaced by the target name and length
+// when the target names are joined.
+var MatchColumns = []string{"read", "target", "pos", "nmiss", "gene"}
+
+// WindowColumns are the columns of the window files written by
+// muscato_window_reads: the window subsequence of a read, the parts
+// of the read to its left and right, the number of reads with the
+// sequence, and the read id, which is the position of the sequence
+// in reads_sorted.txt.sz (counting from 0).
+var WindowColumns = []string{"window", "left", "right", "count", "readid"}
+
+// CandidateColumns are the columns of the candidate match files
+// written by muscato_screen (bmatch) and sorted by sortBloom
+// (smatch): the window subsequence of a target, the parts of the
+// target to its left and right, the target number and the position
+// of the window in the target.
+var CandidateColumns = []string{"window", "left", "right", "gene", "pos"}
+
+// NamedMatchColumns are the columns of the match file after the
+// target names and lengths have been joined.
+var NamedMatchColumns = []string{"read", "target", "pos", "nmiss", "target_id", "target_len"}
+
+// Layout describes the tab-delimited columns of an intermediate file.
+// It is stored next to the file, with the suffix .layout.json, so
+// that the stages reading the file can locate the columns they use,
+// and can detect files written by an incompatible version of a
+// Muscato tool.
+type Layout struct {
+	Version int
+	Columns []string
+
+	// The file that the layout describes
+	File string `json:"-"`
+}
+
+// LayoutName returns the name of the file holding the layout of an
+// intermediate file.
+func LayoutName(file string) string {
+	return file + ".layout.json"
+}
+
+// WriteLayout records the columns of an intermediate file.
+func WriteLayout(file string, columns []string) error {
+
+	fid, err := os.Create(LayoutName(file))
+	if err != nil {
+		return err
+	}
+
+	lay := Layout{Version: LayoutVersion, Columns: columns}
+	if err := json.NewEncoder(fid).Encode(lay); err != nil {
+		fid.Close()
+		return err
+	}
+
+	return fid.Close()
+}
+
+// ReadLayout returns the layout of an intermediate file.  If the file
+// has no recorded layout, the given default columns are used.  An
+// error is returned if the layout was written by a newer version of
+// Muscato.
+func ReadLayout(file string, dflt []string) (*Layout, error) {
+
+	fid, err := os.Open(LayoutName(file))
+	if os.IsNotExist(err) {
+		return &Layout{Columns: dflt, File: file}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	lay := &Layout{File: file}
+	if err := json.NewDecoder(fid).Decode(lay); err != nil {
+		return nil, fmt.Errorf("%s: %w", LayoutName(file), err)
+	}
+	if lay.Version > LayoutVersion {
+		return nil, fmt.Errorf("%s was written by a newer version of Muscato (layout version %d, this version reads up to %d), do not mix versions of the Muscato tools within a run",
+			file, lay.Version, LayoutVersion)
+	}
+
+	return lay, nil
+}
+
+// Column returns the position (counting from 1, as used by sort, join
+// and cut) of the named column.
+func (lay *Layout) Column(name string) (int, error) {
+
+	for i, c := range lay.Columns {
+		if c == name {
+			return i + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s has no %s column (layout version %d has columns %s), it may have been written by an incompatible version of Muscato",
+		lay.File, name, lay.Version, strings.Join(lay.Columns, ","))
+}
+
+// Same returns an error unless the two layouts have the same columns.
+func (lay *Layout) Same(other *Layout) error {
+
+	if strings.Join(lay.Columns, "\t") != strings.Join(other.Columns, "\t") {
+		return fmt.Errorf("%s and %s have different columns (%s and %s), they may have been written by different versions of Muscato",
+			lay.File, other.File, strings.Join(lay.Columns, ","), strings.Join(other.Columns, ","))
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits holds the settings that bound the work done, and the
+// resources used, by a run.  It is embedded in Config, so the limits
+// are given in the configuration file and on the command line like
+// the other settings.  Each field has a help tag (the usage of its
+// command-line flag), a default tag, and a bound tag describing what
+// happens when the limit is reached, which are shown by 'muscato
+// limits'.
+type Limits struct {
+
+	// If positive, window subsequences shared by more than this
+	// many reads are left out of the screen, and are listed in
+	// blacklist_k.txt in the log directory for window k.  Such
+	// subsequences (e.g. poly-A) are uninformative, and can
+	// produce huge numbers of candidate matches.
+	MaxKmerReads int `help:"Skip window subsequences shared by more than this many reads in the screen" default:"no limit" bound:"The subsequence is not screened, so its reads can only be matched through their other windows.  The subsequences are listed in blacklist_k.txt in the log directory."`
+
+	// If positive, the screen fails if any window produces more
+	// than this many candidate matches, rather than filling
+	// TempDir.
+	MaxCandidates int `help:"Fail if any window produces more than this many candidate matches" default:"no limit" bound:"The screen stops with an error naming the window, so that TempDir is not filled by the candidate matches."`
+
+	// The confirmatory matching step returns at most this many
+	// matches for each k-mer seqeunces.  Since a k-mer sequence
+	// may match many reads and many genes, setting MaxMatches to
+	// a low value may lead to some reads not being mapped, or not
+	// multi-mapping as well as possible.
+	MaxMatches int `help:"Return no more than this number of matches per window" default:"1000000" bound:"The further matches of the window subsequence are dropped (or, with MatchMode=best, those with the most mismatches), and muscato_confirm gives a max_matches warning."`
+
+	// If positive, at most this many matches are kept for each
+	// target, drawn at random from its matches.  The number of
+	// matches to each downsampled target and the factor by which
+	// its counts are scaled are written to a file whose name is
+	// derived from the results file name, and the gene statistics
+	// are scaled accordingly.
+	GeneSampleSize int `help:"Keep at most this many randomly chosen matches for each target" default:"no limit" bound:"A random sample of the matches to the target is kept, and its gene statistics are scaled up to estimate the full counts."`
+
+	// The maximum length of the list of read names for one
+	// sequence.  Longer lists are truncated.  The default is
+	// 1000.
+	MaxNameList int `help:"Truncate the list of read names for each sequence at this length (default 1000)" default:"1000" bound:"The list of names is truncated, and the read counts are unaffected."`
+
+	// The maximum number of confirmation processes that are run
+	// simultaneously.  The windows with the largest intermediate
+	// files are confirmed first, and a new window is started as
+	// soon as one finishes.  The default is based on the number of
+	// available CPUs.
+	MaxConfirmProcs int `help:"Run this number of match confirmation processes concurrently" default:"based on the number of CPUs" bound:"The remaining windows wait until a confirmation process finishes."`
+
+	// The maximum wall-clock time of the run, as a duration such
+	// as "11h30m".  Once it has passed, no further windows are
+	// confirmed; the windows already being confirmed are
+	// finished, and the results are written using the matches
+	// from these windows, and marked as partial.  If it passes
+	// before the confirm stage, the run stops with no results.
+	MaxWallTime string `help:"Stop confirming windows after this time (e.g. 11h30m) and write partial results" default:"no limit" bound:"No further windows are confirmed, the results are written from the confirmed windows and marked as partial, and muscato exits with status 3."`
+
+	// The maximum memory used by each process, as a number of
+	// bytes with an optional suffix K, M, G or T (powers of 1024),
+	// e.g. "16G".  It is passed to the Muscato tools as their
+	// soft memory limit (GOMEMLIMIT), so that they collect garbage
+	// more often as they approach it, and the screen is not
+	// started if its Bloom filters would not fit.
+	MaxMemory string `help:"Memory limit for each process, e.g. 16G (the screen fails if its Bloom filters do not fit)" default:"no limit" bound:"The tools collect garbage more often as they approach the limit.  If the Bloom filters of the screen would exceed it, the run stops before the screen with exit status 4; reduce BloomSize or set WindowBatch."`
+}
+
+// limitFields returns the fields of Limits, in order.
+func limitFields() []reflect.StructField {
+	t := reflect.TypeOf(Limits{})
+	var fields []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		fields = append(fields, t.Field(i))
+	}
+	return fields
+}
+
+// validate checks the limits, and fills in the defaults.  Zero means
+// no limit, or the default for the limits that always apply.
+func (l *Limits) validate() error {
+
+	for _, f := range []struct {
+		name string
+		val  int
+	}{
+		{"MaxKmerReads", l.MaxKmerReads},
+		{"MaxCandidates", l.MaxCandidates},
+		{"MaxMatches", l.MaxMatches},
+		{"GeneSampleSize", l.GeneSampleSize},
+		{"MaxNameList", l.MaxNameList},
+		{"MaxConfirmProcs", l.MaxConfirmProcs},
+	} {
+		if f.val < 0 {
+			return invalid(f.name, "%s must not be negative", f.name)
+		}
+	}
+
+	if l.MaxMatches == 0 {
+		note("MaxMatches not provided, defaulting to 1 million")
+		l.MaxMatches = 1000 * 1000
+	}
+	if l.MaxNameList == 0 {
+		l.MaxNameList = 1000
+	}
+	if l.MaxConfirmProcs == 0 {
+		l.MaxConfirmProcs = DefaultMaxConfirmProcs()
+		note(fmt.Sprintf("MaxConfirmProcs not provided, defaulting to %d", l.MaxConfirmProcs))
+	}
+
+	if l.MaxWallTime != "" {
+		d, err := time.ParseDuration(l.MaxWallTime)
+		if err != nil {
+			return invalid("MaxWallTime", "invalid MaxWallTime '%s': %v", l.MaxWallTime, err)
+		}
+		if d <= 0 {
+			return invalid("MaxWallTime", "MaxWallTime must be positive")
+		}
+	}
+	if l.MaxMemory != "" {
+		n, err := ParseBytes(l.MaxMemory)
+		if err != nil {
+			return invalid("MaxMemory", "invalid MaxMemory: %v", err)
+		}
+		if n == 0 {
+			return invalid("MaxMemory", "MaxMemory must be positive")
+		}
+	}
+
+	return nil
+}
+
+// ParseBytes parses a number of bytes, with an optional suffix K, M,
+// G or T (optionally followed by B) for powers of 1024.
+func ParseBytes(s string) (uint64, error) {
+
+	u := strings.ToUpper(strings.TrimSpace(s))
+	u = strings.TrimSuffix(u, "B")
+	var mult uint64 = 1
+	if n := len(u); n > 0 {
+		if i := strings.IndexByte("KMGT", u[n-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			u = u[0 : n-1]
+		}
+	}
+
+	x, err := strconv.ParseUint(u, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s', expected a number of bytes such as 512M or 16G", s)
+	}
+
+	return x * mult, nil
+}
+
+// FormatBytes formats a number of bytes for messages, in the largest
+// of the units of ParseBytes that it is at least one of.
+func FormatBytes(n uint64) string {
+
+	if n < 1<<10 {
+		return fmt.Sprintf("%dB", n)
+	}
+	x := float64(n)
+	for _, u := range []string{"KB", "MB", "GB"} {
+		x /= 1 << 10
+		if x < 1<<10 {
+			return fmt.Sprintf("%.1f%s", x, u)
+		}
+	}
+
+	return fmt.Sprintf("%.1fTB", x/(1<<10))
+}
+
+// MemoryBytes returns MaxMemory as a number of bytes, or zero if it
+// is not set.  MaxMemory is checked by Validate.
+func (l *Limits) MemoryBytes() uint64 {
+	if l.MaxMemory == "" {
+		return 0
+	}
+	n, _ := ParseBytes(l.MaxMemory)
+	return n
+}
+
+// WriteLimits writes a description of each limit, generated from the
+// tags of the Limits fields, for 'muscato limits'.
+func WriteLimits(w io.Writer) error {
+
+	_, err := io.WriteString(w, `The limits bound the work done, and the resources used, by a run, so
+that the worst case behavior on difficult data is known in advance.
+They are set like the other configuration values, in the configuration
+file or on the command line (e.g. --MaxCandidates=100000000).
+`)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range limitFields() {
+		typ := "integer"
+		if f.Type.Kind() == reflect.String {
+			typ = "string"
+		}
+		_, err := fmt.Fprintf(w, "\n%s (%s, default: %s)\n%s\n%s\n", f.Name, typ, f.Tag.Get("default"),
+			indent(f.Tag.Get("help")+"."), indent("When reached: "+f.Tag.Get("bound")))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indent fills text into indented lines of at most 72 characters.
+func indent(text string) string {
+
+	var lines []string
+	line := "   "
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > 72 && len(line) > 3 {
+			lines = append(lines, line)
+			line = "   "
+		}
+		line += " " + word
+	}
+
+	return strings.Join(append(lines, line), "\n")
+}
@@ -0,0 +1,98 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+)
+
+// renamedFields maps configuration field names used by earlier
+// versions of Muscato to their current names.
+var renamedFields = map[string]string{
+	"NoCleanTmp":    "NoCleanTemp",
+	"MaxMergeProcs": "MaxConfirmProcs",
+}
+
+// deprecatedFields lists configuration fields that are no longer
+// used.  They are dropped during migration.
+var deprecatedFields = map[string]string{}
+
+// configFields returns the set of field names in the Config struct,
+// including the fields of Limits.
+func configFields() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Name] = true
+	}
+	for _, f := range limitFields() {
+		fields[f.Name] = true
+	}
+	return fields
+}
+
+// MigrateConfig reads a JSON configuration file that may have been
+// written for an earlier version of Muscato, and returns an
+// equivalent configuration using the current field names.  The
+// returned notes describe each change that was made, and any fields
+// that were not recognized.
+func MigrateConfig(filename string) (*Config, []string, error) {
+
+	fid, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fid.Close()
+
+	raw := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(fid).Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+
+	// Process the keys in a fixed order so that the notes are
+	// reproducible.
+	var keys []string
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := configFields()
+	var notes []string
+	for _, k := range keys {
+		if fields[k] {
+			continue
+		}
+		if nk, ok := renamedFields[k]; ok {
+			if _, ok := raw[nk]; ok {
+				notes = append(notes, fmt.Sprintf("%s was renamed to %s, which is already set; dropping %s", k, nk, k))
+			} else {
+				notes = append(notes, fmt.Sprintf("%s was renamed to %s", k, nk))
+				raw[nk] = raw[k]
+			}
+		} else if msg, ok := deprecatedFields[k]; ok {
+			notes = append(notes, fmt.Sprintf("%s is deprecated and was dropped: %s", k, msg))
+		} else {
+			notes = append(notes, fmt.Sprintf("%s is not a recognized field and was dropped", k))
+		}
+		delete(raw, k)
+	}
+
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	config := new(Config)
+	if err := dec.Decode(config); err != nil {
+		return nil, nil, err
+	}
+
+	return config, notes, nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// NamesFileName is the name of the file in TempDir that holds the
+// complete read name lists of the sequences whose lists were
+// truncated by muscato_uniqify.  Each line contains the SeqHash of a
+// sequence, a tab, and the semicolon-delimited list of all names of
+// reads with that sequence.
+const NamesFileName = "read_names.txt.sz"
+
+// SeqHash returns the key of a read sequence in NamesFileName.
+func SeqHash(seq []byte) string {
+	h := fnv.New64a()
+	h.Write(seq)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
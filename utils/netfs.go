@@ -0,0 +1,21 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"os"
+)
+
+// CloseFile closes a file, first flushing its contents to stable
+// storage if sync is true.  Some network file systems only report
+// write errors when the file is synced, so without the sync a full or
+// unreachable server can silently truncate the file.
+func CloseFile(f *os.File, sync bool) error {
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
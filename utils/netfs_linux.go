@@ -0,0 +1,32 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+//go:build linux
+
+package utils
+
+import (
+	"syscall"
+)
+
+// File system magic numbers, from statfs(2).
+var networkFSTypes = map[int64]string{
+	0x6969:     "nfs",
+	0x5346414f: "afs",
+	0x6b414653: "afs",
+	0x517b:     "smb",
+	0xfe534d42: "smb2",
+	0xff534d42: "cifs",
+	0x0bd00bd0: "lustre",
+	0x47504653: "gpfs",
+}
+
+// NetworkFS returns the type of the file system containing the given
+// path if it is a network file system, otherwise it returns an empty
+// string.
+func NetworkFS(path string) string {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return ""
+	}
+	return networkFSTypes[int64(st.Type)]
+}
@@ -0,0 +1,12 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+//go:build !linux
+
+package utils
+
+// NetworkFS returns the type of the file system containing the given
+// path if it is a network file system.  The file system type is only
+// detected on Linux, on other platforms an empty string is returned.
+func NetworkFS(path string) string {
+	return ""
+}
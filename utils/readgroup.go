@@ -0,0 +1,141 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UnknownReadGroup is the read group of reads whose names do not have
+// the form given by the ReadGroup configuration value.
+const UnknownReadGroup = "unknown"
+
+// ReadGroup describes how the read group (e.g. the sequencing lane)
+// of each read is found in its name, as given by the ReadGroup
+// configuration value.
+type ReadGroup struct {
+
+	// If positive, the group is taken from an Illumina read name,
+	// using the flow cell and lane (Fields=2), or the flow cell,
+	// lane and tile (Fields=3).
+	Fields int
+
+	// If not nil, the group is the first parenthesized
+	// subexpression (or the whole match if there is none) of the
+	// first match in the read name.
+	Pattern *regexp.Regexp
+}
+
+// ParseReadGroup parses a ReadGroup configuration value, which is
+// either "lane" or "tile", to take the flow cell and lane (and tile)
+// from Illumina read names, or "regexp:re", to take the part of the
+// read name matched by the regular expression re.  An empty value
+// returns nil.
+func ParseReadGroup(spec string) (*ReadGroup, error) {
+
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "lane":
+		return &ReadGroup{Fields: 2}, nil
+	case spec == "tile":
+		return &ReadGroup{Fields: 3}, nil
+	case strings.HasPrefix(spec, "regexp:"):
+		re, err := regexp.Compile(spec[len("regexp:"):])
+		if err != nil {
+			return nil, fmt.Errorf("ReadGroup '%s' has an invalid regular expression: %v", spec, err)
+		}
+		return &ReadGroup{Pattern: re}, nil
+	}
+
+	return nil, fmt.Errorf("ReadGroup '%s' should be 'lane', 'tile' or 'regexp:re'", spec)
+}
+
+// Extract returns the read group of a read with the given name (the
+// header line of the fastq record), or UnknownReadGroup if it is not
+// found.  Whitespace, and the characters that separate the groups in
+// the results (';' and '='), are replaced with '_'.
+func (g *ReadGroup) Extract(name string) string {
+
+	name = strings.TrimPrefix(name, "@")
+
+	var grp string
+	if g.Pattern != nil {
+		m := g.Pattern.FindStringSubmatch(name)
+		switch {
+		case len(m) > 1:
+			grp = m[1]
+		case len(m) == 1:
+			grp = m[0]
+		}
+	} else {
+		if i := strings.IndexAny(name, " \t"); i >= 0 {
+			name = name[0:i]
+		}
+		f := strings.Split(name, ":")
+		switch {
+		case len(f) >= 7:
+			// Casava 1.8 and later:
+			// instrument:run:flowcell:lane:tile:x:y
+			grp = strings.Join(f[2:2+g.Fields], ".")
+		case len(f) == 5:
+			// Earlier versions, without the flow cell:
+			// instrument:lane:tile:x:y
+			grp = strings.Join(f[1:g.Fields], ".")
+		}
+	}
+
+	if grp == "" {
+		return UnknownReadGroup
+	}
+	return strings.NewReplacer("\t", "_", " ", "_", ";", "_", "=", "_").Replace(grp)
+}
+
+// FormatReadGroups formats the number of reads in each read group as
+// a semicolon-delimited list of group=count, ordered by group.
+func FormatReadGroups(counts map[string]int) string {
+
+	var groups []string
+	for g := range counts {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	var buf strings.Builder
+	for i, g := range groups {
+		if i > 0 {
+			buf.WriteString(";")
+		}
+		buf.WriteString(g)
+		buf.WriteString("=")
+		buf.WriteString(strconv.Itoa(counts[g]))
+	}
+
+	return buf.String()
+}
+
+// ParseReadGroups parses a list of read group counts written by
+// FormatReadGroups, calling f with each group and its count.
+func ParseReadGroups(s string, f func(group string, n int)) error {
+
+	if s == "" {
+		return nil
+	}
+	for _, x := range strings.Split(s, ";") {
+		i := strings.LastIndex(x, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid read group count '%s'", x)
+		}
+		n, err := strconv.Atoi(x[i+1:])
+		if err != nil {
+			return fmt.Errorf("invalid read group count '%s'", x)
+		}
+		f(x[0:i], n)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+)
+
+// ReadStatus is how far a distinct read sequence got through the
+// pipeline, which is recorded if UnmatchedReasons is set so that the
+// reason that an unmatched read was not matched can be reported.  The
+// values are ordered by progress, and the status of a read over
+// several windows is the largest of its statuses in each window.
+type ReadStatus byte
+
+const (
+	// The read is too short to cover any window.
+	StatusTooShort ReadStatus = iota
+
+	// The read covers at least one window, but the read sequence
+	// in every window that it covers has fewer than MinDinuc
+	// distinct dinucleotides.
+	StatusLowEntropy
+
+	// No target passed the screen for any of the windows of the
+	// read.
+	StatusNoCandidate
+
+	// At least one target passed the screen, but none of them
+	// agreed with the full read to within PMatch.
+	StatusRejected
+
+	// At least one target may have agreed with the full read, but
+	// the matches were dropped, or the read was not compared, since
+	// its window sequence already had MaxMatches matches.
+	StatusMaxMatches
+
+	// The read was matched to at least one target.
+	StatusMatched
+)
+
+var statusNames = []string{"too_short", "low_entropy", "no_candidate", "rejected_pmatch", "max_matches", "matched"}
+
+// String returns the name of the status, as used in the unmatched
+// reads file.
+func (s ReadStatus) String() string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return "unknown"
+}
+
+// ReadStatusNames returns the names of the statuses, in order of
+// progress.
+func ReadStatusNames() []string {
+	return append([]string(nil), statusNames...)
+}
+
+// WriteReadStatus saves the status of each read, indexed by read id,
+// with one byte per read.
+func WriteReadStatus(fname string, st []ReadStatus) error {
+
+	buf := make([]byte, len(st))
+	for i, s := range st {
+		buf[i] = byte(s)
+	}
+
+	return ioutil.WriteFile(fname, buf, 0666)
+}
+
+// MergeReadStatus reads all the files written by WriteReadStatus
+// whose names match the given pattern, and returns the largest status
+// of each read in any of them.  The status of a read beyond the end of
+// every file is StatusTooShort.
+func MergeReadStatus(pattern string) ([]ReadStatus, error) {
+
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var st []ReadStatus
+	for _, name := range names {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for len(st) < len(buf) {
+			st = append(st, StatusTooShort)
+		}
+		for i, b := range buf {
+			if ReadStatus(b) > st[i] {
+				st[i] = ReadStatus(b)
+			}
+		}
+	}
+
+	return st, nil
+}
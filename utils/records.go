@@ -0,0 +1,106 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// integerColumns are the columns, in any intermediate file, that hold
+// integers.
+var integerColumns = map[string]bool{
+	"count":      true,
+	"readid":     true,
+	"pos":        true,
+	"nmiss":      true,
+	"gene":       true,
+	"target_len": true,
+}
+
+// RecordSchema describes the tab-delimited records of an input file of
+// a Muscato tool.  The tools check the first record that they read
+// against the schema, so that a file written by an incompatible
+// version of Muscato, or truncated by a failed stage, is reported
+// immediately, naming the stage that wrote it, rather than causing a
+// failure part way through the processing.
+type RecordSchema struct {
+
+	// The name of the file, or a description of the input.
+	File string
+
+	// The stage of the pipeline that writes the file.
+	Stage string
+
+	// The names of the columns.  A record may have more fields
+	// than this, but not fewer.
+	Columns []string
+}
+
+// ReadsSortedSchema is the schema of reads_sorted.txt.sz, which holds
+// the distinct read sequences, the number of reads with each
+// sequence, and their names.  If ReadGroup is set, a fourth column
+// gives the number of reads in each read group.
+var ReadsSortedSchema = &RecordSchema{
+	File:    "reads_sorted.txt.sz",
+	Stage:   "prepReads",
+	Columns: []string{"seq", "count", "names"},
+}
+
+// ResultsSchema is the schema of the results file, with the read
+// statistics columns appended by joinReadNames.
+var ResultsSchema = &RecordSchema{
+	File:    "the results file",
+	Stage:   "joinReadNames",
+	Columns: []string{"read", "target", "pos", "nmiss", "target_id", "target_len", "count", "names"},
+}
+
+// Schema returns the schema of the records of the file described by a
+// layout, which is written by the given stage.
+func (lay *Layout) Schema(stage string) *RecordSchema {
+	return &RecordSchema{File: lay.File, Stage: stage, Columns: lay.Columns}
+}
+
+// Check returns an error if a record does not have the columns of
+// the schema, or if a column that holds integers cannot be parsed.
+func (rs *RecordSchema) Check(line []byte) error {
+
+	fields := bytes.Split(line, []byte("\t"))
+	if len(fields) < len(rs.Columns) {
+		return fmt.Errorf("the first record of %s has %d fields, expected at least %d (%s); it is written by the %s stage, which may have failed, or been run by an incompatible version of Muscato",
+			rs.File, len(fields), len(rs.Columns), strings.Join(rs.Columns, ","), rs.Stage)
+	}
+
+	for j, c := range rs.Columns {
+		if !integerColumns[c] {
+			continue
+		}
+		if _, err := strconv.Atoi(string(bytes.TrimSpace(fields[j]))); err != nil {
+			return fmt.Errorf("the %s column of the first record of %s is '%s', expected an integer; it is written by the %s stage, which may have been run by an incompatible version of Muscato",
+				c, rs.File, fields[j], rs.Stage)
+		}
+	}
+
+	return nil
+}
+
+// Require checks the first record of an input against the schema.  If
+// it does not match, the error is written to the log (if logger is
+// not nil) and to stderr, and the tool exits.
+func (rs *RecordSchema) Require(line []byte, logger *log.Logger) {
+
+	err := rs.Check(line)
+	if err == nil {
+		return
+	}
+	if logger != nil {
+		logger.Print(err)
+	}
+	os.Stderr.WriteString(fmt.Sprintf("%s: %v\n", path.Base(os.Args[0]), err))
+	os.Exit(1)
+}
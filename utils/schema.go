@@ -0,0 +1,105 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"reflect"
+)
+
+// jsonType returns the JSON schema type corresponding to a Go type.
+func jsonType(t reflect.Type) map[string]interface{} {
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": jsonType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonType(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+
+	panic("jsonType: unsupported type " + t.String())
+}
+
+// structSchema returns a JSON schema for a struct type, in which
+// each exported field is a property.  The fields of embedded structs
+// (e.g. Limits) are properties of the outer struct, as in their JSON
+// encoding.  Properties that are not fields of the struct are not
+// allowed.
+func structSchema(t reflect.Type) map[string]interface{} {
+
+	props := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			for k, v := range structSchema(f.Type)["properties"].(map[string]interface{}) {
+				props[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		props[f.Name] = jsonType(f.Type)
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+// configEnums lists the values accepted for the string options that
+// are chosen from a fixed set.  The empty string selects the default.
+var configEnums = map[string][]string{
+	"MatchMode":        {"", "first", "best"},
+	"AssignMode":       {"", "unique", "fractional", "best"},
+	"IndexSide":        {"", "reads", "targets", "auto"},
+	"ScreenMethod":     {"", "bloom", "exact"},
+	"WindowAnchor":     {"", "start", "end"},
+	"CompressResults":  {"", "snappy", "gzip"},
+	"BloomHash":        {"", "buzhash32", "buzhash64", "auto"},
+	"SpaceCheck":       {"", "warn", "error", "off"},
+	"SequenceAlphabet": {"", "dna", "protein"},
+}
+
+// fileOnlyUsage describes the settings that have no flag, and can
+// only be given in the configuration file.
+var fileOnlyUsage = map[string]string{
+	"LogDir": "Directory for log files (default muscato_logs)",
+}
+
+// ConfigSchema returns a JSON schema describing the configuration
+// file format, generated from the Config struct.  The description of
+// each property is the usage of the corresponding flag, if any.
+func ConfigSchema() map[string]interface{} {
+
+	schema := structSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Muscato configuration"
+
+	props := schema["properties"].(map[string]interface{})
+	for _, cf := range allFlags() {
+		props[cf.name].(map[string]interface{})["description"] = cf.usage
+	}
+	for name, usage := range fileOnlyUsage {
+		props[name].(map[string]interface{})["description"] = usage
+	}
+	for name, vals := range configEnums {
+		props[name].(map[string]interface{})["enum"] = vals
+	}
+
+	return schema
+}
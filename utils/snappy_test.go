@@ -0,0 +1,124 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// records returns n lines of random bases, in tab-separated fields of
+// the given lengths, resembling the lines of an intermediate file.
+func records(n int, fields []int, seed int64) [][]byte {
+	rng := rand.New(rand.NewSource(seed))
+	recs := make([][]byte, n)
+	for i := range recs {
+		var r []byte
+		for j, m := range fields {
+			if j > 0 {
+				r = append(r, '\t')
+			}
+			for k := 0; k < m; k++ {
+				r = append(r, "ACGT"[rng.Intn(4)])
+			}
+		}
+		recs[i] = append(r, '\n')
+	}
+	return recs
+}
+
+func TestSnappyWriter(t *testing.T) {
+
+	recs := records(10000, []int{15, 20, 65}, 1)
+	for _, bufsize := range []int{0, 1, 4096} {
+		var out bytes.Buffer
+		w := NewSnappyWriter(&out, bufsize)
+		var want []byte
+		for _, r := range recs {
+			w.Write(r)
+			want = append(want, r...)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(snappy.NewReader(&out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("bufsize %d: the data read back differ from the data written", bufsize)
+		}
+	}
+}
+
+// slowWriter discards the data written to it, taking a fixed time
+// for each write, like a network file system with the given round
+// trip time.
+type slowWriter time.Duration
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(w))
+	return len(p), nil
+}
+
+// BenchmarkSnappyWriter writes records with the layout of the
+// candidate matches (bmatch and smatch files: window, left, right,
+// target number and position) and the confirmed matches (rmatch
+// files: read, target sequence, position, mismatches and target
+// number), for 150 base reads, with several values of
+// WriterBufferSize.  The records are written to a file in TempDir
+// ("local"), and to a writer taking 200us for each write ("remote").
+func BenchmarkSnappyWriter(b *testing.B) {
+
+	kinds := []struct {
+		name   string
+		fields []int
+	}{
+		{"bmatch", []int{20, 20, 110, 11, 4}},
+		{"rmatch", []int{150, 150, 4, 1, 11}},
+	}
+
+	for _, kind := range kinds {
+		recs := records(1<<14, kind.fields, 1)
+		var size int64
+		for _, r := range recs {
+			size += int64(len(r))
+		}
+		for _, dest := range []string{"local", "remote"} {
+			for _, bufsize := range []int{4 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20} {
+				name := fmt.Sprintf("%s/%s/%dK", kind.name, dest, bufsize>>10)
+				b.Run(name, func(b *testing.B) {
+					var out io.Writer = slowWriter(200 * time.Microsecond)
+					if dest == "local" {
+						fid, err := os.Create(path.Join(b.TempDir(), "bench.txt.sz"))
+						if err != nil {
+							b.Fatal(err)
+						}
+						defer fid.Close()
+						out = fid
+					}
+					b.ReportAllocs()
+					b.SetBytes(size)
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						w := NewSnappyWriter(out, bufsize)
+						for _, r := range recs {
+							w.Write(r)
+						}
+						if err := w.Close(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
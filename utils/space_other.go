@@ -0,0 +1,13 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+//go:build !linux && !darwin && !freebsd
+
+package utils
+
+// FreeSpace returns the number of bytes available on the file system
+// containing the given path.  The free space is only determined on
+// Linux, macOS and FreeBSD, on other platforms the second return
+// value is false.
+func FreeSpace(path string) (uint64, bool) {
+	return 0, false
+}
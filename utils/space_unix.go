@@ -0,0 +1,20 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+//go:build linux || darwin || freebsd
+
+package utils
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to an unprivileged
+// user on the file system containing the given path.  The second
+// return value is false if the free space could not be determined.
+func FreeSpace(path string) (uint64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), true
+}
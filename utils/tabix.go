@@ -0,0 +1,173 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// The size of the windows of the tabix linear index.
+	tabixShift = 14
+
+	// The tabix format flag for 0-based, half-open coordinates.
+	tabixZeroBased = 0x10000
+
+	// Marks a window of the linear index that has no lines.
+	tabixNoOffset = ^uint64(0)
+)
+
+type tabixChunk struct {
+	beg, end uint64
+}
+
+// tabixRef is the index of one reference (target) sequence.
+type tabixRef struct {
+	name   string
+	bins   map[uint32][]tabixChunk
+	linear []uint64
+	maxBeg int
+}
+
+// TabixIndex builds a tabix index for a BGZF compressed, tab-delimited
+// file, which must be sorted by sequence name and then by start
+// position, with all lines for each sequence name contiguous.
+// Positions are 0-based, with exclusive end positions.
+type TabixIndex struct {
+
+	// The 1-based columns containing the sequence name, and the
+	// start and end positions.
+	ColSeq, ColBeg, ColEnd int
+
+	refs []*tabixRef
+}
+
+// reg2bin returns the smallest bin of the UCSC binning scheme that
+// contains the 0-based, half-open interval [beg, end).
+func reg2bin(beg, end int) uint32 {
+	end--
+	switch {
+	case beg>>14 == end>>14:
+		return uint32(((1<<15)-1)/7 + (beg >> 14))
+	case beg>>17 == end>>17:
+		return uint32(((1<<12)-1)/7 + (beg >> 17))
+	case beg>>20 == end>>20:
+		return uint32(((1<<9)-1)/7 + (beg >> 20))
+	case beg>>23 == end>>23:
+		return uint32(((1<<6)-1)/7 + (beg >> 23))
+	case beg>>26 == end>>26:
+		return uint32(((1<<3)-1)/7 + (beg >> 26))
+	}
+	return 0
+}
+
+// Add records a line of the file, covering [beg, end) on sequence
+// name, that occupies the virtual offsets [voff, vend) in the BGZF
+// file.
+func (idx *TabixIndex) Add(name string, beg, end int, voff, vend uint64) error {
+
+	if end <= beg {
+		end = beg + 1
+	}
+
+	var ref *tabixRef
+	if n := len(idx.refs); n > 0 && idx.refs[n-1].name == name {
+		ref = idx.refs[n-1]
+		if beg < ref.maxBeg {
+			return fmt.Errorf("tabix: %s is not sorted by position at %d", name, beg)
+		}
+	} else {
+		for _, r := range idx.refs {
+			if r.name == name {
+				return fmt.Errorf("tabix: lines for %s are not contiguous", name)
+			}
+		}
+		ref = &tabixRef{name: name, bins: make(map[uint32][]tabixChunk)}
+		idx.refs = append(idx.refs, ref)
+	}
+	ref.maxBeg = beg
+
+	bin := reg2bin(beg, end)
+	chunks := ref.bins[bin]
+	if n := len(chunks); n > 0 && chunks[n-1].end == voff {
+		chunks[n-1].end = vend
+	} else {
+		chunks = append(chunks, tabixChunk{voff, vend})
+	}
+	ref.bins[bin] = chunks
+
+	for w := beg >> tabixShift; w <= (end-1)>>tabixShift; w++ {
+		for len(ref.linear) <= w {
+			ref.linear = append(ref.linear, tabixNoOffset)
+		}
+		if ref.linear[w] == tabixNoOffset {
+			ref.linear[w] = voff
+		}
+	}
+
+	return nil
+}
+
+// WriteTo writes the index in the tabix (.tbi) format.  The index
+// should be written through a BGZFWriter.
+func (idx *TabixIndex) WriteTo(w io.Writer) (int64, error) {
+
+	var out []byte
+	put32 := func(x int32) {
+		out = binary.LittleEndian.AppendUint32(out, uint32(x))
+	}
+	put64 := func(x uint64) {
+		out = binary.LittleEndian.AppendUint64(out, x)
+	}
+
+	out = append(out, "TBI\x01"...)
+	put32(int32(len(idx.refs)))
+	put32(tabixZeroBased)
+	put32(int32(idx.ColSeq))
+	put32(int32(idx.ColBeg))
+	put32(int32(idx.ColEnd))
+	put32('#')
+	put32(0)
+
+	var names []byte
+	for _, ref := range idx.refs {
+		names = append(names, ref.name...)
+		names = append(names, 0)
+	}
+	put32(int32(len(names)))
+	out = append(out, names...)
+
+	for _, ref := range idx.refs {
+		put32(int32(len(ref.bins)))
+		for bin, chunks := range ref.bins {
+			put32(int32(bin))
+			put32(int32(len(chunks)))
+			for _, c := range chunks {
+				put64(c.beg)
+				put64(c.end)
+			}
+		}
+
+		// Empty windows of the linear index point to the
+		// previous non-empty window.
+		for i := range ref.linear {
+			if ref.linear[i] != tabixNoOffset {
+				continue
+			}
+			ref.linear[i] = 0
+			if i > 0 {
+				ref.linear[i] = ref.linear[i-1]
+			}
+		}
+		put32(int32(len(ref.linear)))
+		for _, v := range ref.linear {
+			put64(v)
+		}
+	}
+
+	n, err := w.Write(out)
+
+	return int64(n), err
+}
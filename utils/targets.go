@@ -0,0 +1,113 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TargetManifest lists the volumes of a target sequence or id file
+// that was split by muscato_prep_targets -volsize.  The volumes are
+// numbered in order, and their concatenation is the same as the file
+// that would be written without -volsize.
+type TargetManifest struct {
+	Volumes []TargetVolume
+}
+
+// TargetVolume is one volume in a TargetManifest.  File is relative to
+// the directory containing the manifest, and Bytes is the size of the
+// volume before compression.
+type TargetVolume struct {
+	File  string
+	Bytes int64
+}
+
+// TargetFiles returns the files making up a prepared target sequence
+// or id file.  If name is a manifest (with a .json extension), the
+// volumes it lists are returned, otherwise name is the only file.
+func TargetFiles(name string) ([]string, error) {
+
+	if !strings.EqualFold(filepath.Ext(name), ".json") {
+		return []string{name}, nil
+	}
+
+	fid, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	var m TargetManifest
+	if err := json.NewDecoder(fid).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(m.Volumes) == 0 {
+		return nil, fmt.Errorf("%s: manifest lists no volumes", name)
+	}
+
+	dir := filepath.Dir(name)
+	var files []string
+	for _, v := range m.Volumes {
+		f := v.File
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(dir, f)
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// targetReader reads the decompressed volumes of a target file in
+// order.
+type targetReader struct {
+	io.Reader
+	fids []*os.File
+}
+
+func (r *targetReader) Close() error {
+	var err error
+	for _, f := range r.fids {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// OpenTargets opens a prepared target sequence or id file, which may
+// be a manifest of volumes, and returns the decompressed contents of
+// all volumes as a single stream.  Each volume may be snappy or gzip
+// compressed, or plain text, as recognized from its contents.
+func OpenTargets(name string) (io.ReadCloser, error) {
+
+	files, err := TargetFiles(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &targetReader{}
+	var rdrs []io.Reader
+	for _, f := range files {
+		fid, err := os.Open(f)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.fids = append(r.fids, fid)
+		rdr, err := decompress(fid)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		rdrs = append(rdrs, rdr)
+	}
+	r.Reader = io.MultiReader(rdrs...)
+
+	return r, nil
+}
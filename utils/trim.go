@@ -0,0 +1,132 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// The proportion of the aligned bases of an adapter that may
+	// differ from the read.
+	adapterErrorRate = 0.1
+
+	// The offset of the quality scores in fastq files.
+	phredOffset = 33
+)
+
+// Trimmer removes adapter sequences and low quality bases from the 3'
+// end of reads, as given by the Adapters, AdapterMinOverlap and
+// QualityTrim configuration values.
+type Trimmer struct {
+
+	// The adapter sequences, in upper case.
+	adapters []string
+
+	// The minimum number of bases of an adapter that must be found
+	// at the end of a read to be removed.
+	minOverlap int
+
+	// Bases with quality below this are trimmed from the 3' end.
+	minQual int
+}
+
+// NewTrimmer returns a Trimmer for the trimming settings of a
+// configuration, or nil if no trimming is to be done.
+func NewTrimmer(c *Config) (*Trimmer, error) {
+
+	if len(c.Adapters) == 0 && c.QualityTrim == 0 {
+		return nil, nil
+	}
+
+	tr := &Trimmer{minOverlap: c.AdapterMinOverlap, minQual: c.QualityTrim}
+	for _, a := range c.Adapters {
+		a = strings.ToUpper(strings.TrimSpace(a))
+		if a == "" {
+			return nil, fmt.Errorf("Adapters contains an empty sequence")
+		}
+		if strings.Trim(a, "ACGTN") != "" {
+			return nil, fmt.Errorf("adapter '%s' contains letters other than A, C, G, T and N", a)
+		}
+		tr.adapters = append(tr.adapters, a)
+	}
+
+	return tr, nil
+}
+
+// Trim returns the length of a read after removing low quality bases
+// from its 3' end, and then the first adapter found in what remains
+// along with everything following it.  The number of bases removed
+// for low quality and for adapters are also returned.  qual holds the
+// quality scores of the read, and may be empty (e.g. if the read has
+// no quality scores), in which case no bases are removed for low
+// quality.
+func (tr *Trimmer) Trim(seq, qual string) (n, nqual, nadapt int) {
+
+	n = len(seq)
+	if tr.minQual > 0 && len(qual) == len(seq) {
+		n = qualityEnd(qual, tr.minQual)
+		nqual = len(seq) - n
+	}
+
+	end := n
+	for _, a := range tr.adapters {
+		if i := findAdapter(seq[0:n], a, tr.minOverlap); i < end {
+			end = i
+		}
+	}
+	nadapt = n - end
+
+	return end, nqual, nadapt
+}
+
+// qualityEnd returns the length of a read after trimming low quality
+// bases from its 3' end, using the method of BWA: the read is cut at
+// the position that maximizes the sum of minQual minus the quality
+// score over the removed bases.
+func qualityEnd(qual string, minQual int) int {
+
+	n := len(qual)
+	var s, best int
+	for i := len(qual) - 1; i >= 0; i-- {
+		s += minQual - (int(qual[i]) - phredOffset)
+		if s < 0 {
+			break
+		}
+		if s > best {
+			best = s
+			n = i
+		}
+	}
+
+	return n
+}
+
+// findAdapter returns the first position in seq at which the adapter
+// a begins, allowing adapterErrorRate mismatches among the aligned
+// bases.  The adapter may extend beyond the end of seq by all but
+// minOverlap of its bases.  If the adapter is not found, len(seq) is
+// returned.  Ns in the read or adapter match any base.
+func findAdapter(seq, a string, minOverlap int) int {
+
+	for i := 0; i+minOverlap <= len(seq); i++ {
+		m := len(a)
+		if i+m > len(seq) {
+			m = len(seq) - i
+		}
+		maxErr := int(adapterErrorRate * float64(m))
+		var nerr int
+		for j := 0; j < m && nerr <= maxErr; j++ {
+			b, c := seq[i+j]&^0x20, a[j]
+			if b != c && b != 'N' && c != 'N' {
+				nerr++
+			}
+		}
+		if nerr <= maxErr {
+			return i
+		}
+	}
+
+	return len(seq)
+}
@@ -0,0 +1,132 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// Phred+33 quality scores of 0, 10, 20 and 40.
+const (
+	q0  = "!"
+	q10 = "+"
+	q20 = "5"
+	q40 = "I"
+)
+
+func TestQualityEnd(t *testing.T) {
+
+	for _, d := range []struct {
+		qual    string
+		minQual int
+		want    int
+	}{
+		{"", 20, 0},
+		{strings.Repeat(q40, 10), 20, 10},
+		{strings.Repeat(q0, 10), 20, 0},
+		{strings.Repeat(q20, 10), 20, 10},
+		{strings.Repeat(q40, 5) + strings.Repeat(q0, 3), 20, 5},
+		// A single good base does not stop the trimming, as in BWA.
+		{q40 + q40 + q40 + q10 + q40 + q0 + q0, 20, 5},
+		{q40 + q40 + q0 + q10 + q0 + q0, 20, 2},
+		{strings.Repeat(q10, 6), 5, 6},
+	} {
+		if n := qualityEnd(d.qual, d.minQual); n != d.want {
+			t.Errorf("qualityEnd(%q, %d) is %d, expected %d", d.qual, d.minQual, n, d.want)
+		}
+	}
+}
+
+func TestFindAdapter(t *testing.T) {
+
+	const a = "AGATCGGAAGAGC"
+	for _, d := range []struct {
+		seq  string
+		want int
+	}{
+		{"ACGTACGTAC" + a + "TTT", 10},
+		{"CCCCCCCCCC", 10},
+		// Runs off the end, with enough or too few bases.
+		{"CCCCCCCCCC" + a[0:6], 10},
+		{"CCCCCCCCCC" + a[0:4], 14},
+		// One mismatch is allowed in 13 bases, but not two.
+		{"CCCC" + "AGATCGGTAGAGC", 4},
+		{"CCCC" + "AGTTCGGTAGAGC", 17},
+		// Lower case and N in the read.
+		{"cccc" + strings.ToLower(a), 4},
+		{"CCCC" + "AGANCGGAAGAGC", 4},
+		{"", 0},
+	} {
+		if i := findAdapter(d.seq, a, 5); i != d.want {
+			t.Errorf("findAdapter(%q) is %d, expected %d", d.seq, i, d.want)
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+
+	c := new(Config)
+	if tr, err := NewTrimmer(c); tr != nil || err != nil {
+		t.Fatalf("NewTrimmer without trimming settings returned %v, %v", tr, err)
+	}
+	for _, a := range []string{"", "AGATXG"} {
+		c.Adapters = []string{a}
+		if _, err := NewTrimmer(c); err == nil {
+			t.Errorf("NewTrimmer accepted adapter %q", a)
+		}
+	}
+
+	c.Adapters = []string{"agatcggaagagc"}
+	c.AdapterMinOverlap = 5
+	c.QualityTrim = 20
+	tr, err := NewTrimmer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []struct {
+		seq, qual          string
+		n, nqual, nadapter int
+	}{
+		// No trimming.
+		{"ACGTACGTAC", strings.Repeat(q40, 10), 10, 0, 0},
+		// Low quality bases only, and no quality scores.
+		{"ACGTACGTAC", strings.Repeat(q40, 6) + strings.Repeat(q0, 4), 6, 4, 0},
+		{"ACGTACGTACAGATCG", "", 10, 0, 6},
+		// The adapter is found in what remains after removing the
+		// low quality bases.
+		{"ACGTACGTACAGATCGGAAG", strings.Repeat(q40, 16) + strings.Repeat(q0, 4), 10, 4, 6},
+		// The whole read is removed.
+		{"ACGTACGTAC", strings.Repeat(q0, 10), 0, 10, 0},
+		{"AGATCGGAAGAGC", strings.Repeat(q40, 13), 0, 0, 13},
+	} {
+		n, nq, na := tr.Trim(d.seq, d.qual)
+		if n != d.n || nq != d.nqual || na != d.nadapter {
+			t.Errorf("Trim(%q, %q) is %d, %d, %d, expected %d, %d, %d",
+				d.seq, d.qual, n, nq, na, d.n, d.nqual, d.nadapter)
+		}
+	}
+}
+
+func TestMinUsableLength(t *testing.T) {
+
+	for _, d := range []struct {
+		name string
+		set  func(c *Config)
+		want int
+	}{
+		{"no windows", func(c *Config) {}, 1},
+		{"MinReadLength", func(c *Config) { c.MinReadLength = 30 }, 30},
+		{"Windows", func(c *Config) { c.Windows = []int{40, 20, 60}; c.WindowWidth = 15 }, 35},
+		{"Windows and MinReadLength", func(c *Config) { c.Windows = []int{20}; c.WindowWidth = 15; c.MinReadLength = 50 }, 50},
+		{"WindowStride", func(c *Config) { c.WindowStride = 20; c.WindowWidth = 15 }, 15},
+		{"ExactTier", func(c *Config) { c.Windows = []int{20}; c.WindowWidth = 15; c.ExactTier = true }, 1},
+	} {
+		c := new(Config)
+		d.set(c)
+		if n := c.MinUsableLength(); n != d.want {
+			t.Errorf("%s: MinUsableLength is %d, expected %d", d.name, n, d.want)
+		}
+	}
+}
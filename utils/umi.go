@@ -0,0 +1,79 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UMI describes where the unique molecular identifier (UMI) of each
+// read is found, as given by the UMI configuration value.
+type UMI struct {
+
+	// If positive, the UMI is the first ReadLen bases of the read,
+	// which are removed from the read before matching.
+	ReadLen int
+
+	// If not empty, the UMI is the text following the last
+	// occurrence of Sep in the first word of the read name.
+	Sep string
+}
+
+// ParseUMI parses a UMI configuration value, which is either
+// "read:n", meaning that the UMI is the first n bases of the read, or
+// "header:c", meaning that the UMI follows the last occurrence of the
+// character c in the read name (before any whitespace).  "header"
+// alone is the same as "header:_".  An empty value returns nil.
+func ParseUMI(spec string) (*UMI, error) {
+
+	if spec == "" {
+		return nil, nil
+	}
+
+	toks := strings.SplitN(spec, ":", 2)
+	switch toks[0] {
+	case "read":
+		if len(toks) == 2 {
+			n, err := strconv.Atoi(toks[1])
+			if err == nil && n > 0 {
+				return &UMI{ReadLen: n}, nil
+			}
+		}
+		return nil, fmt.Errorf("UMI '%s' should have the form read:n, with n positive", spec)
+	case "header":
+		if len(toks) == 1 {
+			return &UMI{Sep: "_"}, nil
+		}
+		if len(toks[1]) == 1 {
+			return &UMI{Sep: toks[1]}, nil
+		}
+		return nil, fmt.Errorf("UMI '%s' should have the form header:c, with c a single character", spec)
+	}
+
+	return nil, fmt.Errorf("UMI '%s' should begin with 'read' or 'header'", spec)
+}
+
+// Extract returns the UMI of a read, and the read sequence with any
+// UMI bases removed.  If the UMI is not found, the returned UMI is
+// empty.
+func (u *UMI) Extract(name, seq string) (string, string) {
+
+	if u.ReadLen > 0 {
+		if len(seq) < u.ReadLen {
+			return "", ""
+		}
+		return seq[0:u.ReadLen], seq[u.ReadLen:]
+	}
+
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name = name[0:i]
+	}
+	i := strings.LastIndex(name, u.Sep)
+	if i < 0 {
+		return "", seq
+	}
+
+	return name[i+1:], seq
+}
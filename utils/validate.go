@@ -0,0 +1,379 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The kinds of ConfigError.
+var (
+	ErrMissing  = errors.New("setting not provided")
+	ErrInvalid  = errors.New("invalid setting")
+	ErrConflict = errors.New("conflicting settings")
+)
+
+// ConfigError is an invalid, missing or conflicting setting, found by
+// Validate or FromFlags.  Its kind can be tested with errors.Is, e.g.
+// errors.Is(err, ErrMissing).
+type ConfigError struct {
+
+	// The name of the setting, e.g. "PMatch".  For conflicting
+	// settings, this is the first of them.
+	Field string
+
+	// One of ErrMissing, ErrInvalid or ErrConflict.
+	Kind error
+
+	msg string
+}
+
+func (e *ConfigError) Error() string {
+	return e.msg
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Kind
+}
+
+// NewConfigError returns a ConfigError of the given kind for a
+// setting, with a formatted message.
+func NewConfigError(field string, kind error, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{Field: field, Kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+func invalid(field string, format string, args ...interface{}) error {
+	return NewConfigError(field, ErrInvalid, format, args...)
+}
+
+func conflict(field string, format string, args ...interface{}) error {
+	return NewConfigError(field, ErrConflict, format, args...)
+}
+
+// note reports a default that was filled in.
+func note(msg string) {
+	os.Stderr.WriteString(msg + "\n")
+}
+
+// Validate confirms that the required settings are present and valid,
+// and fills in defaults for the others.  The defaults that are likely
+// to matter are reported on stderr.  Validate can be called more than
+// once, since the defaults are only set for settings that are unset.
+// The settings that depend on the environment of the run (TempDir,
+// WorkDir and Retention) are checked when the run starts.
+func (c *Config) Validate() error {
+
+	// With ConfirmOnly, the screening parameters are taken from
+	// the earlier run.
+	screening := c.ConfirmOnly == ""
+
+	for _, f := range []struct {
+		name  string
+		unset bool
+	}{
+		{"ReadFileName", c.ReadFileName == ""},
+		{"GeneFileName", c.GeneFileName == ""},
+		{"GeneIdFileName", c.GeneIdFileName == ""},
+		{"Windows", screening && len(c.Windows) == 0 && c.WindowStride == 0},
+		{"WindowWidth", screening && c.WindowWidth == 0},
+		{"MaxReadLength", screening && c.MaxReadLength == 0},
+	} {
+		if f.unset {
+			return NewConfigError(f.name, ErrMissing, "%s not provided, run 'muscato --help' for more information", f.name)
+		}
+	}
+
+	if c.ResultsFileName == "" {
+		c.ResultsFileName = "results.txt"
+		note("ResultsFileName not provided, defaulting to 'results.txt'")
+	}
+	for _, f := range []struct {
+		name string
+		val  int
+	}{
+		{"WindowStride", c.WindowStride},
+		{"WindowBatch", c.WindowBatch},
+		{"MinReadLength", c.MinReadLength},
+		{"MinDinuc", c.MinDinuc},
+		{"MMTol", c.MMTol},
+		{"ReadThrough", c.ReadThrough},
+		{"ConfirmFlank", c.ConfirmFlank},
+		{"StageRetries", c.StageRetries},
+	} {
+		if f.val < 0 {
+			return invalid(f.name, "%s must not be negative", f.name)
+		}
+	}
+	for _, w := range c.Windows {
+		if w < 0 {
+			return invalid("Windows", "Windows must not be negative")
+		}
+	}
+	if c.MonitorPort < 0 || c.MonitorPort > 65535 {
+		return invalid("MonitorPort", "MonitorPort must be between 1 and 65535")
+	}
+	if c.WindowBatch > 0 && c.CacheDir != "" {
+		return conflict("WindowBatch", "WindowBatch and CacheDir cannot both be set")
+	}
+	if c.ConfirmOnly != "" && (c.WindowBatch > 0 || c.CacheDir != "" || c.ScreenOnly) {
+		return conflict("ConfirmOnly", "ConfirmOnly cannot be used with WindowBatch, CacheDir or ScreenOnly")
+	}
+	if len(c.WindowSubset) > 0 && c.ConfirmOnly == "" {
+		return conflict("WindowSubset", "WindowSubset can only be used with ConfirmOnly")
+	}
+	seen := make(map[int]bool)
+	for _, w := range c.WindowSubset {
+		if w < 0 {
+			return invalid("WindowSubset", "WindowSubset must not be negative")
+		}
+		if seen[w] {
+			return invalid("WindowSubset", "WindowSubset lists window %d more than once", w)
+		}
+		seen[w] = true
+	}
+	if c.ScreenOnly && c.RefineCommand != "" {
+		return conflict("ScreenOnly", "RefineCommand cannot be used with ScreenOnly")
+	}
+	if c.ScreenOnly && c.CheckCounts {
+		return conflict("ScreenOnly", "CheckCounts cannot be used with ScreenOnly")
+	}
+	for _, tol := range c.WindowMMTol {
+		if tol < 0 {
+			return invalid("WindowMMTol", "WindowMMTol must not be negative")
+		}
+		if tol > 0 && c.ExactTier {
+			return conflict("ExactTier", "ExactTier cannot be used with WindowMMTol, since reads with exact matches would lose their other matches")
+		}
+	}
+	if c.ExactTier && (c.MMTol > 0 || c.ReadThrough > 0) {
+		return conflict("ExactTier", "ExactTier cannot be used with MMTol or ReadThrough, since reads with exact matches would lose their other matches")
+	}
+	if c.ExactTier && (c.CacheDir != "" || c.ConfirmOnly != "") {
+		return conflict("ExactTier", "ExactTier cannot be used with CacheDir or ConfirmOnly")
+	}
+	if c.UnmatchedReasons && (c.NoPerReadOutput || c.ScreenOnly || c.ConfirmOnly != "" || c.CacheDir != "") {
+		return conflict("UnmatchedReasons", "UnmatchedReasons cannot be used with NoPerReadOutput, ScreenOnly, ConfirmOnly or CacheDir")
+	}
+	if c.GeneSampleSize > 0 && c.CheckCounts {
+		return conflict("GeneSampleSize", "CheckCounts cannot be used with GeneSampleSize, since the reads whose matches were all dropped are not in the results")
+	}
+	if c.WindowStride > 0 && len(c.Windows) > 0 {
+		return conflict("Windows", "Windows and WindowStride cannot both be set")
+	}
+	if c.WindowStride > 0 && (len(c.WindowPMatch) > 0 || len(c.WindowMMTol) > 0) {
+		return conflict("WindowStride", "WindowPMatch and WindowMMTol cannot be used with WindowStride, since the number of windows is not known in advance")
+	}
+	if len(c.Windows) > 0 {
+		if err := c.CheckWindowSettings(); err != nil {
+			return err
+		}
+	}
+	if !c.AutoBloom && c.BloomSize == 0 && c.NumHash == 0 && c.ScreenMethod != "exact" && c.IndexSide != "targets" {
+		note("BloomSize and NumHash not provided, sizing the Bloom filters from the number of distinct reads")
+		c.AutoBloom = true
+	}
+	if c.AutoBloom {
+		// BloomSize and NumHash are set after the reads are
+		// counted.
+		if c.BloomFPR == 0 {
+			c.BloomFPR = 0.01
+		}
+		if c.BloomFPR <= 0 || c.BloomFPR >= 1 {
+			return invalid("BloomFPR", "BloomFPR must be between 0 and 1")
+		}
+	} else {
+		if c.BloomSize == 0 {
+			note("BloomSize not provided, defaulting to 4 billion")
+			c.BloomSize = 4 * 1000 * 1000 * 1000
+		}
+		if c.NumHash == 0 {
+			note("NumHash not provided, defaulting to 20")
+			c.NumHash = 20
+		} else if c.NumHash < 0 {
+			return invalid("NumHash", "NumHash must be positive")
+		}
+	}
+	switch c.BloomHash {
+	case "":
+		c.BloomHash = "auto"
+	case "auto", "buzhash64":
+	case "buzhash32":
+		if c.BloomSize > 1<<32 {
+			note("Warning: BloomSize is more than 2^32 bits, which buzhash32 cannot fully address, consider BloomHash=buzhash64")
+		}
+	default:
+		return invalid("BloomHash", "BloomHash must be 'buzhash32', 'buzhash64' or 'auto'")
+	}
+	if c.RandomSeed == 0 {
+		c.RandomSeed = time.Now().UnixNano()
+		note(fmt.Sprintf("RandomSeed not provided, using %d", c.RandomSeed))
+	}
+	if c.PMatch == 0 {
+		note("PMatch not provided, defaulting to 1")
+		c.PMatch = 1
+	} else if c.PMatch < 0 || c.PMatch > 1 {
+		return invalid("PMatch", "PMatch must be between 0 and 1")
+	}
+	for _, p := range c.WindowPMatch {
+		if p <= 0 || p > 1 {
+			return invalid("WindowPMatch", "WindowPMatch must be between 0 and 1")
+		}
+	}
+	if _, err := ParseUMI(c.UMI); err != nil {
+		return invalid("UMI", "%v", err)
+	}
+	if _, err := ParseReadGroup(c.ReadGroup); err != nil {
+		return invalid("ReadGroup", "%v", err)
+	}
+	if c.ReadGroup != "" && c.NoPerReadOutput {
+		return conflict("ReadGroup", "ReadGroup cannot be used with NoPerReadOutput, since the read groups are reported with the per-read results")
+	}
+	if _, err := NewTrimmer(c); err != nil {
+		return invalid("Adapters", "%v", err)
+	}
+	if len(c.Adapters) > 0 && c.AdapterMinOverlap == 0 {
+		c.AdapterMinOverlap = 5
+	} else if c.AdapterMinOverlap < 0 {
+		return invalid("AdapterMinOverlap", "AdapterMinOverlap must not be negative")
+	}
+	if c.QualityTrim < 0 {
+		return invalid("QualityTrim", "QualityTrim must not be negative")
+	}
+	if (len(c.Adapters) > 0 || c.QualityTrim > 0) && c.SequenceAlphabet == "protein" {
+		return conflict("Adapters", "Adapters and QualityTrim cannot be used with SequenceAlphabet=protein")
+	}
+	if c.CombineFPR == 0 {
+		c.CombineFPR = 1e-6
+	} else if c.CombineFPR < 0 || c.CombineFPR >= 1 {
+		return invalid("CombineFPR", "CombineFPR must be between 0 and 1")
+	}
+	if c.ConfirmBlockSize == 0 {
+		c.ConfirmBlockSize = 1000 * 1000
+	} else if c.ConfirmBlockSize < 0 {
+		return invalid("ConfirmBlockSize", "ConfirmBlockSize must be positive")
+	}
+	if len(c.MismatchCosts) > 0 {
+		if _, err := NewCostMatrix(c.MismatchCosts); err != nil {
+			return invalid("MismatchCosts", "%v", err)
+		}
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if c.RetryDelay == "" {
+		c.RetryDelay = "30s"
+	} else if d, err := time.ParseDuration(c.RetryDelay); err != nil {
+		return invalid("RetryDelay", "invalid RetryDelay '%s': %v", c.RetryDelay, err)
+	} else if d < 0 {
+		return invalid("RetryDelay", "RetryDelay must not be negative")
+	}
+	if c.PanelFileName != "" && c.PanelMinCount == 0 {
+		c.PanelMinCount = 1
+	}
+	switch c.SpaceCheck {
+	case "":
+		c.SpaceCheck = "warn"
+	case "warn", "error", "off":
+	default:
+		return invalid("SpaceCheck", "SpaceCheck must be 'warn', 'error' or 'off'")
+	}
+	switch c.ScreenMethod {
+	case "":
+		c.ScreenMethod = "bloom"
+	case "bloom", "exact":
+	default:
+		return invalid("ScreenMethod", "ScreenMethod must be 'bloom' or 'exact'")
+	}
+	switch c.WindowAnchor {
+	case "":
+		c.WindowAnchor = "start"
+	case "start", "end":
+	default:
+		return invalid("WindowAnchor", "WindowAnchor must be 'start' or 'end'")
+	}
+	switch c.IndexSide {
+	case "":
+		c.IndexSide = "reads"
+	case "reads", "targets", "auto":
+	default:
+		return invalid("IndexSide", "IndexSide must be 'reads', 'targets' or 'auto'")
+	}
+	if _, err := NewAlphabet(c.SequenceAlphabet); err != nil {
+		return invalid("SequenceAlphabet", "SequenceAlphabet must be 'dna' or 'protein', not '%s'", c.SequenceAlphabet)
+	}
+	if c.SequenceAlphabet == "" {
+		c.SequenceAlphabet = "dna"
+	}
+	if c.SequenceAlphabet == "protein" && (len(c.MismatchCosts) > 0 || c.EValues) {
+		return conflict("SequenceAlphabet", "MismatchCosts and EValues are for DNA, and cannot be used with protein sequences")
+	}
+	switch c.MatchMode {
+	case "":
+		note("MatchMode not provided, defaulting to 'best'")
+		c.MatchMode = "best"
+	case "first", "best":
+	default:
+		return invalid("MatchMode", "MatchMode must be 'first' or 'best', not '%s'", c.MatchMode)
+	}
+	switch c.CompressResults {
+	case "", "snappy", "gzip":
+	default:
+		return invalid("CompressResults", "CompressResults must be 'snappy' or 'gzip', not '%s'", c.CompressResults)
+	}
+	if c.NoPerReadOutput && (c.IndexResults || c.AssignMode != "") {
+		return conflict("NoPerReadOutput", "IndexResults and AssignMode use the per-read results, and cannot be used with NoPerReadOutput")
+	}
+	switch c.AssignMode {
+	case "", "unique", "fractional", "best":
+	default:
+		return invalid("AssignMode", "AssignMode must be 'unique', 'fractional' or 'best', not '%s'", c.AssignMode)
+	}
+
+	// Notes are not needed for the parallelism defaults, they are
+	// recorded in the log.
+	if c.SortPar == 0 {
+		c.SortPar = DefaultSortPar()
+	}
+	if c.ScreenConcurrency == 0 {
+		c.ScreenConcurrency = DefaultScreenConcurrency()
+	}
+	if c.ConfirmConcurrency == 0 {
+		c.ConfirmConcurrency = DefaultConfirmConcurrency()
+	}
+	for _, f := range []struct {
+		name string
+		val  int
+	}{
+		{"SortPar", c.SortPar},
+		{"ScreenConcurrency", c.ScreenConcurrency},
+		{"ConfirmConcurrency", c.ConfirmConcurrency},
+	} {
+		if f.val < 0 {
+			return invalid(f.name, "%s must be positive", f.name)
+		}
+	}
+
+	if c.SortMem == "" {
+		note("SortMem not provided, defaulting to 50%")
+		c.SortMem = "50%"
+	}
+
+	return nil
+}
+
+// CheckWindowSettings confirms that WindowPMatch and WindowMMTol, if
+// set, give one value for each window.  It is called by Validate, and
+// again when the windows are taken from an earlier run (see
+// ConfirmOnly).
+func (c *Config) CheckWindowSettings() error {
+	if n := len(c.WindowPMatch); n > 0 && n != len(c.Windows) {
+		return invalid("WindowPMatch", "WindowPMatch has %d values, but there are %d windows", n, len(c.Windows))
+	}
+	if n := len(c.WindowMMTol); n > 0 && n != len(c.Windows) {
+		return invalid("WindowMMTol", "WindowMMTol has %d values, but there are %d windows", n, len(c.Windows))
+	}
+	return nil
+}
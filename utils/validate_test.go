@@ -0,0 +1,312 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// validConfig returns a configuration with the required settings,
+// which passes Validate.
+func validConfig() *Config {
+	c := new(Config)
+	c.ReadFileName = "reads.fastq"
+	c.GeneFileName = "genes.txt.sz"
+	c.GeneIdFileName = "genes_ids.txt.sz"
+	c.Windows = []int{0, 20}
+	c.WindowWidth = 15
+	c.MaxReadLength = 100
+	c.RandomSeed = 1
+	return c
+}
+
+func TestValidateDefaults(t *testing.T) {
+
+	c := validConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"ResultsFileName", c.ResultsFileName, "results.txt"},
+		{"AutoBloom", c.AutoBloom, true},
+		{"BloomFPR", c.BloomFPR, 0.01},
+		{"BloomHash", c.BloomHash, "auto"},
+		{"PMatch", c.PMatch, 1.0},
+		{"CombineFPR", c.CombineFPR, 1e-6},
+		{"ConfirmBlockSize", c.ConfirmBlockSize, 1000 * 1000},
+		{"RetryDelay", c.RetryDelay, "30s"},
+		{"SpaceCheck", c.SpaceCheck, "warn"},
+		{"ScreenMethod", c.ScreenMethod, "bloom"},
+		{"WindowAnchor", c.WindowAnchor, "start"},
+		{"IndexSide", c.IndexSide, "reads"},
+		{"SequenceAlphabet", c.SequenceAlphabet, "dna"},
+		{"MatchMode", c.MatchMode, "best"},
+		{"SortMem", c.SortMem, "50%"},
+		{"MaxMatches", c.MaxMatches, 1000 * 1000},
+		{"MaxNameList", c.MaxNameList, 1000},
+		{"SortPar", c.SortPar > 0, true},
+		{"ScreenConcurrency", c.ScreenConcurrency > 0, true},
+		{"ConfirmConcurrency", c.ConfirmConcurrency > 0, true},
+	} {
+		if !reflect.DeepEqual(d.got, d.want) {
+			t.Errorf("%s is %v, expected %v", d.name, d.got, d.want)
+		}
+	}
+
+	// The defaults do not replace values that are given, and a
+	// second call changes nothing.
+	c = validConfig()
+	c.BloomSize = 1000
+	c.NumHash = 3
+	c.MatchMode = "first"
+	c.AdapterMinOverlap = 0
+	c.Adapters = []string{"AGATCGGAAGAGC"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.AutoBloom || c.BloomSize != 1000 || c.NumHash != 3 || c.MatchMode != "first" {
+		t.Errorf("Validate replaced given values: AutoBloom=%v BloomSize=%d NumHash=%d MatchMode=%s",
+			c.AutoBloom, c.BloomSize, c.NumHash, c.MatchMode)
+	}
+	if c.AdapterMinOverlap != 5 {
+		t.Errorf("AdapterMinOverlap is %d, expected 5", c.AdapterMinOverlap)
+	}
+	d := *c
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*c, d) {
+		t.Errorf("a second call to Validate changed the configuration")
+	}
+
+	// The screening settings are not needed with ConfirmOnly.
+	c = validConfig()
+	c.Windows = nil
+	c.WindowWidth = 0
+	c.MaxReadLength = 0
+	c.ConfirmOnly = "tmp/run1"
+	if err := c.Validate(); err != nil {
+		t.Errorf("ConfirmOnly without the screening settings: %v", err)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+
+	for _, tc := range []struct {
+		field string
+		kind  error
+		set   func(c *Config)
+	}{
+		// Missing settings
+		{"ReadFileName", ErrMissing, func(c *Config) { c.ReadFileName = "" }},
+		{"GeneFileName", ErrMissing, func(c *Config) { c.GeneFileName = "" }},
+		{"GeneIdFileName", ErrMissing, func(c *Config) { c.GeneIdFileName = "" }},
+		{"Windows", ErrMissing, func(c *Config) { c.Windows = nil }},
+		{"WindowWidth", ErrMissing, func(c *Config) { c.WindowWidth = 0 }},
+		{"MaxReadLength", ErrMissing, func(c *Config) { c.MaxReadLength = 0 }},
+
+		// Invalid settings
+		{"MMTol", ErrInvalid, func(c *Config) { c.MMTol = -1 }},
+		{"MinReadLength", ErrInvalid, func(c *Config) { c.MinReadLength = -1 }},
+		{"StageRetries", ErrInvalid, func(c *Config) { c.StageRetries = -1 }},
+		{"Windows", ErrInvalid, func(c *Config) { c.Windows = []int{0, -5} }},
+		{"MonitorPort", ErrInvalid, func(c *Config) { c.MonitorPort = 70000 }},
+		{"WindowSubset", ErrInvalid, func(c *Config) { c.ConfirmOnly = "tmp/run1"; c.WindowSubset = []int{1, 1} }},
+		{"WindowSubset", ErrInvalid, func(c *Config) { c.ConfirmOnly = "tmp/run1"; c.WindowSubset = []int{-1} }},
+		{"WindowMMTol", ErrInvalid, func(c *Config) { c.WindowMMTol = []int{0, -1} }},
+		{"WindowMMTol", ErrInvalid, func(c *Config) { c.WindowMMTol = []int{1} }},
+		{"WindowPMatch", ErrInvalid, func(c *Config) { c.WindowPMatch = []float64{0.9} }},
+		{"WindowPMatch", ErrInvalid, func(c *Config) { c.WindowPMatch = []float64{0.9, 1.5} }},
+		{"BloomFPR", ErrInvalid, func(c *Config) { c.BloomFPR = 2 }},
+		{"NumHash", ErrInvalid, func(c *Config) { c.BloomSize = 1000; c.NumHash = -1 }},
+		{"BloomHash", ErrInvalid, func(c *Config) { c.BloomHash = "md5" }},
+		{"PMatch", ErrInvalid, func(c *Config) { c.PMatch = 1.5 }},
+		{"UMI", ErrInvalid, func(c *Config) { c.UMI = "nowhere" }},
+		{"ReadGroup", ErrInvalid, func(c *Config) { c.ReadGroup = "regexp:(" }},
+		{"Adapters", ErrInvalid, func(c *Config) { c.Adapters = []string{"AGXT"} }},
+		{"AdapterMinOverlap", ErrInvalid, func(c *Config) { c.AdapterMinOverlap = -1 }},
+		{"QualityTrim", ErrInvalid, func(c *Config) { c.QualityTrim = -1 }},
+		{"CombineFPR", ErrInvalid, func(c *Config) { c.CombineFPR = 1 }},
+		{"ConfirmBlockSize", ErrInvalid, func(c *Config) { c.ConfirmBlockSize = -1 }},
+		{"MismatchCosts", ErrInvalid, func(c *Config) { c.MismatchCosts = map[string]float64{"nonsense": 1} }},
+		{"MaxMatches", ErrInvalid, func(c *Config) { c.MaxMatches = -1 }},
+		{"RetryDelay", ErrInvalid, func(c *Config) { c.RetryDelay = "soon" }},
+		{"RetryDelay", ErrInvalid, func(c *Config) { c.RetryDelay = "-1s" }},
+		{"SpaceCheck", ErrInvalid, func(c *Config) { c.SpaceCheck = "maybe" }},
+		{"ScreenMethod", ErrInvalid, func(c *Config) { c.ScreenMethod = "hash" }},
+		{"WindowAnchor", ErrInvalid, func(c *Config) { c.WindowAnchor = "middle" }},
+		{"IndexSide", ErrInvalid, func(c *Config) { c.IndexSide = "genes" }},
+		{"SequenceAlphabet", ErrInvalid, func(c *Config) { c.SequenceAlphabet = "rna" }},
+		{"MatchMode", ErrInvalid, func(c *Config) { c.MatchMode = "all" }},
+		{"CompressResults", ErrInvalid, func(c *Config) { c.CompressResults = "zip" }},
+		{"AssignMode", ErrInvalid, func(c *Config) { c.AssignMode = "random" }},
+		{"SortPar", ErrInvalid, func(c *Config) { c.SortPar = -1 }},
+
+		// Conflicting settings
+		{"WindowBatch", ErrConflict, func(c *Config) { c.WindowBatch = 2; c.CacheDir = "cache" }},
+		{"ConfirmOnly", ErrConflict, func(c *Config) { c.ConfirmOnly = "tmp/run1"; c.ScreenOnly = true }},
+		{"ConfirmOnly", ErrConflict, func(c *Config) { c.ConfirmOnly = "tmp/run1"; c.WindowBatch = 2 }},
+		{"WindowSubset", ErrConflict, func(c *Config) { c.WindowSubset = []int{0} }},
+		{"ScreenOnly", ErrConflict, func(c *Config) { c.ScreenOnly = true; c.RefineCommand = "true" }},
+		{"ScreenOnly", ErrConflict, func(c *Config) { c.ScreenOnly = true; c.CheckCounts = true }},
+		{"ExactTier", ErrConflict, func(c *Config) { c.ExactTier = true; c.MMTol = 1 }},
+		{"ExactTier", ErrConflict, func(c *Config) { c.ExactTier = true; c.ReadThrough = 10 }},
+		{"ExactTier", ErrConflict, func(c *Config) { c.ExactTier = true; c.WindowMMTol = []int{0, 1} }},
+		{"ExactTier", ErrConflict, func(c *Config) { c.ExactTier = true; c.CacheDir = "cache" }},
+		{"UnmatchedReasons", ErrConflict, func(c *Config) { c.UnmatchedReasons = true; c.NoPerReadOutput = true }},
+		{"GeneSampleSize", ErrConflict, func(c *Config) { c.GeneSampleSize = 10; c.CheckCounts = true }},
+		{"Windows", ErrConflict, func(c *Config) { c.WindowStride = 10 }},
+		{"WindowStride", ErrConflict, func(c *Config) { c.Windows = nil; c.WindowStride = 10; c.WindowPMatch = []float64{0.9} }},
+		{"ReadGroup", ErrConflict, func(c *Config) { c.ReadGroup = "lane"; c.NoPerReadOutput = true }},
+		{"Adapters", ErrConflict, func(c *Config) { c.QualityTrim = 20; c.SequenceAlphabet = "protein" }},
+		{"SequenceAlphabet", ErrConflict, func(c *Config) { c.SequenceAlphabet = "protein"; c.EValues = true }},
+		{"NoPerReadOutput", ErrConflict, func(c *Config) { c.NoPerReadOutput = true; c.AssignMode = "unique" }},
+		{"NoPerReadOutput", ErrConflict, func(c *Config) { c.NoPerReadOutput = true; c.IndexResults = true }},
+	} {
+		c := validConfig()
+		tc.set(c)
+		err := c.Validate()
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%s: got %v, expected %v", tc.field, err, tc.kind)
+			continue
+		}
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) || cerr.Field != tc.field {
+			t.Errorf("%s: error is for field %q: %v", tc.field, cerr.Field, err)
+		}
+	}
+}
+
+// parseFlags applies command-line arguments to c, as muscato does.
+func parseFlags(c *Config, args ...string) error {
+	fs := flag.NewFlagSet("muscato", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	DefineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return c.FromFlags(fs)
+}
+
+func TestFromFlags(t *testing.T) {
+
+	// The values read from a configuration file.
+	c := validConfig()
+	c.PMatch = 0.9
+	c.MMTol = 2
+	c.MatchMode = "first"
+	c.Adapters = []string{"AAAA"}
+
+	err := parseFlags(c, "--PMatch=0.95", "--Windows=0, 10,30", "--WindowPMatch=0.9,0.95,1",
+		"--Adapters=AGATCGGAAGAGC, CTGTCTCTTATA", "--MismatchCosts=transition=0.5",
+		"--NoCleanTemp", "--BloomSize=1000", "--MaxMatches=7", "--UnknownToConfig=x")
+	if err == nil {
+		t.Fatal("expected an error for an undefined flag")
+	}
+
+	err = parseFlags(c, "--PMatch=0.95", "--Windows=0, 10,30", "--WindowPMatch=0.9,0.95,1",
+		"--Adapters=AGATCGGAAGAGC, CTGTCTCTTATA", "--MismatchCosts=transition=0.5",
+		"--NoCleanTemp", "--BloomSize=1000", "--MaxMatches=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		// Given as flags
+		{"PMatch", c.PMatch, 0.95},
+		{"Windows", c.Windows, []int{0, 10, 30}},
+		{"WindowPMatch", c.WindowPMatch, []float64{0.9, 0.95, 1}},
+		{"Adapters", c.Adapters, []string{"AGATCGGAAGAGC", "CTGTCTCTTATA"}},
+		{"MismatchCosts", c.MismatchCosts, map[string]float64{"transition": 0.5}},
+		{"NoCleanTemp", c.NoCleanTemp, true},
+		{"BloomSize", c.BloomSize, uint64(1000)},
+		{"MaxMatches", c.MaxMatches, 7},
+
+		// Kept from the file
+		{"MMTol", c.MMTol, 2},
+		{"MatchMode", c.MatchMode, "first"},
+		{"ReadFileName", c.ReadFileName, "reads.fastq"},
+	} {
+		if !reflect.DeepEqual(d.got, d.want) {
+			t.Errorf("%s is %v, expected %v", d.name, d.got, d.want)
+		}
+	}
+
+	for _, arg := range []string{"--Windows=0,x", "--WindowPMatch=0.9,high", "--MismatchCosts=transition"} {
+		err := parseFlags(validConfig(), arg)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: got %v, expected %v", arg, err, ErrInvalid)
+		}
+	}
+
+	// A setting given as a flag is validated in the same way as
+	// one read from a file.
+	c = validConfig()
+	if err := parseFlags(c, "--WindowStride=10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); !errors.Is(err, ErrConflict) {
+		t.Errorf("WindowStride with Windows: got %v, expected %v", err, ErrConflict)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+
+	c, err := LoadConfig(write("good.json", `{"PMatch": 0.9, "Windows": [0, 20]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PMatch != 0.9 || !reflect.DeepEqual(c.Windows, []int{0, 20}) {
+		t.Errorf("read PMatch=%v, Windows=%v", c.PMatch, c.Windows)
+	}
+
+	// A missing file is reported by os.Open, a malformed one as an
+	// invalid setting.
+	if _, err := LoadConfig(filepath.Join(dir, "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v, expected %v", err, os.ErrNotExist)
+	}
+	var cerr *ConfigError
+	for _, s := range []string{`{"PMatch": 0.9,`, `{"PMatch": "high"}`, `{"PMatch": 0.9, "NoCleanTmp": true}`} {
+		_, err := LoadConfig(write("bad.json", s))
+		if !errors.As(err, &cerr) || !errors.Is(err, ErrInvalid) || cerr.Field != "ConfigFileName" {
+			t.Errorf("%s: got %v, expected an invalid ConfigFileName", s, err)
+		}
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+
+	props := ConfigSchema()["properties"].(map[string]interface{})
+	for name, p := range props {
+		if d, _ := p.(map[string]interface{})["description"].(string); d == "" {
+			t.Errorf("no description for %s", name)
+		}
+	}
+
+	enum := props["MatchMode"].(map[string]interface{})["enum"]
+	if !reflect.DeepEqual(enum, []string{"", "first", "best"}) {
+		t.Errorf("MatchMode enum is %v", enum)
+	}
+}
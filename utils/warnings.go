@@ -0,0 +1,110 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// Warning severities
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Warning is a condition noted by one of the Muscato tools that does
+// not necessarily stop the run, but that the user may want to know
+// about.  Repeated occurrences of a warning are counted rather than
+// recorded separately.
+type Warning struct {
+
+	// The tool that produced the warning.
+	Tool string
+
+	// A short identifier for the kind of warning.
+	Code string
+
+	Severity string
+
+	// The message from the first occurrence of the warning.
+	Message string
+
+	// The number of times that the warning occurred.
+	Count int
+}
+
+// Warnings collects the warnings produced by one tool.  It is safe
+// for concurrent use.
+type Warnings struct {
+	mu    sync.Mutex
+	tool  string
+	items []*Warning
+}
+
+// NewWarnings returns a collection of warnings for the given tool.
+func NewWarnings(tool string) *Warnings {
+	return &Warnings{tool: tool}
+}
+
+// Add records one occurrence of a warning.  The message is formatted
+// as by fmt.Sprintf.
+func (w *Warnings) Add(code, severity, format string, args ...interface{}) {
+	w.AddN(1, code, severity, format, args...)
+}
+
+// AddN records n occurrences of a warning.  Nothing is recorded if n
+// is zero.
+func (w *Warnings) AddN(n int, code, severity, format string, args ...interface{}) {
+
+	if n == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, x := range w.items {
+		if x.Code == code {
+			x.Count += n
+			return
+		}
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	w.items = append(w.items, &Warning{Tool: w.tool, Code: code, Severity: severity, Message: msg, Count: n})
+}
+
+// Items returns the warnings that have been recorded.
+func (w *Warnings) Items() []Warning {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var v []Warning
+	for _, x := range w.items {
+		v = append(v, *x)
+	}
+	return v
+}
+
+// Save writes the warnings to warnings_<tool>.json in the log
+// directory.  Nothing is written if there are no warnings.
+func (w *Warnings) Save(logdir string) error {
+
+	items := w.Items()
+	if len(items) == 0 {
+		return nil
+	}
+
+	fid, err := os.Create(path.Join(logdir, fmt.Sprintf("warnings_%s.json", w.tool)))
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	return json.NewEncoder(fid).Encode(items)
+}
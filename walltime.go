@@ -0,0 +1,62 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// ErrWallTime is returned (wrapped) by Run if MaxWallTime passed
+// before any window could be confirmed, so that no results were
+// written.
+var ErrWallTime = errors.New("MaxWallTime exceeded")
+
+var (
+	// The time after which no further windows are confirmed, or
+	// zero if MaxWallTime is not set.
+	wallDeadline time.Time
+
+	// The windows whose matches were confirmed.  If MaxWallTime
+	// passes during the confirm stage, this is a subset of the
+	// windows, and only these are combined into the results.
+	confirmed []int
+)
+
+// startWallClock starts timing the run against MaxWallTime.
+func startWallClock() {
+	wallDeadline = time.Time{}
+	if config.MaxWallTime != "" {
+		d, _ := time.ParseDuration(config.MaxWallTime)
+		wallDeadline = time.Now().Add(d)
+		logger.Printf("MaxWallTime is %s, no windows will be confirmed after %s\n",
+			config.MaxWallTime, wallDeadline.Format(time.RFC3339))
+	}
+}
+
+// wallTimeUp returns true if MaxWallTime has passed.
+func wallTimeUp() bool {
+	return !wallDeadline.IsZero() && time.Now().After(wallDeadline)
+}
+
+// checkWallTime returns an error if MaxWallTime has passed before the
+// named stage, which comes before the confirm stage.
+func checkWallTime(stage string) error {
+	if wallTimeUp() {
+		return fmt.Errorf("%w before %s, no results were written", ErrWallTime, stage)
+	}
+	return nil
+}
+
+// markPartial records that the windows in skipped were not confirmed
+// because MaxWallTime passed.
+func markPartial(skipped []int) {
+	report.Partial = true
+	report.SkippedWindows = skipped
+	warnings.Add("partial_results", utils.SeverityWarning,
+		"MaxWallTime of %s exceeded, windows %v were not confirmed, the results are incomplete",
+		config.MaxWallTime, skipped)
+}
@@ -0,0 +1,80 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/kshedden/muscato/utils"
+)
+
+// Warnings noted by the driver itself.
+var warnings *utils.Warnings
+
+// severityRank orders the severities, most severe first.
+var severityRank = map[string]int{
+	utils.SeverityError:   0,
+	utils.SeverityWarning: 1,
+	utils.SeverityInfo:    2,
+}
+
+// collectWarnings combines the warnings saved by the individual tools
+// (in warnings_<tool>.json files) with those of the driver, writes
+// them to warnings.json in the log directory, and prints a summary to
+// stderr.
+func collectWarnings() []utils.Warning {
+
+	all := warnings.Items()
+
+	files, _ := filepath.Glob(path.Join(config.LogDir, "warnings_*.json"))
+	for _, f := range files {
+		fid, err := os.Open(f)
+		if err != nil {
+			logger.Print(err)
+			continue
+		}
+		var w []utils.Warning
+		if err := json.NewDecoder(fid).Decode(&w); err != nil {
+			logger.Print(err)
+		}
+		fid.Close()
+		all = append(all, w...)
+	}
+
+	if len(all) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return severityRank[all[i].Severity] < severityRank[all[j].Severity]
+	})
+
+	fid, err := os.Create(path.Join(config.LogDir, "warnings.json"))
+	if err != nil {
+		logger.Print(err)
+	} else {
+		enc := json.NewEncoder(fid)
+		enc.SetIndent("", "    ")
+		if err := enc.Encode(all); err != nil {
+			logger.Print(err)
+		}
+		fid.Close()
+	}
+
+	msg := fmt.Sprintf("Warnings (see %s):\n", path.Join(config.LogDir, "warnings.json"))
+	for _, w := range all {
+		msg += fmt.Sprintf("  [%s] %s: %s", w.Severity, w.Tool, w.Message)
+		if w.Count > 1 {
+			msg += fmt.Sprintf(" (%d times)", w.Count)
+		}
+		msg += "\n"
+	}
+	os.Stderr.WriteString(msg)
+
+	return all
+}
@@ -0,0 +1,137 @@
+// Copyright 2017, Kerby Shedden and the Muscato contributors.
+
+package muscato
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where the root of TempDir was taken from.
+var tempSource string
+
+// resolveTempDir chooses the directory under which the temporary
+// directory of the run is created.  The TempDir setting (from the
+// command line, which takes precedence, or the configuration file) is
+// used if given, otherwise the muscato_tmp subdirectory of WorkDir (set
+// in useWorkDir), of $TMPDIR, or of the current directory, in that
+// order.
+func resolveTempDir() {
+
+	switch {
+	case config.TempDir != "":
+		tempSource = "the TempDir setting"
+	case config.WorkDir != "":
+		tempSource = "WorkDir"
+	case os.Getenv("TMPDIR") != "":
+		config.TempDir = filepath.Join(os.Getenv("TMPDIR"), "muscato_tmp")
+		tempSource = "$TMPDIR"
+		msg := fmt.Sprintf("TempDir not provided, defaulting to %s (from $TMPDIR)\n", config.TempDir)
+		os.Stderr.WriteString(msg)
+	default:
+		config.TempDir = "muscato_tmp"
+		tempSource = "the current directory"
+		os.Stderr.WriteString("TempDir not provided, defaulting to 'muscato_tmp' in the current directory\n")
+	}
+}
+
+// checkWritable confirms that a file can be written in dir.
+func checkWritable(dir string) error {
+
+	fid, err := os.CreateTemp(dir, ".muscato_check_*")
+	if err != nil {
+		return fmt.Errorf("cannot write to temporary directory %s: %w", dir, err)
+	}
+	name := fid.Name()
+	_, err = fid.WriteString("muscato\n")
+	if cerr := fid.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("cannot write to temporary directory %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// useWorkDir places all files written during the run under WorkDir.
+// TempDir and LogDir default to the muscato_tmp and muscato_logs
+// subdirectories of WorkDir, and relative paths given for the
+// directories and the results file are taken relative to WorkDir
+// rather than the current directory.  Absolute paths outside of
+// WorkDir are an error.  The input files are not affected.
+func useWorkDir() error {
+
+	wd, err := filepath.Abs(config.WorkDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(wd, os.ModePerm); err != nil {
+		return fmt.Errorf("cannot create WorkDir %s: %w", wd, err)
+	}
+
+	fields := []struct {
+		name string
+		val  *string
+		dflt string
+	}{
+		{"TempDir", &config.TempDir, "muscato_tmp"},
+		{"LogDir", &config.LogDir, "muscato_logs"},
+		{"PipeDir", &config.PipeDir, ""},
+		{"SortTemp", &config.SortTemp, ""},
+		{"CacheDir", &config.CacheDir, ""},
+		{"ResultsFileName", &config.ResultsFileName, ""},
+		{"BestHitFile", &config.BestHitFile, ""},
+	}
+
+	// Check all of the locations before changing any of them.
+	vals := make([]string, len(fields))
+	for i, f := range fields {
+		v := *f.val
+		if v == "" {
+			v = f.dflt
+		}
+		if v == "" {
+			continue
+		}
+		if !filepath.IsAbs(v) {
+			vals[i] = filepath.Join(wd, v)
+			continue
+		}
+		rel, err := filepath.Rel(wd, filepath.Clean(v))
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%s %s is outside of WorkDir %s", f.name, v, wd)
+		}
+		vals[i] = v
+	}
+
+	config.WorkDir = wd
+	for i, f := range fields {
+		*f.val = vals[i]
+	}
+
+	return nil
+}
+
+// workScratch directs the scratch files of sort and of the other
+// external commands into TempDir when WorkDir is set, rather than the
+// system temporary directory.  It is run after TempDir is created.
+func workScratch() error {
+
+	if config.WorkDir == "" {
+		return nil
+	}
+
+	if config.SortTemp == "" {
+		config.SortTemp = filepath.Join(config.TempDir, "sort")
+		if err := os.MkdirAll(config.SortTemp, os.ModePerm); err != nil {
+			return fmt.Errorf("cannot create SortTemp directory %s: %w", config.SortTemp, err)
+		}
+		sortTmpFlag = fmt.Sprintf("--temporary-directory=%s", config.SortTemp)
+	}
+
+	return os.Setenv("TMPDIR", config.TempDir)
+}